@@ -0,0 +1,138 @@
+package internal
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// =================== ClientIP ===================
+
+var ErrTrustedProxy = errors.New("trusted proxy is not an IP or CIDR")
+
+// IPResolver finds the IP of the client behind a request. Forwarding headers are only believed
+// when the request came from one of the trusted proxies, and only as far back as the chain of
+// trusted proxies goes, so clients cannot pick the address they are limited by.
+type IPResolver struct {
+	trusted []*net.IPNet
+}
+
+// NewIPResolver trusts the proxies at the given IPs or CIDRs, e.g. "10.0.0.0/8" or "::1".
+func NewIPResolver(trustedProxies ...string) (*IPResolver, error) {
+	p := &IPResolver{}
+
+	for _, s := range trustedProxies {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, ErrTrustedProxy
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			p.trusted = append(p.trusted, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, ErrTrustedProxy
+		}
+		p.trusted = append(p.trusted, n)
+	}
+
+	return p, nil
+}
+
+// ClientIP returns the client IP of r. The Forwarded header, RFC 7239, or else X-Forwarded-For, is
+// walked right to left from the peer, past every trusted proxy; the first address that is not one is
+// the client.
+func (p *IPResolver) ClientIP(r *http.Request) string {
+	peer := hostIP(r.RemoteAddr)
+	if peer == nil {
+		return r.RemoteAddr
+	}
+	if !p.isTrusted(peer) {
+		return peer.String()
+	}
+
+	hops := forwardedFor(r.Header.Values("Forwarded"))
+	if len(hops) == 0 {
+		hops = xForwardedFor(r.Header.Values("X-Forwarded-For"))
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := hostIP(hops[i])
+		if ip == nil {
+			// Garbage a client made up; the last proxy is all that can be vouched for.
+			break
+		}
+
+		client = ip
+		if !p.isTrusted(ip) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+func (p *IPResolver) isTrusted(ip net.IP) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, n := range p.trusted {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// forwardedFor returns the for= parameters of Forwarded header values, in order.
+func forwardedFor(values []string) []string {
+	var hops []string
+
+	for _, v := range values {
+		for _, element := range strings.Split(v, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				k, val, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(k, "for") {
+					hops = append(hops, strings.Trim(val, `"`))
+				}
+			}
+		}
+	}
+
+	return hops
+}
+
+// xForwardedFor returns the addresses of X-Forwarded-For header values, in order.
+func xForwardedFor(values []string) []string {
+	var hops []string
+
+	for _, v := range values {
+		for _, hop := range strings.Split(v, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+
+	return hops
+}
+
+// hostIP parses an address with or without a port, IPv6 ones in brackets or not.
+func hostIP(addr string) net.IP {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		addr = host
+	}
+
+	return net.ParseIP(strings.Trim(addr, "[]"))
+}
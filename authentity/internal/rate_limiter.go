@@ -2,117 +2,233 @@ package internal
 
 import (
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 )
 
-type IPGetter interface {
-	GetIP() string
-}
+// =================== RateLimiter ===================
 
-type MockIPGetter struct{}
+// Guest is what the RateLimiter remembers of a key, a client IP or an account identifier.
+type Guest struct {
+	attempts    int       // Attempts in the current window
+	windowStart time.Time // When the current window started
+	lockedUntil time.Time // Locked out until then
+	locks       int       // How many times it's been locked, every lockout doubles the next
+	lastSeen    time.Time
+}
 
-func (m *MockIPGetter) GetIP() string {
-	return "192.168.1.1" // or any other IP address
+// RateLimiter allows every key Attempts attempts per Window. The attempt after them locks the key
+// out for Timeout, doubled by every lockout after it up to MaxTimeout. Keys quiet for ForgetAfter
+// start over. Lockouts end on their own, no timers run behind the caller's back.
+type RateLimiter struct {
+	mu        sync.Mutex
+	visitors  map[string]*Guest
+	lastSweep time.Time
+
+	Attempts    int
+	Timeout     time.Duration
+	Window      time.Duration
+	MaxTimeout  time.Duration
+	ForgetAfter time.Duration
+
+	ips *IPResolver
+	now func() time.Time
 }
 
-// =================== RateLimiter ===================
+type RateLimiterOption func(*RateLimiter)
 
-type Guest struct {
-	lastSeen time.Time     // Last time the handler was accessed
-	attempts int           // How many attempts at accessing the handler
-	timeout  time.Duration // timeout extension
-	locked   bool          // Whether the account is locked
-	locks    int           // How many times it's been locked
+// WithTrustedProxies resolves client IPs with ips, see IPResolver. Without it the peer address is the client.
+func WithTrustedProxies(ips *IPResolver) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.ips = ips
+	}
 }
 
-type RateLimiter struct {
-	mu       sync.Mutex
-	visitors map[string]*Guest
-	Attempts int
-	Timeout  time.Duration
-	mockIP   IPGetter
+// WithLimiterClock replaces time.Now. Useful in tests.
+func WithLimiterClock(now func() time.Time) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.now = now
+	}
 }
 
-func NewMockedRateLimiter(attempts int, timeout time.Duration, getter *MockIPGetter) *RateLimiter {
-	return &RateLimiter{
-		visitors: make(map[string]*Guest),
-		Attempts: attempts,
-		Timeout:  timeout,
-		mockIP:   getter,
+// WithWindow sets how long attempts are counted for, defaults to Timeout.
+func WithWindow(window time.Duration) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.Window = window
 	}
 }
-func NewRateLimiter(attempts int, timeout time.Duration) *RateLimiter {
-	return &RateLimiter{
-		visitors: make(map[string]*Guest),
-		Attempts: attempts,
-		Timeout:  timeout,
+
+// WithMaxTimeout caps the exponential lockout, defaults to a day.
+func WithMaxTimeout(max time.Duration) RateLimiterOption {
+	return func(rl *RateLimiter) {
+		rl.MaxTimeout = max
+	}
+}
+
+func NewRateLimiter(attempts int, timeout time.Duration, opts ...RateLimiterOption) *RateLimiter {
+	rl := &RateLimiter{
+		visitors:    make(map[string]*Guest),
+		Attempts:    attempts,
+		Timeout:     timeout,
+		Window:      timeout,
+		MaxTimeout:  24 * time.Hour,
+		ForgetAfter: 24 * time.Hour,
+		now:         time.Now,
+	}
+
+	for _, opt := range opts {
+		opt(rl)
 	}
+
+	return rl
 }
 
-func (rl *RateLimiter) AddVisitor(ip string) *Guest {
+// Attempt counts an attempt of key. It reports false, with how long until key may try again, when
+// key is locked out, or is locked out by this attempt.
+func (rl *RateLimiter) Attempt(key string) (time.Duration, bool) {
 	rl.mu.Lock()
 	defer rl.mu.Unlock()
 
-	v, exists := rl.visitors[ip]
+	now := rl.now()
+	rl.sweep(now)
+
+	v, exists := rl.visitors[key]
 	if !exists {
-		rl.visitors[ip] = &Guest{lastSeen: time.Now(), timeout: rl.Timeout}
-		return rl.visitors[ip]
+		v = &Guest{windowStart: now}
+		rl.visitors[key] = v
+	}
+	v.lastSeen = now
+
+	if now.Before(v.lockedUntil) {
+		return v.lockedUntil.Sub(now), false
 	}
 
-	if v.locked {
-		return v
+	if now.Sub(v.windowStart) >= rl.Window {
+		v.attempts, v.windowStart = 0, now
 	}
 
-	v.lastSeen = time.Now()
 	v.attempts++
+	if v.attempts <= rl.Attempts {
+		return 0, true
+	}
+
+	timeout := rl.lockout(v.locks)
+	v.locks++
+	v.attempts, v.windowStart = 0, now.Add(timeout)
+	v.lockedUntil = now.Add(timeout)
+
+	return timeout, false
+}
+
+// Locked reports whether key is locked out, and for how long still, without counting an attempt.
+func (rl *RateLimiter) Locked(key string) (time.Duration, bool) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	v, exists := rl.visitors[key]
+	if !exists {
+		return 0, false
+	}
 
-	rl.visitors[ip] = v // Update the Allow pointer in the visitors map
+	now := rl.now()
+	if now.Before(v.lockedUntil) {
+		return v.lockedUntil.Sub(now), true
+	}
+
+	return 0, false
+}
+
+// Reset forgets key, e.g. once an account logged in.
+func (rl *RateLimiter) Reset(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
 
-	return v
+	delete(rl.visitors, key)
 }
 
+// Succeeded stops the lockouts of key from escalating, the next one lasts Timeout again. Unlike
+// Reset its attempts in the current window still count.
+func (rl *RateLimiter) Succeeded(key string) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+
+	if v, exists := rl.visitors[key]; exists {
+		v.locks = 0
+	}
+}
+
+// RateLimitMiddleware counts every POST as an attempt of its client IP, and answers the ones
+// locked out with 429 Too Many Requests. Other methods only read and are let through. A POST
+// that succeeds, see Succeeded, keeps a shared IP from being locked out for ever longer.
 func (rl *RateLimiter) RateLimitMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		visitor := rl.AddVisitor(rl.mockIP.GetIP())
-
-		if visitor.locked {
-			err := "Account locked, please wait " + time.Now().Sub(visitor.lastSeen).String()
-			http.Error(w, err, http.StatusLocked)
+		if r.Method != http.MethodPost {
+			next.ServeHTTP(w, r)
 			return
 		}
 
-		if visitor.attempts >= rl.Attempts {
-			rl.lockAccount(rl.mockIP.GetIP())
-
-			err := "too many requests. Account locked, please wait " + visitor.timeout.String()
-			println(err)
-
-			http.Error(w, err, http.StatusTooManyRequests)
+		ip := rl.ClientIP(r)
+		if wait, ok := rl.Attempt(ip); !ok {
+			TooManyRequests(w, wait)
 			return
 		}
 
-		next.ServeHTTP(w, r)
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(sw, r)
+
+		if sw.status < http.StatusBadRequest {
+			rl.Succeeded(ip)
+		}
 	})
 }
 
-func (rl *RateLimiter) lockAccount(ip string) {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
+// statusWriter keeps the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
 
-	if visitor, exists := rl.visitors[ip]; exists {
-		visitor.locked = true
-		visitor.locks++
+func (w *statusWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
 
-		time.AfterFunc(visitor.timeout, func() {
-			visitor.locked = false
-			visitor.attempts = 0
-			visitor.timeout += visitor.timeout
+// ClientIP is the key RateLimitMiddleware limits r by.
+func (rl *RateLimiter) ClientIP(r *http.Request) string {
+	return rl.ips.ClientIP(r)
+}
 
-			rl.visitors[rl.mockIP.GetIP()] = visitor // Update the visitor in the map
-		})
+// TooManyRequests answers a locked out request, telling it when to retry.
+func TooManyRequests(w http.ResponseWriter, wait time.Duration) {
+	secs := int((wait + time.Second - 1) / time.Second)
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "too many attempts, retry in "+strconv.Itoa(secs)+"s", http.StatusTooManyRequests)
+}
 
-		rl.visitors[ip] = visitor
+// lockout is the length of a key's lockout after it was locked out locks times before.
+func (rl *RateLimiter) lockout(locks int) time.Duration {
+	timeout := rl.Timeout
+	for i := 0; i < locks && timeout < rl.MaxTimeout; i++ {
+		timeout *= 2
 	}
 
+	if timeout > rl.MaxTimeout {
+		return rl.MaxTimeout
+	}
+	return timeout
+}
+
+// sweep forgets the keys quiet for ForgetAfter and no longer locked out, at most once a Window.
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.lastSweep) < rl.Window {
+		return
+	}
+	rl.lastSweep = now
+
+	for key, v := range rl.visitors {
+		if now.Sub(v.lastSeen) >= rl.ForgetAfter && !now.Before(v.lockedUntil) {
+			delete(rl.visitors, key)
+		}
+	}
 }
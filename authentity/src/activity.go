@@ -0,0 +1,163 @@
+package src
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var (
+	ActivityPageError = errors.New("page and amount must be positive numbers")
+)
+
+// Activity log
+// ====================================================================================================
+
+// clientKey carries the client a login or refresh is made by, see withClient.
+type clientKey struct{}
+
+type requestClient struct {
+	IP        string
+	UserAgent string
+}
+
+// withClient returns the context of r carrying its client, for the activity log to record.
+func (a *Authentity) withClient(r *http.Request) context.Context {
+	return context.WithValue(r.Context(), clientKey{}, requestClient{IP: a.clients.ClientIP(r), UserAgent: r.UserAgent()})
+}
+
+// recordActivity adds activity, by the client ctx carries, to the log. Successful logins and refreshes
+// of authentity's own sessions are checked for anomalies first, and warned about. A login never fails
+// for the log.
+func (a *Authentity) recordActivity(ctx context.Context, activity *models.Activity) {
+	if c, ok := ctx.Value(clientKey{}).(requestClient); ok {
+		activity.IPAddress, activity.UserAgent = c.IP, c.UserAgent
+	}
+	activity.At = a.now()
+
+	if a.geo != nil && activity.IPAddress != "" {
+		if loc, ok := a.geo.Locate(activity.IPAddress); ok {
+			activity.Country = loc.Country
+		}
+	}
+
+	if activity.Outcome == entities.OutcomeSuccess && activity.ClientID == "" &&
+		(activity.Event == entities.ActivityLogin || activity.Event == entities.ActivityRefresh) {
+		anomalies, err := a.Provider.ActivityService.Anomalies(ctx, activity, a.geo)
+		if err != nil {
+			a.Logger.ERROR(err.Error())
+		}
+
+		if len(anomalies) > 0 {
+			activity.Anomalies = strings.Join(anomalies, ",")
+			a.Logger.WARN("unusual "+activity.Event+": "+activity.Anomalies,
+				activity.IdentityID, activity.IPAddress, activity.Country, activity.Device)
+		}
+	}
+
+	if err := a.Provider.ActivityService.Record(ctx, activity); err != nil {
+		a.Logger.ERROR(err.Error())
+	}
+}
+
+// recordFailure records a failed event of identityID, or of an identifier that names no account.
+func (a *Authentity) recordFailure(ctx context.Context, event, identityID, identifier string, err error) {
+	outcome := entities.OutcomeFailure
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		outcome = entities.OutcomeLockedOut
+	}
+
+	a.recordActivity(ctx, &models.Activity{
+		IdentityID: identityID,
+		Event:      event,
+		Outcome:    outcome,
+		Reason:     err.Error(),
+		Identifier: identifier,
+	})
+}
+
+// Handlers
+// ----------------------------------------------------------------------------------------------------
+
+// ActivityHandler lists the logins, logouts, refreshes and failed attempts of the logged in identity,
+// most recent first, a page at a time, see activityPage.
+func ActivityHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		identityID, ok := service.sessionIdentity(r)
+		if !ok {
+			http.Error(w, "no session", http.StatusUnauthorized)
+			return
+		}
+
+		writeActivity(service, w, r, identityID)
+	}
+}
+
+// ActivityAdminHandler lists the activity of the identity in the identity_id query parameter for
+// administrators. Without it, it lists everyone's, failed attempts with unknown identifiers included.
+func ActivityAdminHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writeActivity(service, w, r, r.URL.Query().Get("identity_id"))
+	}
+}
+
+func writeActivity(service *Authentity, w http.ResponseWriter, r *http.Request, identityID string) {
+	page, amount, err := activityPage(r.URL.Query())
+	if err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	activity, err := service.Provider.ActivityService.Page(r.Context(), identityID, page, amount)
+	if err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	_ = json.NewEncoder(w).Encode(activity)
+}
+
+// activityPage reads the page, from 1, and the amount of entries per page from the query, defaulting
+// to the first ActivityPageSize entries. Amounts over MaxActivityPageSize are cut down to it.
+func activityPage(query url.Values) (int, int, error) {
+	page, amount := 1, ActivityPageSize
+
+	for param, n := range map[string]*int{"page": &page, "amount": &amount} {
+		s := query.Get(param)
+		if s == "" {
+			continue
+		}
+
+		v, err := strconv.Atoi(s)
+		if err != nil || v < 1 || v > math.MaxInt32 {
+			return 0, 0, ActivityPageError
+		}
+		*n = v
+	}
+
+	if amount > MaxActivityPageSize {
+		amount = MaxActivityPageSize
+	}
+
+	return page, amount, nil
+}
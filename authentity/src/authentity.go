@@ -1,18 +1,22 @@
 package src
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"github.com/vaiktorg/grimoire/authentity/internal"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
 	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
 	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/gwt/vhash"
 	"github.com/vaiktorg/grimoire/log"
 	"github.com/vaiktorg/grimoire/uid"
 	"golang.org/x/crypto/bcrypt"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -20,12 +24,119 @@ type Config struct {
 	Issuer string
 	GSpice gwt.Spice
 	Logger log.ILogger
+
+	// Revocations defaults to a gwt.SQLiteRevocationStore in the Authentity database.
+	Revocations gwt.RevocationStore
+
+	// Audience the issued tokens are meant for, defaults to Issuer.
+	// Tokens minted for any other audience (e.g. the dashboard) are rejected.
+	Audience string
+
+	// ResourceTypes and RoleTypes are registered in the gwt.DefaultRegistry on startup.
+	ResourceTypes []gwt.ResourceType
+	RoleTypes     []gwt.RoleType
+
+	// RegistryFile persists the gwt.DefaultRegistry indexes across restarts.
+	// It is validated on startup, and left alone when empty.
+	RegistryFile string
+
+	// Policy refines ResourceAccessMiddleware decisions with attribute rules.
+	// PolicyFile loads it from YAML when Policy is nil.
+	Policy     *gwt.Policy
+	PolicyFile string
+
+	// ResourceAttributes supplies the resource.* policy attributes of a request, e.g. its department.
+	ResourceAttributes func(r *http.Request) gwt.Attributes
+
+	// CompactTokens mints compact, deflated tokens to keep session cookies well under 4KB.
+	// Tokens are decoded whichever way they were minted, so it can be switched on at any time.
+	CompactTokens bool
+
+	// Nonces spends proof of possession IDs, defaults to a gwt.MemoryNonceCache.
+	// Share one between instances behind a load balancer.
+	Nonces gwt.NonceCache
+
+	// Keys sign and verify every token, defaults to gwt.DefaultKeyRing. JWKSHandler publishes the
+	// public half of its EdDSA keys, so other services can check signatures without the HashKey.
+	Keys *gwt.KeyRing
+
+	// IntrospectionClients maps the client IDs allowed to call IntrospectHandler to their secrets,
+	// presented with HTTP basic auth. Introspection is refused to everyone when empty.
+	IntrospectionClients map[string]string
+
+	// CardOptions configure the ID cards CardHandler renders, e.g. vhash.WithTemplate with the
+	// id_card_tmpl.png artwork and the symbol at 128,208.
+	CardOptions []vhash.Option
+
+	// Connectors each add a social login, see SocialLoginPath and SocialCallbackPath.
+	// Their names must be unique.
+	Connectors []services.Connector
+
+	// SocialRedirect is where a social login lands once the session cookies are set, defaults to "/".
+	SocialRedirect string
+
+	// Scopes OAuth clients can be registered for and ask users to consent to, see AuthorizeHandler.
+	Scopes []Scope
+
+	// Clock replaces time.Now for two factor authentication, i.e. TOTP codes and the tokens pending
+	// a second factor, for the links mailed to users and for rate limiting. Useful in tests.
+	Clock func() time.Time
+
+	// Mailer sends the email verification and password reset links, see services.SMTPMailer.
+	// Both flows are off without one.
+	Mailer services.Mailer
+
+	// PublicURL is where users reach authentity, e.g. https://auth.example.com. The mailed links
+	// and the discovery document point to it, so it is required along with a Mailer.
+	PublicURL string
+
+	// RequireVerifiedEmail refuses password logins of accounts whose email is not verified yet.
+	RequireVerifiedEmail bool
+
+	// LoginAttempts failed logins of an account are allowed, the next locks it out for LoginLockout,
+	// doubled by every lockout after it. They default to 5 and a minute.
+	LoginAttempts int
+	LoginLockout  time.Duration
+
+	// ClientRequests is how many posts a client IP gets a minute on the login, two-factor login,
+	// registration and forgot password endpoints, defaults to 30.
+	ClientRequests int
+
+	// TrustedProxies, IPs or CIDRs, are believed about the client IP in Forwarded and X-Forwarded-For.
+	TrustedProxies []string
+
+	// GeoIP locates the client IPs in the activity log, so logins from a new country or after an
+	// impossible trip are warned about. Without it only logins from a new IP range are.
+	GeoIP services.GeoLocator
 }
 
 type Authentity struct {
-	issuer []byte
-	mux    *http.ServeMux
-	mc     *gwt.MultiCoder[*gwt.Resources]
+	issuer       []byte
+	mux          *http.ServeMux
+	mc           *gwt.MultiCoder[*gwt.Resources]
+	clientTokens *gwt.MultiCoder[*gwt.Resources]
+	revocations  gwt.RevocationStore
+	policy       *gwt.Policy
+	resAttrs     func(r *http.Request) gwt.Attributes
+	cardOpts     []vhash.Option
+	keys         *gwt.KeyRing
+	introspect   map[string]string
+	connectors   []services.Connector
+	flows        *gwt.MultiCoder[socialFlow]
+	consents     *gwt.MultiCoder[authorizeRequest]
+	scopes       map[string]Scope
+	pending      *gwt.MultiCoder[pendingLogin]
+	clock        func() time.Time
+	mailer       services.Mailer
+	actions      *gwt.MultiCoder[accountAction]
+	actionsMu    sync.Mutex
+	logins       *internal.RateLimiter
+	clients      *internal.RateLimiter
+	geo          services.GeoLocator
+
+	socialRedirect  string
+	publicURL       string
+	requireVerified bool
 
 	Logger   log.ILogger
 	Provider *DataProvider
@@ -34,24 +145,173 @@ type Authentity struct {
 const issuerName = "Authenitity"
 
 func NewAuthentity(config *Config) *Authentity {
-	db, err := gorm.Open(sqlite.Open(issuerName+".db"), nil)
+	if config.Issuer == "" {
+		config.Issuer = issuerName
+	}
+
+	db, err := gorm.Open(sqlite.Open(config.Issuer+".db"), nil)
+	if err != nil {
+		panic(err)
+	}
+
+	if err = syncRegistry(config); err != nil {
+		panic(err)
+	}
+
+	if config.Clock == nil {
+		config.Clock = time.Now
+	}
+
+	if config.Revocations == nil {
+		sqlDB, err := db.DB()
+		if err != nil {
+			panic(err)
+		}
+
+		config.Revocations, err = gwt.NewSQLiteRevocationStore(sqlDB, gwt.DefaultRevocationGC, gwt.WithGCClock(config.Clock))
+		if err != nil {
+			panic(err)
+		}
+	}
+
+	if config.Policy == nil && config.PolicyFile != "" {
+		if config.Policy, err = gwt.LoadPolicyFile(config.PolicyFile); err != nil {
+			panic(err)
+		}
+	}
+
+	if config.Audience == "" {
+		config.Audience = config.Issuer
+	}
+
+	if config.Nonces == nil {
+		config.Nonces = gwt.NewMemoryNonceCache(gwt.DefaultRevocationGC, gwt.WithGCClock(config.Clock))
+	}
+
+	if config.Keys == nil {
+		config.Keys = gwt.DefaultKeyRing
+	}
+
+	opts := []gwt.Option{
+		gwt.WithRevocationStore(config.Revocations),
+		gwt.WithAudience([]byte(config.Audience)),
+		gwt.WithNonceCache(config.Nonces),
+		gwt.WithKeyRing(config.Keys),
+	}
+	if config.CompactTokens {
+		opts = append(opts, gwt.WithCompactEncoding(true))
+	}
+
+	mc, err := gwt.NewMultiCoder[*gwt.Resources](opts...)
+	if err != nil {
+		panic(err)
+	}
+
+	// Access tokens of OAuth clients are minted for an audience of their own, so one is never
+	// taken for a session of authentity. The last audience option wins.
+	clientTokens, err := gwt.NewMultiCoder[*gwt.Resources](append(opts[:len(opts):len(opts)],
+		gwt.WithAudience([]byte(config.Audience+"#client")))...)
 	if err != nil {
 		panic(err)
 	}
 
-	mc, err := gwt.NewMultiCoder[*gwt.Resources]()
+	if config.SocialRedirect == "" {
+		config.SocialRedirect = "/"
+	}
+
+	flows, err := newEphemeralCoder[socialFlow](config, "social")
 	if err != nil {
 		panic(err)
 	}
 
-	config.Logger.TRACE("Authentity entity " + issuerName + " is running")
+	consents, err := newEphemeralCoder[authorizeRequest](config, "consent")
+	if err != nil {
+		panic(err)
+	}
+
+	pending, err := newEphemeralCoder[pendingLogin](config, "2fa", gwt.WithClock(config.Clock))
+	if err != nil {
+		panic(err)
+	}
+
+	if config.Mailer != nil && config.PublicURL == "" {
+		panic("a PublicURL is required for the links a Mailer sends")
+	}
+
+	// Mailed links outlive restarts, so unlike the ephemeral coders these are only signed,
+	// and revoked in the persistent store once spent.
+	actions, err := gwt.NewMultiCoder[accountAction](
+		gwt.WithKeyRing(config.Keys),
+		gwt.WithAudience([]byte(config.Audience+"#account")),
+		gwt.WithRevocationStore(config.Revocations),
+		gwt.WithClock(config.Clock),
+	)
+	if err != nil {
+		panic(err)
+	}
+
+	if config.LoginAttempts == 0 {
+		config.LoginAttempts = 5
+	}
+	if config.LoginLockout == 0 {
+		config.LoginLockout = time.Minute
+	}
+	if config.ClientRequests == 0 {
+		config.ClientRequests = 30
+	}
+
+	proxies, err := internal.NewIPResolver(config.TrustedProxies...)
+	if err != nil {
+		panic(err)
+	}
+
+	// Failed logins are counted for a quarter of an hour, posts per client for a minute. Clients
+	// may be many users behind one IP, their lockouts stop growing at an hour.
+	logins := internal.NewRateLimiter(config.LoginAttempts, config.LoginLockout,
+		internal.WithWindow(15*time.Minute),
+		internal.WithLimiterClock(config.Clock),
+	)
+	clients := internal.NewRateLimiter(config.ClientRequests, time.Minute,
+		internal.WithTrustedProxies(proxies),
+		internal.WithMaxTimeout(time.Hour),
+		internal.WithLimiterClock(config.Clock),
+	)
+
+	scopes, err := indexScopes(config.Scopes)
+	if err != nil {
+		panic(err)
+	}
+
+	config.Logger.TRACE("Authentity entity " + config.Issuer + " is running")
 	auth := &Authentity{
-		issuer:   []byte(issuerName),
+		issuer:   []byte(config.Issuer),
 		Provider: NewDataProvider(db),
 		Logger:   config.Logger,
 
-		mux: http.NewServeMux(),
-		mc:  mc,
+		mux:          http.NewServeMux(),
+		mc:           mc,
+		clientTokens: clientTokens,
+		revocations:  config.Revocations,
+		policy:       config.Policy,
+		resAttrs:     config.ResourceAttributes,
+		cardOpts:     config.CardOptions,
+		keys:         config.Keys,
+		introspect:   config.IntrospectionClients,
+		connectors:   config.Connectors,
+		flows:        flows,
+		consents:     consents,
+		scopes:       scopes,
+		pending:      pending,
+		clock:        config.Clock,
+		mailer:       config.Mailer,
+		actions:      actions,
+		logins:       logins,
+		clients:      clients,
+		geo:          config.GeoIP,
+
+		socialRedirect:  config.SocialRedirect,
+		publicURL:       strings.TrimSuffix(config.PublicURL, "/"),
+		requireVerified: config.RequireVerifiedEmail,
 	}
 
 	if err = auth.Migrate(); err != nil && !errors.Is(err, AlreadyExistError) {
@@ -63,6 +323,33 @@ func NewAuthentity(config *Config) *Authentity {
 	return auth
 }
 
+// syncRegistry adopts the persisted registry before registering the configured types,
+// so they keep their indexes, then persists the result.
+func syncRegistry(config *Config) error {
+	if config.RegistryFile != "" {
+		if err := gwt.DefaultRegistry.SyncFile(config.RegistryFile); err != nil {
+			return err
+		}
+	}
+
+	for _, t := range config.ResourceTypes {
+		if _, err := gwt.RegisterResourceType(t); err != nil {
+			return err
+		}
+	}
+	for _, t := range config.RoleTypes {
+		if _, err := gwt.RegisterRoleType(t); err != nil {
+			return err
+		}
+	}
+
+	if config.RegistryFile == "" {
+		return nil
+	}
+
+	return gwt.DefaultRegistry.SaveFile(config.RegistryFile)
+}
+
 func (a *Authentity) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	internal.SecurityMiddleware(a.mux).ServeHTTP(w, r)
 }
@@ -70,16 +357,33 @@ func (a *Authentity) RegisterIdentity(pCtx context.Context, prof *models.Profile
 	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
 	defer cancel()
 
+	identity, err := a.registerIdentity(ctx, prof, acc)
+	if err != nil {
+		return err
+	}
+
+	// The account exists either way, a lost mail is sent again from VerifyEmailHandler.
+	if a.mailer != nil {
+		if err = a.SendEmailVerification(ctx, identity.ID); err != nil {
+			a.Logger.ERROR("could not mail the email verification: "+err.Error(), acc.Username)
+		}
+	}
+
+	return nil
+}
+
+// registerIdentity persists a new identity for acc and returns it, with the generated identity ID.
+func (a *Authentity) registerIdentity(ctx context.Context, prof *models.Profile, acc *models.Account) (*models.Identity, error) {
 	if _, err := a.Provider.AccountsService.FindAccountByEmail(ctx, acc.Email); err == nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return errors.New("email already being used for email: " + acc.Email)
+		return nil, errors.New("email already being used for email: " + acc.Email)
 	}
 	if _, err := a.Provider.AccountsService.FindAccountByUsername(ctx, acc.Username); err == nil && !errors.Is(err, gorm.ErrRecordNotFound) {
-		return errors.New("username already being used for user: " + acc.Username)
+		return nil, errors.New("username already being used for user: " + acc.Username)
 	}
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(acc.Password), bcrypt.DefaultCost)
 	if err != nil {
-		return errors.New("could not create hashed password")
+		return nil, errors.New("could not create hashed password")
 	}
 
 	id := uid.New()
@@ -94,7 +398,7 @@ func (a *Authentity) RegisterIdentity(pCtx context.Context, prof *models.Profile
 
 	t, err := a.mc.Encode(tok)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	identity := &models.Identity{
@@ -109,63 +413,145 @@ func (a *Authentity) RegisterIdentity(pCtx context.Context, prof *models.Profile
 		Resources: tok.Body,
 	}
 
-	return a.Provider.IdentityService.Persist(ctx, identity)
+	if err = a.Provider.IdentityService.Persist(ctx, identity); err != nil {
+		return nil, err
+	}
+
+	return identity, nil
 }
 
-func (a *Authentity) LoginManual(pCtx context.Context, identifier, password string) (*gwt.GWT[*gwt.Resources], error) {
+// TokenPair is handed out on login and on every refresh.
+type TokenPair struct {
+	Access  *gwt.GWT[*gwt.Resources]
+	Refresh *models.RefreshToken
+}
+
+func (a *Authentity) LoginManual(pCtx context.Context, identifier, password string) (*TokenPair, error) {
+	return a.LoginManualBound(pCtx, identifier, password, "")
+}
+
+// LoginManualBound logs in like LoginManual, binding the session to the key with thumbprint,
+// see ProofThumbprint. Every request made with the tokens must then carry a gwt.ProofHeader.
+func (a *Authentity) LoginManualBound(pCtx context.Context, identifier, password, thumbprint string) (pair *TokenPair, err error) {
 	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
 	defer cancel()
 
-	acc, err := a.Provider.AccountsService.GetAccount(ctx, identifier, password)
+	// Failed attempts are recorded for the identity of the account, once identifier names one.
+	var identityID string
+	defer func() {
+		var pending *TwoFactorRequiredError
+		if err != nil && !errors.As(err, &pending) {
+			a.recordFailure(ctx, entities.ActivityLogin, identityID, identifier, err)
+		}
+	}()
+
+	if err = a.checkLockout(identifierKey(identifier)); err != nil {
+		return nil, err
+	}
+
+	// Only a missing account counts against identifier, a failing database is no guess.
+	acc, err := a.Provider.AccountsService.GetAccount(ctx, identifier, identifier)
+	if errors.Is(err, gorm.ErrRecordNotFound) || (err == nil && acc == nil) {
+		return nil, a.failLogin(identifierKey(identifier), errors.New("no account found for identifier or email"))
+	}
 	if err != nil {
 		return nil, err
 	}
 
-	if acc == nil {
-		return nil, errors.New("no account found for identifier or email")
+	identity, err := a.Provider.IdentityService.FetchIdentityByAccountID(ctx, acc.ID)
+	if err != nil {
+		return nil, err
+	}
+	identityID = identity.ID
+
+	if err = a.checkLockout(accountKey(acc.ID)); err != nil {
+		return nil, err
 	}
 
 	if err = bcrypt.CompareHashAndPassword([]byte(acc.Password), []byte(password)); err != nil {
-		return nil, errors.New("password does not match")
+		return nil, a.failLogin(accountKey(acc.ID), errors.New("password does not match"))
 	}
+	a.logins.Reset(accountKey(acc.ID))
 
-	identity, err := a.Provider.IdentityService.FetchIdentityByAccountID(ctx, acc.ID)
+	if a.requireVerified && !acc.Verified {
+		return nil, UnverifiedAccountError
+	}
+
+	return a.loginIdentity(ctx, identity, identifier, thumbprint)
+}
+
+// loginIdentity starts a new session family for identity. Identities with two factor authentication
+// get a *TwoFactorRequiredError instead, see LoginTwoFactor.
+func (a *Authentity) loginIdentity(ctx context.Context, identity *models.Identity, recipient, thumbprint string) (*TokenPair, error) {
+	enabled, err := a.Provider.TwoFactorService.Enabled(ctx, identity.ID)
 	if err != nil {
 		return nil, err
 	}
-
-	tokenVal := &gwt.GWT[*gwt.Resources]{
-		Header: gwt.Header{
-			Issuer:    a.issuer,
-			Recipient: []byte(identifier),
-			Expires:   time.Now().Add(gwt.TokenExpireTime),
-		},
-		Body: identity.Resources,
+	if enabled {
+		a.recordActivity(ctx, &models.Activity{
+			IdentityID: identity.ID,
+			Event:      entities.ActivityLogin,
+			Outcome:    entities.OutcomeTwoFactorRequired,
+			Identifier: recipient,
+		})
+		return nil, a.requireTwoFactor(identity.ID, recipient, thumbprint)
 	}
 
-	tok, err := a.mc.Encode(tokenVal)
+	return a.startSession(ctx, identity, recipient, thumbprint)
+}
+
+// startSession starts a new session family for identity, recording the access token's signature on its account.
+func (a *Authentity) startSession(ctx context.Context, identity *models.Identity, recipient, thumbprint string) (*TokenPair, error) {
+	tokenVal, tok, err := a.newAccessToken(recipient, identity.Resources, thumbprint, "")
 	if err != nil {
 		return nil, err
 	}
 
 	identity.Account.Signature = tok.Signature
-	tokenVal.Token = tok.Token
 
 	err = a.Provider.IdentityService.Updates(ctx, identity)
 	if err != nil {
 		return nil, err
 	}
 
-	return tokenVal, nil
+	pair, err := a.issueRefresh(ctx, tokenVal, identity.ID, "", "", "")
+	if err != nil {
+		return nil, err
+	}
+
+	a.recordActivity(ctx, &models.Activity{
+		IdentityID: identity.ID,
+		Event:      entities.ActivityLogin,
+		Outcome:    entities.OutcomeSuccess,
+		Identifier: recipient,
+	})
+	return pair, nil
 }
 func (a *Authentity) LoginToken(tkn string) error {
-	// Validate Token
-	tokenVal, err := a.mc.Decode(tkn)
+	return a.LoginTokenProof(tkn, "", "", "")
+}
+
+// LoginTokenProof validates tkn like LoginToken. Tokens bound to a key also need a proof
+// made for the request method and rawURL.
+func (a *Authentity) LoginTokenProof(tkn, proof, method, rawURL string) error {
+	// Validate Token, only sessions of authentity pass, not tokens of OAuth clients.
+	tokenVal, err := validToken(a.mc, tkn)
 	if err != nil {
 		return err
 	}
 
-	return gwt.ValidateGWT(tokenVal)
+	return gwt.ValidateProof(tokenVal, proof, method, rawURL)
+}
+
+// ProofThumbprint checks a proof made for a request that asks for a bound session, e.g. on
+// login, and returns the thumbprint of its key.
+func (a *Authentity) ProofThumbprint(proof, method, rawURL string) (string, error) {
+	p, err := a.mc.CheckProof(proof, method, rawURL, "")
+	if err != nil {
+		return "", err
+	}
+
+	return p.Thumbprint, nil
 }
 func (a *Authentity) LogoutToken(pCtx context.Context, tkn string) error {
 	tokenVal, err := a.mc.Decode(tkn)
@@ -182,34 +568,201 @@ func (a *Authentity) LogoutToken(pCtx context.Context, tkn string) error {
 		return errors.New("account not found")
 	}
 
+	if err = a.mc.Revoke(tokenVal); err != nil {
+		return err
+	}
+
+	activity := &models.Activity{Event: entities.ActivityLogout, Outcome: entities.OutcomeSuccess, Identifier: account.Username}
+	if tokenVal.Body != nil {
+		activity.IdentityID = string(tokenVal.Body.UserID)
+	}
+	a.recordActivity(pCtx, activity)
+
 	account.Signature = ""
 
 	defer a.Logger.TRACE("account just logged out", account)
 	return a.Provider.AccountsService.Updates(pCtx, account)
 }
 
-func (a *Authentity) RefreshToken(tkn string) (gwt.Token, error) {
-	t, err := a.mc.Decode(tkn)
-	if err != nil {
-		return gwt.Token{}, err
+// RevokeToken kills the session of the token with tokenID. Without the token at hand its expiry
+// is unknown, so the entry is kept for the longest lifetime a token can have.
+func (a *Authentity) RevokeToken(tokenID string) error {
+	if tokenID == "" {
+		return errors.New("token id is required")
 	}
 
-	if err = gwt.ValidateGWTHeader(t, func(header *gwt.Header) error {
-		if !bytes.Equal(header.Issuer, a.issuer) {
-			return errors.New("invalid token issuer")
+	return a.revocations.Revoke(tokenID, time.Now().UTC().Add(gwt.TokenExpireTime))
+}
+
+// RefreshToken spends a refresh token for a new pair in the same family.
+// Spending a refresh token twice revokes the family and every access token issued with it.
+func (a *Authentity) RefreshToken(pCtx context.Context, refresh string) (*TokenPair, error) {
+	return a.RefreshTokenBound(pCtx, refresh, "")
+}
+
+// RefreshTokenBound refreshes like RefreshToken. A family bound to a key is only refreshed
+// when thumbprint, see ProofThumbprint, names that key.
+func (a *Authentity) RefreshTokenBound(pCtx context.Context, refresh, thumbprint string) (*TokenPair, error) {
+	return a.refreshToken(pCtx, refresh, thumbprint, "")
+}
+
+// refreshToken refreshes for clientID, "" being authentity's own sessions. Families issued to a client
+// keep the scope they were granted, mapped again onto the identity's current resources.
+func (a *Authentity) refreshToken(pCtx context.Context, refresh, thumbprint, clientID string) (pair *TokenPair, err error) {
+	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
+	defer cancel()
+
+	// Checked before spending, so a stolen refresh token cannot burn the holder's session.
+	rt, err := a.Provider.RefreshService.Find(ctx, refresh)
+	if err == nil {
+		// Failures are recorded for the identity the token was issued to, unknown tokens tell nothing.
+		defer func() {
+			if err != nil {
+				a.recordActivity(ctx, &models.Activity{
+					IdentityID: rt.IdentityID,
+					Event:      entities.ActivityRefresh,
+					Outcome:    entities.OutcomeFailure,
+					Reason:     err.Error(),
+					Identifier: rt.Recipient,
+					ClientID:   rt.ClientID,
+				})
+			}
+		}()
+
+		if rt.ClientID != clientID {
+			return nil, services.ErrRefreshInvalid
 		}
+		if rt.Confirmation != thumbprint {
+			return nil, errors.New(gwt.ErrorProofKey)
+		}
+	}
 
-		return a.Provider.AccountsService.AccountHasUsername(context.Background(), string(header.Recipient))
-	}); err != nil {
-		return gwt.Token{}, err
+	prev, err := a.Provider.RefreshService.Rotate(ctx, refresh)
+	if errors.Is(err, services.ErrRefreshReuse) {
+		a.Logger.WARN("refresh token reuse detected, revoking session family", prev.Family, prev.Recipient)
+		if rErr := a.revokeRefreshFamily(ctx, prev.Family); rErr != nil {
+			return nil, rErr
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return a.mc.Encode(&gwt.GWT[*gwt.Resources]{
+	identity, err := a.Provider.IdentityService.FetchIdentity(ctx, prev.IdentityID)
+	if err != nil {
+		return nil, err
+	}
+
+	resources := identity.Resources
+	if prev.ClientID != "" {
+		resources = a.scopedResources(resources, strings.Fields(prev.Scope))
+	}
+
+	tokenVal, _, err := a.newAccessToken(prev.Recipient, resources, prev.Confirmation, prev.ClientID)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err = a.issueRefresh(ctx, tokenVal, identity.ID, prev.Family, prev.ClientID, prev.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	a.recordActivity(ctx, &models.Activity{
+		IdentityID: identity.ID,
+		Event:      entities.ActivityRefresh,
+		Outcome:    entities.OutcomeSuccess,
+		Identifier: prev.Recipient,
+		ClientID:   prev.ClientID,
+	})
+	return pair, nil
+}
+
+// RevokeRefresh ends the session family refresh belongs to.
+func (a *Authentity) RevokeRefresh(ctx context.Context, refresh string) error {
+	rt, err := a.Provider.RefreshService.Find(ctx, refresh)
+	if err != nil {
+		return err
+	}
+
+	return a.revokeRefreshFamily(ctx, rt.Family)
+}
+
+// newAccessToken mints an access token for recipient, for the OAuth client with clientID when not empty.
+func (a *Authentity) newAccessToken(recipient string, resources *gwt.Resources, thumbprint, clientID string) (*gwt.GWT[*gwt.Resources], gwt.Token, error) {
+	tokenVal := &gwt.GWT[*gwt.Resources]{
 		Header: gwt.Header{
 			Issuer:    a.issuer,
-			Recipient: t.Header.Recipient,
+			Recipient: []byte(recipient),
 			Expires:   time.Now().Add(gwt.TokenExpireTime),
+
+			Confirmation: thumbprint,
 		},
-		Body: t.Body,
-	})
+		Body: resources,
+	}
+
+	coder := a.mc
+	if clientID != "" {
+		coder = a.clientTokens
+	}
+
+	tok, err := coder.Encode(tokenVal)
+	if err != nil {
+		return nil, gwt.Token{}, err
+	}
+
+	tokenVal.Token = tok.Token
+	return tokenVal, tok, nil
+}
+
+// issueRefresh issues a refresh token alongside access, for the client with clientID granted scope
+// when the session is not authentity's own.
+func (a *Authentity) issueRefresh(ctx context.Context, access *gwt.GWT[*gwt.Resources], identityID, family, clientID, scope string) (*TokenPair, error) {
+	refresh, err := a.Provider.RefreshService.Issue(ctx, &models.RefreshToken{
+		Family:     family,
+		IdentityID: identityID,
+		Recipient:  string(access.Header.Recipient),
+		AccessID:   access.Header.ID,
+		Expires:    time.Now().Add(RefreshTokenExpireTime),
+
+		Confirmation: access.Header.Confirmation,
+		ClientID:     clientID,
+		Scope:        scope,
+	}, access.Header.Expires)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TokenPair{Access: access, Refresh: refresh}, nil
+}
+func (a *Authentity) revokeRefreshFamily(ctx context.Context, family string) error {
+	access, err := a.Provider.RefreshService.RevokeFamily(ctx, family)
+	if err != nil {
+		return err
+	}
+
+	for id, expires := range access {
+		if err = a.revocations.Revoke(id, expires); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// revokeIdentitySessions ends every session family of identityID and the access tokens issued with them.
+func (a *Authentity) revokeIdentitySessions(ctx context.Context, identityID string) error {
+	access, err := a.Provider.RefreshService.RevokeIdentity(ctx, identityID)
+	if err != nil {
+		return err
+	}
+
+	for id, expires := range access {
+		if err = a.revocations.Revoke(id, expires); err != nil {
+			return err
+		}
+	}
+
+	return nil
 }
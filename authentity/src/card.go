@@ -0,0 +1,49 @@
+package src
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/vaiktorg/grimoire/gwt/vhash"
+	"net/http"
+	"strings"
+)
+
+// CardKeyHeader carries the hex random hash a card rendered by CardHandler only reads back with.
+const CardKeyHeader = "Card-Key"
+
+// CardHandler renders the caller's ID card, a vhash card of their access token's signature, as a PNG.
+// Every card gets a fresh random mask, its key is returned in CardKeyHeader and is not kept.
+// Config.CardOptions pick the card template.
+func CardHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		tokStr, ok := r.Context().Value("token").(string)
+		if !ok {
+			http.Error(w, "could not fetch token for the card", http.StatusInternalServerError)
+			return
+		}
+
+		signature, err := base64.URLEncoding.DecodeString(tokStr[strings.LastIndex(tokStr, ".")+1:])
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		card := new(bytes.Buffer)
+		randHash, _, err := vhash.CreateTokenCard(card, []byte(hex.EncodeToString(signature)), service.cardOpts...)
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set(CardKeyHeader, hex.EncodeToString(randHash))
+		_, _ = w.Write(card.Bytes())
+	}
+}
@@ -1,5 +1,56 @@
 package src
 
+import "time"
+
+const (
+	CookieTokenName   = "gwt"
+	CookieRefreshName = "gwt_refresh"
+)
+
+// RefreshTokenExpireTime is how long a refresh token can be spent for a new pair.
+const RefreshTokenExpireTime = time.Hour * 24 * 14
+
+// Paths other services find authentity's public endpoints at, see DiscoveryHandler.
+const (
+	DiscoveryPath     = "/.well-known/openid-configuration"
+	JWKSPath          = "/.well-known/jwks.json"
+	IntrospectionPath = "/introspect"
+)
+
+// Paths of authentity's OAuth2 authorization server.
+const (
+	AuthorizePath = "/oauth/authorize"
+	TokenPath     = "/oauth/token"
+	ClientsPath   = "/oauth/clients"
+)
+
+// AuthorizationCodeExpireTime is how long a client has to exchange an authorization code.
+const AuthorizationCodeExpireTime = time.Minute
+
+// Paths of two factor authentication, see TwoFactorLoginHandler.
+const (
+	TwoFactorLoginPath   = "/login/2fa"
+	TwoFactorEnrollPath  = "/2fa/enroll"
+	TwoFactorConfirmPath = "/2fa/confirm"
+	TwoFactorAdminPath   = "/2fa/admin"
+)
+
+// Paths of the email verification and password reset flows.
+const (
+	VerifyEmailPath    = "/verify-email"
+	ForgotPasswordPath = "/forgot-password"
+	ResetPasswordPath  = "/reset-password"
+)
+
+// Paths of the activity log, see ActivityHandler.
+const (
+	ActivityPath      = "/activity"
+	ActivityAdminPath = "/activity/admin"
+)
+
+// ActivityPageSize is how many entries a page of the activity log has unless asked for otherwise,
+// MaxActivityPageSize at most.
 const (
-	CookieTokenName = "gwt"
+	ActivityPageSize    = 20
+	MaxActivityPageSize = 100
 )
@@ -0,0 +1,91 @@
+package src
+
+import (
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/gwt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// DiscoveryHandler serves the discovery document listing authentity's public endpoints.
+// Endpoint URLs are absolute, on Config.PublicURL. Without one they are on the host the document
+// was requested from, and only the client may cache it, or one Host header would poison it for all.
+func DiscoveryHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		algs := []string{}
+		if len(service.keys.JWKS().Keys) > 0 {
+			algs = append(algs, string(gwt.EdDSA))
+		}
+
+		scopes := make([]string, 0, len(service.scopes))
+		for name := range service.scopes {
+			scopes = append(scopes, name)
+		}
+		sort.Strings(scopes)
+
+		origin, cache := service.publicURL, writePublicJSON
+		if origin == "" {
+			origin, cache = requestOrigin(r), writePrivateJSON
+		}
+
+		cache(service, w, models.Discovery{
+			Issuer:                string(service.issuer),
+			JWKSURI:               origin + JWKSPath,
+			IntrospectionEndpoint: origin + IntrospectionPath,
+			IntrospectionEndpointAuthMethodsSupported: []string{"client_secret_basic"},
+			TokenSigningAlgValuesSupported:            algs,
+
+			AuthorizationEndpoint:             origin + AuthorizePath,
+			TokenEndpoint:                     origin + TokenPath,
+			TokenEndpointAuthMethodsSupported: []string{"client_secret_basic", "client_secret_post", "none"},
+			ScopesSupported:                   scopes,
+			ResponseTypesSupported:            []string{"code"},
+			GrantTypesSupported:               []string{"authorization_code", "refresh_token"},
+			CodeChallengeMethodsSupported:     []string{"S256"},
+		})
+	}
+}
+
+// JWKSHandler serves the public half of every EdDSA key in Config.Keys. HS512 keys are shared
+// secrets and are never listed, the set is empty when authentity only signs with those.
+func JWKSHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		writePublicJSON(service, w, service.keys.JWKS())
+	}
+}
+
+// publicCacheAge lets verifiers cache the key set while a rotated key is still picked up quickly.
+const publicCacheAge = 5 * time.Minute
+
+func writePublicJSON(service *Authentity, w http.ResponseWriter, v any) {
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(publicCacheAge.Seconds())))
+	writeJSON(service, w, v)
+}
+
+// writePrivateJSON writes v, made for the Host of its request, for the client alone to cache.
+func writePrivateJSON(service *Authentity, w http.ResponseWriter, v any) {
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(publicCacheAge.Seconds())))
+	w.Header().Set("Vary", "Host")
+	writeJSON(service, w, v)
+}
+
+func writeJSON(service *Authentity, w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		service.Logger.ERROR(err.Error())
+	}
+}
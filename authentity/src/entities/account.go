@@ -6,4 +6,5 @@ type Account struct {
 	Email     *string // Unique
 	Password  *string
 	Signature *string
+	Verified  bool // Email was verified, reset whenever it changes.
 }
@@ -0,0 +1,12 @@
+package entities
+
+// ExternalIdentity links a social login subject to the Identity it logs into.
+type ExternalIdentity struct {
+	Entity
+
+	Connector  string `gorm:"uniqueIndex:idx_connector_subject"`
+	Subject    string `gorm:"uniqueIndex:idx_connector_subject"`
+	IdentityID string `gorm:"index"`
+
+	Email string // as the connector last reported it
+}
@@ -5,6 +5,21 @@ import (
 	"time"
 )
 
+// Events and outcomes of the UserActivityLog.
+const (
+	ActivityLogin     = "login"
+	ActivityLogout    = "logout"
+	ActivityRefresh   = "refresh"
+	ActivityTwoFactor = "two_factor"
+
+	OutcomeSuccess           = "success"
+	OutcomeFailure           = "failure"
+	OutcomeLockedOut         = "locked_out"
+	OutcomeTwoFactorRequired = "two_factor_required"
+)
+
+// UserActivityLog records a login, logout, refresh or failed attempt. Attempts with an identifier
+// of no account have no IdentityId. CreatedAt is when it happened.
 type UserActivityLog struct {
 	Entity
 
@@ -14,6 +29,15 @@ type UserActivityLog struct {
 	LoggedIn  time.Time
 	LoggedOut time.Time
 
+	Event      string
+	Outcome    string
+	Reason     string
+	Identifier string // As typed on login, or the username
+	ClientID   string // OAuth client the refreshed session was issued to
+
 	IPAddress string
+	UserAgent string
 	Device    string
+	Country   string
+	Anomalies string // Comma separated, see services.Anomalies
 }
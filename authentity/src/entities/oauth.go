@@ -0,0 +1,41 @@
+package entities
+
+import "time"
+
+// OAuthClient is a registered client. RedirectURIs and Scopes are space separated.
+type OAuthClient struct {
+	Entity
+
+	Name         string
+	SecretHash   string // SHA-256, empty for public clients
+	RedirectURIs string
+	Scopes       string
+	Public       bool
+}
+
+// AuthorizationCode is the server side record of an authorization code. Only a hash of the code is stored.
+type AuthorizationCode struct {
+	Entity
+
+	CodeHash    string `gorm:"uniqueIndex"`
+	ClientID    string
+	IdentityID  string
+	RedirectURI string
+	Scope       string
+	Challenge   string
+
+	RedirectURIExplicit bool
+
+	Expires time.Time
+	Used    bool   // Already exchanged; presenting it again is reuse.
+	Family  string // Refresh family issued for it, revoked on reuse.
+}
+
+// OAuthConsent remembers the scopes an identity granted a client, so it is not asked again.
+type OAuthConsent struct {
+	Entity
+
+	ClientID   string `gorm:"uniqueIndex:idx_consent_client_identity"`
+	IdentityID string `gorm:"uniqueIndex:idx_consent_client_identity"`
+	Scope      string
+}
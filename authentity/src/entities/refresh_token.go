@@ -0,0 +1,29 @@
+package entities
+
+import "time"
+
+// RefreshToken is the server side record of a long-lived refresh token.
+// Only a hash of the token is stored. Every rotation issues a new row in the same Family.
+type RefreshToken struct {
+	Entity
+
+	TokenHash  string `gorm:"uniqueIndex"`
+	Family     string `gorm:"index"`
+	IdentityID string `gorm:"index"`
+	Recipient  string
+
+	// Thumbprint of the key the family is bound to, see gwt.ValidateProof.
+	Confirmation string
+
+	// OAuth client the family was issued to, and the scope it was granted. Empty for authentity's own sessions.
+	ClientID string `gorm:"index"`
+	Scope    string
+
+	// Access token issued alongside, revoked with the family.
+	AccessID      string
+	AccessExpires time.Time
+
+	Expires time.Time
+	Rotated bool // Already exchanged for a new pair; presenting it again is reuse.
+	Revoked bool
+}
@@ -0,0 +1,21 @@
+package entities
+
+// TwoFactor is an identity's TOTP enrollment. It only guards logins once Enabled, after the
+// first code from the authenticator app was confirmed.
+type TwoFactor struct {
+	Entity
+
+	IdentityID  string `gorm:"uniqueIndex"`
+	Secret      string // base32, the codes can't be checked against a hash of it
+	Enabled     bool
+	LastCounter int64 // TOTP period of the last code accepted, earlier codes are never accepted again.
+}
+
+// RecoveryCode logs in once in place of a TOTP code. Only a hash of the code is stored.
+type RecoveryCode struct {
+	Entity
+
+	IdentityID string `gorm:"index"`
+	CodeHash   string `gorm:"uniqueIndex"`
+	Used       bool
+}
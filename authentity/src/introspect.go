@@ -0,0 +1,140 @@
+package src
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/gwt"
+	"net/http"
+	"time"
+)
+
+// Introspect decodes and validates an access token the way TokenMiddleware does, proof of
+// possession aside: the caller gets the token's confirmation to check the proof itself.
+// Access tokens of OAuth clients, which TokenMiddleware refuses, are valid here too.
+func (a *Authentity) Introspect(tkn string) (*gwt.GWT[*gwt.Resources], error) {
+	tokenVal, err := validToken(a.mc, tkn)
+	if err != nil {
+		if clientVal, cErr := validToken(a.clientTokens, tkn); cErr == nil {
+			return clientVal, nil
+		}
+		return nil, err
+	}
+
+	return tokenVal, nil
+}
+
+// validToken decodes tkn with coder and validates it for coder's audience.
+func validToken(coder *gwt.MultiCoder[*gwt.Resources], tkn string) (*gwt.GWT[*gwt.Resources], error) {
+	tokenVal, err := coder.Decode(tkn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = gwt.ValidateGWT(tokenVal); err != nil {
+		return nil, err
+	}
+
+	return tokenVal, nil
+}
+
+// IntrospectHandler answers RFC 7662 token introspection requests, a form POST with a token field,
+// from the clients in Config.IntrospectionClients. Tokens that fail validation for any reason are
+// reported inactive, without saying why.
+func IntrospectHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		clientID, ok := service.introspectionClient(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", `Basic realm="introspection"`)
+			http.Error(w, service.Logger.ERROR("introspection client not authorized"), http.StatusUnauthorized)
+			return
+		}
+
+		if err := r.ParseForm(); err != nil || r.PostForm.Get("token") == "" {
+			http.Error(w, "token is required", http.StatusBadRequest)
+			return
+		}
+
+		resp := models.Introspection{}
+		if tok, err := service.Introspect(r.PostForm.Get("token")); err == nil {
+			resp = introspection(tok)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		if err := json.NewEncoder(w).Encode(resp); err != nil {
+			service.Logger.ERROR(err.Error())
+			return
+		}
+
+		service.Logger.INFO("client: " + clientID + " introspected token: " + resp.Jti)
+	}
+}
+
+// introspectionClient checks the basic auth credentials of r against Config.IntrospectionClients.
+func (a *Authentity) introspectionClient(r *http.Request) (string, bool) {
+	id, secret, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+
+	want, ok := a.introspect[id]
+	if !ok || want == "" {
+		return "", false
+	}
+
+	return id, subtle.ConstantTimeCompare([]byte(secret), []byte(want)) == 1
+}
+
+func introspection(tok *gwt.GWT[*gwt.Resources]) models.Introspection {
+	resp := models.Introspection{
+		Active:    true,
+		TokenType: "access_token",
+		Jti:       tok.Header.ID,
+		Iss:       string(tok.Header.Issuer),
+		Sub:       string(tok.Header.Recipient),
+		Aud:       string(tok.Header.Audience),
+		Iat:       unixOrZero(tok.Header.IssuedAt),
+		Nbf:       unixOrZero(tok.Header.NotBefore),
+		Exp:       tok.Header.Expires.Unix(),
+		Kid:       tok.Header.KeyID,
+		Alg:       string(tok.Header.Algorithm),
+	}
+	if tok.Header.Confirmation != "" {
+		resp.Cnf = &models.Confirmation{Jkt: tok.Header.Confirmation}
+	}
+
+	if tok.Body == nil {
+		return resp
+	}
+
+	resp.UserID = string(tok.Body.UserID)
+	for _, res := range tok.Body.Resources {
+		r := models.IntrospectionResource{ResID: string(res.ResID), Type: string(res.Type), Roles: []models.IntrospectionRole{}}
+		for _, role := range res.Roles {
+			ir := models.IntrospectionRole{Type: string(role.Type), Permissions: int32(role.Permissions)}
+			for k, v := range role.Claims {
+				if ir.Claims == nil {
+					ir.Claims = make(map[string]string, len(role.Claims))
+				}
+				ir.Claims[string(k)] = string(v)
+			}
+			r.Roles = append(r.Roles, ir)
+		}
+		resp.Resources = append(resp.Resources, r)
+	}
+
+	return resp
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
@@ -0,0 +1,50 @@
+package src
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LockoutError refuses the logins of an account locked out after too many failed attempts.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e *LockoutError) Error() string {
+	return "too many failed logins, retry in " + strconv.Itoa(int(e.RetryAfter.Round(time.Second).Seconds())) + "s"
+}
+
+// Failed logins are counted per account once the identifier names one, so username and email share
+// their attempts. Identifiers of no account are counted as typed.
+
+func identifierKey(identifier string) string {
+	return "identifier:" + strings.ToLower(strings.TrimSpace(identifier))
+}
+func accountKey(accountID string) string {
+	return "account:" + accountID
+}
+func twoFactorKey(identityID string) string {
+	return "2fa:" + identityID
+}
+
+// checkLockout returns a *LockoutError when any of keys is locked out.
+func (a *Authentity) checkLockout(keys ...string) error {
+	for _, key := range keys {
+		if wait, locked := a.logins.Locked(key); locked {
+			return &LockoutError{RetryAfter: wait}
+		}
+	}
+
+	return nil
+}
+
+// failLogin counts a failed login of key and returns err, or a *LockoutError when it locked key out.
+func (a *Authentity) failLogin(key string, err error) error {
+	if wait, ok := a.logins.Attempt(key); !ok {
+		a.Logger.WARN("too many failed logins, locked out for "+wait.String(), key)
+		return &LockoutError{RetryAfter: wait}
+	}
+
+	return err
+}
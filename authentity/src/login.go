@@ -2,8 +2,13 @@ package src
 
 import (
 	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/internal"
 	"github.com/vaiktorg/grimoire/authentity/src/models"
 	"net/http"
+	"net/url"
+	"strings"
+	"time"
 )
 
 func LoginHandler(service *Authentity) http.HandlerFunc {
@@ -50,19 +55,85 @@ func postLogin(service *Authentity, w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	tokenValue, err := service.LoginManual(r.Context(), identifier, req.Password)
+	thumbprint, err := requestThumbprint(service, r)
+	if err != nil {
+		service.Logger.ERROR(err.Error())
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	pair, err := service.LoginManualBound(service.withClient(r), identifier, req.Password, thumbprint)
+	var pending *TwoFactorRequiredError
+	if errors.As(err, &pending) {
+		writeTwoFactorRequired(w, r, pending)
+		return
+	}
+	var lockout *LockoutError
+	if errors.As(err, &lockout) {
+		service.Logger.WARN(err.Error(), identifier)
+		internal.TooManyRequests(w, lockout.RetryAfter)
+		return
+	}
+	if errors.Is(err, UnverifiedAccountError) {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusForbidden)
+		return
+	}
 	if err != nil {
 		service.Logger.ERROR(err.Error())
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	setSessionCookies(w, pair)
+
+	// Sent here by the authorization endpoint, the user goes back to it.
+	if next := localRedirect(r.URL.Query().Get("next")); next != "" {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	}
+
+	service.Logger.INFO(req.Email + "has logged in")
+}
+
+// localRedirect returns next if it is a path on this origin, and "" otherwise, so a next parameter
+// can never send the user to another site.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return ""
+	}
+
+	u, err := url.Parse(next)
+	if err != nil || u.Scheme != "" || u.Host != "" {
+		return ""
+	}
+
+	return u.RequestURI()
+}
+
+func setSessionCookies(w http.ResponseWriter, pair *TokenPair) {
 	http.SetCookie(w, &http.Cookie{
 		Name:    CookieTokenName,
-		Value:   tokenValue.Token,
-		Expires: tokenValue.Header.Expires,
+		Value:   pair.Access.Token,
+		Path:    "/",
+		Expires: pair.Access.Header.Expires,
 		MaxAge:  0,
 	})
 
-	service.Logger.INFO(req.Email + "has logged in")
+	http.SetCookie(w, &http.Cookie{
+		Name:     CookieRefreshName,
+		Value:    pair.Refresh.Token,
+		Path:     "/",
+		Expires:  pair.Refresh.Expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteStrictMode,
+	})
+}
+func clearSessionCookies(w http.ResponseWriter) {
+	for _, name := range []string{CookieTokenName, CookieRefreshName} {
+		http.SetCookie(w, &http.Cookie{
+			Name:    name,
+			Value:   "",
+			Path:    "/",
+			Expires: time.Unix(0, 0),
+		})
+	}
 }
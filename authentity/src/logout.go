@@ -1,8 +1,8 @@
 package src
 
 import (
+	"encoding/json"
 	"net/http"
-	"time"
 )
 
 func LogoutHandler(service *Authentity) http.HandlerFunc {
@@ -14,20 +14,47 @@ func LogoutHandler(service *Authentity) http.HandlerFunc {
 			return
 		}
 
-		err = service.LogoutToken(r.Context(), tokenCookie.Value)
+		err = service.LogoutToken(service.withClient(r), tokenCookie.Value)
 		if err != nil {
 			service.Logger.ERROR(err.Error())
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
 
-		http.SetCookie(w, &http.Cookie{
-			Name:    CookieTokenName,
-			Value:   "",
-			Path:    "/",
-			Expires: time.Unix(0, 0),
-		})
+		if refreshCookie, err := r.Cookie(CookieRefreshName); err == nil && refreshCookie.Value != "" {
+			if err = service.RevokeRefresh(r.Context(), refreshCookie.Value); err != nil {
+				service.Logger.ERROR(err.Error())
+			}
+		}
+
+		clearSessionCookies(w)
 
 		service.Logger.INFO("token: " + tokenCookie.Value + " has logged out")
 	}
 }
+
+// RevokeHandler lets an administrator kill any session by its token ID.
+func RevokeHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		req := &struct {
+			TokenID string `json:"token_id"`
+		}{}
+
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		if err := service.RevokeToken(req.TokenID); err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		service.Logger.INFO("token: " + req.TokenID + " has been revoked")
+	}
+}
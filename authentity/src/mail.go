@@ -0,0 +1,385 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	_ "embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"github.com/vaiktorg/grimoire/gwt"
+	"golang.org/x/crypto/bcrypt"
+	htmltemplate "html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Email verification and password reset
+// ====================================================================================================
+// Both flows mail the user a link with a signed GWT. The tokens expire and are revoked once spent,
+// so every link works once. Reset links also die with the password they were sent for.
+
+var (
+	AccountTokenError      = errors.New("link is invalid, expired or was already used")
+	UnverifiedAccountError = errors.New("email is not verified yet")
+	NoMailerError          = errors.New("no mailer is configured")
+)
+
+const (
+	// EmailVerificationExpireTime is how long a verification link works.
+	EmailVerificationExpireTime = 48 * time.Hour
+
+	// PasswordResetExpireTime is how long a password reset link works.
+	PasswordResetExpireTime = time.Hour
+)
+
+const (
+	actionVerifyEmail   = "verify_email"
+	actionResetPassword = "reset_password"
+)
+
+// accountAction is what a mailed link lets its holder do.
+type accountAction struct {
+	Purpose    string
+	IdentityID string
+	Email      string // the address verified
+	Stamp      string // fingerprint of the password a reset replaces
+}
+
+//go:embed tmpl/mail_verify_email.gotmpl
+var verifyEmailMail string
+
+//go:embed tmpl/mail_reset_password.gotmpl
+var resetPasswordMail string
+
+var (
+	verifyEmailTmpl   = template.Must(template.New("verify_email").Parse(verifyEmailMail))
+	resetPasswordTmpl = template.Must(template.New("reset_password").Parse(resetPasswordMail))
+)
+
+// SendEmailVerification mails identityID a link verifying its current email.
+func (a *Authentity) SendEmailVerification(ctx context.Context, identityID string) error {
+	identity, err := a.Provider.IdentityService.FetchIdentity(ctx, identityID)
+	if err != nil {
+		return err
+	}
+
+	return a.mailAction(ctx, identity, verifyEmailTmpl, "Verify your email", VerifyEmailPath, EmailVerificationExpireTime,
+		accountAction{Purpose: actionVerifyEmail, IdentityID: identity.ID, Email: identity.Account.Email})
+}
+
+// VerifyEmail spends a link of SendEmailVerification. It fails when the email changed since.
+func (a *Authentity) VerifyEmail(pCtx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
+	defer cancel()
+
+	return a.spendAction(token, actionVerifyEmail, func(action *accountAction) error {
+		identity, err := a.Provider.IdentityService.FetchIdentity(ctx, action.IdentityID)
+		if err != nil {
+			return AccountTokenError
+		}
+
+		err = a.Provider.AccountsService.SetVerified(ctx, identity.Account.ID, action.Email)
+		if errors.Is(err, services.ErrEmailChanged) {
+			return AccountTokenError
+		}
+
+		return err
+	})
+}
+
+// RequestPasswordReset mails a reset link to the account using email. Neither an unknown email nor a
+// failing mailer is an error, and the mail is sent off the request path, so neither the answer nor
+// how long it takes tells whether an account exists.
+func (a *Authentity) RequestPasswordReset(pCtx context.Context, email string) error {
+	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
+	defer cancel()
+
+	if a.mailer == nil {
+		return NoMailerError
+	}
+
+	identity, err := a.Provider.IdentityService.FetchIdentityByEmail(ctx, email)
+	if err != nil {
+		a.Logger.INFO("password reset asked for an unknown email")
+		return nil
+	}
+
+	mail, err := a.actionMail(identity, resetPasswordTmpl, "Reset your password", ResetPasswordPath, PasswordResetExpireTime,
+		accountAction{Purpose: actionResetPassword, IdentityID: identity.ID, Stamp: passwordStamp(identity.Account.Password)})
+	if err != nil {
+		a.Logger.ERROR("could not write a password reset: "+err.Error(), identity.Account.Username)
+		return nil
+	}
+
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+		defer cancel()
+
+		if err := a.mailer.Send(ctx, mail); err != nil {
+			a.Logger.ERROR("could not mail a password reset: "+err.Error(), identity.Account.Username)
+		}
+	}()
+
+	return nil
+}
+
+// ResetPassword spends a link of RequestPasswordReset on password, and ends every session of the account.
+func (a *Authentity) ResetPassword(pCtx context.Context, token, password string) error {
+	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
+	defer cancel()
+
+	if password == "" {
+		return errors.New("password is required")
+	}
+
+	return a.spendAction(token, actionResetPassword, func(action *accountAction) error {
+		identity, err := a.Provider.IdentityService.FetchIdentity(ctx, action.IdentityID)
+		if err != nil || passwordStamp(identity.Account.Password) != action.Stamp {
+			return AccountTokenError
+		}
+
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return errors.New("could not create hashed password")
+		}
+
+		if err = a.Provider.AccountsService.SetPassword(ctx, identity.Account.ID, string(hash)); err != nil {
+			return err
+		}
+
+		a.Logger.WARN("password reset, ending every session", identity.Account.Username)
+		return a.revokeIdentitySessions(ctx, identity.ID)
+	})
+}
+
+func (a *Authentity) mailAction(ctx context.Context, identity *models.Identity, tmpl *template.Template, subject, path string, ttl time.Duration, action accountAction) error {
+	if a.mailer == nil {
+		return NoMailerError
+	}
+
+	mail, err := a.actionMail(identity, tmpl, subject, path, ttl, action)
+	if err != nil {
+		return err
+	}
+
+	return a.mailer.Send(ctx, mail)
+}
+
+// actionMail writes the mail carrying a link to action for identity.
+func (a *Authentity) actionMail(identity *models.Identity, tmpl *template.Template, subject, path string, ttl time.Duration, action accountAction) (services.Mail, error) {
+	tok, err := a.actions.Encode(&gwt.GWT[accountAction]{
+		Header: gwt.Header{
+			Issuer:    a.issuer,
+			Recipient: []byte(identity.Account.Username),
+			Expires:   a.now().Add(ttl),
+		},
+		Body: action,
+	})
+	if err != nil {
+		return services.Mail{}, err
+	}
+
+	body := new(bytes.Buffer)
+	err = tmpl.Execute(body, map[string]any{
+		"Username": identity.Account.Username,
+		"Email":    identity.Account.Email,
+		"Link":     a.publicURL + path + "?" + url.Values{"token": {tok.Token}}.Encode(),
+		"Expires":  ttl.String(),
+	})
+	if err != nil {
+		return services.Mail{}, err
+	}
+
+	return services.Mail{To: identity.Account.Email, Subject: subject, Body: body.String()}, nil
+}
+
+// spendAction runs do with the action of token, and revokes token once do succeeds.
+func (a *Authentity) spendAction(token, purpose string, do func(*accountAction) error) error {
+	a.actionsMu.Lock()
+	defer a.actionsMu.Unlock()
+
+	tok, err := a.actions.Decode(token)
+	if err == nil {
+		err = gwt.ValidateGWT(tok)
+	}
+	if err != nil || tok.Body.Purpose != purpose {
+		return AccountTokenError
+	}
+
+	if err = do(&tok.Body); err != nil {
+		return err
+	}
+
+	return a.actions.Revoke(tok)
+}
+
+// passwordStamp fingerprints a password hash, so a reset link only replaces the password it was sent for.
+func passwordStamp(hash string) string {
+	sum := sha256.Sum256([]byte(hash))
+	return hex.EncodeToString(sum[:8])
+}
+
+// Handlers
+// ----------------------------------------------------------------------------------------------------
+
+//go:embed tmpl/forgot_password.gohtml
+var forgotPasswordPage string
+
+//go:embed tmpl/reset_password.gohtml
+var resetPasswordPage string
+
+//go:embed tmpl/account_notice.gohtml
+var accountNoticePage string
+
+var (
+	forgotPasswordTmpl = htmltemplate.Must(htmltemplate.New("forgot_password").Parse(forgotPasswordPage))
+	resetPasswordForm  = htmltemplate.Must(htmltemplate.New("reset_password").Parse(resetPasswordPage))
+	accountNoticeTmpl  = htmltemplate.Must(htmltemplate.New("account_notice").Parse(accountNoticePage))
+)
+
+// VerifyEmailHandler verifies the email of the link's token on GET. POST mails the session's
+// identity a new link.
+func VerifyEmailHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			if err := service.VerifyEmail(r.Context(), r.URL.Query().Get("token")); err != nil {
+				renderAccountPage(service, w, http.StatusBadRequest, accountNoticeTmpl,
+					map[string]any{"Title": "Email not verified", "Message": err.Error()})
+				return
+			}
+
+			renderAccountPage(service, w, http.StatusOK, accountNoticeTmpl,
+				map[string]any{"Title": "Email verified", "Message": "Thank you, your email is verified."})
+		case http.MethodPost:
+			identityID, ok := service.sessionIdentity(r)
+			if !ok {
+				http.Error(w, "session required", http.StatusUnauthorized)
+				return
+			}
+
+			if err := service.SendEmailVerification(r.Context(), identityID); err != nil {
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+				return
+			}
+
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// ForgotPasswordHandler serves the forgot password form on GET. POST takes its form, or a JSON
+// models.PasswordResetRequest, and mails the reset link.
+func ForgotPasswordHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			renderAccountPage(service, w, http.StatusOK, forgotPasswordTmpl, map[string]any{"Action": ForgotPasswordPath})
+		case http.MethodPost:
+			req, form, err := passwordResetRequest(r)
+			if err != nil || req.Email == "" {
+				http.Error(w, service.Logger.ERROR("email is required"), http.StatusBadRequest)
+				return
+			}
+
+			if err = service.RequestPasswordReset(r.Context(), req.Email); err != nil {
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+				return
+			}
+
+			if !form {
+				w.WriteHeader(http.StatusAccepted)
+				return
+			}
+			renderAccountPage(service, w, http.StatusOK, accountNoticeTmpl, map[string]any{
+				"Title":   "Check your inbox",
+				"Message": "If an account uses that email, a link to reset its password is on its way.",
+			})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// ResetPasswordHandler serves the form choosing a new password for the link's token on GET. POST takes
+// its form, or a JSON models.PasswordResetRequest, and changes the password.
+func ResetPasswordHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			renderAccountPage(service, w, http.StatusOK, resetPasswordForm, map[string]any{
+				"Action": ResetPasswordPath,
+				"Token":  r.URL.Query().Get("token"),
+			})
+		case http.MethodPost:
+			req, form, err := passwordResetRequest(r)
+			if err != nil {
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+				return
+			}
+
+			err = service.ResetPassword(r.Context(), req.Token, req.Password)
+			switch {
+			case errors.Is(err, AccountTokenError):
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+				return
+			case err != nil:
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+				return
+			}
+
+			if !form {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			renderAccountPage(service, w, http.StatusOK, accountNoticeTmpl, map[string]any{
+				"Title":   "Password changed",
+				"Message": "Your password was changed, log in with the new one.",
+			})
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// passwordResetRequest reads a models.PasswordResetRequest from a JSON body or a form, and reports which.
+func passwordResetRequest(r *http.Request) (*models.PasswordResetRequest, bool, error) {
+	var req models.PasswordResetRequest
+
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		return &req, false, json.NewDecoder(r.Body).Decode(&req)
+	}
+
+	if err := r.ParseForm(); err != nil {
+		return nil, true, err
+	}
+	req.Email = r.PostForm.Get("email")
+	req.Token = r.PostForm.Get("token")
+	req.Password = r.PostForm.Get("password")
+
+	return &req, true, nil
+}
+
+func renderAccountPage(service *Authentity, w http.ResponseWriter, status int, tmpl *htmltemplate.Template, data map[string]any) {
+	page := new(bytes.Buffer)
+	if err := tmpl.Execute(page, data); err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Referrer-Policy", "no-referrer") // the token is in the URL
+	w.WriteHeader(status)
+	_, _ = w.Write(page.Bytes())
+}
@@ -10,19 +10,35 @@ var (
 	AlreadyExistError = errors.New("tables already in database")
 )
 
+// sessionTables were added, or grew columns, after the identity tables shipped,
+// so they are migrated even on databases that already exist.
+var sessionTables = []any{
+	&entities.Account{}, // Verified
+	&entities.RefreshToken{},
+	&entities.ExternalIdentity{},
+	&entities.OAuthClient{},
+	&entities.AuthorizationCode{},
+	&entities.OAuthConsent{},
+	&entities.TwoFactor{},
+	&entities.RecoveryCode{},
+	&entities.UserActivityLog{}, // Event, Outcome, UserAgent...
+}
+
 func (a *Authentity) Migrate() error {
 	if a.Provider.migrator.HasTable(entities.Identity{}) {
+		if err := a.Provider.migrator.AutoMigrate(sessionTables...); err != nil {
+			return err
+		}
 		return AlreadyExistError
 	}
 
-	return a.Provider.migrator.AutoMigrate(
+	return a.Provider.migrator.AutoMigrate(append([]any{
 		&entities.Identity{
 			Entity:  entities.Entity{},
 			Profile: &entities.Profile{},
 			Account: &entities.Account{},
 		},
-		&entities.UserActivityLog{},
-	)
+	}, sessionTables...)...)
 }
 
 func (a *Authentity) Drop(db *gorm.DB) error {
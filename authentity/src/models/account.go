@@ -6,4 +6,5 @@ type Account struct {
 	Email     string `json:"email"`
 	Password  string `json:"password"`
 	Signature string `json:"signature"`
+	Verified  bool   `json:"verified"`
 }
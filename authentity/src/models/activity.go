@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// Activity is an entry of the activity log of an identity, see services.ActivityService.
+type Activity struct {
+	ID         string    `json:"id"`
+	IdentityID string    `json:"identity_id,omitempty"`
+	At         time.Time `json:"at"`
+
+	Event      string `json:"event"`   // e.g. entities.ActivityLogin
+	Outcome    string `json:"outcome"` // e.g. entities.OutcomeSuccess
+	Reason     string `json:"reason,omitempty"`
+	Identifier string `json:"identifier,omitempty"`
+	ClientID   string `json:"client_id,omitempty"`
+
+	IPAddress string `json:"ip_address,omitempty"`
+	UserAgent string `json:"user_agent,omitempty"`
+	Device    string `json:"device,omitempty"`
+	Country   string `json:"country,omitempty"`
+	Anomalies string `json:"anomalies,omitempty"`
+}
+
+// ActivityPage is a page of an activity log, most recent first.
+type ActivityPage struct {
+	Activity []*Activity `json:"activity"`
+	Page     int         `json:"page"`
+	Amount   int         `json:"amount"`
+	Total    int64       `json:"total"`
+}
@@ -10,3 +10,10 @@ type LoginRequest struct {
 	Email    string
 	Password string
 }
+
+// PasswordResetRequest asks for a reset link to be mailed to Email, or spends Token on Password.
+type PasswordResetRequest struct {
+	Email    string `json:"email,omitempty"`
+	Token    string `json:"token,omitempty"`
+	Password string `json:"password,omitempty"`
+}
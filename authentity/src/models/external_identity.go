@@ -0,0 +1,15 @@
+package models
+
+// ExternalIdentity is who a social login connector says the user is. Once linked, the connector
+// and subject pair logs into IdentityID.
+type ExternalIdentity struct {
+	ID         string `json:"id"`
+	Connector  string `json:"connector"`
+	Subject    string `json:"subject"` // stable user ID at the connector, never the email
+	IdentityID string `json:"identity_id"`
+
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	Name          string `json:"name"`
+	Username      string `json:"username"` // preferred username, a hint for new accounts
+}
@@ -0,0 +1,55 @@
+package models
+
+// Introspection is an RFC 7662 introspection response. Inactive tokens only carry Active.
+type Introspection struct {
+	Active    bool   `json:"active"`
+	TokenType string `json:"token_type,omitempty"`
+
+	Jti string        `json:"jti,omitempty"`
+	Iss string        `json:"iss,omitempty"`
+	Sub string        `json:"sub,omitempty"`
+	Aud string        `json:"aud,omitempty"`
+	Iat int64         `json:"iat,omitempty"`
+	Nbf int64         `json:"nbf,omitempty"`
+	Exp int64         `json:"exp,omitempty"`
+	Kid string        `json:"kid,omitempty"`
+	Alg string        `json:"alg,omitempty"`
+	Cnf *Confirmation `json:"cnf,omitempty"` // the key the holder must prove possession of
+
+	UserID    string                  `json:"user_id,omitempty"`
+	Resources []IntrospectionResource `json:"resources,omitempty"`
+}
+
+// Confirmation is the RFC 7800 cnf claim, the jkt member as RFC 9449 uses it.
+type Confirmation struct {
+	Jkt string `json:"jkt"`
+}
+
+type IntrospectionResource struct {
+	ResID string              `json:"res_id"`
+	Type  string              `json:"type"`
+	Roles []IntrospectionRole `json:"roles"`
+}
+
+type IntrospectionRole struct {
+	Type        string            `json:"type"`
+	Permissions int32             `json:"permissions"` // bit flags: read 1, write 2, edit 4, delete 8
+	Claims      map[string]string `json:"claims,omitempty"`
+}
+
+// Discovery is an OpenID Connect style discovery document, served at /.well-known/openid-configuration.
+type Discovery struct {
+	Issuer                                    string   `json:"issuer"`
+	JWKSURI                                   string   `json:"jwks_uri"`
+	IntrospectionEndpoint                     string   `json:"introspection_endpoint"`
+	IntrospectionEndpointAuthMethodsSupported []string `json:"introspection_endpoint_auth_methods_supported"`
+	TokenSigningAlgValuesSupported            []string `json:"token_signing_alg_values_supported"` // what the jwks_uri keys verify
+
+	AuthorizationEndpoint             string   `json:"authorization_endpoint"`
+	TokenEndpoint                     string   `json:"token_endpoint"`
+	TokenEndpointAuthMethodsSupported []string `json:"token_endpoint_auth_methods_supported"`
+	ScopesSupported                   []string `json:"scopes_supported"`
+	ResponseTypesSupported            []string `json:"response_types_supported"`
+	GrantTypesSupported               []string `json:"grant_types_supported"`
+	CodeChallengeMethodsSupported     []string `json:"code_challenge_methods_supported"`
+}
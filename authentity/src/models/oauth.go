@@ -0,0 +1,46 @@
+package models
+
+import "time"
+
+// OAuthClient is an application that logs its users in with authentity.
+type OAuthClient struct {
+	ID           string   `json:"client_id"`
+	Secret       string   `json:"client_secret,omitempty"` // Only known when registered, the database keeps a hash.
+	Name         string   `json:"client_name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+
+	// Public clients, e.g. single page and native apps, cannot keep a secret and have none. PKCE alone binds their codes.
+	Public bool `json:"public"`
+}
+
+// AuthorizationCode is a user's consent to a client, spent once at the token endpoint.
+type AuthorizationCode struct {
+	ID          string    `json:"-"`
+	Code        string    `json:"-"` // Only known when issued, the database keeps a hash.
+	ClientID    string    `json:"client_id"`
+	IdentityID  string    `json:"identity_id"`
+	RedirectURI string    `json:"redirect_uri"`
+	Scope       string    `json:"scope"`
+	Challenge   string    `json:"-"` // PKCE S256 code challenge
+	Family      string    `json:"-"` // Refresh family the code was exchanged for.
+	Expires     time.Time `json:"expires"`
+
+	// RedirectURIExplicit tells the authorization request named RedirectURI, so the token request must too.
+	RedirectURIExplicit bool `json:"-"`
+}
+
+// OAuthToken is a token endpoint response, RFC 6749 section 5.1.
+type OAuthToken struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int64  `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
+
+// OAuthError is a token endpoint error response, RFC 6749 section 5.2.
+type OAuthError struct {
+	Error       string `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
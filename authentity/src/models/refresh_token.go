@@ -0,0 +1,16 @@
+package models
+
+import "time"
+
+type RefreshToken struct {
+	Token      string    `json:"-"` // Only known when issued, the database keeps a hash.
+	Family     string    `json:"family"`
+	IdentityID string    `json:"identity_id"`
+	Recipient  string    `json:"recipient"`
+	AccessID   string    `json:"access_id"`
+	Expires    time.Time `json:"expires"`
+
+	Confirmation string `json:"confirmation,omitempty"`
+	ClientID     string `json:"client_id,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+}
@@ -0,0 +1,36 @@
+package models
+
+import "time"
+
+// TwoFactorEnrollment is handed to a user enrolling an authenticator app. URI is the payload of the
+// QR code the app scans, Secret is there for typing in by hand.
+type TwoFactorEnrollment struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// TwoFactorStatus tells whether an identity logs in with a second factor.
+type TwoFactorStatus struct {
+	IdentityID    string `json:"identity_id"`
+	Enabled       bool   `json:"enabled"`
+	RecoveryCodes int64  `json:"recovery_codes"` // Left unused.
+}
+
+// TwoFactorChallenge answers a password login of an identity with two factor authentication.
+// The session is only handed out for Token and a code, before Expires.
+type TwoFactorChallenge struct {
+	Token   string    `json:"two_factor_token"`
+	Expires time.Time `json:"expires"`
+}
+
+// TwoFactorRequest carries a TOTP code, or a recovery code, for the login pending on Token.
+// Confirming an enrollment only needs Code.
+type TwoFactorRequest struct {
+	Token string `json:"two_factor_token"`
+	Code  string `json:"code"`
+}
+
+// RecoveryCodes are shown once, when two factor authentication is enabled.
+type RecoveryCodes struct {
+	Codes []string `json:"recovery_codes"`
+}
@@ -5,7 +5,6 @@ import (
 	"github.com/vaiktorg/grimoire/authentity/src/handlers"
 	"github.com/vaiktorg/grimoire/gwt"
 	"net/http"
-	"time"
 )
 
 func (a *Authentity) registerMux() {
@@ -13,9 +12,25 @@ func (a *Authentity) registerMux() {
 	a.mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "tmpl/home.html")
 	})
-	a.mux.HandleFunc("/register", RegisterHandler(a))
-	a.mux.HandleFunc("/login", LoginHandler(a))
+	a.mux.Handle("/register", a.clients.RateLimitMiddleware(RegisterHandler(a)))
+	a.mux.Handle("/login", a.clients.RateLimitMiddleware(LoginHandler(a)))
+	a.mux.Handle(TwoFactorLoginPath, a.clients.RateLimitMiddleware(TwoFactorLoginHandler(a)))
+	a.mux.HandleFunc(VerifyEmailPath, VerifyEmailHandler(a))
+	a.mux.Handle(ForgotPasswordPath, a.clients.RateLimitMiddleware(ForgotPasswordHandler(a)))
+	a.mux.HandleFunc(ResetPasswordPath, ResetPasswordHandler(a))
 	a.mux.HandleFunc("/logout", LogoutHandler(a))
+	a.mux.HandleFunc("/refresh", RefreshHandler(a))
+
+	a.mux.HandleFunc(DiscoveryPath, DiscoveryHandler(a))
+	a.mux.HandleFunc(JWKSPath, JWKSHandler(a))
+	a.mux.HandleFunc(IntrospectionPath, IntrospectHandler(a))
+	a.mux.HandleFunc(AuthorizePath, AuthorizeHandler(a))
+	a.mux.HandleFunc(TokenPath, TokenHandler(a))
+
+	for _, c := range a.connectors {
+		a.mux.HandleFunc(SocialLoginPath(c.Name()), SocialLoginHandler(a, c))
+		a.mux.HandleFunc(SocialCallbackPath(c.Name()), SocialCallbackHandler(a, c))
+	}
 
 	a.mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("res/"))))
 
@@ -25,6 +40,12 @@ func (a *Authentity) registerMux() {
 		handlers.AccountHandler(&a.Provider.AccountsService)),
 	)
 
+	a.mux.Handle("/account/card", a.AuthMiddleware(
+		gwt.DataManagement,
+		gwt.DefaultRoles[gwt.Owner],
+		CardHandler(a)),
+	)
+
 	a.mux.Handle("/accounts", a.AuthMiddleware(
 		gwt.DataManagement,
 		gwt.DefaultRoles[gwt.Owner],
@@ -55,6 +76,34 @@ func (a *Authentity) registerMux() {
 		handlers.IdentitiesHandler(&a.Provider.IdentityService)),
 	)
 
+	a.mux.Handle(ClientsPath, a.AuthMiddleware(
+		gwt.SystemAdmin,
+		gwt.DefaultRoles[gwt.Admin],
+		ClientsHandler(a)),
+	)
+
+	a.mux.Handle(TwoFactorEnrollPath, TokenMiddleware(a, TwoFactorEnrollHandler(a)))
+	a.mux.Handle(TwoFactorConfirmPath, TokenMiddleware(a, TwoFactorConfirmHandler(a)))
+
+	a.mux.Handle(TwoFactorAdminPath, a.AuthMiddleware(
+		gwt.SystemAdmin,
+		gwt.DefaultRoles[gwt.Admin],
+		TwoFactorAdminHandler(a)),
+	)
+
+	a.mux.Handle(ActivityPath, TokenMiddleware(a, ActivityHandler(a)))
+	a.mux.Handle(ActivityAdminPath, a.AuthMiddleware(
+		gwt.SystemAdmin,
+		gwt.DefaultRoles[gwt.Admin],
+		ActivityAdminHandler(a)),
+	)
+
+	a.mux.Handle("/sessions/revoke", a.AuthMiddleware(
+		gwt.DataManagement,
+		gwt.DefaultRoles[gwt.Owner],
+		RevokeHandler(a)),
+	)
+
 	a.Logger.TRACE("mux paths registered")
 }
 
@@ -73,13 +122,8 @@ func TokenMiddleware(service *Authentity, next http.Handler) http.HandlerFunc {
 			return
 		}
 
-		if time.Now().UTC().After(tokenCookie.Expires) {
-			service.Logger.ERROR("token expired")
-			http.Error(w, "token expired", http.StatusUnauthorized)
-			return
-		}
-
-		if err = service.LoginToken(tokenCookie.Value); err != nil {
+		proof := r.Header.Get(gwt.ProofHeader)
+		if err = service.LoginTokenProof(tokenCookie.Value, proof, r.Method, requestURL(r)); err != nil {
 			service.Logger.ERROR(err.Error(), "Redirecting to /login.html")
 			http.Redirect(w, r, "/auth/login.html", http.StatusTemporaryRedirect)
 			return
@@ -95,7 +139,7 @@ func ResourceAccessMiddleware(service *Authentity, resType gwt.ResourceType, rol
 	return func(next http.Handler) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
 			// Step 1: Extract user information from the request (e.g., from a tokStr or session)
-			tokStr, ok := r.Context().Value("tokStr").(string)
+			tokStr, ok := r.Context().Value("token").(string)
 			if !ok {
 				http.Error(w, "could not fetch tokStr for authorization", http.StatusInternalServerError)
 				return
@@ -110,12 +154,18 @@ func ResourceAccessMiddleware(service *Authentity, resType gwt.ResourceType, rol
 			}
 
 			// Step 3: Check if the user has access to the required resource with the required permission
-			if !tok.Body.HasAccess(resType, roles...) {
+			decision := tok.Body.Authorize(resType, roles...)
+			if service.policy != nil {
+				decision = service.policy.Apply(decision, service.policyRequest(r, resType))
+			}
+
+			if !decision.Allowed {
+				service.Logger.WARN("Resource Access "+decision.String(), string(tok.Header.Recipient))
 				http.Error(w, "Access denied", http.StatusForbidden)
 				return
 			}
 
-			service.Logger.INFO("Resource Access", tok.Body.Resources)
+			service.Logger.INFO("Resource Access "+decision.String(), string(tok.Header.Recipient))
 
 			// User has the required access, proceed with the request
 			next.ServeHTTP(w, r)
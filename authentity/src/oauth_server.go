@@ -0,0 +1,570 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"github.com/vaiktorg/grimoire/gwt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Authorization server
+// ====================================================================================================
+// Registered clients log their users in with the OAuth2 authorization code flow, RFC 6749, with PKCE
+// S256 required of every client, RFC 7636. Users consent once per client to the scopes it asks for.
+// Clients get the same GWT access and refresh tokens as authentity's own sessions, but their
+// resources are narrowed down to the granted scopes, see Scope.
+
+var (
+	RedirectURIError = errors.New("redirect_uri is not registered for the client")
+	ScopeError       = errors.New("scope is not known or not allowed for the client")
+	ConsentError     = errors.New("consent was not given from this session")
+)
+
+// Scope is an OAuth2 scope. A token granted it holds Role on every resource of ResourceType its user
+// holds Role, or a higher role, on. A client never gets more than its user has.
+type Scope struct {
+	Name         string
+	Description  string // shown on the consent screen
+	ResourceType gwt.ResourceType
+	Role         gwt.Role
+}
+
+func indexScopes(scopes []Scope) (map[string]Scope, error) {
+	idx := make(map[string]Scope, len(scopes))
+	for _, s := range scopes {
+		if s.Name == "" || strings.ContainsAny(s.Name, " \"\\") || s.ResourceType == "" || s.Role.Type == "" {
+			return nil, errors.New("scope " + s.Name + " is invalid")
+		}
+		if _, ok := idx[s.Name]; ok {
+			return nil, errors.New("scope " + s.Name + " is configured twice")
+		}
+		idx[s.Name] = s
+	}
+
+	return idx, nil
+}
+
+// scopedResources maps scope onto held, the resources of the user who granted it.
+func (a *Authentity) scopedResources(held *gwt.Resources, scope []string) *gwt.Resources {
+	scoped := &gwt.Resources{UserID: held.UserID}
+
+	for _, name := range scope {
+		s, ok := a.scopes[name]
+		if !ok {
+			continue
+		}
+
+		for _, r := range held.GetResourceByType(s.ResourceType) {
+			decision := held.Evaluate(gwt.AccessRequest{
+				ResourceType: r.Type,
+				ResourceID:   r.ResID,
+				Permission:   s.Role.Permissions,
+				MinRole:      s.Role.Type,
+			})
+			if !decision.Allowed {
+				continue
+			}
+
+			var granted *gwt.Resource
+			for _, g := range scoped.GetResourceByType(r.Type) {
+				if bytes.Equal(g.ResID, r.ResID) {
+					granted = g
+				}
+			}
+			if granted == nil {
+				granted = &gwt.Resource{ResID: r.ResID, Type: r.Type}
+				scoped.Resources = append(scoped.Resources, granted)
+			}
+
+			role := gwt.Role{Type: s.Role.Type, Permissions: s.Role.Permissions}
+			for _, g := range decision.Grants {
+				for k, v := range g.Claims {
+					if role.Claims == nil {
+						role.Claims = make(map[gwt.RoleType]gwt.Claim)
+					}
+					role.Claims[k] = v
+				}
+			}
+			granted.AssignRoles(role)
+		}
+	}
+
+	return scoped
+}
+
+// Clients
+// ----------------------------------------------------------------------------------------------------
+
+// RegisterClient registers client for scopes in Config.Scopes. Redirect URIs are matched exactly.
+// The returned client holds its secret, which cannot be recovered later.
+func (a *Authentity) RegisterClient(ctx context.Context, client *models.OAuthClient) (*models.OAuthClient, error) {
+	for _, uri := range client.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Fragment != "" || strings.ContainsAny(uri, " ") {
+			return nil, errors.New("redirect uri " + uri + " must be absolute and have no fragment")
+		}
+	}
+
+	for _, s := range client.Scopes {
+		if _, ok := a.scopes[s]; !ok {
+			return nil, ScopeError
+		}
+	}
+
+	return a.Provider.OAuthService.RegisterClient(ctx, client)
+}
+
+// ClientsHandler registers the client JSON posted to it and answers with its credentials.
+func ClientsHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		var req models.OAuthClient
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		client, err := service.RegisterClient(r.Context(), &req)
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusCreated)
+		if err = json.NewEncoder(w).Encode(client); err != nil {
+			service.Logger.ERROR(err.Error())
+			return
+		}
+
+		service.Logger.INFO("oauth client " + client.Name + " registered: " + client.ID)
+	}
+}
+
+// Authorization endpoint
+// ----------------------------------------------------------------------------------------------------
+
+// authorizeRequest is a validated authorization request. It is also the consent ticket the consent
+// screen posts back, so the answer can only come from the session the screen was shown to.
+type authorizeRequest struct {
+	ClientID    string
+	RedirectURI string
+	Scope       string
+	State       string
+	Challenge   string
+	IdentityID  string
+
+	// RedirectURIExplicit tells the redirect_uri was in the request, not the client's only one.
+	RedirectURIExplicit bool
+}
+
+// authorizeError is reported to the client at its redirect URI, RFC 6749 section 4.1.2.1.
+type authorizeError struct {
+	req         *authorizeRequest
+	code        string
+	description string
+}
+
+func (e *authorizeError) Error() string { return e.code + ": " + e.description }
+
+// consentExpireTime is how long the consent screen can be answered.
+const consentExpireTime = 10 * time.Minute
+
+//go:embed tmpl/consent.gohtml
+var consentPage string
+
+var consentTmpl = template.Must(template.New("consent").Parse(consentPage))
+
+// AuthorizeHandler is the authorization endpoint. Users without a session are sent to log in first
+// and come back to it, users who did not consent yet to every scope asked for get the consent screen.
+func AuthorizeHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getAuthorize(service, w, r)
+		case http.MethodPost:
+			postAuthorize(service, w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func getAuthorize(service *Authentity, w http.ResponseWriter, r *http.Request) {
+	req, client, err := service.authorizeRequest(r.Context(), r.URL.Query())
+	var authErr *authorizeError
+	if errors.As(err, &authErr) {
+		service.Logger.ERROR(err.Error())
+		redirectToClient(w, r, authErr.req, url.Values{"error": {authErr.code}, "error_description": {authErr.description}})
+		return
+	}
+	if err != nil {
+		// Without a registered redirect URI the user cannot be sent back, the error is theirs to see.
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	identityID, ok := service.sessionIdentity(r)
+	if !ok {
+		http.Redirect(w, r, "/login?next="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+		return
+	}
+	req.IdentityID = identityID
+
+	if service.Provider.OAuthService.Consented(r.Context(), client.ID, identityID, strings.Fields(req.Scope)) {
+		grantCode(service, w, r, req)
+		return
+	}
+
+	renderConsent(service, w, client, req)
+}
+
+func postAuthorize(service *Authentity, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	ticket, err := service.consents.Decode(r.PostForm.Get("consent"))
+	if err == nil {
+		err = gwt.ValidateGWT(ticket)
+	}
+	if err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+		return
+	}
+	req := &ticket.Body
+
+	if identityID, ok := service.sessionIdentity(r); !ok || identityID != req.IdentityID {
+		http.Error(w, service.Logger.ERROR(ConsentError.Error()), http.StatusForbidden)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "allow" {
+		service.Logger.INFO("consent denied to client: "+req.ClientID, req.IdentityID)
+		redirectToClient(w, r, req, url.Values{"error": {"access_denied"}})
+		return
+	}
+
+	if err = service.Provider.OAuthService.GrantConsent(r.Context(), req.ClientID, req.IdentityID, strings.Fields(req.Scope)); err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	service.Logger.INFO("consent given to client: "+req.ClientID+" for scope: "+req.Scope, req.IdentityID)
+	grantCode(service, w, r, req)
+}
+
+// authorizeRequest validates an authorization request. Once the redirect URI is known to be the
+// client's, errors are *authorizeError.
+func (a *Authentity) authorizeRequest(ctx context.Context, q url.Values) (*authorizeRequest, *models.OAuthClient, error) {
+	client, err := a.Provider.OAuthService.FindClient(ctx, q.Get("client_id"))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	redirectURI := q.Get("redirect_uri")
+	if redirectURI == "" && len(client.RedirectURIs) == 1 {
+		redirectURI = client.RedirectURIs[0]
+	}
+	if !containsString(client.RedirectURIs, redirectURI) {
+		return nil, nil, RedirectURIError
+	}
+
+	req := &authorizeRequest{
+		ClientID:    client.ID,
+		RedirectURI: redirectURI,
+		State:       q.Get("state"),
+		Challenge:   q.Get("code_challenge"),
+
+		RedirectURIExplicit: q.Get("redirect_uri") != "",
+	}
+
+	switch {
+	case q.Get("response_type") != "code":
+		return nil, nil, &authorizeError{req, "unsupported_response_type", "only the code response type is supported"}
+	case q.Get("code_challenge_method") != "S256" || len(req.Challenge) != 43:
+		return nil, nil, &authorizeError{req, "invalid_request", "a S256 code_challenge is required"}
+	}
+
+	scope := strings.Fields(q.Get("scope"))
+	if len(scope) == 0 {
+		scope = client.Scopes
+	}
+	for _, s := range scope {
+		if _, ok := a.scopes[s]; !ok || !containsString(client.Scopes, s) {
+			return nil, nil, &authorizeError{req, "invalid_scope", ScopeError.Error()}
+		}
+	}
+	req.Scope = strings.Join(scope, " ")
+
+	return req, client, nil
+}
+
+// sessionIdentity returns the identity of the access token cookie r carries, if it is a valid session
+// of authentity. Tokens of OAuth clients are not sessions.
+func (a *Authentity) sessionIdentity(r *http.Request) (string, bool) {
+	c, err := r.Cookie(CookieTokenName)
+	if err != nil || c.Value == "" {
+		return "", false
+	}
+
+	tok, err := validToken(a.mc, c.Value)
+	if err != nil || tok.Body == nil {
+		return "", false
+	}
+
+	return string(tok.Body.UserID), true
+}
+
+func renderConsent(service *Authentity, w http.ResponseWriter, client *models.OAuthClient, req *authorizeRequest) {
+	ticket, err := service.consents.Encode(&gwt.GWT[authorizeRequest]{
+		Header: gwt.Header{
+			Issuer:    service.issuer,
+			Recipient: []byte(req.IdentityID),
+			Expires:   time.Now().Add(consentExpireTime),
+		},
+		Body: *req,
+	})
+	if err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	var scopes []Scope
+	for _, s := range strings.Fields(req.Scope) {
+		scopes = append(scopes, service.scopes[s])
+	}
+
+	page := new(bytes.Buffer)
+	err = consentTmpl.Execute(page, map[string]any{
+		"Client": client.Name,
+		"Scopes": scopes,
+		"Ticket": ticket.Token,
+		"Action": AuthorizePath,
+	})
+	if err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY") // consent must never be clicked through from a frame
+	_, _ = w.Write(page.Bytes())
+}
+
+func grantCode(service *Authentity, w http.ResponseWriter, r *http.Request, req *authorizeRequest) {
+	code, err := service.Provider.OAuthService.IssueCode(r.Context(), &models.AuthorizationCode{
+		ClientID:    req.ClientID,
+		IdentityID:  req.IdentityID,
+		RedirectURI: req.RedirectURI,
+		Scope:       req.Scope,
+		Challenge:   req.Challenge,
+		Expires:     time.Now().Add(AuthorizationCodeExpireTime),
+
+		RedirectURIExplicit: req.RedirectURIExplicit,
+	})
+	if err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	redirectToClient(w, r, req, url.Values{"code": {code.Code}})
+}
+
+// redirectToClient sends the user back to the client with params, and the state of req.
+func redirectToClient(w http.ResponseWriter, r *http.Request, req *authorizeRequest, params url.Values) {
+	u, _ := url.Parse(req.RedirectURI) // registered URIs are validated by RegisterClient
+
+	q := u.Query()
+	for k, v := range params {
+		q[k] = v
+	}
+	if req.State != "" {
+		q.Set("state", req.State)
+	}
+	u.RawQuery = q.Encode()
+
+	http.Redirect(w, r, u.String(), http.StatusFound)
+}
+
+// Token endpoint
+// ----------------------------------------------------------------------------------------------------
+
+// TokenHandler is the token endpoint, exchanging authorization codes and refresh tokens of
+// authenticated clients. Confidential clients authenticate with client_secret_basic or
+// client_secret_post, public clients with their client_id alone.
+func TokenHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Pragma", "no-cache")
+
+		if err := r.ParseForm(); err != nil {
+			writeOAuthError(service, w, http.StatusBadRequest, "invalid_request", err)
+			return
+		}
+
+		client, err := service.tokenClient(r)
+		if err != nil {
+			if _, _, basic := r.BasicAuth(); basic {
+				w.Header().Set("WWW-Authenticate", `Basic realm="token"`)
+			}
+			writeOAuthError(service, w, http.StatusUnauthorized, "invalid_client", err)
+			return
+		}
+
+		var pair *TokenPair
+		switch r.PostForm.Get("grant_type") {
+		case "authorization_code":
+			pair, err = service.ExchangeCode(r.Context(), client,
+				r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+		case "refresh_token":
+			pair, err = service.RefreshClientToken(service.withClient(r), client, r.PostForm.Get("refresh_token"))
+		default:
+			writeOAuthError(service, w, http.StatusBadRequest, "unsupported_grant_type", nil)
+			return
+		}
+		if err != nil {
+			writeOAuthError(service, w, http.StatusBadRequest, "invalid_grant", err)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(models.OAuthToken{
+			AccessToken:  pair.Access.Token,
+			TokenType:    "Bearer",
+			ExpiresIn:    int64(time.Until(pair.Access.Header.Expires).Seconds()),
+			RefreshToken: pair.Refresh.Token,
+			Scope:        pair.Refresh.Scope,
+		})
+		if err != nil {
+			service.Logger.ERROR(err.Error())
+			return
+		}
+
+		service.Logger.INFO("client: " + client.ID + " was issued token: " + pair.Access.Header.ID)
+	}
+}
+
+// tokenClient authenticates the client of a token request.
+func (a *Authentity) tokenClient(r *http.Request) (*models.OAuthClient, error) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// Basic credentials are form encoded, RFC 6749 section 2.3.1.
+		var err error
+		if id, err = url.QueryUnescape(id); err != nil {
+			return nil, services.ErrClientCredentials
+		}
+		if secret, err = url.QueryUnescape(secret); err != nil {
+			return nil, services.ErrClientCredentials
+		}
+	} else {
+		id, secret = r.PostForm.Get("client_id"), r.PostForm.Get("client_secret")
+	}
+
+	return a.Provider.OAuthService.AuthenticateClient(r.Context(), id, secret)
+}
+
+func writeOAuthError(service *Authentity, w http.ResponseWriter, status int, code string, err error) {
+	resp := models.OAuthError{Error: code}
+	if err != nil {
+		resp.Description = err.Error()
+		service.Logger.ERROR(code + ": " + err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// ExchangeCode spends an authorization code issued to client for a token pair. Spending a code twice
+// revokes the tokens it was first exchanged for, as whoever spent it first may not have been the client.
+func (a *Authentity) ExchangeCode(pCtx context.Context, client *models.OAuthClient, code, redirectURI, verifier string) (*TokenPair, error) {
+	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
+	defer cancel()
+
+	// A redirect_uri given to the authorization endpoint must be given again, RFC 6749 section 4.1.3.
+	grant, err := a.Provider.OAuthService.RedeemCode(ctx, code, func(grant *models.AuthorizationCode) error {
+		if grant.ClientID != client.ID || !verifyChallenge(verifier, grant.Challenge) ||
+			(redirectURI != grant.RedirectURI && (redirectURI != "" || grant.RedirectURIExplicit)) {
+			return services.ErrCodeInvalid
+		}
+		return nil
+	})
+	if errors.Is(err, services.ErrCodeReuse) {
+		a.Logger.WARN("authorization code reuse detected, revoking its tokens", grant.ClientID, grant.IdentityID)
+		if grant.Family != "" {
+			if rErr := a.revokeRefreshFamily(ctx, grant.Family); rErr != nil {
+				return nil, rErr
+			}
+		}
+		return nil, err
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	identity, err := a.Provider.IdentityService.FetchIdentity(ctx, grant.IdentityID)
+	if err != nil {
+		return nil, err
+	}
+
+	tokenVal, _, err := a.newAccessToken(identity.Account.Username, a.scopedResources(identity.Resources, strings.Fields(grant.Scope)), "", client.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	pair, err := a.issueRefresh(ctx, tokenVal, identity.ID, "", client.ID, grant.Scope)
+	if err != nil {
+		return nil, err
+	}
+
+	return pair, a.Provider.OAuthService.SetCodeFamily(ctx, grant.ID, pair.Refresh.Family)
+}
+
+// RefreshClientToken spends a refresh token issued to client, see RefreshToken.
+func (a *Authentity) RefreshClientToken(pCtx context.Context, client *models.OAuthClient, refresh string) (*TokenPair, error) {
+	return a.refreshToken(pCtx, refresh, "", client.ID)
+}
+
+// verifyChallenge checks a PKCE code_verifier against its S256 code_challenge, RFC 7636 section 4.6.
+func verifyChallenge(verifier, challenge string) bool {
+	if len(verifier) < 43 || len(verifier) > 128 {
+		return false
+	}
+
+	sum := sha256.Sum256([]byte(verifier))
+	return subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) == 1
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,46 @@
+package src
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"net/http"
+	"time"
+)
+
+// methodPermissions maps HTTP methods onto the gwt.Permission a request asks for.
+var methodPermissions = map[string]gwt.Permission{
+	http.MethodGet:    gwt.Read,
+	http.MethodHead:   gwt.Read,
+	http.MethodPost:   gwt.Write,
+	http.MethodPut:    gwt.Edit,
+	http.MethodPatch:  gwt.Edit,
+	http.MethodDelete: gwt.Delete,
+}
+
+// PermissionForMethod returns the permission an HTTP method asks for, Read when unknown.
+func PermissionForMethod(method string) gwt.Permission {
+	if perm, ok := methodPermissions[method]; ok {
+		return perm
+	}
+
+	return gwt.Read
+}
+
+// policyRequest describes r for the configured gwt.Policy.
+func (a *Authentity) policyRequest(r *http.Request, resType gwt.ResourceType) gwt.PolicyRequest {
+	req := gwt.PolicyRequest{
+		ResourceType: resType,
+		Permission:   PermissionForMethod(r.Method),
+		Request: gwt.Attributes{
+			"method": r.Method,
+			"path":   r.URL.Path,
+			"host":   r.Host,
+		},
+		Time: time.Now(),
+	}
+
+	if a.resAttrs != nil {
+		req.Resource = a.resAttrs(r)
+	}
+
+	return req
+}
@@ -0,0 +1,32 @@
+package src
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"net/http"
+)
+
+// requestURL is the URL a client signs in its gwt.ProofHeader, without query or fragment.
+func requestURL(r *http.Request) string {
+	return requestOrigin(r) + r.URL.Path
+}
+
+// requestOrigin is the scheme and host a request was sent to.
+func requestOrigin(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+
+	return scheme + "://" + r.Host
+}
+
+// requestThumbprint returns the key thumbprint a request asks its session to be bound to,
+// or "" when it carries no proof.
+func requestThumbprint(service *Authentity, r *http.Request) (string, error) {
+	proof := r.Header.Get(gwt.ProofHeader)
+	if proof == "" {
+		return "", nil
+	}
+
+	return service.ProofThumbprint(proof, r.Method, requestURL(r))
+}
@@ -14,6 +14,12 @@ type DataProvider struct {
 	IdentityService  services.IdentityService
 	AccountsService  services.AccountService
 	ResourcesService services.ResourceService
+	RefreshService   services.RefreshTokenService
+
+	ExternalIdentityService services.ExternalIdentityService
+	OAuthService            services.OAuthService
+	TwoFactorService        services.TwoFactorService
+	ActivityService         services.ActivityService
 }
 
 func NewDataProvider(db *gorm.DB) *DataProvider {
@@ -23,5 +29,11 @@ func NewDataProvider(db *gorm.DB) *DataProvider {
 		IdentityService:  services.NewIdentityService(repo.NewIdentityRepo(db)),
 		ProfileService:   services.NewProfileService(repo.NewProfileRepo(db)),
 		ResourcesService: services.NewResourceService(repo.NewIdentityRepo(db)),
+		RefreshService:   services.NewRefreshTokenService(repo.NewRefreshTokenRepo(db)),
+
+		ExternalIdentityService: services.NewExternalIdentityService(repo.NewExternalIdentityRepo(db)),
+		OAuthService:            services.NewOAuthService(repo.NewOAuthRepo(db)),
+		TwoFactorService:        services.NewTwoFactorService(repo.NewTwoFactorRepo(db)),
+		ActivityService:         services.NewActivityService(repo.NewActivityRepo(db)),
 	}
 }
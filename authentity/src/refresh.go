@@ -0,0 +1,38 @@
+package src
+
+import (
+	"net/http"
+)
+
+// RefreshHandler exchanges the refresh cookie for a new access and refresh token pair.
+func RefreshHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		refreshCookie, err := r.Cookie(CookieRefreshName)
+		if err != nil || refreshCookie.Value == "" {
+			service.Logger.ERROR("refresh token not found")
+			http.Error(w, "refresh token not found", http.StatusUnauthorized)
+			return
+		}
+
+		thumbprint, err := requestThumbprint(service, r)
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusUnauthorized)
+			return
+		}
+
+		pair, err := service.RefreshTokenBound(service.withClient(r), refreshCookie.Value, thumbprint)
+		if err != nil {
+			clearSessionCookies(w)
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusUnauthorized)
+			return
+		}
+
+		setSessionCookies(w, pair)
+		service.Logger.INFO(string(pair.Access.Header.Recipient) + " has refreshed their session")
+	}
+}
@@ -88,5 +88,35 @@ func (a *AccountRepo) Persist(ctx context.Context, account *entities.Account) er
 	return a.db.WithContext(ctx).Save(account).Error
 }
 func (a *AccountRepo) Update(ctx context.Context, account *entities.Account) error {
-	return a.db.WithContext(ctx).Model(&account).Select("Email", "Password", "Signature").Updates(account).Error
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		// A new email has to be verified again.
+		if account.Email != nil {
+			err := tx.Model(&entities.Account{}).
+				Where("id = ? AND email <> ?", account.ID, *account.Email).
+				Update("verified", false).Error
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Model(&account).Select("Email", "Password", "Signature").Updates(account).Error
+	})
+}
+
+// SetVerified marks the account verified. It reports false when its email is no longer email.
+func (a *AccountRepo) SetVerified(ctx context.Context, id, email string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := a.db.WithContext(ctx).Model(&entities.Account{}).
+		Where("id = ? AND email = ?", id, email).
+		Update("verified", true)
+
+	return res.RowsAffected == 1, res.Error
+}
+func (a *AccountRepo) SetPassword(ctx context.Context, id, hash string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Model(&entities.Account{}).Where("id = ?", id).Update("password", hash).Error
 }
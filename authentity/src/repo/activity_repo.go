@@ -0,0 +1,70 @@
+package repo
+
+import (
+	"context"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"gorm.io/gorm"
+	"sync"
+)
+
+// ActivityRepo stores the UserActivityLog, the logins, logouts, refreshes and failed attempts of identities.
+type ActivityRepo struct {
+	mu sync.Mutex
+	db *gorm.DB
+}
+
+func NewActivityRepo(db *gorm.DB) *ActivityRepo {
+	return &ActivityRepo{db: db}
+}
+
+func (a *ActivityRepo) Create(ctx context.Context, log *entities.UserActivityLog) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Create(log).Error
+}
+
+// Page returns limit entries of the log of identityID, or of everyone when empty, most recent first,
+// skipping offset of them, along with how many there are.
+func (a *ActivityRepo) Page(ctx context.Context, identityID string, offset, limit int) ([]*entities.UserActivityLog, int64, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	query := a.db.WithContext(ctx).Model(&entities.UserActivityLog{})
+	if identityID != "" {
+		query = query.Where("identity_id = ?", identityID)
+	}
+
+	var total int64
+	if err := query.Count(&total).Error; err != nil {
+		return nil, 0, err
+	}
+
+	var logs []*entities.UserActivityLog
+	err := query.Order("created_at desc, id desc").Offset(offset).Limit(limit).Find(&logs).Error
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return logs, total, nil
+}
+
+// RecentSessions returns the limit most recent logins and refreshes of identityID's own sessions,
+// not those of OAuth clients, that succeeded.
+func (a *ActivityRepo) RecentSessions(ctx context.Context, identityID string, limit int) ([]*entities.UserActivityLog, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var logs []*entities.UserActivityLog
+	err := a.db.WithContext(ctx).
+		Where("identity_id = ? AND event IN ? AND outcome = ? AND client_id = ?", identityID,
+			[]string{entities.ActivityLogin, entities.ActivityRefresh}, entities.OutcomeSuccess, "").
+		Order("created_at desc, id desc").
+		Limit(limit).
+		Find(&logs).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return logs, nil
+}
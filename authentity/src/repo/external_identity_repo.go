@@ -0,0 +1,59 @@
+package repo
+
+import (
+	"context"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"gorm.io/gorm"
+	"sync"
+)
+
+type ExternalIdentityRepo struct {
+	mu sync.Mutex
+	db *gorm.DB
+}
+
+func NewExternalIdentityRepo(db *gorm.DB) *ExternalIdentityRepo {
+	return &ExternalIdentityRepo{db: db}
+}
+
+func (a *ExternalIdentityRepo) FindBySubject(ctx context.Context, connector, subject string) (*entities.ExternalIdentity, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	link := &entities.ExternalIdentity{}
+	if err := a.db.WithContext(ctx).Take(link, "connector = ? AND subject = ?", connector, subject).Error; err != nil {
+		return nil, err
+	}
+
+	return link, nil
+}
+func (a *ExternalIdentityRepo) FindByIdentity(ctx context.Context, identityID string) ([]*entities.ExternalIdentity, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var links []*entities.ExternalIdentity
+	if err := a.db.WithContext(ctx).Find(&links, "identity_id = ?", identityID).Error; err != nil {
+		return nil, err
+	}
+
+	return links, nil
+}
+
+func (a *ExternalIdentityRepo) Persist(ctx context.Context, link *entities.ExternalIdentity) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Create(link).Error
+}
+func (a *ExternalIdentityRepo) UpdateEmail(ctx context.Context, id, email string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Model(&entities.ExternalIdentity{}).Where("id = ?", id).Update("email", email).Error
+}
+func (a *ExternalIdentityRepo) Delete(ctx context.Context, id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Delete(&entities.ExternalIdentity{}, "id = ?", id).Error
+}
@@ -21,7 +21,7 @@ func (a *IdentityRepo) FindIdentityByID(ctx context.Context, id string) (*entiti
 	defer a.mu.Unlock()
 
 	identity := &entities.Identity{}
-	if err := a.db.WithContext(ctx).Take(&identity, "id  = ?", id).Error; err != nil {
+	if err := a.db.WithContext(ctx).Joins("Account").Where("identities.id = ?", id).Take(&identity).Error; err != nil {
 		return nil, err
 	}
 
@@ -47,7 +47,7 @@ func (a *IdentityRepo) FindIdentityByAccountID(ctx context.Context, accId string
 	defer a.mu.Unlock()
 
 	identity := &entities.Identity{}
-	if err := a.db.WithContext(ctx).Joins("Account", a.db.Where("account_id = ?", accId)).Find(&identity).Error; err != nil {
+	if err := a.db.WithContext(ctx).Joins("Account").Where("identities.account_id = ?", accId).Take(&identity).Error; err != nil {
 		return nil, err
 	}
 
@@ -58,9 +58,7 @@ func (a *IdentityRepo) FindIdentityByAccountUsername(ctx context.Context, userna
 	defer a.mu.Unlock()
 
 	identity := &entities.Identity{}
-	if err := a.db.WithContext(ctx).Joins(
-		"Account",
-		a.db.Where("username = ?", username)).Take(&identity).Error; err != nil {
+	if err := a.db.WithContext(ctx).Joins("Account").Where("Account.username = ?", username).Take(&identity).Error; err != nil {
 		return nil, err
 	}
 
@@ -71,7 +69,7 @@ func (a *IdentityRepo) FindIdentityByAccountEmail(ctx context.Context, email str
 	defer a.mu.Unlock()
 
 	identity := &entities.Identity{}
-	if err := a.db.WithContext(ctx).Joins("Account", a.db.Where("email = ?", email)).Take(&identity).Error; err != nil {
+	if err := a.db.WithContext(ctx).Joins("Account").Where("Account.email = ?", email).Take(&identity).Error; err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,116 @@
+package repo
+
+import (
+	"context"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"gorm.io/gorm"
+	"sync"
+)
+
+// OAuthRepo stores registered clients, the authorization codes issued to them and the consents they were given.
+type OAuthRepo struct {
+	mu sync.Mutex
+	db *gorm.DB
+}
+
+func NewOAuthRepo(db *gorm.DB) *OAuthRepo {
+	return &OAuthRepo{db: db}
+}
+
+// Clients
+// ----------------------------------------------------------------------------------------------------
+
+func (a *OAuthRepo) FindClient(ctx context.Context, id string) (*entities.OAuthClient, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	client := &entities.OAuthClient{}
+	if err := a.db.WithContext(ctx).Take(client, "id = ?", id).Error; err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+func (a *OAuthRepo) PersistClient(ctx context.Context, client *entities.OAuthClient) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Create(client).Error
+}
+func (a *OAuthRepo) DeleteClient(ctx context.Context, id string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&entities.OAuthConsent{}, "client_id = ?", id).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&entities.OAuthClient{}, "id = ?", id).Error
+	})
+}
+
+// Authorization codes
+// ----------------------------------------------------------------------------------------------------
+
+func (a *OAuthRepo) FindCodeByHash(ctx context.Context, hash string) (*entities.AuthorizationCode, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	code := &entities.AuthorizationCode{}
+	if err := a.db.WithContext(ctx).Take(code, "code_hash = ?", hash).Error; err != nil {
+		return nil, err
+	}
+
+	return code, nil
+}
+func (a *OAuthRepo) PersistCode(ctx context.Context, code *entities.AuthorizationCode) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Create(code).Error
+}
+
+// MarkCodeUsed flags the code as exchanged. It reports false when another request exchanged it first.
+func (a *OAuthRepo) MarkCodeUsed(ctx context.Context, id string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := a.db.WithContext(ctx).Model(&entities.AuthorizationCode{}).
+		Where("id = ? AND used = ?", id, false).
+		Update("used", true)
+
+	return res.RowsAffected == 1, res.Error
+}
+func (a *OAuthRepo) SetCodeFamily(ctx context.Context, id, family string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Model(&entities.AuthorizationCode{}).Where("id = ?", id).Update("family", family).Error
+}
+
+// Consents
+// ----------------------------------------------------------------------------------------------------
+
+func (a *OAuthRepo) FindConsent(ctx context.Context, clientID, identityID string) (*entities.OAuthConsent, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	consent := &entities.OAuthConsent{}
+	if err := a.db.WithContext(ctx).Take(consent, "client_id = ? AND identity_id = ?", clientID, identityID).Error; err != nil {
+		return nil, err
+	}
+
+	return consent, nil
+}
+func (a *OAuthRepo) SaveConsent(ctx context.Context, consent *entities.OAuthConsent) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Save(consent).Error
+}
+func (a *OAuthRepo) DeleteConsent(ctx context.Context, clientID, identityID string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Delete(&entities.OAuthConsent{}, "client_id = ? AND identity_id = ?", clientID, identityID).Error
+}
@@ -0,0 +1,80 @@
+package repo
+
+import (
+	"context"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"gorm.io/gorm"
+	"sync"
+)
+
+type RefreshTokenRepo struct {
+	mu sync.Mutex
+	db *gorm.DB
+}
+
+func NewRefreshTokenRepo(db *gorm.DB) *RefreshTokenRepo {
+	return &RefreshTokenRepo{db: db}
+}
+
+func (a *RefreshTokenRepo) FindByHash(ctx context.Context, hash string) (*entities.RefreshToken, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	token := &entities.RefreshToken{}
+	if err := a.db.WithContext(ctx).Take(token, "token_hash = ?", hash).Error; err != nil {
+		return nil, err
+	}
+
+	return token, nil
+}
+func (a *RefreshTokenRepo) FindFamily(ctx context.Context, family string) ([]*entities.RefreshToken, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var tokens []*entities.RefreshToken
+	if err := a.db.WithContext(ctx).Find(&tokens, "family = ?", family).Error; err != nil {
+		return nil, err
+	}
+
+	return tokens, nil
+}
+
+// MarkRotated flags the token as used. It reports false when another request rotated it first.
+func (a *RefreshTokenRepo) MarkRotated(ctx context.Context, id string) (bool, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	res := a.db.WithContext(ctx).Model(&entities.RefreshToken{}).
+		Where("id = ? AND rotated = ?", id, false).
+		Update("rotated", true)
+
+	return res.RowsAffected == 1, res.Error
+}
+func (a *RefreshTokenRepo) RevokeFamily(ctx context.Context, family string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Model(&entities.RefreshToken{}).
+		Where("family = ?", family).
+		Update("revoked", true).Error
+}
+
+// FindIdentityFamilies returns the families of identityID that were not revoked yet.
+func (a *RefreshTokenRepo) FindIdentityFamilies(ctx context.Context, identityID string) ([]string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	var families []string
+	err := a.db.WithContext(ctx).Model(&entities.RefreshToken{}).
+		Where("identity_id = ? AND revoked = ?", identityID, false).
+		Distinct().Pluck("family", &families).Error
+
+	return families, err
+}
+
+func (a *RefreshTokenRepo) Persist(ctx context.Context, token *entities.RefreshToken) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	return a.db.WithContext(ctx).Save(token).Error
+}
@@ -0,0 +1,120 @@
+package repo
+
+import (
+	"context"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"gorm.io/gorm"
+	"sync"
+)
+
+// TwoFactorRepo stores TOTP enrollments and the recovery codes of identities with two factor authentication.
+type TwoFactorRepo struct {
+	mu sync.Mutex
+	db *gorm.DB
+}
+
+func NewTwoFactorRepo(db *gorm.DB) *TwoFactorRepo {
+	return &TwoFactorRepo{db: db}
+}
+
+// Enrollments
+// ----------------------------------------------------------------------------------------------------
+
+func (t *TwoFactorRepo) Find(ctx context.Context, identityID string) (*entities.TwoFactor, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	tf := &entities.TwoFactor{}
+	if err := t.db.WithContext(ctx).Take(tf, "identity_id = ?", identityID).Error; err != nil {
+		return nil, err
+	}
+
+	return tf, nil
+}
+
+// Enroll replaces the enrollment of tf.IdentityID, confirmed or not, with tf.
+func (t *TwoFactorRepo) Enroll(ctx context.Context, tf *entities.TwoFactor) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&entities.TwoFactor{}, "identity_id = ?", tf.IdentityID).Error; err != nil {
+			return err
+		}
+		return tx.Create(tf).Error
+	})
+}
+
+// Enable turns on the enrollment with id and replaces the identity's recovery codes with codes.
+func (t *TwoFactorRepo) Enable(ctx context.Context, id string, counter int64, codes []*entities.RecoveryCode) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		tf := &entities.TwoFactor{}
+		if err := tx.Take(tf, "id = ?", id).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Model(tf).Updates(map[string]any{"enabled": true, "last_counter": counter}).Error; err != nil {
+			return err
+		}
+
+		if err := tx.Delete(&entities.RecoveryCode{}, "identity_id = ?", tf.IdentityID).Error; err != nil {
+			return err
+		}
+		return tx.Create(codes).Error
+	})
+}
+
+// Advance records counter as the last TOTP period spent. It reports false when a code for that
+// period, or a later one, was spent first.
+func (t *TwoFactorRepo) Advance(ctx context.Context, id string, counter int64) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := t.db.WithContext(ctx).Model(&entities.TwoFactor{}).
+		Where("id = ? AND last_counter < ?", id, counter).
+		Update("last_counter", counter)
+
+	return res.RowsAffected == 1, res.Error
+}
+
+// Delete removes the enrollment and the recovery codes of identityID.
+func (t *TwoFactorRepo) Delete(ctx context.Context, identityID string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return t.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Delete(&entities.RecoveryCode{}, "identity_id = ?", identityID).Error; err != nil {
+			return err
+		}
+		return tx.Delete(&entities.TwoFactor{}, "identity_id = ?", identityID).Error
+	})
+}
+
+// Recovery codes
+// ----------------------------------------------------------------------------------------------------
+
+// UseRecoveryCode spends the unused code with hash of identityID. It reports false when there is none.
+func (t *TwoFactorRepo) UseRecoveryCode(ctx context.Context, identityID, hash string) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	res := t.db.WithContext(ctx).Model(&entities.RecoveryCode{}).
+		Where("identity_id = ? AND code_hash = ? AND used = ?", identityID, hash, false).
+		Update("used", true)
+
+	return res.RowsAffected == 1, res.Error
+}
+func (t *TwoFactorRepo) CountRecoveryCodes(ctx context.Context, identityID string) (int64, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var n int64
+	err := t.db.WithContext(ctx).Model(&entities.RecoveryCode{}).
+		Where("identity_id = ? AND used = ?", identityID, false).
+		Count(&n).Error
+
+	return n, err
+}
@@ -2,11 +2,14 @@ package services
 
 import (
 	"context"
+	"errors"
 	"github.com/vaiktorg/grimoire/authentity/src/entities"
 	"github.com/vaiktorg/grimoire/authentity/src/models"
 	"github.com/vaiktorg/grimoire/authentity/src/repo"
 )
 
+var ErrEmailChanged = errors.New("account email changed since it was sent")
+
 type AccountService struct {
 	Repo *repo.AccountRepo
 }
@@ -59,6 +62,24 @@ func (a *AccountService) Updates(ctx context.Context, account *models.Account) e
 	return a.Repo.Update(ctx, AccountToEntity(account))
 }
 
+// SetVerified marks the email of the account with id verified, as long as it still is email.
+func (a *AccountService) SetVerified(ctx context.Context, id, email string) error {
+	ok, err := a.Repo.SetVerified(ctx, id, email)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrEmailChanged
+	}
+
+	return nil
+}
+
+// SetPassword replaces the password hash of the account with id.
+func (a *AccountService) SetPassword(ctx context.Context, id, hash string) error {
+	return a.Repo.SetPassword(ctx, id, hash)
+}
+
 func AccountToModel(account *entities.Account) *models.Account {
 	if account == nil {
 		return nil
@@ -70,6 +91,7 @@ func AccountToModel(account *entities.Account) *models.Account {
 		Email:     *account.Email,
 		Signature: *account.Signature,
 		Password:  *account.Password,
+		Verified:  account.Verified,
 	}
 }
 func AccountToEntity(account *models.Account) *entities.Account {
@@ -85,5 +107,6 @@ func AccountToEntity(account *models.Account) *entities.Account {
 		Email:     &account.Email,
 		Signature: &account.Signature,
 		Password:  &account.Password,
+		Verified:  account.Verified,
 	}
 }
@@ -0,0 +1,259 @@
+package services
+
+import (
+	"context"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/repo"
+	"github.com/vaiktorg/grimoire/uid"
+	"math"
+	"net"
+	"strings"
+)
+
+// Anomalies a session can be flagged with, see ActivityService.Anomalies.
+const (
+	AnomalyNewIPRange       = "new_ip_range"
+	AnomalyNewCountry       = "new_country"
+	AnomalyImpossibleTravel = "impossible_travel"
+)
+
+const (
+	// AnomalyHistory is how many of the latest sessions of an identity a new one is compared to.
+	AnomalyHistory = 20
+
+	// MaxTravelSpeed, in km/h, is the fastest a user is believed to get from one session to the next,
+	// a bit faster than an airliner.
+	MaxTravelSpeed = 1000.0
+
+	// travelSlack, in km, forgives how roughly IPs are located.
+	travelSlack = 200.0
+)
+
+// GeoLocator locates client IPs, e.g. with a GeoLite2 database.
+type GeoLocator interface {
+	Locate(ip string) (Location, bool)
+}
+
+// Location of an IP. Country is its ISO 3166-1 alpha-2 code.
+type Location struct {
+	Country   string
+	Latitude  float64
+	Longitude float64
+}
+
+// ActivityService keeps the activity log of identities, and tells the sessions that look unlike their
+// earlier ones.
+type ActivityService struct {
+	Repo *repo.ActivityRepo
+}
+
+func NewActivityService(activityRepo *repo.ActivityRepo) ActivityService {
+	return ActivityService{Repo: activityRepo}
+}
+
+// Record adds activity to the log, naming its Device after its UserAgent when empty.
+func (s *ActivityService) Record(ctx context.Context, activity *models.Activity) error {
+	if activity.Device == "" {
+		activity.Device = DeviceName(activity.UserAgent)
+	}
+
+	log := ActivityToEntity(activity)
+	if err := s.Repo.Create(ctx, log); err != nil {
+		return err
+	}
+
+	activity.ID = log.ID
+	return nil
+}
+
+// Page returns the page, of amount entries, of the log of identityID, or of everyone when empty.
+func (s *ActivityService) Page(ctx context.Context, identityID string, page, amount int) (*models.ActivityPage, error) {
+	logs, total, err := s.Repo.Page(ctx, identityID, (page-1)*amount, amount)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &models.ActivityPage{Activity: make([]*models.Activity, len(logs)), Page: page, Amount: amount, Total: total}
+	for i, log := range logs {
+		p.Activity[i] = ActivityToModel(log)
+	}
+
+	return p, nil
+}
+
+// Anomalies compares a successful login or refresh, not yet recorded, to the latest sessions of its
+// identity. Its IP range, or country when geo locates the IPs, is new when none of them had it. The
+// trip from the latest session is impossible when it would take faster than MaxTravelSpeed.
+// The very first session of an identity is never anomalous.
+func (s *ActivityService) Anomalies(ctx context.Context, activity *models.Activity, geo GeoLocator) ([]string, error) {
+	if activity.IdentityID == "" || activity.IPAddress == "" {
+		return nil, nil
+	}
+
+	recent, err := s.Repo.RecentSessions(ctx, activity.IdentityID, AnomalyHistory)
+	if err != nil {
+		return nil, err
+	}
+
+	// Sessions started without a request, through the API, tell nothing.
+	var history []*entities.UserActivityLog
+	ranges := map[string]bool{}
+	countries := map[string]bool{}
+	for _, log := range recent {
+		if log.IPAddress == "" {
+			continue
+		}
+
+		history = append(history, log)
+		ranges[ipRange(log.IPAddress)] = true
+		if log.Country != "" {
+			countries[log.Country] = true
+		}
+	}
+	if len(history) == 0 {
+		return nil, nil
+	}
+
+	var anomalies []string
+	switch {
+	case len(countries) > 0 && activity.Country != "" && !countries[activity.Country]:
+		anomalies = append(anomalies, AnomalyNewCountry)
+	case !ranges[ipRange(activity.IPAddress)]:
+		anomalies = append(anomalies, AnomalyNewIPRange)
+	}
+
+	if geo == nil {
+		return anomalies, nil
+	}
+
+	latest := history[0]
+	from, ok := geo.Locate(latest.IPAddress)
+	if !ok {
+		return anomalies, nil
+	}
+	to, ok := geo.Locate(activity.IPAddress)
+	if !ok {
+		return anomalies, nil
+	}
+
+	km := distance(from, to)
+	hours := activity.At.Sub(latest.CreatedAt).Hours()
+	if km > travelSlack && km-travelSlack > MaxTravelSpeed*hours {
+		anomalies = append(anomalies, AnomalyImpossibleTravel)
+	}
+
+	return anomalies, nil
+}
+
+// DeviceName tells the browser and operating system of userAgent, e.g. "Firefox on Windows".
+func DeviceName(userAgent string) string {
+	var browser, os string
+
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"},
+		{"Safari/", "Safari"}, {"curl/", "curl"},
+	} {
+		if strings.Contains(userAgent, b.token) {
+			browser = b.name
+			break
+		}
+	}
+
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iOS"}, {"iPad", "iOS"}, {"Windows", "Windows"},
+		{"Mac OS X", "macOS"}, {"CrOS", "ChromeOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(userAgent, o.token) {
+			os = o.name
+			break
+		}
+	}
+
+	switch {
+	case browser != "" && os != "":
+		return browser + " on " + os
+	case browser != "":
+		return browser
+	default:
+		return os
+	}
+}
+
+func ActivityToModel(log *entities.UserActivityLog) *models.Activity {
+	if log == nil {
+		return nil
+	}
+
+	return &models.Activity{
+		ID:         log.ID,
+		IdentityID: log.IdentityId.String(),
+		At:         log.CreatedAt,
+
+		Event:      log.Event,
+		Outcome:    log.Outcome,
+		Reason:     log.Reason,
+		Identifier: log.Identifier,
+		ClientID:   log.ClientID,
+
+		IPAddress: log.IPAddress,
+		UserAgent: log.UserAgent,
+		Device:    log.Device,
+		Country:   log.Country,
+		Anomalies: log.Anomalies,
+	}
+}
+func ActivityToEntity(activity *models.Activity) *entities.UserActivityLog {
+	log := &entities.UserActivityLog{
+		Entity:     entities.Entity{ID: activity.ID, CreatedAt: activity.At},
+		IdentityId: uid.UID(activity.IdentityID),
+
+		Event:      activity.Event,
+		Outcome:    activity.Outcome,
+		Reason:     activity.Reason,
+		Identifier: activity.Identifier,
+		ClientID:   activity.ClientID,
+
+		IPAddress: activity.IPAddress,
+		UserAgent: activity.UserAgent,
+		Device:    activity.Device,
+		Country:   activity.Country,
+		Anomalies: activity.Anomalies,
+	}
+
+	switch {
+	case activity.Event == entities.ActivityLogin && activity.Outcome == entities.OutcomeSuccess:
+		log.LoggedIn = activity.At
+	case activity.Event == entities.ActivityLogout:
+		log.LoggedOut = activity.At
+	}
+
+	return log
+}
+
+// ====================================================================================================
+
+// ipRange is the network ip is in, its /16 for IPv4 and /48 for IPv6, about the block of a provider.
+func ipRange(ip string) string {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return ip
+	}
+
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.Mask(net.CIDRMask(16, 32)).String() + "/16"
+	}
+	return parsed.Mask(net.CIDRMask(48, 128)).String() + "/48"
+}
+
+// distance is the great circle distance between two locations in km.
+func distance(from, to Location) float64 {
+	const earthRadius = 6371.0
+
+	lat1, lat2 := from.Latitude*math.Pi/180, to.Latitude*math.Pi/180
+	dLat := lat2 - lat1
+	dLon := (to.Longitude - from.Longitude) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(h))
+}
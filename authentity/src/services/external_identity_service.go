@@ -0,0 +1,93 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/repo"
+	"gorm.io/gorm"
+)
+
+var (
+	ErrExternalNotLinked = errors.New("external identity is not linked")
+	ErrExternalLinked    = errors.New("external identity is already linked to another identity")
+)
+
+type ExternalIdentityService struct {
+	Repo *repo.ExternalIdentityRepo
+}
+
+func NewExternalIdentityService(externalRepo *repo.ExternalIdentityRepo) ExternalIdentityService {
+	return ExternalIdentityService{Repo: externalRepo}
+}
+
+// Find returns the link of connector's subject, or ErrExternalNotLinked.
+func (e *ExternalIdentityService) Find(ctx context.Context, connector, subject string) (*models.ExternalIdentity, error) {
+	link, err := e.Repo.FindBySubject(ctx, connector, subject)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrExternalNotLinked
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return ExternalIdentityToModel(link), nil
+}
+
+// Link ties ext to identityID. Linking it again to the same identity is a no-op.
+func (e *ExternalIdentityService) Link(ctx context.Context, ext *models.ExternalIdentity, identityID string) error {
+	existing, err := e.Find(ctx, ext.Connector, ext.Subject)
+	switch {
+	case err == nil && existing.IdentityID != identityID:
+		return ErrExternalLinked
+	case err == nil:
+		return nil
+	case !errors.Is(err, ErrExternalNotLinked):
+		return err
+	}
+
+	ext.IdentityID = identityID
+	return e.Repo.Persist(ctx, &entities.ExternalIdentity{
+		Connector:  ext.Connector,
+		Subject:    ext.Subject,
+		IdentityID: identityID,
+		Email:      ext.Email,
+	})
+}
+
+// ForIdentity lists every external identity linked to identityID.
+func (e *ExternalIdentityService) ForIdentity(ctx context.Context, identityID string) ([]models.ExternalIdentity, error) {
+	links, err := e.Repo.FindByIdentity(ctx, identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := make([]models.ExternalIdentity, 0, len(links))
+	for _, link := range links {
+		ret = append(ret, *ExternalIdentityToModel(link))
+	}
+
+	return ret, nil
+}
+
+func (e *ExternalIdentityService) UpdateEmail(ctx context.Context, id, email string) error {
+	return e.Repo.UpdateEmail(ctx, id, email)
+}
+func (e *ExternalIdentityService) Unlink(ctx context.Context, id string) error {
+	return e.Repo.Delete(ctx, id)
+}
+
+func ExternalIdentityToModel(link *entities.ExternalIdentity) *models.ExternalIdentity {
+	if link == nil {
+		return nil
+	}
+
+	return &models.ExternalIdentity{
+		ID:         link.ID,
+		Connector:  link.Connector,
+		Subject:    link.Subject,
+		IdentityID: link.IdentityID,
+		Email:      link.Email,
+	}
+}
@@ -82,22 +82,57 @@ func (i *IdentityService) FetchIdentityByUsername(ctx context.Context, username
 	return IdentityToModel(identity)
 }
 func (i *IdentityService) Persist(ctx context.Context, identity *models.Identity) error {
-	return i.Repo.Persist(ctx, IdentityToEntity(identity))
+	entity, err := IdentityToEntity(identity)
+	if err != nil {
+		return err
+	}
+	return i.Repo.Persist(ctx, entity)
 }
 func (i *IdentityService) Updates(ctx context.Context, identity *models.Identity) error {
-	return i.Repo.Update(ctx, IdentityToEntity(identity))
+	entity, err := IdentityToEntity(identity)
+	if err != nil {
+		return err
+	}
+	return i.Repo.Update(ctx, entity)
 }
 
 // ====================================================================================================
 
-func IdentityToModel(identity *entities.Identity) (*models.Identity, error) {
-	decoded, err := base64.URLEncoding.DecodeString(*identity.Resources)
+// ResourcesToEntity serializes resources into the form stored in the identities table.
+func ResourcesToEntity(resources *gwt.Resources) (*string, error) {
+	data, err := resources.Serialize()
 	if err != nil {
 		return nil, err
 	}
 
-	resource := new(gwt.Resources)
-	if err = resource.Deserialize(decoded); err != nil {
+	res := base64.URLEncoding.EncodeToString(data)
+	return &res, nil
+}
+
+// ResourcesFromEntity reverses ResourcesToEntity. Identities stored before resources were base64
+// encoded hold them serialized as is, those are read as they are.
+func ResourcesFromEntity(stored *string) (*gwt.Resources, error) {
+	resources := new(gwt.Resources)
+	if stored == nil {
+		return resources, nil
+	}
+
+	decoded, err := base64.URLEncoding.DecodeString(*stored)
+	if err == nil && resources.Deserialize(decoded) == nil {
+		return resources, nil
+	}
+
+	resources = new(gwt.Resources)
+	if err = resources.Deserialize([]byte(*stored)); err != nil {
+		return nil, err
+	}
+
+	return resources, nil
+}
+
+func IdentityToModel(identity *entities.Identity) (*models.Identity, error) {
+	resource, err := ResourcesFromEntity(identity.Resources)
+	if err != nil {
 		return nil, err
 	}
 
@@ -111,11 +146,15 @@ func IdentityToModel(identity *entities.Identity) (*models.Identity, error) {
 
 	return model, nil
 }
-func IdentityToEntity(identity *models.Identity) *entities.Identity {
-	res := string(identity.Resources.Serialize())
+func IdentityToEntity(identity *models.Identity) (*entities.Identity, error) {
+	resources, err := ResourcesToEntity(identity.Resources)
+	if err != nil {
+		return nil, err
+	}
+
 	entity := &entities.Identity{
 		Entity:    entities.Entity{ID: identity.ID},
-		Resources: &res,
+		Resources: resources,
 	}
 
 	if identity.Profile != nil {
@@ -150,8 +189,9 @@ func IdentityToEntity(identity *models.Identity) *entities.Identity {
 			Email:     &identity.Account.Email,
 			Signature: &identity.Account.Signature,
 			Password:  &identity.Account.Password,
+			Verified:  identity.Account.Verified,
 		}
 	}
 
-	return entity
+	return entity, nil
 }
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"mime"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mail
+// ====================================================================================================
+
+var ErrMailHeader = errors.New("mail header contains a line break")
+
+// Mail is a plain text email.
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends the mails authentity sends its users, e.g. to verify their email or reset their password.
+type Mailer interface {
+	Send(ctx context.Context, mail Mail) error
+}
+
+// SMTP
+// ----------------------------------------------------------------------------------------------------
+
+// SMTPMailer sends mail through an SMTP relay, upgrading the connection with STARTTLS when the relay offers it.
+type SMTPMailer struct {
+	Addr string // host:port
+	From string
+	Auth smtp.Auth // nil for relays that need no authentication
+
+	// TLSConfig for STARTTLS, defaults to verifying the host of Addr.
+	TLSConfig *tls.Config
+}
+
+func NewSMTPMailer(addr, from string, auth smtp.Auth) *SMTPMailer {
+	return &SMTPMailer{Addr: addr, From: from, Auth: auth}
+}
+
+func (m *SMTPMailer) Send(ctx context.Context, mail Mail) error {
+	msg, err := m.message(mail)
+	if err != nil {
+		return err
+	}
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", m.Addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	} else {
+		_ = conn.SetDeadline(time.Now().Add(time.Minute))
+	}
+
+	host, _, err := net.SplitHostPort(m.Addr)
+	if err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		conf := m.TLSConfig
+		if conf == nil {
+			conf = &tls.Config{ServerName: host}
+		}
+		if err = c.StartTLS(conf); err != nil {
+			return err
+		}
+	}
+
+	if m.Auth != nil {
+		if err = c.Auth(m.Auth); err != nil {
+			return err
+		}
+	}
+
+	if err = c.Mail(m.From); err != nil {
+		return err
+	}
+	if err = c.Rcpt(mail.To); err != nil {
+		return err
+	}
+
+	wc, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err = wc.Write(msg); err != nil {
+		return err
+	}
+	if err = wc.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// message formats mail as an RFC 5322 message.
+func (m *SMTPMailer) message(mail Mail) ([]byte, error) {
+	for _, h := range []string{m.From, mail.To, mail.Subject} {
+		if strings.ContainsAny(h, "\r\n") {
+			return nil, ErrMailHeader
+		}
+	}
+
+	var b strings.Builder
+	b.WriteString("From: " + m.From + "\r\n")
+	b.WriteString("To: " + mail.To + "\r\n")
+	b.WriteString("Subject: " + mime.QEncoding.Encode("utf-8", mail.Subject) + "\r\n")
+	b.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(mail.Body, "\r\n", "\n"), "\n", "\r\n"))
+
+	return []byte(b.String()), nil
+}
+
+// Memory
+// ----------------------------------------------------------------------------------------------------
+
+// MemoryMailer keeps the mails it is sent, for tests and development.
+type MemoryMailer struct {
+	mu   sync.Mutex
+	sent []Mail
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return &MemoryMailer{}
+}
+
+func (m *MemoryMailer) Send(_ context.Context, mail Mail) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent = append(m.sent, mail)
+	return nil
+}
+
+// Sent returns every mail sent so far, oldest first.
+func (m *MemoryMailer) Sent() []Mail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return append([]Mail(nil), m.sent...)
+}
+
+// Last returns the latest mail sent to to.
+func (m *MemoryMailer) Last(to string) (Mail, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i], true
+		}
+	}
+
+	return Mail{}, false
+}
@@ -2,62 +2,171 @@ package services
 
 import (
 	"context"
-	"fmt"
-	"log"
-	"net/http"
-	"os"
-
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
 	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
+	"golang.org/x/oauth2/github"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// Social login
+// ====================================================================================================
+// A Connector logs users in through an external identity provider with the OAuth2 authorization code
+// flow and PKCE. Authentity keeps the state, nonce and code verifier of every flow; a connector only
+// builds the authorization URL and turns the code it gets back into an ExternalIdentity.
+
 var (
-	googleOauthConfig = &oauth2.Config{
-		RedirectURL:  "http://localhost:8080/auth/google/callback",
-		ClientID:     os.Getenv("GOOGLE_CLIENT_ID"),
-		ClientSecret: os.Getenv("GOOGLE_CLIENT_SECRET"),
-		Scopes:       []string{"https://www.googleapis.com/auth/userinfo.profile", "https://www.googleapis.com/auth/userinfo.email"},
-		Endpoint:     google.Endpoint,
-	}
+	ErrConnectorExchange = errors.New("connector could not exchange the authorization code")
+	ErrConnectorIdentity = errors.New("connector returned no usable identity")
 )
 
-func main() {
-	http.HandleFunc("/", handleMain)
-	http.HandleFunc("/auth/google/login", handleGoogleLogin)
-	http.HandleFunc("/auth/google/callback", handleGoogleCallback)
-	http.ListenAndServe(":8080", nil)
+type Connector interface {
+	// Name identifies the connector in URLs and in linked identities, e.g. "google". It must never change.
+	Name() string
+
+	// AuthCodeURL is where the user is sent to log in.
+	AuthCodeURL(state, nonce, verifier string) string
+
+	// Exchange redeems an authorization code and returns who logged in.
+	Exchange(ctx context.Context, code, nonce, verifier string) (*models.ExternalIdentity, error)
 }
 
-func handleMain(w http.ResponseWriter, r *http.Request) {
-	var htmlIndex = `<html>
-		<body>
-			<a href="/auth/google/login">Google Log In</a>
-		</body>
-		</html>`
-	fmt.Fprintf(w, htmlIndex)
+// OAuthConfig is the client registration of a connector.
+type OAuthConfig struct {
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string   // authentity's callback, e.g. https://auth.example.com/auth/google/callback
+	Scopes       []string // on top of the connector's own
+
+	HTTPClient *http.Client // defaults to a client with a 10 second timeout
 }
 
-func handleGoogleLogin(w http.ResponseWriter, r *http.Request) {
-	url := googleOauthConfig.AuthCodeURL("state", oauth2.AccessTypeOffline)
-	http.Redirect(w, r, url, http.StatusTemporaryRedirect)
+func (c OAuthConfig) oauth2(endpoint oauth2.Endpoint, scopes ...string) *oauth2.Config {
+	return &oauth2.Config{
+		ClientID:     c.ClientID,
+		ClientSecret: c.ClientSecret,
+		RedirectURL:  c.RedirectURL,
+		Scopes:       append(scopes, c.Scopes...),
+		Endpoint:     endpoint,
+	}
+}
+func (c OAuthConfig) client() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return &http.Client{Timeout: 10 * time.Second}
 }
 
-func handleGoogleCallback(w http.ResponseWriter, r *http.Request) {
-	code := r.FormValue("code")
-	token, err := googleOauthConfig.Exchange(context.Background(), code)
+// getJSON decodes the JSON a GET to url answers with, authenticated with an access token when one is given.
+func getJSON(ctx context.Context, client *http.Client, url, accessToken string, v any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		log.Printf("Code exchange failed with '%s'\n", err)
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
 	}
 
-	response, err := http.Get("https://www.googleapis.com/oauth2/v2/userinfo?access_token=" + token.AccessToken)
+	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Failed getting user info: '%s'\n", err)
-		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
-		return
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.New("GET " + url + ": " + resp.Status)
+	}
+
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// GitHub
+// ----------------------------------------------------------------------------------------------------
+
+// GitHubConnector logs in with GitHub, which speaks plain OAuth2: the user is read from its REST API.
+type GitHubConnector struct {
+	conf   *oauth2.Config
+	client *http.Client
+	apiURL string
+}
+
+// NewGitHubConnector asks for the read:user and user:email scopes.
+func NewGitHubConnector(conf OAuthConfig) *GitHubConnector {
+	return &GitHubConnector{
+		conf:   conf.oauth2(github.Endpoint, "read:user", "user:email"),
+		client: conf.client(),
+		apiURL: "https://api.github.com",
+	}
+}
+
+// NewGitHubEnterpriseConnector logs in with the GitHub Enterprise Server at baseURL, e.g. https://github.example.com.
+func NewGitHubEnterpriseConnector(conf OAuthConfig, baseURL string) *GitHubConnector {
+	baseURL = strings.TrimSuffix(baseURL, "/")
+
+	return &GitHubConnector{
+		conf: conf.oauth2(oauth2.Endpoint{
+			AuthURL:  baseURL + "/login/oauth/authorize",
+			TokenURL: baseURL + "/login/oauth/access_token",
+		}, "read:user", "user:email"),
+		client: conf.client(),
+		apiURL: baseURL + "/api/v3",
+	}
+}
+
+func (g *GitHubConnector) Name() string { return "github" }
+
+// AuthCodeURL ignores nonce, GitHub issues no ID token to bind it to.
+func (g *GitHubConnector) AuthCodeURL(state, _, verifier string) string {
+	return g.conf.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier))
+}
+
+func (g *GitHubConnector) Exchange(ctx context.Context, code, _, verifier string) (*models.ExternalIdentity, error) {
+	ctx = context.WithValue(ctx, oauth2.HTTPClient, g.client)
+
+	tok, err := g.conf.Exchange(ctx, code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, ErrConnectorExchange
+	}
+
+	var user struct {
+		ID    int64  `json:"id"`
+		Login string `json:"login"`
+		Name  string `json:"name"`
+	}
+	if err = getJSON(ctx, g.client, g.apiURL+"/user", tok.AccessToken, &user); err != nil {
+		return nil, err
+	}
+	if user.ID == 0 {
+		return nil, ErrConnectorIdentity
+	}
+
+	// The profile email is optional and unverified, the primary address of /user/emails is neither.
+	var emails []struct {
+		Email    string `json:"email"`
+		Primary  bool   `json:"primary"`
+		Verified bool   `json:"verified"`
+	}
+	if err = getJSON(ctx, g.client, g.apiURL+"/user/emails", tok.AccessToken, &emails); err != nil {
+		return nil, err
+	}
+
+	ext := &models.ExternalIdentity{
+		Connector: g.Name(),
+		Subject:   strconv.FormatInt(user.ID, 10),
+		Name:      user.Name,
+		Username:  user.Login,
+	}
+	for _, e := range emails {
+		if e.Primary {
+			ext.Email, ext.EmailVerified = e.Email, e.Verified
+		}
 	}
-	defer response.Body.Close()
 
-	fmt.Fprintf(w, "UserInfo: %s\n", response.Status)
+	return ext, nil
 }
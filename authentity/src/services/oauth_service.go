@@ -0,0 +1,269 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/repo"
+	"github.com/vaiktorg/grimoire/uid"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+var (
+	ErrClientUnknown      = errors.New("oauth client is not registered")
+	ErrClientCredentials  = errors.New("oauth client credentials are invalid")
+	ErrCodeInvalid        = errors.New("authorization code is invalid")
+	ErrCodeExpired        = errors.New("authorization code has expired")
+	ErrCodeReuse          = errors.New("authorization code reuse detected, its tokens were revoked")
+	ErrClientRedirectURIs = errors.New("oauth client needs at least one redirect uri")
+)
+
+// OAuthService keeps the clients of authentity's authorization server. Client secrets and
+// authorization codes are random 512 bit values, so like refresh tokens only a SHA-256 is stored.
+type OAuthService struct {
+	Repo *repo.OAuthRepo
+}
+
+func NewOAuthService(oauthRepo *repo.OAuthRepo) OAuthService {
+	return OAuthService{Repo: oauthRepo}
+}
+
+// Clients
+// ----------------------------------------------------------------------------------------------------
+
+// RegisterClient stores client and returns it with its ID, and its Secret unless it is public.
+func (o *OAuthService) RegisterClient(ctx context.Context, client *models.OAuthClient) (*models.OAuthClient, error) {
+	if len(client.RedirectURIs) == 0 {
+		return nil, ErrClientRedirectURIs
+	}
+
+	client.ID = uid.New().String()
+	client.Secret = ""
+
+	entity := &entities.OAuthClient{
+		Entity:       entities.Entity{ID: client.ID},
+		Name:         client.Name,
+		RedirectURIs: strings.Join(client.RedirectURIs, " "),
+		Scopes:       strings.Join(client.Scopes, " "),
+		Public:       client.Public,
+	}
+
+	if !client.Public {
+		secret, err := uid.NewSecure512()
+		if err != nil {
+			return nil, err
+		}
+		client.Secret = secret.String()
+		entity.SecretHash = hashSecret(client.Secret)
+	}
+
+	if err := o.Repo.PersistClient(ctx, entity); err != nil {
+		return nil, err
+	}
+
+	return client, nil
+}
+
+func (o *OAuthService) FindClient(ctx context.Context, id string) (*models.OAuthClient, error) {
+	client, err := o.Repo.FindClient(ctx, id)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrClientUnknown
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return OAuthClientToModel(client), nil
+}
+
+// AuthenticateClient checks the credentials a client presents. Public clients present no secret.
+func (o *OAuthService) AuthenticateClient(ctx context.Context, id, secret string) (*models.OAuthClient, error) {
+	client, err := o.Repo.FindClient(ctx, id)
+	if err != nil {
+		return nil, ErrClientCredentials
+	}
+
+	if client.Public {
+		if secret != "" {
+			return nil, ErrClientCredentials
+		}
+		return OAuthClientToModel(client), nil
+	}
+
+	if secret == "" || subtle.ConstantTimeCompare([]byte(hashSecret(secret)), []byte(client.SecretHash)) != 1 {
+		return nil, ErrClientCredentials
+	}
+
+	return OAuthClientToModel(client), nil
+}
+
+func (o *OAuthService) DeleteClient(ctx context.Context, id string) error {
+	return o.Repo.DeleteClient(ctx, id)
+}
+
+// Authorization codes
+// ----------------------------------------------------------------------------------------------------
+
+// IssueCode stores code and returns it with Code set.
+func (o *OAuthService) IssueCode(ctx context.Context, code *models.AuthorizationCode) (*models.AuthorizationCode, error) {
+	secret, err := uid.NewSecure512()
+	if err != nil {
+		return nil, err
+	}
+	code.Code = secret.String()
+
+	entity := &entities.AuthorizationCode{
+		CodeHash:    hashSecret(code.Code),
+		ClientID:    code.ClientID,
+		IdentityID:  code.IdentityID,
+		RedirectURI: code.RedirectURI,
+		Scope:       code.Scope,
+		Challenge:   code.Challenge,
+		Expires:     code.Expires.UTC(),
+
+		RedirectURIExplicit: code.RedirectURIExplicit,
+	}
+	if err = o.Repo.PersistCode(ctx, entity); err != nil {
+		return nil, err
+	}
+
+	code.ID = entity.ID
+	return code, nil
+}
+
+// RedeemCode spends code and returns the record it belonged to. Presenting a code that was already
+// spent returns it with ErrCodeReuse, so the tokens issued for it can be revoked. The code is only
+// spent once check accepts the record, so a request that fails it cannot burn the code.
+func (o *OAuthService) RedeemCode(ctx context.Context, code string, check func(*models.AuthorizationCode) error) (*models.AuthorizationCode, error) {
+	stored, err := o.Repo.FindCodeByHash(ctx, hashSecret(code))
+	if err != nil {
+		return nil, ErrCodeInvalid
+	}
+
+	if stored.Used {
+		return AuthorizationCodeToModel(stored), ErrCodeReuse
+	}
+
+	if time.Now().UTC().After(stored.Expires) {
+		return nil, ErrCodeExpired
+	}
+
+	grant := AuthorizationCodeToModel(stored)
+	if err = check(grant); err != nil {
+		return nil, err
+	}
+
+	ok, err := o.Repo.MarkCodeUsed(ctx, stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Lost a race against another request spending the same code.
+		return grant, ErrCodeReuse
+	}
+
+	return grant, nil
+}
+
+// SetCodeFamily records the refresh family code was exchanged for.
+func (o *OAuthService) SetCodeFamily(ctx context.Context, codeID, family string) error {
+	return o.Repo.SetCodeFamily(ctx, codeID, family)
+}
+
+// Consents
+// ----------------------------------------------------------------------------------------------------
+
+// Consented reports whether identityID already granted clientID every scope in scope.
+func (o *OAuthService) Consented(ctx context.Context, clientID, identityID string, scope []string) bool {
+	consent, err := o.Repo.FindConsent(ctx, clientID, identityID)
+	if err != nil {
+		return false
+	}
+
+	granted := strings.Fields(consent.Scope)
+	for _, s := range scope {
+		if !contains(granted, s) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// GrantConsent adds scope to what identityID granted clientID.
+func (o *OAuthService) GrantConsent(ctx context.Context, clientID, identityID string, scope []string) error {
+	consent, err := o.Repo.FindConsent(ctx, clientID, identityID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		consent, err = &entities.OAuthConsent{ClientID: clientID, IdentityID: identityID}, nil
+	}
+	if err != nil {
+		return err
+	}
+
+	granted := strings.Fields(consent.Scope)
+	for _, s := range scope {
+		if !contains(granted, s) {
+			granted = append(granted, s)
+		}
+	}
+	consent.Scope = strings.Join(granted, " ")
+
+	return o.Repo.SaveConsent(ctx, consent)
+}
+
+func (o *OAuthService) RevokeConsent(ctx context.Context, clientID, identityID string) error {
+	return o.Repo.DeleteConsent(ctx, clientID, identityID)
+}
+
+// ====================================================================================================
+
+func OAuthClientToModel(client *entities.OAuthClient) *models.OAuthClient {
+	if client == nil {
+		return nil
+	}
+
+	return &models.OAuthClient{
+		ID:           client.ID,
+		Name:         client.Name,
+		RedirectURIs: strings.Fields(client.RedirectURIs),
+		Scopes:       strings.Fields(client.Scopes),
+		Public:       client.Public,
+	}
+}
+func AuthorizationCodeToModel(code *entities.AuthorizationCode) *models.AuthorizationCode {
+	if code == nil {
+		return nil
+	}
+
+	return &models.AuthorizationCode{
+		ID:          code.ID,
+		ClientID:    code.ClientID,
+		IdentityID:  code.IdentityID,
+		RedirectURI: code.RedirectURI,
+		Scope:       code.Scope,
+		Challenge:   code.Challenge,
+		Family:      code.Family,
+		Expires:     code.Expires,
+
+		RedirectURIExplicit: code.RedirectURIExplicit,
+	}
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
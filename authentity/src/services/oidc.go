@@ -0,0 +1,381 @@
+package services
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"golang.org/x/oauth2"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// OpenID Connect
+// ----------------------------------------------------------------------------------------------------
+
+var (
+	ErrOIDCDiscovery = errors.New("openid provider discovery document is invalid")
+	ErrIDToken       = errors.New("id token is invalid")
+	ErrIDTokenKey    = errors.New("id token signing key is unknown")
+)
+
+const (
+	// idTokenLeeway absorbs clock skew between authentity and the provider.
+	idTokenLeeway = time.Minute
+
+	// jwksRefetch limits how often an unknown key ID makes the connector fetch the provider's keys.
+	jwksRefetch = time.Minute
+)
+
+// OIDCConnector logs in with any OpenID Connect provider. Who logged in is read from the ID token,
+// which is verified against the provider's published keys, issuer, client ID and the flow's nonce.
+type OIDCConnector struct {
+	name     string
+	clientID string
+	issuers  []string
+	conf     *oauth2.Config
+	client   *http.Client
+	jwksURI  string
+
+	mu      sync.Mutex
+	keys    map[string]crypto.PublicKey
+	fetched time.Time
+}
+
+// NewOIDCConnector reads the provider's endpoints from the discovery document of issuer.
+// It asks for the openid, email and profile scopes.
+func NewOIDCConnector(ctx context.Context, name, issuer string, conf OAuthConfig) (*OIDCConnector, error) {
+	client := conf.client()
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := getJSON(ctx, client, strings.TrimSuffix(issuer, "/")+"/.well-known/openid-configuration", "", &discovery); err != nil {
+		return nil, err
+	}
+
+	if discovery.Issuer != issuer || discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return nil, ErrOIDCDiscovery
+	}
+
+	return &OIDCConnector{
+		name:     name,
+		clientID: conf.ClientID,
+		issuers:  []string{issuer},
+		conf: conf.oauth2(oauth2.Endpoint{
+			AuthURL:   discovery.AuthorizationEndpoint,
+			TokenURL:  discovery.TokenEndpoint,
+			AuthStyle: oauth2.AuthStyleInHeader,
+		}, "openid", "email", "profile"),
+		client:  client,
+		jwksURI: discovery.JWKSURI,
+	}, nil
+}
+
+// NewGoogleConnector logs in with Google accounts.
+func NewGoogleConnector(ctx context.Context, conf OAuthConfig) (*OIDCConnector, error) {
+	c, err := NewOIDCConnector(ctx, "google", "https://accounts.google.com", conf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Google also signs ID tokens with the issuer written without its scheme.
+	c.issuers = append(c.issuers, "accounts.google.com")
+	return c, nil
+}
+
+func (o *OIDCConnector) Name() string { return o.name }
+
+func (o *OIDCConnector) AuthCodeURL(state, nonce, verifier string) string {
+	return o.conf.AuthCodeURL(state, oauth2.S256ChallengeOption(verifier), oauth2.SetAuthURLParam("nonce", nonce))
+}
+
+func (o *OIDCConnector) Exchange(ctx context.Context, code, nonce, verifier string) (*models.ExternalIdentity, error) {
+	tok, err := o.conf.Exchange(context.WithValue(ctx, oauth2.HTTPClient, o.client), code, oauth2.VerifierOption(verifier))
+	if err != nil {
+		return nil, ErrConnectorExchange
+	}
+
+	rawIDToken, _ := tok.Extra("id_token").(string)
+	if rawIDToken == "" {
+		return nil, ErrIDToken
+	}
+
+	claims, err := o.verify(ctx, rawIDToken, nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.ExternalIdentity{
+		Connector:     o.name,
+		Subject:       claims.Subject,
+		Email:         claims.Email,
+		EmailVerified: bool(claims.EmailVerified),
+		Name:          claims.Name,
+		Username:      claims.PreferredUsername,
+	}, nil
+}
+
+// ID tokens
+// ----------------------------------------------------------------------------------------------------
+
+type idTokenClaims struct {
+	Issuer   string   `json:"iss"`
+	Subject  string   `json:"sub"`
+	Audience audience `json:"aud"`
+	Party    string   `json:"azp"`
+	Expires  int64    `json:"exp"`
+	IssuedAt int64    `json:"iat"`
+	Nonce    string   `json:"nonce"`
+
+	Email             string   `json:"email"`
+	EmailVerified     flexBool `json:"email_verified"`
+	Name              string   `json:"name"`
+	PreferredUsername string   `json:"preferred_username"`
+}
+
+// audience is a JWT aud claim, a single string or an array of them.
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var one string
+	if err := json.Unmarshal(b, &one); err == nil {
+		*a = audience{one}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+
+	*a = many
+	return nil
+}
+func (a audience) contains(s string) bool {
+	for _, v := range a {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// flexBool is a boolean claim some providers send as a "true" or "false" string.
+type flexBool bool
+
+func (f *flexBool) UnmarshalJSON(b []byte) error {
+	var v bool
+	if err := json.Unmarshal(b, &v); err == nil {
+		*f = flexBool(v)
+		return nil
+	}
+
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+
+	*f = s == "true"
+	return nil
+}
+
+// verify checks the signature and claims of an ID token and returns its claims.
+func (o *OIDCConnector) verify(ctx context.Context, raw, nonce string) (*idTokenClaims, error) {
+	parts := strings.Split(raw, ".")
+	if len(parts) != 3 {
+		return nil, ErrIDToken
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return nil, ErrIDToken
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrIDToken
+	}
+
+	key, err := o.key(ctx, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+
+	if !verifySignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, ErrIDToken
+	}
+
+	claims := new(idTokenClaims)
+	if err = decodeSegment(parts[1], claims); err != nil {
+		return nil, ErrIDToken
+	}
+
+	now := time.Now()
+	switch {
+	case !o.knownIssuer(claims.Issuer),
+		claims.Subject == "",
+		!claims.Audience.contains(o.clientID),
+		claims.Party != "" && claims.Party != o.clientID,
+		now.After(time.Unix(claims.Expires, 0).Add(idTokenLeeway)),
+		time.Unix(claims.IssuedAt, 0).After(now.Add(idTokenLeeway)),
+		claims.Nonce != nonce:
+		return nil, ErrIDToken
+	}
+
+	return claims, nil
+}
+func (o *OIDCConnector) knownIssuer(iss string) bool {
+	for _, v := range o.issuers {
+		if v == iss {
+			return true
+		}
+	}
+	return false
+}
+
+func decodeSegment(seg string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(seg)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// verifySignature checks sig with the algorithms ID tokens are signed with in practice.
+// The algorithm must match the key type, so an RSA key is never used as an HMAC secret.
+func verifySignature(alg string, key crypto.PublicKey, data, sig []byte) bool {
+	switch pub := key.(type) {
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			return false
+		}
+		h := sha256.Sum256(data)
+		return rsa.VerifyPKCS1v15(pub, crypto.SHA256, h[:], sig) == nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" || len(sig) != 64 {
+			return false
+		}
+		h := sha256.Sum256(data)
+		return ecdsa.Verify(pub, h[:], new(big.Int).SetBytes(sig[:32]), new(big.Int).SetBytes(sig[32:]))
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(pub, data, sig)
+	}
+	return false
+}
+
+// Provider keys
+// ----------------------------------------------------------------------------------------------------
+
+// key returns the provider key with kid, fetching the key set again when it is unknown, as providers
+// rotate keys. A token without kid is only accepted while the provider publishes a single key.
+func (o *OIDCConnector) key(ctx context.Context, kid string) (crypto.PublicKey, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if key, ok := o.lookup(kid); ok {
+		return key, nil
+	}
+
+	if time.Since(o.fetched) < jwksRefetch {
+		return nil, ErrIDTokenKey
+	}
+
+	keys, err := o.fetchKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	o.keys, o.fetched = keys, time.Now()
+
+	if key, ok := o.lookup(kid); ok {
+		return key, nil
+	}
+
+	return nil, ErrIDTokenKey
+}
+func (o *OIDCConnector) lookup(kid string) (crypto.PublicKey, bool) {
+	if kid == "" && len(o.keys) == 1 {
+		for _, key := range o.keys {
+			return key, true
+		}
+	}
+
+	key, ok := o.keys[kid]
+	return key, ok
+}
+
+// fetchKeys reads the signing keys of the provider's JWKS, skipping the ones it cannot use.
+func (o *OIDCConnector) fetchKeys(ctx context.Context) (map[string]crypto.PublicKey, error) {
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := getJSON(ctx, o.client, o.jwksURI, "", &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey, len(set.Keys))
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		switch {
+		case jwk.Kty == "RSA":
+			n, nErr := base64.RawURLEncoding.DecodeString(jwk.N)
+			e, eErr := base64.RawURLEncoding.DecodeString(jwk.E)
+			if nErr != nil || eErr != nil || len(e) == 0 || len(e) > 4 {
+				continue
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		case jwk.Kty == "EC" && jwk.Crv == "P-256":
+			x, xErr := base64.RawURLEncoding.DecodeString(jwk.X)
+			y, yErr := base64.RawURLEncoding.DecodeString(jwk.Y)
+			if xErr != nil || yErr != nil {
+				continue
+			}
+			pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+				continue
+			}
+			key = pub
+		case jwk.Kty == "OKP" && jwk.Crv == "Ed25519":
+			x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+			if err != nil || len(x) != ed25519.PublicKeySize {
+				continue
+			}
+			key = ed25519.PublicKey(x)
+		default:
+			continue
+		}
+
+		keys[jwk.Kid] = key
+	}
+
+	return keys, nil
+}
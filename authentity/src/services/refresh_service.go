@@ -0,0 +1,173 @@
+package services
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/repo"
+	"github.com/vaiktorg/grimoire/uid"
+	"time"
+)
+
+var (
+	ErrRefreshInvalid = errors.New("refresh token is invalid")
+	ErrRefreshExpired = errors.New("refresh token has expired")
+	ErrRefreshReuse   = errors.New("refresh token reuse detected, session family revoked")
+)
+
+type RefreshTokenService struct {
+	Repo *repo.RefreshTokenRepo
+}
+
+func NewRefreshTokenService(refreshRepo *repo.RefreshTokenRepo) RefreshTokenService {
+	return RefreshTokenService{Repo: refreshRepo}
+}
+
+// Issue stores a new refresh token for rt and returns it with Token set.
+// A new family is started when rt.Family is empty.
+func (r *RefreshTokenService) Issue(ctx context.Context, rt *models.RefreshToken, accessExpires time.Time) (*models.RefreshToken, error) {
+	secret, err := uid.NewSecure512()
+	if err != nil {
+		return nil, err
+	}
+
+	if rt.Family == "" {
+		rt.Family = uid.New().String()
+	}
+	rt.Token = secret.String()
+
+	err = r.Repo.Persist(ctx, &entities.RefreshToken{
+		TokenHash:     hashRefreshToken(rt.Token),
+		Family:        rt.Family,
+		IdentityID:    rt.IdentityID,
+		Recipient:     rt.Recipient,
+		AccessID:      rt.AccessID,
+		AccessExpires: accessExpires.UTC(),
+		Confirmation:  rt.Confirmation,
+		ClientID:      rt.ClientID,
+		Scope:         rt.Scope,
+		Expires:       rt.Expires.UTC(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rt, nil
+}
+
+// Rotate spends token and returns the record it belonged to, so a new pair can be issued in its family.
+// Presenting a token that was already rotated revokes the whole family and returns ErrRefreshReuse.
+func (r *RefreshTokenService) Rotate(ctx context.Context, token string) (*models.RefreshToken, error) {
+	stored, err := r.Repo.FindByHash(ctx, hashRefreshToken(token))
+	if err != nil {
+		return nil, ErrRefreshInvalid
+	}
+
+	if stored.Revoked {
+		return nil, ErrRefreshInvalid
+	}
+
+	if stored.Rotated {
+		if err = r.Repo.RevokeFamily(ctx, stored.Family); err != nil {
+			return nil, err
+		}
+		return RefreshTokenToModel(stored), ErrRefreshReuse
+	}
+
+	if time.Now().UTC().After(stored.Expires) {
+		return nil, ErrRefreshExpired
+	}
+
+	ok, err := r.Repo.MarkRotated(ctx, stored.ID)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		// Lost a race against another request spending the same token.
+		if err = r.Repo.RevokeFamily(ctx, stored.Family); err != nil {
+			return nil, err
+		}
+		return RefreshTokenToModel(stored), ErrRefreshReuse
+	}
+
+	return RefreshTokenToModel(stored), nil
+}
+
+// Find returns the record for token without spending it.
+func (r *RefreshTokenService) Find(ctx context.Context, token string) (*models.RefreshToken, error) {
+	stored, err := r.Repo.FindByHash(ctx, hashRefreshToken(token))
+	if err != nil {
+		return nil, ErrRefreshInvalid
+	}
+
+	return RefreshTokenToModel(stored), nil
+}
+
+// RevokeFamily kills every refresh token in family and returns the access tokens
+// that were issued alongside them, with their expiry, so they can be revoked too.
+func (r *RefreshTokenService) RevokeFamily(ctx context.Context, family string) (map[string]time.Time, error) {
+	if err := r.Repo.RevokeFamily(ctx, family); err != nil {
+		return nil, err
+	}
+
+	tokens, err := r.Repo.FindFamily(ctx, family)
+	if err != nil {
+		return nil, err
+	}
+
+	access := make(map[string]time.Time, len(tokens))
+	for _, t := range tokens {
+		if t.AccessID != "" {
+			access[t.AccessID] = t.AccessExpires
+		}
+	}
+
+	return access, nil
+}
+
+// RevokeIdentity kills every session family of identityID, see RevokeFamily.
+func (r *RefreshTokenService) RevokeIdentity(ctx context.Context, identityID string) (map[string]time.Time, error) {
+	families, err := r.Repo.FindIdentityFamilies(ctx, identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	access := make(map[string]time.Time)
+	for _, family := range families {
+		revoked, err := r.RevokeFamily(ctx, family)
+		if err != nil {
+			return nil, err
+		}
+		for id, expires := range revoked {
+			access[id] = expires
+		}
+	}
+
+	return access, nil
+}
+
+func RefreshTokenToModel(token *entities.RefreshToken) *models.RefreshToken {
+	if token == nil {
+		return nil
+	}
+
+	return &models.RefreshToken{
+		Family:     token.Family,
+		IdentityID: token.IdentityID,
+		Recipient:  token.Recipient,
+		AccessID:   token.AccessID,
+		Expires:    token.Expires,
+
+		Confirmation: token.Confirmation,
+		ClientID:     token.ClientID,
+		Scope:        token.Scope,
+	}
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
@@ -22,8 +22,7 @@ func (r *ResourceService) ResourcesByIdentityID(ctx context.Context, id uid.UID)
 		return nil, err
 	}
 
-	resources := &gwt.Resources{}
-	err = resources.Deserialize([]byte(*identity.Resources))
+	resources, err := ResourcesFromEntity(identity.Resources)
 	if err != nil {
 		return nil, err
 	}
@@ -36,8 +35,7 @@ func (r *ResourceService) ResourcesByAccountEmail(ctx context.Context, email uid
 		return nil, err
 	}
 
-	resources := &gwt.Resources{}
-	err = resources.Deserialize([]byte(*identity.Resources))
+	resources, err := ResourcesFromEntity(identity.Resources)
 	if err != nil {
 		return nil, err
 	}
@@ -50,8 +48,7 @@ func (r *ResourceService) ResourcesByAccountUsername(ctx context.Context, userna
 		return nil, err
 	}
 
-	resources := &gwt.Resources{}
-	err = resources.Deserialize([]byte(*identity.Resources))
+	resources, err := ResourcesFromEntity(identity.Resources)
 	if err != nil {
 		return nil, err
 	}
@@ -67,8 +64,7 @@ func (r *ResourceService) GetResourceByID(ctx context.Context, userID uid.UID, r
 		return nil, err
 	}
 
-	resources := &gwt.Resources{}
-	err = resources.Deserialize([]byte(*identity.Resources))
+	resources, err := ResourcesFromEntity(identity.Resources)
 	if err != nil {
 		return nil, err
 	}
@@ -93,6 +89,26 @@ func (r *ResourceService) AddResource(ctx context.Context, userID uid.UID, resou
 	return r.UpdateResource(ctx, string(userID), *resources)
 }
 
+// GrantResource gives the user resource, merging its roles into the resource with the same ResID
+// when the user already holds it. Grant gwt.AnyResourceID for every resource of a type.
+func (r *ResourceService) GrantResource(ctx context.Context, userID uid.UID, resource gwt.Resource) error {
+	resources, err := r.ResourcesByIdentityID(ctx, userID)
+	if err != nil {
+		return err
+	}
+
+	switch held := resources.GetResourceByID(resource.ResID); {
+	case held == nil:
+		resources.Resources = append(resources.Resources, &resource)
+	case held.Type != resource.Type:
+		return errors.New("resource id is already held with another type")
+	default:
+		held.AssignRoles(resource.Roles...)
+	}
+
+	return r.UpdateResource(ctx, string(userID), *resources)
+}
+
 // UpdateResource adds a new resource to the user's resources
 func (r *ResourceService) UpdateResource(ctx context.Context, userId string, resources gwt.Resources) error {
 	identity, err := r.Repo.FindIdentityByID(ctx, userId)
@@ -100,8 +116,9 @@ func (r *ResourceService) UpdateResource(ctx context.Context, userId string, res
 		return err
 	}
 
-	res := string(resources.Serialize())
-	identity.Resources = &res
+	if identity.Resources, err = ResourcesToEntity(&resources); err != nil {
+		return err
+	}
 
 	return r.Repo.Update(ctx, identity)
 }
@@ -184,7 +201,7 @@ func (r *ResourceService) AddClaim(ctx context.Context, userID uid.UID, resource
 
 	for _, role := range res.GetRole(roleType) {
 		if !role.HasClaim(claim.Key()) {
-			role.AddClaim(claim.Key(), claim.Value())
+			role.AddClaim(gwt.RoleType(claim.Key()), claim.Value())
 			break
 		}
 	}
@@ -206,7 +223,7 @@ func (r *ResourceService) RemoveClaim(ctx context.Context, userID uid.UID, resou
 
 	for _, role := range res.GetRole(roleType) {
 		if role.HasClaim(claim.Key()) {
-			role.DeleteClaim(claim.Key())
+			role.DeleteClaim(gwt.RoleType(claim.Key()))
 			break
 		}
 	}
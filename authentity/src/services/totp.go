@@ -0,0 +1,119 @@
+package services
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TOTP
+// ====================================================================================================
+// Time based one time passwords, RFC 6238, with the parameters every authenticator app supports:
+// HMAC-SHA1, 6 digits and 30 second periods.
+
+const (
+	TOTPDigits = 6
+	TOTPPeriod = 30 * time.Second
+
+	// TOTPSkew is how many periods a code may be off by, either way, to make up for clock drift.
+	TOTPSkew = 1
+)
+
+var ErrTOTPSecret = errors.New("totp secret is not valid base32")
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewTOTPSecret returns a random 160 bit secret, base32 encoded as authenticator apps expect it.
+func NewTOTPSecret() (string, error) {
+	key := make([]byte, 20)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+
+	return totpEncoding.EncodeToString(key), nil
+}
+
+// TOTPURI is the otpauth:// provisioning URI authenticator apps import, usually from a QR code of it.
+func TOTPURI(issuer, account, secret string) string {
+	q := url.Values{
+		"secret":    {secret},
+		"issuer":    {issuer},
+		"algorithm": {"SHA1"},
+		"digits":    {strconv.Itoa(TOTPDigits)},
+		"period":    {strconv.Itoa(int(TOTPPeriod.Seconds()))},
+	}
+
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+account) + "?" + q.Encode()
+}
+
+// TOTPCode returns the code of secret for the period t falls in.
+func TOTPCode(secret string, t time.Time) (string, error) {
+	key, err := totpKey(secret)
+	if err != nil {
+		return "", err
+	}
+
+	return hotp(key, totpCounter(t)), nil
+}
+
+// ValidateTOTP checks code against the periods around t and returns the counter of the one it
+// matched. Only periods after the counter last is are accepted, so a code is never spent twice.
+func ValidateTOTP(secret, code string, t time.Time, last int64) (int64, bool) {
+	key, err := totpKey(secret)
+	if err != nil || len(code) != TOTPDigits {
+		return 0, false
+	}
+
+	now := totpCounter(t)
+	for c := now - TOTPSkew; c <= now+TOTPSkew; c++ {
+		if c <= last {
+			continue
+		}
+		if subtle.ConstantTimeCompare([]byte(hotp(key, c)), []byte(code)) == 1 {
+			return c, true
+		}
+	}
+
+	return 0, false
+}
+
+func totpKey(secret string) ([]byte, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(strings.ReplaceAll(secret, " ", "")))
+	if err != nil || len(key) == 0 {
+		return nil, ErrTOTPSecret
+	}
+
+	return key, nil
+}
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / int64(TOTPPeriod.Seconds())
+}
+
+// hotp is the HMAC based one time password of RFC 4226.
+func hotp(key []byte, counter int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	bin := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+
+	return fmt.Sprintf("%0*d", TOTPDigits, bin%mod)
+}
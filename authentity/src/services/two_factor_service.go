@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/repo"
+	"gorm.io/gorm"
+	"strings"
+	"time"
+)
+
+var (
+	ErrTwoFactorEnabled     = errors.New("two factor authentication is already enabled")
+	ErrTwoFactorNotEnrolled = errors.New("two factor authentication is not enrolled")
+	ErrTwoFactorCode        = errors.New("two factor code is invalid")
+)
+
+// RecoveryCodeCount is how many recovery codes are handed out when two factor authentication is enabled.
+const RecoveryCodeCount = 10
+
+// TwoFactorService keeps the TOTP enrollments of identities. Every time is passed in by the caller,
+// so the codes can be checked against any clock.
+type TwoFactorService struct {
+	Repo *repo.TwoFactorRepo
+}
+
+func NewTwoFactorService(twoFactorRepo *repo.TwoFactorRepo) TwoFactorService {
+	return TwoFactorService{Repo: twoFactorRepo}
+}
+
+// Enroll starts over the enrollment of identityID with a new secret. It is not enabled until Confirm.
+func (s *TwoFactorService) Enroll(ctx context.Context, identityID string) (string, error) {
+	tf, err := s.Repo.Find(ctx, identityID)
+	if err == nil && tf.Enabled {
+		return "", ErrTwoFactorEnabled
+	}
+	if err != nil && !errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", err
+	}
+
+	secret, err := NewTOTPSecret()
+	if err != nil {
+		return "", err
+	}
+
+	if err = s.Repo.Enroll(ctx, &entities.TwoFactor{IdentityID: identityID, Secret: secret}); err != nil {
+		return "", err
+	}
+
+	return secret, nil
+}
+
+// Confirm enables the enrollment of identityID once code proves the authenticator app has the secret,
+// and returns the recovery codes.
+func (s *TwoFactorService) Confirm(ctx context.Context, identityID, code string, now time.Time) ([]string, error) {
+	tf, err := s.find(ctx, identityID)
+	if err != nil {
+		return nil, err
+	}
+	if tf.Enabled {
+		return nil, ErrTwoFactorEnabled
+	}
+
+	counter, ok := ValidateTOTP(tf.Secret, code, now, tf.LastCounter)
+	if !ok {
+		return nil, ErrTwoFactorCode
+	}
+
+	codes, stored, err := newRecoveryCodes(identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.Repo.Enable(ctx, tf.ID, counter, stored); err != nil {
+		return nil, err
+	}
+
+	return codes, nil
+}
+
+// Enabled reports whether identityID has to log in with a second factor.
+func (s *TwoFactorService) Enabled(ctx context.Context, identityID string) (bool, error) {
+	tf, err := s.Repo.Find(ctx, identityID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return tf.Enabled, nil
+}
+
+// Verify checks a TOTP code of identityID. Each code is accepted once.
+func (s *TwoFactorService) Verify(ctx context.Context, identityID, code string, now time.Time) error {
+	tf, err := s.find(ctx, identityID)
+	if err != nil {
+		return err
+	}
+	if !tf.Enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	counter, ok := ValidateTOTP(tf.Secret, code, now, tf.LastCounter)
+	if !ok {
+		return ErrTwoFactorCode
+	}
+
+	if ok, err = s.Repo.Advance(ctx, tf.ID, counter); err != nil {
+		return err
+	}
+	if !ok {
+		// Lost a race against another request spending the same code.
+		return ErrTwoFactorCode
+	}
+
+	return nil
+}
+
+// Recover spends a recovery code of identityID.
+func (s *TwoFactorService) Recover(ctx context.Context, identityID, code string) error {
+	if enabled, err := s.Enabled(ctx, identityID); err != nil || !enabled {
+		return ErrTwoFactorNotEnrolled
+	}
+
+	ok, err := s.Repo.UseRecoveryCode(ctx, identityID, hashSecret(normalizeRecoveryCode(code)))
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return ErrTwoFactorCode
+	}
+
+	return nil
+}
+
+func (s *TwoFactorService) Status(ctx context.Context, identityID string) (*models.TwoFactorStatus, error) {
+	enabled, err := s.Enabled(ctx, identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	left, err := s.Repo.CountRecoveryCodes(ctx, identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorStatus{IdentityID: identityID, Enabled: enabled, RecoveryCodes: left}, nil
+}
+
+// Reset removes the enrollment and recovery codes of identityID, who then logs in with a password alone.
+func (s *TwoFactorService) Reset(ctx context.Context, identityID string) error {
+	return s.Repo.Delete(ctx, identityID)
+}
+
+func (s *TwoFactorService) find(ctx context.Context, identityID string) (*entities.TwoFactor, error) {
+	tf, err := s.Repo.Find(ctx, identityID)
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrTwoFactorNotEnrolled
+	}
+
+	return tf, err
+}
+
+// ====================================================================================================
+
+// newRecoveryCodes returns RecoveryCodeCount codes of 80 random bits, formatted like abcd-efgh-ijkl-mnop,
+// along with the records keeping their hashes.
+func newRecoveryCodes(identityID string) ([]string, []*entities.RecoveryCode, error) {
+	codes := make([]string, RecoveryCodeCount)
+	stored := make([]*entities.RecoveryCode, RecoveryCodeCount)
+
+	raw := make([]byte, 10)
+	for i := range codes {
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+
+		code := strings.ToLower(totpEncoding.EncodeToString(raw))
+		codes[i] = code[0:4] + "-" + code[4:8] + "-" + code[8:12] + "-" + code[12:16]
+		stored[i] = &entities.RecoveryCode{IdentityID: identityID, CodeHash: hashSecret(code)}
+	}
+
+	return codes, stored, nil
+}
+
+// normalizeRecoveryCode forgives the dashes, spaces and case users type recovery codes with.
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
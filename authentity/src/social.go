@@ -0,0 +1,328 @@
+package src
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"github.com/vaiktorg/grimoire/gwt"
+	"golang.org/x/oauth2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Social login
+// ====================================================================================================
+// Every Config.Connectors entry gets a login and a callback path. The login handler keeps the flow's
+// state, nonce and PKCE verifier in a short lived, encrypted cookie scoped to the connector's paths
+// and sends the user to the provider. The callback checks the state, has the connector redeem the
+// code and logs into the identity the external one is linked to, linking or registering it first.
+
+var (
+	LinkRequiredError    = errors.New("an account already uses this email, log in and link the provider from it")
+	UnverifiedEmailError = errors.New("provider did not verify the email of the account")
+	SocialStateError     = errors.New("social login state does not match")
+)
+
+const CookieSocialName = "gwt_social"
+
+// SocialFlowExpireTime is how long a user has to log in at the provider.
+const SocialFlowExpireTime = 10 * time.Minute
+
+// SocialLoginPath starts a social login with the connector named name.
+func SocialLoginPath(name string) string { return "/auth/" + name + "/login" }
+
+// SocialCallbackPath is where the connector named name sends users back to, its OAuthConfig.RedirectURL.
+func SocialCallbackPath(name string) string { return "/auth/" + name + "/callback" }
+
+// socialFlow is a login in progress. LinkTo is the identity that started it, when logged in.
+type socialFlow struct {
+	Connector string
+	State     string
+	Nonce     string
+	Verifier  string
+	LinkTo    string
+}
+
+// newEphemeralCoder returns a coder of short lived state handed to browsers, e.g. social login flows.
+// That state never outlives a restart, so it is sealed with a key of its own and minted for an
+// audience, named after purpose, no access token is ever valid for.
+func newEphemeralCoder[T any](config *Config, purpose string, opts ...gwt.Option) (*gwt.MultiCoder[T], error) {
+	encKey := make([]byte, 32)
+	if _, err := rand.Read(encKey); err != nil {
+		return nil, err
+	}
+
+	return gwt.NewMultiCoder[T](append([]gwt.Option{
+		gwt.WithKeyRing(config.Keys),
+		gwt.WithEncryptionKey(encKey),
+		gwt.WithAudience([]byte(config.Audience + "#" + purpose)),
+	}, opts...)...)
+}
+
+// SocialLoginHandler sends the user to log in at connector. Users with a session link the external
+// identity to their own when they come back.
+func SocialLoginHandler(service *Authentity, connector services.Connector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		flow := socialFlow{
+			Connector: connector.Name(),
+			State:     randomSecret(),
+			Nonce:     randomSecret(),
+			Verifier:  oauth2.GenerateVerifier(),
+		}
+
+		if identityID, ok := service.sessionIdentity(r); ok {
+			flow.LinkTo = identityID
+		}
+
+		tok, err := service.flows.Encode(&gwt.GWT[socialFlow]{
+			Header: gwt.Header{
+				Issuer:    service.issuer,
+				Recipient: []byte(flow.Connector),
+				Expires:   time.Now().Add(SocialFlowExpireTime),
+			},
+			Body: flow,
+		})
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		http.SetCookie(w, socialCookie(r, connector.Name(), tok.Token, SocialFlowExpireTime))
+		http.Redirect(w, r, connector.AuthCodeURL(flow.State, flow.Nonce, flow.Verifier), http.StatusFound)
+	}
+}
+
+// SocialCallbackHandler finishes a login started by SocialLoginHandler, sets the session cookies
+// and sends the user on to Config.SocialRedirect.
+func SocialCallbackHandler(service *Authentity, connector services.Connector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// A flow is spent by its first callback, whatever the outcome.
+		http.SetCookie(w, socialCookie(r, connector.Name(), "", -time.Second))
+
+		flow, err := service.socialFlow(r, connector)
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		query := r.URL.Query()
+		if e := query.Get("error"); e != "" {
+			http.Error(w, service.Logger.ERROR(connector.Name()+" login failed: "+e), http.StatusUnauthorized)
+			return
+		}
+
+		ext, err := connector.Exchange(r.Context(), query.Get("code"), flow.Nonce, flow.Verifier)
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadGateway)
+			return
+		}
+
+		pair, err := service.LoginExternal(service.withClient(r), ext, flow.LinkTo)
+		var pending *TwoFactorRequiredError
+		switch {
+		case errors.As(err, &pending):
+			http.SetCookie(w, twoFactorCookie(r, pending.Token, TwoFactorPendingExpireTime))
+			http.Redirect(w, r, TwoFactorLoginPath, http.StatusSeeOther)
+			return
+		case errors.Is(err, LinkRequiredError), errors.Is(err, services.ErrExternalLinked):
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusConflict)
+			return
+		case errors.Is(err, UnverifiedEmailError):
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusForbidden)
+			return
+		case err != nil:
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		setSessionCookies(w, pair)
+		http.Redirect(w, r, service.socialRedirect, http.StatusSeeOther)
+
+		service.Logger.INFO(string(pair.Access.Header.Recipient) + " has logged in with " + connector.Name())
+	}
+}
+
+// socialFlow reads the flow of the callback r and checks it was started for connector with the state r carries.
+func (a *Authentity) socialFlow(r *http.Request, connector services.Connector) (*socialFlow, error) {
+	c, err := r.Cookie(CookieSocialName)
+	if err != nil {
+		return nil, SocialStateError
+	}
+
+	tok, err := a.flows.Decode(c.Value)
+	if err != nil {
+		return nil, err
+	}
+	if err = gwt.ValidateGWT(tok); err != nil {
+		return nil, err
+	}
+
+	state := r.URL.Query().Get("state")
+	if tok.Body.Connector != connector.Name() || state == "" ||
+		subtle.ConstantTimeCompare([]byte(state), []byte(tok.Body.State)) != 1 {
+		return nil, SocialStateError
+	}
+
+	return &tok.Body, nil
+}
+
+func socialCookie(r *http.Request, connector, value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     CookieSocialName,
+		Value:    value,
+		Path:     "/auth/" + connector + "/",
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode, // sent along with the provider's redirect back
+	}
+}
+
+// LoginExternal logs in with an identity a connector vouched for. An external identity already linked
+// logs into its identity. Otherwise it is linked to linkTo, the identity of the user who started the
+// login, or to a new account registered with its verified email. An email another account already
+// uses is never linked on its own, the owner has to log in and link the provider.
+func (a *Authentity) LoginExternal(pCtx context.Context, ext *models.ExternalIdentity, linkTo string) (*TokenPair, error) {
+	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
+	defer cancel()
+
+	if ext == nil || ext.Connector == "" || ext.Subject == "" {
+		return nil, services.ErrConnectorIdentity
+	}
+
+	link, err := a.Provider.ExternalIdentityService.Find(ctx, ext.Connector, ext.Subject)
+	switch {
+	case err == nil && linkTo != "" && link.IdentityID != linkTo:
+		return nil, services.ErrExternalLinked
+	case err == nil:
+		if ext.Email != "" && ext.Email != link.Email {
+			if err = a.Provider.ExternalIdentityService.UpdateEmail(ctx, link.ID, ext.Email); err != nil {
+				return nil, err
+			}
+		}
+
+		identity, err := a.Provider.IdentityService.FetchIdentity(ctx, link.IdentityID)
+		if err != nil {
+			return nil, err
+		}
+		return a.loginIdentity(ctx, identity, identity.Account.Username, "")
+	case !errors.Is(err, services.ErrExternalNotLinked):
+		return nil, err
+	}
+
+	var identity *models.Identity
+	if linkTo != "" {
+		identity, err = a.Provider.IdentityService.FetchIdentity(ctx, linkTo)
+	} else {
+		identity, err = a.registerExternal(ctx, ext)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err = a.Provider.ExternalIdentityService.Link(ctx, ext, identity.ID); err != nil {
+		return nil, err
+	}
+
+	a.Logger.INFO("linked "+ext.Connector+" identity to "+identity.Account.Username, identity.ID)
+	return a.loginIdentity(ctx, identity, identity.Account.Username, "")
+}
+
+// registerExternal registers a new account for ext. Its password is random: the account
+// logs in through the connector until its owner resets it.
+func (a *Authentity) registerExternal(ctx context.Context, ext *models.ExternalIdentity) (*models.Identity, error) {
+	if ext.Email == "" || !ext.EmailVerified {
+		return nil, UnverifiedEmailError
+	}
+
+	if _, err := a.Provider.AccountsService.FindAccountByEmail(ctx, ext.Email); err == nil {
+		return nil, LinkRequiredError
+	}
+
+	username, err := a.freeUsername(ctx, ext)
+	if err != nil {
+		return nil, err
+	}
+
+	first, last, _ := strings.Cut(strings.TrimSpace(ext.Name), " ")
+	identity, err := a.registerIdentity(ctx,
+		&models.Profile{FirstName: first, LastName: strings.TrimSpace(last)},
+		&models.Account{Username: username, Email: ext.Email, Password: randomSecret()},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	// Fetched back for the account ID the repo assigned.
+	if identity, err = a.Provider.IdentityService.FetchIdentity(ctx, identity.ID); err != nil {
+		return nil, err
+	}
+
+	// The connector vouched for the email.
+	if err = a.Provider.AccountsService.SetVerified(ctx, identity.Account.ID, identity.Account.Email); err != nil {
+		return nil, err
+	}
+	identity.Account.Verified = true
+
+	return identity, nil
+}
+
+// freeUsername picks an unused username from the connector's username hint or the email's local part.
+func (a *Authentity) freeUsername(ctx context.Context, ext *models.ExternalIdentity) (string, error) {
+	base := usernameFrom(ext.Username)
+	if base == "" {
+		local, _, _ := strings.Cut(ext.Email, "@")
+		base = usernameFrom(local)
+	}
+	if base == "" {
+		base = "user"
+	}
+
+	for i := 1; i <= 100; i++ {
+		username := base
+		if i > 1 {
+			username += strconv.Itoa(i)
+		}
+
+		if _, err := a.Provider.AccountsService.FindAccountByUsername(ctx, username); err != nil {
+			return username, nil
+		}
+	}
+
+	return "", errors.New("no username available for " + base)
+}
+
+func usernameFrom(s string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(s) {
+		if r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r == '.' || r == '_' || r == '-' {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+// randomSecret returns 256 random bits, URL safe. It stays well under bcrypt's 72 byte limit.
+func randomSecret() string {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
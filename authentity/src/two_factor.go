@@ -0,0 +1,391 @@
+package src
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/internal"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"github.com/vaiktorg/grimoire/gwt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Two factor authentication
+// ====================================================================================================
+// Identities that enabled TOTP log in in two steps. The password, or a social login, only buys a
+// short lived token pending the second factor, which LoginTwoFactor trades for the session along
+// with a code from the authenticator app or a single use recovery code.
+
+var (
+	TwoFactorTokenError = errors.New("two factor token is invalid or expired")
+)
+
+const CookieTwoFactorName = "gwt_2fa"
+
+// TwoFactorPendingExpireTime is how long a user has to enter the second factor of a login.
+const TwoFactorPendingExpireTime = 5 * time.Minute
+
+// TwoFactorRequiredError is returned in place of a session by logins of identities with two factor
+// authentication. Token proves the first factor, see LoginTwoFactor.
+type TwoFactorRequiredError struct {
+	Token   string
+	Expires time.Time
+}
+
+func (e *TwoFactorRequiredError) Error() string { return "two factor authentication required" }
+
+// pendingLogin is what a two factor token carries over from the first factor.
+type pendingLogin struct {
+	IdentityID string
+	Recipient  string
+	Thumbprint string
+}
+
+// requireTwoFactor returns the *TwoFactorRequiredError a login of identityID is answered with.
+func (a *Authentity) requireTwoFactor(identityID, recipient, thumbprint string) error {
+	expires := a.now().Add(TwoFactorPendingExpireTime)
+
+	tok, err := a.pending.Encode(&gwt.GWT[pendingLogin]{
+		Header: gwt.Header{
+			Issuer:    a.issuer,
+			Recipient: []byte(recipient),
+			Expires:   expires,
+		},
+		Body: pendingLogin{IdentityID: identityID, Recipient: recipient, Thumbprint: thumbprint},
+	})
+	if err != nil {
+		return err
+	}
+
+	return &TwoFactorRequiredError{Token: tok.Token, Expires: expires}
+}
+
+// LoginTwoFactor finishes the login pending on token with a TOTP code, or a recovery code, of its identity.
+// A login bound to a key is only finished with a proof of the same key, see ProofThumbprint.
+func (a *Authentity) LoginTwoFactor(pCtx context.Context, token, code, thumbprint string) (pair *TokenPair, err error) {
+	ctx, cancel := context.WithTimeout(pCtx, time.Minute)
+	defer cancel()
+
+	tok, err := a.pending.Decode(token)
+	if err == nil {
+		err = gwt.ValidateGWT(tok)
+	}
+	if err != nil {
+		return nil, TwoFactorTokenError
+	}
+	pending := tok.Body
+
+	defer func() {
+		if err != nil {
+			a.recordFailure(ctx, entities.ActivityTwoFactor, pending.IdentityID, pending.Recipient, err)
+		}
+	}()
+
+	// A token stolen from a bound login is no use without the key.
+	if pending.Thumbprint != thumbprint {
+		return nil, TwoFactorTokenError
+	}
+
+	if err = a.checkLockout(twoFactorKey(pending.IdentityID)); err != nil {
+		return nil, err
+	}
+
+	if isTOTPCode(code) {
+		err = a.Provider.TwoFactorService.Verify(ctx, pending.IdentityID, code, a.now())
+	} else if err = a.Provider.TwoFactorService.Recover(ctx, pending.IdentityID, code); err == nil {
+		a.Logger.WARN("recovery code used to log in", pending.Recipient)
+	}
+	if err != nil {
+		a.Logger.WARN("second factor rejected", pending.Recipient)
+		return nil, a.failLogin(twoFactorKey(pending.IdentityID), err)
+	}
+	a.logins.Reset(twoFactorKey(pending.IdentityID))
+
+	identity, err := a.Provider.IdentityService.FetchIdentity(ctx, pending.IdentityID)
+	if err != nil {
+		return nil, err
+	}
+
+	return a.startSession(ctx, identity, pending.Recipient, pending.Thumbprint)
+}
+
+// EnrollTwoFactor starts over the TOTP enrollment of identityID. It guards logins once ConfirmTwoFactor.
+func (a *Authentity) EnrollTwoFactor(ctx context.Context, identityID string) (*models.TwoFactorEnrollment, error) {
+	identity, err := a.Provider.IdentityService.FetchIdentity(ctx, identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	secret, err := a.Provider.TwoFactorService.Enroll(ctx, identityID)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.TwoFactorEnrollment{
+		Secret: secret,
+		URI:    services.TOTPURI(string(a.issuer), identity.Account.Username, secret),
+	}, nil
+}
+
+// ConfirmTwoFactor enables two factor authentication of identityID with the first code of its
+// authenticator app, and returns the recovery codes. They are never shown again.
+func (a *Authentity) ConfirmTwoFactor(ctx context.Context, identityID, code string) ([]string, error) {
+	return a.Provider.TwoFactorService.Confirm(ctx, identityID, code, a.now())
+}
+
+func (a *Authentity) now() time.Time {
+	return a.clock()
+}
+
+func isTOTPCode(code string) bool {
+	if len(code) != services.TOTPDigits {
+		return false
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Handlers
+// ----------------------------------------------------------------------------------------------------
+
+//go:embed tmpl/two_factor.gohtml
+var twoFactorPage string
+
+var twoFactorTmpl = template.Must(template.New("two_factor").Parse(twoFactorPage))
+
+// TwoFactorLoginHandler takes the second factor of a login. GET serves the page browsers enter it on,
+// POST takes a models.TwoFactorRequest as JSON, or that page's form with the token in its cookie.
+func TwoFactorLoginHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			getTwoFactorLogin(service, w, r)
+		case http.MethodPost:
+			postTwoFactorLogin(service, w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func getTwoFactorLogin(service *Authentity, w http.ResponseWriter, r *http.Request) {
+	action := TwoFactorLoginPath
+	if next := localRedirect(r.URL.Query().Get("next")); next != "" {
+		action += "?next=" + url.QueryEscape(next)
+	}
+
+	page := new(bytes.Buffer)
+	if err := twoFactorTmpl.Execute(page, map[string]any{"Action": action}); err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("X-Frame-Options", "DENY")
+	_, _ = w.Write(page.Bytes())
+}
+
+func postTwoFactorLogin(service *Authentity, w http.ResponseWriter, r *http.Request) {
+	var req models.TwoFactorRequest
+
+	form := !strings.HasPrefix(r.Header.Get("Content-Type"), "application/json")
+	if form {
+		if err := r.ParseForm(); err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+		req.Code = r.PostForm.Get("code")
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	if req.Token == "" {
+		if c, err := r.Cookie(CookieTwoFactorName); err == nil {
+			req.Token = c.Value
+		}
+	}
+
+	thumbprint, err := requestThumbprint(service, r)
+	if err != nil {
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusUnauthorized)
+		return
+	}
+
+	pair, err := service.LoginTwoFactor(service.withClient(r), req.Token, req.Code, thumbprint)
+	var lockout *LockoutError
+	switch {
+	case errors.As(err, &lockout):
+		internal.TooManyRequests(w, lockout.RetryAfter)
+		return
+	case errors.Is(err, TwoFactorTokenError), errors.Is(err, services.ErrTwoFactorCode),
+		errors.Is(err, services.ErrTwoFactorNotEnrolled):
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusUnauthorized)
+		return
+	case err != nil:
+		http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	http.SetCookie(w, twoFactorCookie(r, "", -time.Second))
+	setSessionCookies(w, pair)
+
+	if next := localRedirect(r.URL.Query().Get("next")); next != "" {
+		http.Redirect(w, r, next, http.StatusSeeOther)
+	} else if form {
+		http.Redirect(w, r, service.socialRedirect, http.StatusSeeOther)
+	}
+
+	service.Logger.INFO(string(pair.Access.Header.Recipient) + " has logged in with a second factor")
+}
+
+// writeTwoFactorRequired answers a login that needs a second factor with the pending token, both as a
+// models.TwoFactorChallenge and in a cookie for the page of TwoFactorLoginHandler.
+func writeTwoFactorRequired(w http.ResponseWriter, r *http.Request, pending *TwoFactorRequiredError) {
+	http.SetCookie(w, twoFactorCookie(r, pending.Token, TwoFactorPendingExpireTime))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(models.TwoFactorChallenge{Token: pending.Token, Expires: pending.Expires})
+}
+
+func twoFactorCookie(r *http.Request, value string, maxAge time.Duration) *http.Cookie {
+	return &http.Cookie{
+		Name:     CookieTwoFactorName,
+		Value:    value,
+		Path:     TwoFactorLoginPath,
+		MaxAge:   int(maxAge.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode, // set on the redirect back from social logins
+	}
+}
+
+// TwoFactorEnrollHandler starts the enrollment of the session's identity and responds with a
+// models.TwoFactorEnrollment for its authenticator app.
+func TwoFactorEnrollHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		identityID, ok := service.sessionIdentity(r)
+		if !ok {
+			http.Error(w, "session required", http.StatusUnauthorized)
+			return
+		}
+
+		enrollment, err := service.EnrollTwoFactor(r.Context(), identityID)
+		if errors.Is(err, services.ErrTwoFactorEnabled) {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(enrollment)
+	}
+}
+
+// TwoFactorConfirmHandler enables the enrollment of the session's identity with the models.TwoFactorRequest
+// code, and responds with its models.RecoveryCodes.
+func TwoFactorConfirmHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		identityID, ok := service.sessionIdentity(r)
+		if !ok {
+			http.Error(w, "session required", http.StatusUnauthorized)
+			return
+		}
+
+		var req models.TwoFactorRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		codes, err := service.ConfirmTwoFactor(r.Context(), identityID, req.Code)
+		switch {
+		case errors.Is(err, services.ErrTwoFactorCode):
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusUnauthorized)
+			return
+		case errors.Is(err, services.ErrTwoFactorEnabled), errors.Is(err, services.ErrTwoFactorNotEnrolled):
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusConflict)
+			return
+		case err != nil:
+			http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		service.Logger.INFO("two factor authentication enabled", identityID)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Cache-Control", "no-store")
+		_ = json.NewEncoder(w).Encode(models.RecoveryCodes{Codes: codes})
+	}
+}
+
+// TwoFactorAdminHandler lets administrators look up, GET, or reset, DELETE, the two factor authentication
+// of the identity in the identity_id query parameter, e.g. for a user who lost their device.
+func TwoFactorAdminHandler(service *Authentity) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identityID := r.URL.Query().Get("identity_id")
+		if identityID == "" {
+			http.Error(w, "identity_id is required", http.StatusBadRequest)
+			return
+		}
+
+		switch r.Method {
+		case http.MethodGet:
+			status, err := service.Provider.TwoFactorService.Status(r.Context(), identityID)
+			if err != nil {
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+				return
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			_ = json.NewEncoder(w).Encode(status)
+		case http.MethodDelete:
+			if err := service.Provider.TwoFactorService.Reset(r.Context(), identityID); err != nil {
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+				return
+			}
+
+			// Whoever took the second factor over may hold sessions, the user logs in again.
+			if err := service.revokeIdentitySessions(r.Context(), identityID); err != nil {
+				http.Error(w, service.Logger.ERROR(err.Error()), http.StatusInternalServerError)
+				return
+			}
+
+			service.Logger.WARN("two factor authentication reset by an administrator, ending every session", identityID)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
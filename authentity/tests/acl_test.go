@@ -0,0 +1,124 @@
+package tests
+
+import (
+	"context"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResourceACLMiddleware(t *testing.T) {
+	ctx := context.Background()
+	acc := models.Account{Username: "acl-editor", Email: "acl-editor@elder1s.com", Password: "MrN00dle$123"}
+	prof := TestProfile
+
+	if err := Auth.RegisterIdentity(ctx, &prof, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := Auth.LoginManual(ctx, acc.Username, acc.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityID := uid.UID(pair.Access.Body.UserID)
+
+	grant := func(resID []byte) {
+		err := Auth.Provider.ResourcesService.GrantResource(ctx, identityID, gwt.Resource{
+			ResID: resID,
+			Type:  gwt.DataManagement,
+			Roles: []gwt.Role{{Type: gwt.User, Permissions: gwt.Edit}},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	login := func() string {
+		pair, err := Auth.LoginManual(ctx, acc.Username, acc.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return pair.Access.Token
+	}
+
+	handler := Auth.ACLMiddleware(gwt.DataManagement, gwt.Edit, src.FromPath("/documents/"),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(token, path string) int {
+		r := httptest.NewRequest(http.MethodPut, path, nil)
+		r.AddCookie(&http.Cookie{Name: src.CookieTokenName, Value: token})
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	grant([]byte("doc-1"))
+	token := login()
+
+	if code := serve(token, "/documents/doc-1"); code != http.StatusOK {
+		t.Errorf("granted document: expected %d, got %d", http.StatusOK, code)
+	}
+	if code := serve(token, "/documents/doc-2"); code != http.StatusForbidden {
+		t.Errorf("other document: expected %d, got %d", http.StatusForbidden, code)
+	}
+	if code := serve(token, "/documents/"); code != http.StatusBadRequest {
+		t.Errorf("missing id: expected %d, got %d", http.StatusBadRequest, code)
+	}
+
+	// A type-level grant covers every document.
+	grant(gwt.AnyResourceID)
+	token = login()
+
+	if code := serve(token, "/documents/doc-2"); code != http.StatusOK {
+		t.Errorf("type-level grant: expected %d, got %d", http.StatusOK, code)
+	}
+
+	decision, err := Auth.CheckResourceAccess(ctx, identityID, gwt.DataManagement, "doc-3", gwt.Delete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decision.Allowed {
+		t.Errorf("delete granted without a grant: %s", decision)
+	}
+
+	// Without a type the type-level grant above would hold on resources of every type.
+	if decision, err = Auth.CheckResourceAccess(ctx, identityID, "", "doc-2", gwt.Edit); err == nil || decision.Allowed {
+		t.Errorf("empty resource type was checked: %s %v", decision, err)
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("middleware built for an empty resource type")
+			}
+		}()
+		src.ResourceACLMiddleware(Auth, "", gwt.Edit, src.FromPath("/documents/"))
+	}()
+}
+
+func TestResourceIDResolvers(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/documents/doc-1/edit?doc=doc-2", nil)
+	r.Header.Set("X-Resource-ID", "doc-3")
+
+	tests := []struct {
+		resolve src.ResourceIDResolver
+		want    string
+	}{
+		{src.FromPath("/documents/"), "doc-1"},
+		{src.FromQuery("doc"), "doc-2"},
+		{src.FromHeader("X-Resource-ID"), "doc-3"},
+		{src.FirstResourceID(src.FromQuery("missing"), src.FromHeader("X-Resource-ID")), "doc-3"},
+	}
+
+	for _, tt := range tests {
+		if got, ok := tt.resolve(r); !ok || got != tt.want {
+			t.Errorf("expected %s, got %s", tt.want, got)
+		}
+	}
+
+	if _, ok := src.FromPath("/reports/")(r); ok {
+		t.Error("resolved an id from a path outside the prefix")
+	}
+}
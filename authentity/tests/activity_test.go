@@ -0,0 +1,244 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/entities"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"github.com/vaiktorg/grimoire/log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// warnLog keeps the warnings logged, passing everything on to Logger.
+type warnLog struct {
+	log.ILogger
+
+	mu    sync.Mutex
+	warns []string
+}
+
+func (l *warnLog) WARN(warn string, obj ...any) {
+	l.mu.Lock()
+	l.warns = append(l.warns, warn)
+	l.mu.Unlock()
+
+	l.ILogger.WARN(warn, obj...)
+}
+
+func (l *warnLog) logged(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, w := range l.warns {
+		if strings.Contains(w, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+type fakeGeo map[string]services.Location
+
+func (g fakeGeo) Locate(ip string) (services.Location, bool) {
+	loc, ok := g[ip]
+	return loc, ok
+}
+
+const firefox = "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0"
+
+func TestActivity(t *testing.T) {
+	var (
+		newYork    = services.Location{Country: "US", Latitude: 40.71, Longitude: -74.01}
+		newYork2   = services.Location{Country: "US", Latitude: 40.73, Longitude: -73.99}
+		tokyo      = services.Location{Country: "JP", Latitude: 35.68, Longitude: 139.69}
+		losAngeles = services.Location{Country: "US", Latitude: 34.05, Longitude: -118.24}
+	)
+
+	clock := &fakeClock{t: time.Now()}
+	logger := &warnLog{ILogger: Logger}
+	auth := newTestAuthentity(t, "activity", &src.Config{
+		Logger: logger,
+		Clock:  clock.Now,
+		GeoIP: fakeGeo{
+			"198.51.100.7": newYork,
+			"198.51.100.9": newYork2,
+			"203.0.113.5":  tokyo,
+			"192.0.2.1":    losAngeles,
+		},
+	})
+
+	ctx := context.Background()
+	acc := registerTestAccount(t, auth, "active")
+	identity, err := auth.Provider.IdentityService.FetchIdentityByUsername(ctx, acc.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// serve makes a request from ip, a second after the one before, so the log has an order.
+	serve := func(method, target, ip, body string, cookies ...*http.Cookie) *httptest.ResponseRecorder {
+		clock.t = clock.t.Add(time.Second)
+
+		r := httptest.NewRequest(method, target, strings.NewReader(body))
+		r.RemoteAddr = ip + ":4321"
+		r.Header.Set("User-Agent", firefox)
+		for _, c := range cookies {
+			r.AddCookie(c)
+		}
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, r)
+		return w
+	}
+	login := func(ip, identifier, password string) *httptest.ResponseRecorder {
+		return serve(http.MethodPost, "/login", ip, `{"Username":"`+identifier+`","Password":"`+password+`"}`)
+	}
+	latest := func(t *testing.T) *models.Activity {
+		t.Helper()
+
+		page, err := auth.Provider.ActivityService.Page(ctx, identity.ID, 1, 1)
+		if err != nil || len(page.Activity) != 1 {
+			t.Fatalf("no activity: %v", err)
+		}
+		return page.Activity[0]
+	}
+
+	var session []*http.Cookie
+
+	t.Run("RecordsSessions", func(t *testing.T) {
+		if w := login("198.51.100.7", acc.Username, acc.Password); w.Code != http.StatusOK {
+			t.Fatalf("login: expected %d, got %d", http.StatusOK, w.Code)
+		}
+		if w := login("198.51.100.7", acc.Email, "wrong"); w.Code == http.StatusOK {
+			t.Fatal("login with the wrong password")
+		}
+		login("198.51.100.7", "ghost", "wrong")
+
+		failed := latest(t)
+		w := login("198.51.100.7", acc.Username, acc.Password)
+		session = w.Result().Cookies()
+
+		if w = serve(http.MethodPost, "/refresh", "198.51.100.7", "", session...); w.Code != http.StatusOK {
+			t.Fatalf("refresh: expected %d, got %d", http.StatusOK, w.Code)
+		}
+		session = w.Result().Cookies()
+
+		w = serve(http.MethodGet, src.ActivityPath, "198.51.100.7", "", session...)
+		var page models.ActivityPage
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&page) != nil {
+			t.Fatalf("activity: expected %d, got %d", http.StatusOK, w.Code)
+		}
+
+		want := []struct{ event, outcome, identifier string }{
+			{entities.ActivityRefresh, entities.OutcomeSuccess, acc.Username},
+			{entities.ActivityLogin, entities.OutcomeSuccess, acc.Username},
+			{entities.ActivityLogin, entities.OutcomeFailure, acc.Email},
+			{entities.ActivityLogin, entities.OutcomeSuccess, acc.Username},
+		}
+		if page.Total != int64(len(want)) || len(page.Activity) != len(want) {
+			t.Fatalf("expected %d entries, got %d of %d", len(want), len(page.Activity), page.Total)
+		}
+		for i, a := range page.Activity {
+			if a.Event != want[i].event || a.Outcome != want[i].outcome || a.Identifier != want[i].identifier {
+				t.Errorf("entry %d: expected %+v, got %+v", i, want[i], a)
+			}
+			if a.IdentityID != identity.ID || a.IPAddress != "198.51.100.7" || a.Country != "US" ||
+				a.Device != "Firefox on Windows" || a.UserAgent != firefox || a.Anomalies != "" {
+				t.Errorf("entry %d: unexpected %+v", i, a)
+			}
+		}
+		if failed.Reason == "" {
+			t.Error("failed login recorded without a reason")
+		}
+	})
+
+	t.Run("Paginates", func(t *testing.T) {
+		w := serve(http.MethodGet, src.ActivityPath+"?page=2&amount=3", "198.51.100.7", "", session...)
+		var page models.ActivityPage
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&page) != nil {
+			t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+		}
+		if page.Page != 2 || page.Amount != 3 || page.Total != 4 || len(page.Activity) != 1 ||
+			page.Activity[0].Outcome != entities.OutcomeSuccess || page.Activity[0].Event != entities.ActivityLogin {
+			t.Errorf("unexpected page %+v", page)
+		}
+
+		for _, query := range []string{"?amount=0", "?page=-1", "?page=one"} {
+			if w = serve(http.MethodGet, src.ActivityPath+query, "198.51.100.7", "", session...); w.Code != http.StatusBadRequest {
+				t.Errorf("%s: expected %d, got %d", query, http.StatusBadRequest, w.Code)
+			}
+		}
+	})
+
+	t.Run("Admin", func(t *testing.T) {
+		list := func(query string) models.ActivityPage {
+			w := httptest.NewRecorder()
+			src.ActivityAdminHandler(auth)(w, httptest.NewRequest(http.MethodGet, src.ActivityAdminPath+query, nil))
+
+			var page models.ActivityPage
+			if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&page) != nil {
+				t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+			}
+			return page
+		}
+
+		if page := list("?identity_id=" + url.QueryEscape(identity.ID)); page.Total != 4 {
+			t.Errorf("expected 4 entries of the identity, got %d", page.Total)
+		}
+
+		ghost := false
+		for _, a := range list("?amount=100").Activity {
+			ghost = ghost || (a.Identifier == "ghost" && a.IdentityID == "" && a.Outcome == entities.OutcomeFailure)
+		}
+		if !ghost {
+			t.Error("failed login of an unknown identifier missing")
+		}
+
+		if w := serve(http.MethodGet, src.ActivityAdminPath, "198.51.100.7", "", session...); w.Code != http.StatusForbidden {
+			t.Errorf("as a user: expected %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	t.Run("RecordsLogouts", func(t *testing.T) {
+		if w := serve(http.MethodPost, "/logout", "198.51.100.7", "", session...); w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+		}
+
+		if a := latest(t); a.Event != entities.ActivityLogout || a.IPAddress != "198.51.100.7" {
+			t.Errorf("expected a logout, got %+v", a)
+		}
+	})
+
+	t.Run("DetectsAnomalies", func(t *testing.T) {
+		for _, step := range []struct {
+			name      string
+			after     time.Duration
+			ip        string
+			anomalies string
+		}{
+			{"SameRange", time.Hour, "198.51.100.9", ""},
+			{"ImpossibleTravel", time.Minute, "203.0.113.5", services.AnomalyNewCountry + "," + services.AnomalyImpossibleTravel},
+			{"NewRange", 24 * time.Hour, "192.0.2.1", services.AnomalyNewIPRange},
+		} {
+			clock.t = clock.t.Add(step.after)
+			if w := login(step.ip, acc.Username, acc.Password); w.Code != http.StatusOK {
+				t.Fatalf("%s: expected %d, got %d", step.name, http.StatusOK, w.Code)
+			}
+
+			if a := latest(t); a.Anomalies != step.anomalies {
+				t.Errorf("%s: expected anomalies %q, got %q", step.name, step.anomalies, a.Anomalies)
+			}
+		}
+
+		if !logger.logged(services.AnomalyImpossibleTravel) || !logger.logged(services.AnomalyNewIPRange) {
+			t.Error("anomalies not warned about")
+		}
+	})
+}
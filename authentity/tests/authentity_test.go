@@ -2,15 +2,23 @@ package tests
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/vaiktorg/grimoire/authentity/src"
 	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
 	"github.com/vaiktorg/grimoire/gwt"
 	"github.com/vaiktorg/grimoire/log"
 	"github.com/vaiktorg/grimoire/names"
 	"github.com/vaiktorg/grimoire/uid"
 	"os"
 	"testing"
+	"time"
+)
+
+const (
+	IntrospectionClient = "resource-server"
+	IntrospectionSecret = "r3source-$ecret"
 )
 
 var (
@@ -23,6 +31,12 @@ var (
 			Pepper: []byte(uid.New()),
 		},
 		Logger: Logger,
+
+		IntrospectionClients: map[string]string{IntrospectionClient: IntrospectionSecret},
+		Scopes: []src.Scope{
+			{Name: "data:read", Description: "Read your data", ResourceType: gwt.DataManagement, Role: gwt.DefaultRoles[gwt.User]},
+			{Name: "data:edit", Description: "Edit your data", ResourceType: gwt.DataManagement, Role: gwt.DefaultRoles[gwt.Mod]},
+		},
 	})
 	TestProfile = models.Profile{
 		FirstName:   "John",
@@ -53,11 +67,50 @@ func TestMain(m *testing.M) {
 		panic("auth is nil")
 	}
 
-	if _, err := os.Stat(ServerName); os.IsNotExist(err) {
+	if _, err := os.Stat(ServerName + ".db"); os.IsNotExist(err) {
 		panic("sql db not created")
 	}
 
-	m.Run()
+	// Nothing reads the logs, drain them so logging never blocks once the output buffer is full.
+	go Logger.Output(func(log.Log) error { return nil })
+
+	code := m.Run()
+	_ = os.Remove(ServerName + ".db")
+	os.Exit(code)
+}
+
+// fakeClock is an injectable clock the test moves by hand.
+type fakeClock struct{ t time.Time }
+
+func (c *fakeClock) Now() time.Time { return c.t }
+
+// newTestAuthentity starts an Authentity of t's own on cfg. Its issuer is name and a random suffix,
+// it logs to Logger unless cfg has a logger, and its database is removed once t is done.
+func newTestAuthentity(t *testing.T, name string, cfg *src.Config) *src.Authentity {
+	t.Helper()
+
+	cfg.Issuer = name + "_" + string(uid.New())
+	if cfg.Logger == nil {
+		cfg.Logger = Logger
+	}
+
+	auth := src.NewAuthentity(cfg)
+	t.Cleanup(func() { _ = os.Remove(cfg.Issuer + ".db") })
+	return auth
+}
+
+// registerTestAccount registers username with auth, on TestProfile and an email of its own,
+// and returns the account with its password.
+func registerTestAccount(t *testing.T, auth *src.Authentity, username string) models.Account {
+	t.Helper()
+
+	acc := models.Account{Username: username, Email: username + "@elder1s.com", Password: "MrN00dle$123"}
+	prof := TestProfile
+	if err := auth.RegisterIdentity(context.Background(), &prof, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	return acc
 }
 
 func TestAuthentityHappyPath(t *testing.T) {
@@ -84,7 +137,7 @@ func TestAuthentityHappyPath(t *testing.T) {
 			t.FailNow()
 		}
 
-		Token.Token = tkn.Token
+		Token.Token = tkn.Access.Token
 		fmt.Println(Token)
 	})
 
@@ -103,4 +156,71 @@ func TestAuthentityHappyPath(t *testing.T) {
 			t.FailNow()
 		}
 	})
+
+	t.Run("TestLoginTokenAfterLogout", func(t *testing.T) {
+		err := Auth.LoginToken(Token.Token)
+		if err == nil {
+			t.Error("token still valid after logout")
+			t.FailNow()
+		}
+	})
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	pair, err := Auth.LoginManual(context.Background(), TestAccount.Username, TestAccount.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotated, err := Auth.RefreshToken(context.Background(), pair.Refresh.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if rotated.Refresh.Token == pair.Refresh.Token {
+		t.Error("refresh token was not rotated")
+	}
+	if rotated.Refresh.Family != pair.Refresh.Family {
+		t.Error("rotated refresh token left its family")
+	}
+	if err = Auth.LoginToken(rotated.Access.Token); err != nil {
+		t.Error(err)
+	}
+
+	// Spending the old refresh token again must kill the whole family.
+	if _, err = Auth.RefreshToken(context.Background(), pair.Refresh.Token); !errors.Is(err, services.ErrRefreshReuse) {
+		t.Fatalf("expected reuse detection, got %v", err)
+	}
+
+	if _, err = Auth.RefreshToken(context.Background(), rotated.Refresh.Token); err == nil {
+		t.Error("refresh token of a revoked family was accepted")
+	}
+	if err = Auth.LoginToken(rotated.Access.Token); err == nil {
+		t.Error("access token of a revoked family is still valid")
+	}
+}
+
+func TestResourcesFromEntity(t *testing.T) {
+	res := gwt.Resources{
+		UserID:    []byte(uid.New()),
+		Resources: []*gwt.Resource{{ResID: []byte(uid.New()), Type: gwt.DataManagement, Roles: []gwt.Role{gwt.DefaultRoles[gwt.User]}}},
+	}
+
+	encoded, err := services.ResourcesToEntity(&res)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Identities stored before the base64 encoding hold the serialized resources as is.
+	data, _ := res.Serialize()
+	raw := string(data)
+	for name, stored := range map[string]*string{"Encoded": encoded, "Raw": &raw} {
+		decoded, err := services.ResourcesFromEntity(stored)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if string(decoded.UserID) != string(res.UserID) || !decoded.HasAccess(gwt.DataManagement, gwt.DefaultRoles[gwt.User]) {
+			t.Errorf("%s: resources changed: %+v", name, decoded)
+		}
+	}
 }
@@ -0,0 +1,56 @@
+package tests
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/gwt/vhash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCardHandler(t *testing.T) {
+	ctx := context.Background()
+	acc := models.Account{Username: "card-holder", Email: "card-holder@elder1s.com", Password: "MrN00dle$123"}
+	prof := TestProfile
+
+	if err := Auth.RegisterIdentity(ctx, &prof, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := Auth.LoginManual(ctx, acc.Username, acc.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/account/card", nil)
+	r.AddCookie(&http.Cookie{Name: src.CookieTokenName, Value: pair.Access.Token})
+
+	w := httptest.NewRecorder()
+	src.TokenMiddleware(Auth, src.CardHandler(Auth)).ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected %d, got %d %s", http.StatusOK, w.Code, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "image/png" {
+		t.Errorf("unexpected content type %q", ct)
+	}
+
+	key, err := hex.DecodeString(w.Header().Get(src.CardKeyHeader))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hash, err := vhash.ReadTokenCard(w.Body, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tok := pair.Access.Token
+	signature, _ := base64.URLEncoding.DecodeString(tok[strings.LastIndex(tok, ".")+1:])
+	if string(hash) != hex.EncodeToString(signature) {
+		t.Error("card does not hold the access token's signature")
+	}
+}
@@ -0,0 +1,131 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/gwt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestIntrospection(t *testing.T) {
+	ctx := context.Background()
+	acc := models.Account{Username: "introspected", Email: "introspected@elder1s.com", Password: "MrN00dle$123"}
+	prof := TestProfile
+
+	if err := Auth.RegisterIdentity(ctx, &prof, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := Auth.LoginManual(ctx, acc.Username, acc.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	introspect := func(token, client, secret string) (int, models.Introspection) {
+		form := url.Values{"token": {token}}
+		r := httptest.NewRequest(http.MethodPost, src.IntrospectionPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if client != "" {
+			r.SetBasicAuth(client, secret)
+		}
+
+		w := httptest.NewRecorder()
+		src.IntrospectHandler(Auth)(w, r)
+
+		var resp models.Introspection
+		if w.Code == http.StatusOK {
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return w.Code, resp
+	}
+
+	code, resp := introspect(pair.Access.Token, IntrospectionClient, IntrospectionSecret)
+	if code != http.StatusOK || !resp.Active {
+		t.Fatalf("expected an active token, got %d %+v", code, resp)
+	}
+	if resp.Sub != acc.Username || resp.Jti != pair.Access.Header.ID || resp.Exp != pair.Access.Header.Expires.Unix() {
+		t.Errorf("unexpected claims %+v", resp)
+	}
+	if resp.UserID != string(pair.Access.Body.UserID) || len(resp.Resources) != len(pair.Access.Body.Resources) {
+		t.Errorf("resources did not come through: %+v", resp.Resources)
+	}
+
+	if code, _ = introspect(pair.Access.Token, "", ""); code != http.StatusUnauthorized {
+		t.Errorf("anonymous caller: expected %d, got %d", http.StatusUnauthorized, code)
+	}
+	if code, _ = introspect(pair.Access.Token, IntrospectionClient, "guess"); code != http.StatusUnauthorized {
+		t.Errorf("wrong secret: expected %d, got %d", http.StatusUnauthorized, code)
+	}
+
+	// Garbage and revoked tokens are inactive, and nothing else is said about them.
+	if _, resp = introspect("not.a.token", IntrospectionClient, IntrospectionSecret); resp.Active || resp.Sub != "" {
+		t.Errorf("garbage token: %+v", resp)
+	}
+	if err = Auth.RevokeToken(pair.Access.Header.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, resp = introspect(pair.Access.Token, IntrospectionClient, IntrospectionSecret); resp.Active {
+		t.Error("revoked token is still active")
+	}
+}
+
+func TestDiscovery(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "http://auth.example.com"+src.DiscoveryPath, nil)
+	w := httptest.NewRecorder()
+	src.DiscoveryHandler(Auth)(w, r)
+
+	var doc models.Discovery
+	if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.Issuer != ServerName || doc.JWKSURI != "http://auth.example.com"+src.JWKSPath || doc.IntrospectionEndpoint != "http://auth.example.com"+src.IntrospectionPath {
+		t.Errorf("unexpected discovery document %+v", doc)
+	}
+	if doc.AuthorizationEndpoint != "http://auth.example.com"+src.AuthorizePath || doc.TokenEndpoint != "http://auth.example.com"+src.TokenPath {
+		t.Errorf("authorization server endpoints missing: %+v", doc)
+	}
+	if len(doc.ScopesSupported) != 2 || len(doc.CodeChallengeMethodsSupported) != 1 || doc.CodeChallengeMethodsSupported[0] != "S256" {
+		t.Errorf("unexpected authorization server capabilities %+v", doc)
+	}
+	if cc := w.Header().Get("Cache-Control"); strings.Contains(cc, "public") || w.Header().Get("Vary") != "Host" {
+		t.Errorf("document made for the Host header may be shared: %q", cc)
+	}
+
+	// The test instance signs with the shared HashKey, which is never published.
+	w = httptest.NewRecorder()
+	src.JWKSHandler(Auth)(w, httptest.NewRequest(http.MethodGet, src.JWKSPath, nil))
+
+	var set gwt.JWKS
+	if err := json.NewDecoder(w.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+	if set.Keys == nil || len(set.Keys) != 0 || len(doc.TokenSigningAlgValuesSupported) != 0 {
+		t.Errorf("HS512 keys were published: %+v %v", set, doc.TokenSigningAlgValuesSupported)
+	}
+
+	t.Run("OnThePublicURL", func(t *testing.T) {
+		auth := newTestAuthentity(t, "discovery", &src.Config{PublicURL: "https://auth.example.com/"})
+
+		w := httptest.NewRecorder()
+		src.DiscoveryHandler(auth)(w, httptest.NewRequest(http.MethodGet, "http://evil.example.com"+src.DiscoveryPath, nil))
+
+		var doc models.Discovery
+		if err := json.NewDecoder(w.Body).Decode(&doc); err != nil {
+			t.Fatal(err)
+		}
+		if doc.TokenEndpoint != "https://auth.example.com"+src.TokenPath || doc.JWKSURI != "https://auth.example.com"+src.JWKSPath {
+			t.Errorf("endpoints follow the Host header: %+v", doc)
+		}
+		if !strings.Contains(w.Header().Get("Cache-Control"), "public") {
+			t.Errorf("expected a public document, got %q", w.Header().Get("Cache-Control"))
+		}
+	})
+}
@@ -0,0 +1,312 @@
+package tests
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeSMTP accepts a single mail on a local port and hands over what it was sent.
+func fakeSMTP(t *testing.T) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = l.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		reply := func(s string) {
+			_, _ = rw.WriteString(s + "\r\n")
+			_ = rw.Flush()
+		}
+
+		var transcript strings.Builder
+		reply("220 localhost ESMTP")
+		for {
+			line, err := rw.ReadString('\n')
+			if err != nil {
+				return
+			}
+
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"):
+				reply("250-localhost\r\n250 8BITMIME")
+			case strings.HasPrefix(cmd, "DATA"):
+				reply("354 go ahead")
+				for {
+					line, err = rw.ReadString('\n')
+					if err != nil || line == ".\r\n" {
+						break
+					}
+					transcript.WriteString(line)
+				}
+				reply("250 queued")
+			case strings.HasPrefix(cmd, "QUIT"):
+				reply("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				transcript.WriteString(line)
+				reply("250 OK")
+			}
+		}
+	}()
+
+	return l.Addr().String(), received
+}
+
+func TestSMTPMailer(t *testing.T) {
+	addr, received := fakeSMTP(t)
+
+	mailer := services.NewSMTPMailer(addr, "authentity@example.com", nil)
+	err := mailer.Send(context.Background(), services.Mail{To: "user@example.com", Subject: "Hi", Body: "line one\nline two"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case got := <-received:
+		for _, want := range []string{"MAIL FROM:<authentity@example.com>", "RCPT TO:<user@example.com>", "Subject: Hi\r\n", "line one\r\nline two"} {
+			if !strings.Contains(got, want) {
+				t.Errorf("%q missing from %q", want, got)
+			}
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no mail received")
+	}
+
+	err = mailer.Send(context.Background(), services.Mail{To: "user@example.com", Subject: "Hi\r\nBcc: everyone@example.com"})
+	if !errors.Is(err, services.ErrMailHeader) {
+		t.Errorf("header injection: expected %v, got %v", services.ErrMailHeader, err)
+	}
+}
+
+var mailedLink = regexp.MustCompile(`https://auth\.example\.com(/[\w-]+)\?token=(\S+)`)
+
+func TestEmailFlows(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	mailer := services.NewMemoryMailer()
+	auth := newTestAuthentity(t, "mail", &src.Config{
+		Clock: clock.Now,
+
+		Mailer:               mailer,
+		PublicURL:            "https://auth.example.com/",
+		RequireVerifiedEmail: true,
+	})
+
+	ctx := context.Background()
+	acc := models.Account{Username: "mailed", Email: "mailed@elder1s.com", Password: "MrN00dle$123"}
+
+	link := func(t *testing.T, path string) string {
+		t.Helper()
+
+		mail, ok := mailer.Last(acc.Email)
+		m := mailedLink.FindStringSubmatch(mail.Body)
+		if !ok || m == nil || m[1] != path {
+			t.Fatalf("no %s link mailed: %+v", path, mail)
+		}
+		token, err := url.QueryUnescape(m[2])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	verify := func(token string) int {
+		w := httptest.NewRecorder()
+		src.VerifyEmailHandler(auth)(w, httptest.NewRequest(http.MethodGet, src.VerifyEmailPath+"?token="+url.QueryEscape(token), nil))
+		return w.Code
+	}
+
+	t.Run("VerifiesEmails", func(t *testing.T) {
+		body, _ := json.Marshal(models.RegisterRequest{Account: acc, Profile: TestProfile})
+		w := httptest.NewRecorder()
+		src.RegisterHandler(auth)(w, httptest.NewRequest(http.MethodPost, "/register", strings.NewReader(string(body))))
+		if w.Code != http.StatusOK {
+			t.Fatalf("register: expected %d, got %d %s", http.StatusOK, w.Code, w.Body.String())
+		}
+
+		token := link(t, src.VerifyEmailPath)
+		if _, err := auth.LoginManual(ctx, acc.Username, acc.Password); !errors.Is(err, src.UnverifiedAccountError) {
+			t.Errorf("unverified login: expected %v, got %v", src.UnverifiedAccountError, err)
+		}
+
+		w = httptest.NewRecorder()
+		src.LoginHandler(auth)(w, httptest.NewRequest(http.MethodPost, "/login",
+			strings.NewReader(`{"Username":"`+acc.Username+`","Password":"`+acc.Password+`"}`)))
+		if w.Code != http.StatusForbidden {
+			t.Errorf("unverified login handler: expected %d, got %d", http.StatusForbidden, w.Code)
+		}
+
+		if code := verify(token); code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, code)
+		}
+		if code := verify(token); code != http.StatusBadRequest {
+			t.Errorf("link used twice: expected %d, got %d", http.StatusBadRequest, code)
+		}
+
+		if _, err := auth.LoginManual(ctx, acc.Username, acc.Password); err != nil {
+			t.Errorf("verified login: %v", err)
+		}
+	})
+
+	t.Run("LinksExpire", func(t *testing.T) {
+		identity, err := auth.Provider.IdentityService.FetchIdentityByUsername(ctx, acc.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = auth.SendEmailVerification(ctx, identity.ID); err != nil {
+			t.Fatal(err)
+		}
+
+		token := link(t, src.VerifyEmailPath)
+		clock.t = clock.t.Add(src.EmailVerificationExpireTime + time.Minute)
+		if code := verify(token); code != http.StatusBadRequest {
+			t.Errorf("expired link: expected %d, got %d", http.StatusBadRequest, code)
+		}
+		clock.t = time.Now()
+
+		if _, err = auth.LoginManual(ctx, acc.Username, acc.Password); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("ResetsPasswords", func(t *testing.T) {
+		session, err := auth.LoginManual(ctx, acc.Username, acc.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		sent := len(mailer.Sent())
+		forgot := func(email string) {
+			before := len(mailer.Sent())
+
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPost, src.ForgotPasswordPath, strings.NewReader(`{"email":"`+email+`"}`))
+			r.Header.Set("Content-Type", "application/json")
+			src.ForgotPasswordHandler(auth)(w, r)
+			if w.Code != http.StatusAccepted {
+				t.Fatalf("expected %d, got %d", http.StatusAccepted, w.Code)
+			}
+
+			// Reset links are mailed off the request path.
+			for deadline := time.Now().Add(5 * time.Second); email == acc.Email && len(mailer.Sent()) == before; {
+				if time.Now().After(deadline) {
+					t.Fatal("reset link was never mailed")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+
+		forgot("nobody@elder1s.com")
+		if len(mailer.Sent()) != sent {
+			t.Error("reset mailed for an unknown email")
+		}
+
+		forgot(acc.Email)
+		stale := link(t, src.ResetPasswordPath)
+		forgot(acc.Email)
+		token := link(t, src.ResetPasswordPath)
+
+		w := httptest.NewRecorder()
+		src.ResetPasswordHandler(auth)(w, httptest.NewRequest(http.MethodGet, src.ResetPasswordPath+"?token="+url.QueryEscape(token), nil))
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `name="token"`) {
+			t.Fatalf("expected the reset form, got %d", w.Code)
+		}
+
+		reset := func(token, password string) int {
+			form := url.Values{"token": {token}, "password": {password}}
+			r := httptest.NewRequest(http.MethodPost, src.ResetPasswordPath, strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+			w := httptest.NewRecorder()
+			src.ResetPasswordHandler(auth)(w, r)
+			return w.Code
+		}
+
+		if code := reset(token, "N3w-Pa$$word"); code != http.StatusOK {
+			t.Fatalf("expected %d, got %d", http.StatusOK, code)
+		}
+		if code := reset(token, "An0ther-Pa$$word"); code != http.StatusBadRequest {
+			t.Errorf("link used twice: expected %d, got %d", http.StatusBadRequest, code)
+		}
+		if code := reset(stale, "An0ther-Pa$$word"); code != http.StatusBadRequest {
+			t.Errorf("link for the old password: expected %d, got %d", http.StatusBadRequest, code)
+		}
+
+		if _, err = auth.LoginManual(ctx, acc.Username, acc.Password); err == nil {
+			t.Error("old password still logs in")
+		}
+		if _, err = auth.LoginManual(ctx, acc.Username, "N3w-Pa$$word"); err != nil {
+			t.Errorf("new password: %v", err)
+		}
+
+		if err = auth.LoginToken(session.Access.Token); err == nil {
+			t.Error("session from before the reset is still valid")
+		}
+		if _, err = auth.RefreshToken(ctx, session.Refresh.Token); err == nil {
+			t.Error("refresh token from before the reset is still valid")
+		}
+	})
+
+	t.Run("ChangedEmailsNeedVerifying", func(t *testing.T) {
+		account, err := auth.Provider.AccountsService.FindAccountByUsername(ctx, acc.Username)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		account.Email = "moved@elder1s.com"
+		if err = auth.Provider.AccountsService.Updates(ctx, account); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err = auth.LoginManual(ctx, acc.Username, "N3w-Pa$$word"); !errors.Is(err, src.UnverifiedAccountError) {
+			t.Errorf("expected %v, got %v", src.UnverifiedAccountError, err)
+		}
+	})
+}
+
+// failingMailer fails every mail, like an unreachable relay.
+type failingMailer struct{}
+
+func (failingMailer) Send(context.Context, services.Mail) error {
+	return errors.New("relay unreachable")
+}
+
+func TestPasswordResetHidesAccounts(t *testing.T) {
+	auth := newTestAuthentity(t, "reset", &src.Config{
+		Mailer:    failingMailer{},
+		PublicURL: "https://auth.example.com/",
+	})
+	acc := registerTestAccount(t, auth, "reset-hidden")
+
+	// A known email whose mail fails is answered like an unknown one.
+	for _, email := range []string{acc.Email, "nobody@elder1s.com"} {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodPost, src.ForgotPasswordPath, strings.NewReader(`{"email":"`+email+`"}`))
+		r.Header.Set("Content-Type", "application/json")
+		src.ForgotPasswordHandler(auth)(w, r)
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%s: expected %d, got %d", email, http.StatusAccepted, w.Code)
+		}
+	}
+}
@@ -0,0 +1,469 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"golang.org/x/oauth2"
+	"html"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const appRedirectURI = "https://app.example.com/callback"
+
+var consentTicket = regexp.MustCompile(`name="consent" value="([^"]+)"`)
+
+// oauthApp plays a client of the authorization server, driving the user's browser with session.
+type oauthApp struct {
+	t       *testing.T
+	client  *models.OAuthClient
+	session *http.Cookie
+}
+
+// authorize starts the flow for scope and returns the authorization endpoint's response.
+func (a *oauthApp) authorize(scope, verifier string) *httptest.ResponseRecorder {
+	q := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {a.client.ID},
+		"redirect_uri":          {appRedirectURI},
+		"scope":                 {scope},
+		"state":                 {"xyz"},
+		"code_challenge":        {oauth2.S256ChallengeFromVerifier(verifier)},
+		"code_challenge_method": {"S256"},
+	}
+
+	r := httptest.NewRequest(http.MethodGet, src.AuthorizePath+"?"+q.Encode(), nil)
+	if a.session != nil {
+		r.AddCookie(a.session)
+	}
+	w := httptest.NewRecorder()
+	src.AuthorizeHandler(Auth)(w, r)
+	return w
+}
+
+// consent answers the consent screen w shows with decision, from session.
+func (a *oauthApp) consent(w *httptest.ResponseRecorder, decision string, session *http.Cookie) *httptest.ResponseRecorder {
+	a.t.Helper()
+
+	m := consentTicket.FindStringSubmatch(w.Body.String())
+	if w.Code != http.StatusOK || m == nil {
+		a.t.Fatalf("expected the consent screen, got %d %s", w.Code, w.Body.String())
+	}
+
+	form := url.Values{"consent": {html.UnescapeString(m[1])}, "decision": {decision}}
+	r := httptest.NewRequest(http.MethodPost, src.AuthorizePath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	r.AddCookie(session)
+
+	w = httptest.NewRecorder()
+	src.AuthorizeHandler(Auth)(w, r)
+	return w
+}
+
+// redirected returns the query the user was sent back to the app with.
+func (a *oauthApp) redirected(w *httptest.ResponseRecorder) url.Values {
+	a.t.Helper()
+
+	loc, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil || !strings.HasPrefix(loc.String(), appRedirectURI+"?") {
+		a.t.Fatalf("expected a redirect to the app, got %d %s", w.Code, w.Header().Get("Location"))
+	}
+	if loc.Query().Get("state") != "xyz" {
+		a.t.Errorf("state was not returned: %s", loc)
+	}
+	return loc.Query()
+}
+
+// token posts form to the token endpoint with the app's credentials.
+func (a *oauthApp) token(form url.Values) (int, models.OAuthToken, models.OAuthError) {
+	if a.client.Public {
+		form.Set("client_id", a.client.ID)
+	}
+
+	r := httptest.NewRequest(http.MethodPost, src.TokenPath, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if !a.client.Public {
+		r.SetBasicAuth(url.QueryEscape(a.client.ID), url.QueryEscape(a.client.Secret))
+	}
+	w := httptest.NewRecorder()
+	src.TokenHandler(Auth)(w, r)
+
+	var tok models.OAuthToken
+	var oErr models.OAuthError
+	if w.Code == http.StatusOK {
+		_ = json.NewDecoder(w.Body).Decode(&tok)
+	} else {
+		_ = json.NewDecoder(w.Body).Decode(&oErr)
+	}
+	if w.Header().Get("Cache-Control") != "no-store" {
+		a.t.Error("token response may be cached")
+	}
+	return w.Code, tok, oErr
+}
+
+// login runs the whole flow, consent already given, and returns the tokens.
+func (a *oauthApp) login(scope string) models.OAuthToken {
+	a.t.Helper()
+
+	verifier := oauth2.GenerateVerifier()
+	code := a.redirected(a.authorize(scope, verifier)).Get("code")
+
+	status, tok, oErr := a.token(url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {appRedirectURI},
+		"code_verifier": {verifier},
+	})
+	if status != http.StatusOK {
+		a.t.Fatalf("code exchange: expected %d, got %d %+v", http.StatusOK, status, oErr)
+	}
+	return tok
+}
+
+func TestAuthorizationServer(t *testing.T) {
+	ctx := context.Background()
+	acc := models.Account{Username: "oauth-user", Email: "oauth-user@elder1s.com", Password: "MrN00dle$123"}
+	prof := TestProfile
+	if err := Auth.RegisterIdentity(ctx, &prof, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	pair, err := Auth.LoginManual(ctx, acc.Username, acc.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityID := uid.UID(pair.Access.Body.UserID)
+
+	for _, res := range []gwt.Resource{
+		{ResID: []byte("doc-1"), Type: gwt.DataManagement, Roles: []gwt.Role{{Type: gwt.Mod, Permissions: gwt.Read | gwt.Edit}}},
+		{ResID: []byte("net-1"), Type: gwt.Network, Roles: []gwt.Role{gwt.DefaultRoles[gwt.Owner]}},
+	} {
+		if err = Auth.Provider.ResourcesService.GrantResource(ctx, identityID, res); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pair, err = Auth.LoginManual(ctx, acc.Username, acc.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := &http.Cookie{Name: src.CookieTokenName, Value: pair.Access.Token}
+
+	client, err := Auth.RegisterClient(ctx, &models.OAuthClient{
+		Name:         "Dashboard",
+		RedirectURIs: []string{appRedirectURI},
+		Scopes:       []string{"data:read", "data:edit"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if client.ID == "" || client.Secret == "" {
+		t.Fatalf("client registered without credentials: %+v", client)
+	}
+	app := &oauthApp{t: t, client: client, session: session}
+
+	t.Run("SendsUsersToLogInFirst", func(t *testing.T) {
+		anon := &oauthApp{t: t, client: client}
+		w := anon.authorize("data:read", oauth2.GenerateVerifier())
+		loginURL := w.Header().Get("Location")
+		if w.Code != http.StatusFound || !strings.HasPrefix(loginURL, "/login?next=") {
+			t.Fatalf("expected a redirect to log in, got %d %s", w.Code, loginURL)
+		}
+
+		body, _ := json.Marshal(models.LoginRequest{Username: acc.Username, Password: acc.Password})
+		w = httptest.NewRecorder()
+		src.LoginHandler(Auth)(w, httptest.NewRequest(http.MethodPost, loginURL, bytes.NewReader(body)))
+		next := w.Header().Get("Location")
+		if w.Code != http.StatusSeeOther || !strings.HasPrefix(next, src.AuthorizePath+"?") {
+			t.Fatalf("expected a redirect back to authorize, got %d %s", w.Code, next)
+		}
+
+		// Back at the authorization endpoint with the new session, the user is asked to consent.
+		r := httptest.NewRequest(http.MethodGet, next, nil)
+		for _, c := range w.Result().Cookies() {
+			r.AddCookie(c)
+		}
+		w = httptest.NewRecorder()
+		src.AuthorizeHandler(Auth)(w, r)
+		if w.Code != http.StatusOK || !consentTicket.MatchString(w.Body.String()) {
+			t.Errorf("expected the consent screen after logging in, got %d %s", w.Code, w.Header().Get("Location"))
+		}
+	})
+
+	t.Run("OnlyRedirectsLocallyAfterLogin", func(t *testing.T) {
+		body, _ := json.Marshal(models.LoginRequest{Username: acc.Username, Password: acc.Password})
+		for _, next := range []string{"https://evil.example.com/", "//evil.example.com/", "/\\evil.example.com/", "javascript:alert(1)"} {
+			w := httptest.NewRecorder()
+			src.LoginHandler(Auth)(w, httptest.NewRequest(http.MethodPost, "/login?next="+url.QueryEscape(next), bytes.NewReader(body)))
+			if w.Code != http.StatusOK || w.Header().Get("Location") != "" {
+				t.Errorf("next %q: expected no redirect, got %d %s", next, w.Code, w.Header().Get("Location"))
+			}
+		}
+	})
+
+	t.Run("RejectsBadRequests", func(t *testing.T) {
+		q := url.Values{"response_type": {"code"}, "client_id": {client.ID}, "redirect_uri": {"https://evil.example.com/"}}
+		w := httptest.NewRecorder()
+		src.AuthorizeHandler(Auth)(w, httptest.NewRequest(http.MethodGet, src.AuthorizePath+"?"+q.Encode(), nil))
+		if w.Code != http.StatusBadRequest || w.Header().Get("Location") != "" {
+			t.Errorf("unregistered redirect uri: expected %d without redirect, got %d %s", http.StatusBadRequest, w.Code, w.Header().Get("Location"))
+		}
+
+		q.Set("redirect_uri", appRedirectURI)
+		q.Set("state", "xyz")
+		w = httptest.NewRecorder()
+		src.AuthorizeHandler(Auth)(w, httptest.NewRequest(http.MethodGet, src.AuthorizePath+"?"+q.Encode(), nil))
+		if got := app.redirected(w).Get("error"); got != "invalid_request" {
+			t.Errorf("missing PKCE: expected invalid_request, got %q", got)
+		}
+
+		if got := app.redirected(app.authorize("data:delete", oauth2.GenerateVerifier())).Get("error"); got != "invalid_scope" {
+			t.Errorf("unknown scope: expected invalid_scope, got %q", got)
+		}
+	})
+
+	t.Run("DeniedConsent", func(t *testing.T) {
+		w := app.consent(app.authorize("data:read", oauth2.GenerateVerifier()), "deny", session)
+		if got := app.redirected(w).Get("error"); got != "access_denied" {
+			t.Errorf("expected access_denied, got %q", got)
+		}
+	})
+
+	t.Run("ConsentFromAnotherSession", func(t *testing.T) {
+		otherAcc := models.Account{Username: "oauth-other", Email: "oauth-other@elder1s.com", Password: "MrN00dle$123"}
+		otherProf := TestProfile
+		if err := Auth.RegisterIdentity(ctx, &otherProf, &otherAcc); err != nil {
+			t.Fatal(err)
+		}
+		other, err := Auth.LoginManual(ctx, otherAcc.Username, otherAcc.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		w := app.consent(app.authorize("data:read", oauth2.GenerateVerifier()), "allow",
+			&http.Cookie{Name: src.CookieTokenName, Value: other.Access.Token})
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+	var first models.OAuthToken
+	var firstCode, firstVerifier string
+	t.Run("IssuesScopedTokens", func(t *testing.T) {
+		firstVerifier = oauth2.GenerateVerifier()
+		w := app.consent(app.authorize("data:read", firstVerifier), "allow", session)
+		firstCode = app.redirected(w).Get("code")
+
+		status, tok, oErr := app.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {firstCode},
+			"redirect_uri":  {appRedirectURI},
+			"code_verifier": {firstVerifier},
+		})
+		if status != http.StatusOK {
+			t.Fatalf("expected %d, got %d %+v", http.StatusOK, status, oErr)
+		}
+		if tok.TokenType != "Bearer" || tok.RefreshToken == "" || tok.Scope != "data:read" || tok.ExpiresIn <= 0 {
+			t.Errorf("unexpected token response %+v", tok)
+		}
+		first = tok
+
+		access, err := Auth.Introspect(tok.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(access.Header.Recipient) != acc.Username || string(access.Body.UserID) != string(identityID) {
+			t.Errorf("token issued to the wrong user %s", access.Header.Recipient)
+		}
+		if !access.Body.HasAccess(gwt.DataManagement, gwt.DefaultRoles[gwt.User]) {
+			t.Error("granted scope data:read is missing")
+		}
+		if access.Body.HasAccess(gwt.DataManagement, gwt.Role{Type: gwt.Mod, Permissions: gwt.Edit}) {
+			t.Error("token can edit, data:edit was not granted")
+		}
+		if len(access.Body.GetResourceByType(gwt.Network)) != 0 {
+			t.Error("resources outside the granted scopes leaked into the token")
+		}
+	})
+
+	t.Run("RemembersConsent", func(t *testing.T) {
+		tok := app.login("data:read")
+		if tok.AccessToken == "" {
+			t.Fatal("no access token")
+		}
+
+		// A wider scope needs consent again.
+		w := app.authorize("data:read data:edit", oauth2.GenerateVerifier())
+		if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "Edit your data") {
+			t.Errorf("expected the consent screen for data:edit, got %d", w.Code)
+		}
+	})
+
+	t.Run("ChecksTheCodeVerifier", func(t *testing.T) {
+		verifier := oauth2.GenerateVerifier()
+		code := app.redirected(app.authorize("data:read", verifier)).Get("code")
+		status, _, oErr := app.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {appRedirectURI},
+			"code_verifier": {oauth2.GenerateVerifier()},
+		})
+		if status != http.StatusBadRequest || oErr.Error != "invalid_grant" {
+			t.Errorf("expected invalid_grant, got %d %+v", status, oErr)
+		}
+
+		// An intercepted code presented with the wrong verifier is not burnt for its client.
+		status, tok, oErr := app.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {appRedirectURI},
+			"code_verifier": {verifier},
+		})
+		if status != http.StatusOK || tok.AccessToken == "" {
+			t.Errorf("expected %d after a wrong verifier, got %d %+v", http.StatusOK, status, oErr)
+		}
+	})
+
+	t.Run("ChecksTheRedirectURI", func(t *testing.T) {
+		// authorize names the redirect URI, so the token request must name the same one.
+		for _, redirectURI := range []string{"", appRedirectURI + "/other"} {
+			verifier := oauth2.GenerateVerifier()
+			code := app.redirected(app.authorize("data:read", verifier)).Get("code")
+
+			form := url.Values{"grant_type": {"authorization_code"}, "code": {code}, "code_verifier": {verifier}}
+			if redirectURI != "" {
+				form.Set("redirect_uri", redirectURI)
+			}
+			if status, _, oErr := app.token(form); status != http.StatusBadRequest || oErr.Error != "invalid_grant" {
+				t.Errorf("redirect_uri %q: expected invalid_grant, got %d %+v", redirectURI, status, oErr)
+			}
+		}
+	})
+
+	t.Run("AuthenticatesClients", func(t *testing.T) {
+		impostor := &oauthApp{t: t, client: &models.OAuthClient{ID: client.ID, Secret: "guess"}}
+		status, _, oErr := impostor.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}})
+		if status != http.StatusUnauthorized || oErr.Error != "invalid_client" {
+			t.Errorf("expected invalid_client, got %d %+v", status, oErr)
+		}
+	})
+
+	t.Run("RefreshesWithinTheScope", func(t *testing.T) {
+		tok := app.login("data:read")
+
+		status, refreshed, oErr := app.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {tok.RefreshToken}})
+		if status != http.StatusOK {
+			t.Fatalf("expected %d, got %d %+v", http.StatusOK, status, oErr)
+		}
+		if refreshed.Scope != "data:read" || refreshed.RefreshToken == tok.RefreshToken {
+			t.Errorf("unexpected refresh response %+v", refreshed)
+		}
+
+		access, err := Auth.Introspect(refreshed.AccessToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(access.Body.GetResourceByType(gwt.Network)) != 0 {
+			t.Error("refreshed token outgrew its scope")
+		}
+
+		// A client's refresh token is no first party session.
+		if _, err = Auth.RefreshToken(ctx, refreshed.RefreshToken); err == nil {
+			t.Error("client refresh token refreshed a first party session")
+		}
+	})
+
+	t.Run("ClientTokensAreNoSessions", func(t *testing.T) {
+		tok := app.login("data:read")
+		if _, err := Auth.Introspect(tok.AccessToken); err != nil {
+			t.Fatalf("client token does not introspect: %v", err)
+		}
+
+		if err := Auth.LoginToken(tok.AccessToken); err == nil {
+			t.Error("client token logged in")
+		}
+
+		// Used as the session cookie, the authorization endpoint asks the user to log in.
+		thief := &oauthApp{t: t, client: client, session: &http.Cookie{Name: src.CookieTokenName, Value: tok.AccessToken}}
+		if w := thief.authorize("data:read", oauth2.GenerateVerifier()); w.Code != http.StatusFound ||
+			!strings.HasPrefix(w.Header().Get("Location"), "/login?") {
+			t.Errorf("client token passed for a session: %d %s", w.Code, w.Header().Get("Location"))
+		}
+
+		r := httptest.NewRequest(http.MethodGet, src.ActivityPath, nil)
+		r.AddCookie(thief.session)
+		w := httptest.NewRecorder()
+		Auth.ServeHTTP(w, r)
+		if w.Code == http.StatusOK {
+			t.Error("client token read the activity log")
+		}
+	})
+
+	t.Run("PublicClients", func(t *testing.T) {
+		public, err := Auth.RegisterClient(ctx, &models.OAuthClient{
+			Name:         "Mobile",
+			RedirectURIs: []string{appRedirectURI},
+			Scopes:       []string{"data:read"},
+			Public:       true,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if public.Secret != "" {
+			t.Error("public client was given a secret")
+		}
+
+		mobile := &oauthApp{t: t, client: public, session: session}
+		verifier := oauth2.GenerateVerifier()
+		code := mobile.redirected(mobile.consent(mobile.authorize("data:read", verifier), "allow", session)).Get("code")
+		status, tok, oErr := mobile.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {appRedirectURI},
+			"code_verifier": {verifier},
+		})
+		if status != http.StatusOK || tok.AccessToken == "" {
+			t.Errorf("expected %d, got %d %+v", http.StatusOK, status, oErr)
+		}
+
+		// Codes are bound to the client they were issued to.
+		code = mobile.redirected(mobile.authorize("data:read", verifier)).Get("code")
+		status, _, oErr = app.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {code},
+			"redirect_uri":  {appRedirectURI},
+			"code_verifier": {verifier},
+		})
+		if status != http.StatusBadRequest || oErr.Error != "invalid_grant" {
+			t.Errorf("another client's code: expected invalid_grant, got %d %+v", status, oErr)
+		}
+	})
+
+	t.Run("CodeReuseRevokesItsTokens", func(t *testing.T) {
+		status, _, oErr := app.token(url.Values{
+			"grant_type":    {"authorization_code"},
+			"code":          {firstCode},
+			"redirect_uri":  {appRedirectURI},
+			"code_verifier": {firstVerifier},
+		})
+		if status != http.StatusBadRequest || oErr.Error != "invalid_grant" {
+			t.Errorf("expected invalid_grant, got %d %+v", status, oErr)
+		}
+
+		if _, err := Auth.Introspect(first.AccessToken); err == nil {
+			t.Error("access token of a reused code is still valid")
+		}
+		if status, _, _ = app.token(url.Values{"grant_type": {"refresh_token"}, "refresh_token": {first.RefreshToken}}); status == http.StatusOK {
+			t.Error("refresh token of a reused code is still valid")
+		}
+	})
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/gwt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBoundSession(t *testing.T) {
+	acc := models.Account{Username: "pop-holder", Email: "pop-holder@elder1s.com", Password: "MrN00dle$123"}
+	prof := TestProfile
+	if err := Auth.RegisterIdentity(context.Background(), &prof, &acc); err != nil {
+		t.Fatal(err)
+	}
+
+	holder, _ := gwt.NewEd25519Key("holder")
+	thief, _ := gwt.NewEd25519Key("thief")
+
+	body, _ := json.Marshal(models.LoginRequest{Username: acc.Username, Password: acc.Password})
+	login := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(body))
+	proof, _ := gwt.NewProof(holder, http.MethodPost, "http://example.com/login", "")
+	login.Header.Set(gwt.ProofHeader, proof)
+
+	w := httptest.NewRecorder()
+	src.LoginHandler(Auth)(w, login)
+	if w.Code != http.StatusOK {
+		t.Fatalf("login failed: %d %s", w.Code, w.Body.String())
+	}
+
+	var access, refresh *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		switch c.Name {
+		case src.CookieTokenName:
+			access = c
+		case src.CookieRefreshName:
+			refresh = c
+		}
+	}
+	if access == nil || refresh == nil {
+		t.Fatal("login did not set the session cookies")
+	}
+
+	handler := src.TokenMiddleware(Auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(key *gwt.Key) int {
+		r := httptest.NewRequest(http.MethodGet, "/account", nil)
+		r.AddCookie(access)
+		if key != nil {
+			proof, _ := gwt.NewProof(key, http.MethodGet, "http://example.com/account", access.Value)
+			r.Header.Set(gwt.ProofHeader, proof)
+		}
+
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	if code := serve(holder); code != http.StatusOK {
+		t.Errorf("holder: expected %d, got %d", http.StatusOK, code)
+	}
+	if code := serve(nil); code == http.StatusOK {
+		t.Error("bound token was accepted without a proof")
+	}
+	if code := serve(thief); code == http.StatusOK {
+		t.Error("bound token was accepted with another key's proof")
+	}
+
+	// The refresh token stays bound to the same key.
+	if _, err := Auth.RefreshToken(context.Background(), refresh.Value); err == nil {
+		t.Error("bound refresh token was spent without a proof")
+	}
+
+	pair, err := Auth.RefreshTokenBound(context.Background(), refresh.Value, holder.Thumbprint())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pair.Access.Header.Confirmation != holder.Thumbprint() {
+		t.Error("refreshed token lost the key binding")
+	}
+}
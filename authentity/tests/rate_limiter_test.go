@@ -1,145 +1,363 @@
 package tests
 
 import (
+	"context"
+	"errors"
 	"github.com/vaiktorg/grimoire/authentity/internal"
+	"github.com/vaiktorg/grimoire/authentity/src"
 	"net/http"
 	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
 
 var attempts = 5
-var RateLimiter = internal.NewMockedRateLimiter(attempts, timeout, &internal.MockIPGetter{})
+var timeout = time.Minute
 
-var timeout = time.Second
+func newTestLimiter(clock *fakeClock, opts ...internal.RateLimiterOption) *internal.RateLimiter {
+	return internal.NewRateLimiter(attempts, timeout, append(opts, internal.WithLimiterClock(clock.Now))...)
+}
+
+func request(handler http.Handler, remoteAddr string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, "/", nil)
+	r.RemoteAddr = remoteAddr
+	for k, v := range header {
+		r.Header[k] = v
+	}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	return w
+}
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
 
 func TestRateLimitMiddleware_AllowsAccessWithFewAttempts(t *testing.T) {
-	handler := RateLimiter.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
-	server := httptest.NewServer(handler)
-	defer server.Close()
+	handler := newTestLimiter(&fakeClock{t: time.Now()}).RateLimitMiddleware(okHandler)
 
 	for i := 0; i < attempts; i++ {
-		req, err := http.NewRequest("GET", server.URL, nil)
-		if err != nil {
-			t.Fatal(err)
-			return
+		if w := request(handler, "203.0.113.1:1234", nil); w.Code != http.StatusOK {
+			t.Errorf("Expected status 200, got %d", w.Code)
 		}
+	}
+}
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			t.Fatal(err)
-			return
-		}
+func TestRateLimitMiddleware_BlocksAccessWithTooManyAttempts(t *testing.T) {
+	handler := newTestLimiter(&fakeClock{t: time.Now()}).RateLimitMiddleware(okHandler)
 
-		if resp.StatusCode != http.StatusOK {
-			t.Errorf("Expected status 200, got %d", resp.StatusCode)
-		}
+	for i := 0; i < attempts; i++ {
+		request(handler, "203.0.113.1:1234", nil)
+	}
+
+	w := request(handler, "203.0.113.1:1234", nil)
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", w.Code)
+	}
+	if w.Header().Get("Retry-After") != "60" {
+		t.Errorf("Expected Retry-After 60, got %q", w.Header().Get("Retry-After"))
+	}
 
-		_ = resp.Body.Close()
+	// Every client has a bucket of its own.
+	if w = request(handler, "203.0.113.2:1234", nil); w.Code != http.StatusOK {
+		t.Errorf("another client: expected status 200, got %d", w.Code)
 	}
 }
 
-func TestRateLimitMiddleware_BlocksAccessWithTooManyAttempts(t *testing.T) {
-	handler := RateLimiter.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
-	server := httptest.NewServer(handler)
-	defer server.Close()
+func TestRateLimitMiddleware_UnblocksAfterTimeout(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	handler := newTestLimiter(clock).RateLimitMiddleware(okHandler)
 
 	for i := 0; i <= attempts; i++ {
-		req, err := http.NewRequest("GET", server.URL, nil)
-		if err != nil {
-			t.Fatal(err)
-			return
-		}
+		request(handler, "203.0.113.1:1234", nil)
+	}
+
+	clock.t = clock.t.Add(timeout - time.Second)
+	if w := request(handler, "203.0.113.1:1234", nil); w.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected status 429, got %d", w.Code)
+	}
+
+	clock.t = clock.t.Add(time.Second)
+	if w := request(handler, "203.0.113.1:1234", nil); w.Code != http.StatusOK {
+		t.Errorf("Expected status 200, got %d", w.Code)
+	}
+}
+
+func TestRateLimitMiddleware_IncreasesTimeoutAfterLockout(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	limiter := newTestLimiter(clock, internal.WithMaxTimeout(3*timeout))
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			t.Fatal(err)
-			return
+	for _, want := range []time.Duration{timeout, 2 * timeout, 3 * timeout, 3 * timeout} {
+		var wait time.Duration
+		for i := 0; i <= attempts; i++ {
+			wait, _ = limiter.Attempt("203.0.113.1")
+		}
+		if wait != want {
+			t.Errorf("Expected a lockout of %s, got %s", want, wait)
 		}
 
-		time.Sleep(time.Second)
+		clock.t = clock.t.Add(wait)
+	}
+}
+
+func TestRateLimitMiddleware_CountsPosts(t *testing.T) {
+	handler := newTestLimiter(&fakeClock{t: time.Now()}).RateLimitMiddleware(okHandler)
 
-		if i >= attempts && resp.StatusCode != http.StatusTooManyRequests {
-			t.Errorf("Expected status 429, got %d", resp.StatusCode)
+	for i := 0; i < 3*attempts; i++ {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = "203.0.113.1:1234"
+		handler.ServeHTTP(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("GET %d: expected status 200, got %d", i, w.Code)
 		}
+	}
 
-		_ = resp.Body.Close()
+	if w := request(handler, "203.0.113.1:1234", nil); w.Code != http.StatusOK {
+		t.Errorf("GETs were counted: expected status 200, got %d", w.Code)
 	}
 }
 
-func TestRateLimitMiddleware_UnblocksAfterTimeout(t *testing.T) {
-	handler := RateLimiter.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
-	server := httptest.NewServer(handler)
-	defer server.Close()
+func TestRateLimitMiddleware_SuccessStopsEscalation(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	limiter := newTestLimiter(clock)
+	failing := limiter.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "wrong password", http.StatusUnauthorized)
+	}))
 
-	for i := 0; i <= attempts; i++ {
-		req, err := http.NewRequest("GET", server.URL, nil)
-		if err != nil {
-			t.Fatal(err)
-			return
+	lockout := func(handler http.Handler) string {
+		var w *httptest.ResponseRecorder
+		for i := 0; i <= attempts; i++ {
+			w = request(handler, "203.0.113.1:1234", nil)
 		}
+		return w.Header().Get("Retry-After")
+	}
+
+	if wait := lockout(failing); wait != "60" {
+		t.Fatalf("Expected Retry-After 60, got %q", wait)
+	}
+	clock.t = clock.t.Add(timeout)
+	if wait := lockout(failing); wait != "120" {
+		t.Fatalf("Expected Retry-After 120, got %q", wait)
+	}
+	clock.t = clock.t.Add(2 * timeout)
+
+	// Someone behind the same IP logs in, the next lockout is the first again.
+	if w := request(limiter.RateLimitMiddleware(okHandler), "203.0.113.1:1234", nil); w.Code != http.StatusOK {
+		t.Fatalf("Expected status 200, got %d", w.Code)
+	}
+	if wait := lockout(failing); wait != "60" {
+		t.Errorf("Expected Retry-After 60 after a success, got %q", wait)
+	}
+}
+
+func TestRateLimiter_WindowsAndForgetting(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	limiter := newTestLimiter(clock)
 
-		resp, err := http.DefaultClient.Do(req)
-		if err != nil {
-			t.Fatal(err)
-			return
+	// Attempts spread over windows never lock out.
+	for i := 0; i < 3*attempts; i++ {
+		if _, ok := limiter.Attempt("key"); !ok {
+			t.Fatalf("attempt %d locked out", i)
 		}
-		_ = resp.Body.Close()
+		clock.t = clock.t.Add(timeout / time.Duration(attempts))
 	}
 
-	time.Sleep(timeout * 2)
+	for i := 0; i <= attempts; i++ {
+		limiter.Attempt("key")
+	}
+	if _, locked := limiter.Locked("key"); !locked {
+		t.Fatal("expected key to be locked")
+	}
 
-	req, err := http.NewRequest("GET", server.URL, nil)
-	if err != nil {
-		t.Fatal(err)
-		return
+	// A day later the earlier lockout is forgotten, the next one is the first again.
+	clock.t = clock.t.Add(24 * time.Hour)
+	limiter.Attempt("other") // sweeps
+	var wait time.Duration
+	for i := 0; i <= attempts; i++ {
+		wait, _ = limiter.Attempt("key")
+	}
+	if wait != timeout {
+		t.Errorf("Expected a lockout of %s, got %s", timeout, wait)
+	}
+
+	limiter.Reset("key")
+	if _, ok := limiter.Attempt("key"); !ok {
+		t.Error("reset key still locked")
+	}
+}
+
+func TestRateLimiter_Concurrent(t *testing.T) {
+	limiter := newTestLimiter(&fakeClock{t: time.Now()})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := limiter.Attempt("key"); ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	if allowed != attempts {
+		t.Errorf("Expected %d attempts allowed, got %d", attempts, allowed)
 	}
+}
 
-	resp, err := http.DefaultClient.Do(req)
+func TestClientIP(t *testing.T) {
+	ips, err := internal.NewIPResolver("10.0.0.0/8", "2001:db8::1")
 	if err != nil {
 		t.Fatal(err)
-		return
 	}
-	defer resp.Body.Close()
+	if _, err = internal.NewIPResolver("proxy.example.com"); !errors.Is(err, internal.ErrTrustedProxy) {
+		t.Errorf("expected %v, got %v", internal.ErrTrustedProxy, err)
+	}
 
-	if resp.StatusCode != http.StatusOK {
-		t.Errorf("Expected status 200, got %d", resp.StatusCode)
+	for _, tc := range []struct {
+		name   string
+		remote string
+		header http.Header
+		want   string
+	}{
+		{"Peer", "203.0.113.7:5555", nil, "203.0.113.7"},
+		{"UntrustedPeerSpoofing", "203.0.113.7:5555", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.7"},
+		{"TrustedProxy", "10.0.0.2:80", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"ProxyChain", "10.0.0.2:80", http.Header{"X-Forwarded-For": {"6.6.6.6, 198.51.100.1", "10.1.1.1"}}, "198.51.100.1"},
+		{"ForgedHop", "10.0.0.2:80", http.Header{"X-Forwarded-For": {"not-an-ip, 10.1.1.1"}}, "10.1.1.1"},
+		{"Forwarded", "10.0.0.2:80", http.Header{"Forwarded": {`for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https`}}, "2001:db8:cafe::17"},
+		{"ForwardedWins", "10.0.0.2:80", http.Header{"Forwarded": {"for=198.51.100.9"}, "X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.9"},
+		{"TrustedIPv6Peer", "[2001:db8::1]:443", http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.RemoteAddr = tc.remote
+			r.Header = tc.header
+			if r.Header == nil {
+				r.Header = http.Header{}
+			}
+
+			if got := ips.ClientIP(r); got != tc.want {
+				t.Errorf("expected %s, got %s", tc.want, got)
+			}
+		})
 	}
 }
 
-func TestRateLimitMiddleware_IncreasesTimeoutAfterLockout(t *testing.T) {
-	handler := RateLimiter.RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
-	server := httptest.NewServer(handler)
-	defer server.Close()
+func TestLoginLockout(t *testing.T) {
+	clock := &fakeClock{t: time.Now()}
+	auth := newTestAuthentity(t, "lockout", &src.Config{
+		Clock: clock.Now,
 
-	res := &http.Response{}
-	for j := 0; j < 2; j++ {
-		// Try 1
-		for i := 0; i <= attempts; i++ {
-			req, err := http.NewRequest("GET", server.URL, nil)
-			if err != nil {
-				t.Fatal(err)
-				return
+		LoginAttempts:  3,
+		LoginLockout:   time.Minute,
+		ClientRequests: 10,
+		TrustedProxies: []string{"10.0.0.0/8"},
+	})
+
+	ctx := context.Background()
+	acc := registerTestAccount(t, auth, "locked")
+
+	t.Run("LocksOutAccounts", func(t *testing.T) {
+		// Username and email count against the same account.
+		for i, identifier := range []string{acc.Username, acc.Email, acc.Username} {
+			if _, err := auth.LoginManual(ctx, identifier, "wrong"); err == nil || errors.As(err, new(*src.LockoutError)) {
+				t.Fatalf("attempt %d: expected a failed login, got %v", i, err)
 			}
+		}
 
-			resp, err := http.DefaultClient.Do(req)
-			if err != nil {
-				t.Fatal(err)
-				return
+		var lockout *src.LockoutError
+		if _, err := auth.LoginManual(ctx, acc.Email, "wrong"); !errors.As(err, &lockout) || lockout.RetryAfter != time.Minute {
+			t.Fatalf("expected a lockout of a minute, got %v", err)
+		}
+		if _, err := auth.LoginManual(ctx, acc.Username, acc.Password); !errors.As(err, &lockout) {
+			t.Errorf("right password let in while locked out: %v", err)
+		}
+
+		clock.t = clock.t.Add(time.Minute)
+		if _, err := auth.LoginManual(ctx, acc.Username, acc.Password); err != nil {
+			t.Errorf("expected a login after the lockout, got %v", err)
+		}
+	})
+
+	t.Run("DoublesLockouts", func(t *testing.T) {
+		var lockout *src.LockoutError
+		for _, want := range []time.Duration{time.Minute, 2 * time.Minute, 4 * time.Minute} {
+			for i := 0; i < 3; i++ {
+				_, _ = auth.LoginManual(ctx, acc.Username, "wrong")
+			}
+			if _, err := auth.LoginManual(ctx, acc.Username, "wrong"); !errors.As(err, &lockout) || lockout.RetryAfter != want {
+				t.Fatalf("expected a lockout of %s, got %v", want, err)
 			}
+			clock.t = clock.t.Add(want)
+		}
+	})
 
-			res = resp
+	t.Run("UnknownIdentifiers", func(t *testing.T) {
+		for i := 0; i < 3; i++ {
+			_, _ = auth.LoginManual(ctx, "nobody", "wrong")
+		}
+		if _, err := auth.LoginManual(ctx, "NOBODY", "wrong"); !errors.As(err, new(*src.LockoutError)) {
+			t.Errorf("expected a lockout, got %v", err)
+		}
+	})
+
+	t.Run("DatabaseErrorsAreNoAttempts", func(t *testing.T) {
+		canceled, cancel := context.WithCancel(ctx)
+		cancel()
 
-			_ = resp.Body.Close()
+		for i := 0; i < 5; i++ {
+			if _, err := auth.LoginManual(canceled, "someone", "wrong"); !errors.Is(err, context.Canceled) {
+				t.Fatalf("attempt %d: expected the database error, got %v", i, err)
+			}
+		}
+		if _, err := auth.LoginManual(ctx, "someone", "wrong"); err == nil || errors.As(err, new(*src.LockoutError)) {
+			t.Errorf("database errors locked the identifier out: %v", err)
 		}
+	})
 
-		timeout += timeout
-		// locked 1
-		time.Sleep(timeout)
-	}
+	t.Run("LoginHandler", func(t *testing.T) {
+		clock.t = clock.t.Add(24 * time.Hour)
 
-	if res.StatusCode != http.StatusLocked {
-		t.Errorf("Expected status 423, got %d", res.StatusCode)
-	}
+		login := func(remote, forwarded, password string) *httptest.ResponseRecorder {
+			r := httptest.NewRequest(http.MethodPost, "/login",
+				strings.NewReader(`{"Username":"`+acc.Username+`","Password":"`+password+`"}`))
+			r.RemoteAddr = remote
+			if forwarded != "" {
+				r.Header.Set("X-Forwarded-For", forwarded)
+			}
+
+			w := httptest.NewRecorder()
+			auth.ServeHTTP(w, r)
+			return w
+		}
 
+		for i := 0; i < 3; i++ {
+			login("10.0.0.2:80", "198.51.100.1", "wrong")
+		}
+		w := login("10.0.0.2:80", "198.51.100.1", "wrong")
+		if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+			t.Errorf("account lockout: expected %d with Retry-After, got %d", http.StatusTooManyRequests, w.Code)
+		}
+
+		// The client behind the proxy has made 4 requests of its 10, the proxy itself none.
+		for i := 0; i < 6; i++ {
+			login("10.0.0.2:80", "198.51.100.1", "wrong")
+		}
+		if w = login("10.0.0.2:80", "198.51.100.1", acc.Password); w.Code != http.StatusTooManyRequests {
+			t.Errorf("client rate: expected %d, got %d", http.StatusTooManyRequests, w.Code)
+		}
+
+		clock.t = clock.t.Add(24 * time.Hour)
+		if w = login("10.0.0.2:80", "198.51.100.2", acc.Password); w.Code != http.StatusOK {
+			t.Errorf("another client: expected %d, got %d %s", http.StatusOK, w.Code, w.Body.String())
+		}
+	})
 }
@@ -0,0 +1,406 @@
+package tests
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"github.com/vaiktorg/grimoire/uid"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	socialClientID     = "authentity"
+	socialClientSecret = "s0cial-$ecret"
+	socialRedirectURL  = "http://auth.example.com/auth/mock/callback"
+)
+
+// mockUser is who logs in at the mock provider.
+type mockUser struct {
+	Subject  string
+	Email    string
+	Verified bool
+	Name     string
+	Username string
+}
+
+// mockProvider is an OpenID provider, and a GitHub Enterprise server, that logs in as User without asking.
+type mockProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu     sync.Mutex
+	User   mockUser
+	Tamper func(claims map[string]any)
+	codes  map[string]mockGrant
+}
+type mockGrant struct {
+	user      mockUser
+	nonce     string
+	challenge string
+}
+
+func newMockProvider(t *testing.T) *mockProvider {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := &mockProvider{key: key, codes: map[string]mockGrant{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]string{
+			"issuer":                 m.URL,
+			"authorization_endpoint": m.URL + "/authorize",
+			"token_endpoint":         m.URL + "/token",
+			"jwks_uri":               m.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, map[string]any{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "mock-1",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/authorize", m.authorize)
+	mux.HandleFunc("/login/oauth/authorize", m.authorize)
+	mux.HandleFunc("/token", m.token)
+	mux.HandleFunc("/login/oauth/access_token", m.token)
+	mux.HandleFunc("/api/v3/user", func(w http.ResponseWriter, r *http.Request) {
+		grant, ok := m.bearer(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, map[string]any{"id": 4242, "login": grant.user.Username, "name": grant.user.Name})
+	})
+	mux.HandleFunc("/api/v3/user/emails", func(w http.ResponseWriter, r *http.Request) {
+		grant, ok := m.bearer(r)
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(w, []map[string]any{
+			{"email": "old-" + grant.user.Email, "primary": false, "verified": true},
+			{"email": grant.user.Email, "primary": true, "verified": grant.user.Verified},
+		})
+	})
+
+	m.Server = httptest.NewServer(mux)
+	t.Cleanup(m.Close)
+	return m
+}
+
+func (m *mockProvider) authorize(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("client_id") != socialClientID || q.Get("code_challenge_method") != "S256" || q.Get("code_challenge") == "" {
+		http.Error(w, "bad authorization request", http.StatusBadRequest)
+		return
+	}
+
+	m.mu.Lock()
+	code := string(uid.New())
+	m.codes[code] = mockGrant{user: m.User, nonce: q.Get("nonce"), challenge: q.Get("code_challenge")}
+	m.mu.Unlock()
+
+	back, _ := url.Parse(q.Get("redirect_uri"))
+	bq := back.Query()
+	bq.Set("code", code)
+	bq.Set("state", q.Get("state"))
+	back.RawQuery = bq.Encode()
+	http.Redirect(w, r, back.String(), http.StatusFound)
+}
+
+func (m *mockProvider) token(w http.ResponseWriter, r *http.Request) {
+	// Basic auth credentials are form encoded, RFC 6749 section 2.3.1.
+	id, secret, _ := r.BasicAuth()
+	id, _ = url.QueryUnescape(id)
+	secret, _ = url.QueryUnescape(secret)
+	if id != socialClientID || secret != socialClientSecret {
+		if r.PostFormValue("client_id") != socialClientID || r.PostFormValue("client_secret") != socialClientSecret {
+			http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+			return
+		}
+	}
+
+	m.mu.Lock()
+	grant, ok := m.codes[r.PostFormValue("code")]
+	delete(m.codes, r.PostFormValue("code"))
+	m.mu.Unlock()
+
+	challenge := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(challenge[:]) != grant.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_grant"}`))
+		return
+	}
+
+	claims := map[string]any{
+		"iss":                m.URL,
+		"sub":                grant.user.Subject,
+		"aud":                socialClientID,
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"iat":                time.Now().Unix(),
+		"nonce":              grant.nonce,
+		"email":              grant.user.Email,
+		"email_verified":     grant.user.Verified,
+		"name":               grant.user.Name,
+		"preferred_username": grant.user.Username,
+	}
+	if m.Tamper != nil {
+		m.Tamper(claims)
+	}
+
+	access := string(uid.New())
+	m.mu.Lock()
+	m.codes["bearer "+access] = grant
+	m.mu.Unlock()
+
+	writeJSON(w, map[string]any{
+		"access_token": access,
+		"token_type":   "Bearer",
+		"expires_in":   3600,
+		"id_token":     m.sign(claims),
+	})
+}
+
+func (m *mockProvider) bearer(r *http.Request) (mockGrant, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	grant, ok := m.codes["bearer "+strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")]
+	return grant, ok
+}
+
+func (m *mockProvider) sign(claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "mock-1", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	h := sha256.Sum256([]byte(signed))
+	sig, _ := rsa.SignPKCS1v15(rand.Reader, m.key, crypto.SHA256, h[:])
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// socialLogin walks a browser through connector's login: authentity, the provider and back.
+// tamperState changes the state the provider sends back.
+func socialLogin(t *testing.T, connector services.Connector, session *http.Cookie, tamperState bool) *httptest.ResponseRecorder {
+	t.Helper()
+
+	r := httptest.NewRequest(http.MethodGet, src.SocialLoginPath(connector.Name()), nil)
+	if session != nil {
+		r.AddCookie(session)
+	}
+	w := httptest.NewRecorder()
+	src.SocialLoginHandler(Auth, connector)(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: expected %d, got %d %s", http.StatusFound, w.Code, w.Body.String())
+	}
+
+	var flow *http.Cookie
+	for _, c := range w.Result().Cookies() {
+		if c.Name == src.CookieSocialName {
+			flow = c
+		}
+	}
+	if flow == nil || !flow.HttpOnly || !strings.HasPrefix(src.SocialCallbackPath(connector.Name()), flow.Path) {
+		t.Fatalf("login flow cookie not set for the callback: %+v", flow)
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noFollow.Get(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusFound {
+		t.Fatalf("provider: expected %d, got %d", http.StatusFound, resp.StatusCode)
+	}
+
+	back, _ := url.Parse(resp.Header.Get("Location"))
+	if tamperState {
+		q := back.Query()
+		q.Set("state", "forged")
+		back.RawQuery = q.Encode()
+	}
+
+	r = httptest.NewRequest(http.MethodGet, back.String(), nil)
+	r.AddCookie(flow)
+	w = httptest.NewRecorder()
+	src.SocialCallbackHandler(Auth, connector)(w, r)
+
+	return w
+}
+
+func sessionOf(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	t.Helper()
+
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("callback: expected %d, got %d %s", http.StatusSeeOther, w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == src.CookieTokenName && c.Value != "" {
+			return c
+		}
+	}
+
+	t.Fatal("callback set no session")
+	return nil
+}
+
+func userOf(t *testing.T, session *http.Cookie) string {
+	t.Helper()
+
+	tok, err := Auth.Introspect(session.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(tok.Body.UserID)
+}
+
+func TestSocialLogin(t *testing.T) {
+	provider := newMockProvider(t)
+
+	connector, err := services.NewOIDCConnector(context.Background(), "mock", provider.URL, services.OAuthConfig{
+		ClientID:     socialClientID,
+		ClientSecret: socialClientSecret,
+		RedirectURL:  socialRedirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	provider.User = mockUser{
+		Subject:  "mock-" + string(uid.New()),
+		Email:    "shub-niggurath@elder1s.com",
+		Verified: true,
+		Name:     "Shub Niggurath",
+		Username: "BlackGoat",
+	}
+
+	var created string
+	t.Run("RegistersNewUsers", func(t *testing.T) {
+		session := sessionOf(t, socialLogin(t, connector, nil, false))
+		created = userOf(t, session)
+
+		identity, err := Auth.Provider.IdentityService.FetchIdentity(context.Background(), created)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if identity.Account.Username != "blackgoat" || identity.Account.Email != provider.User.Email {
+			t.Errorf("unexpected account %+v", identity.Account)
+		}
+
+		link, err := Auth.Provider.ExternalIdentityService.Find(context.Background(), "mock", provider.User.Subject)
+		if err != nil || link.IdentityID != created {
+			t.Errorf("external identity not linked: %+v %v", link, err)
+		}
+	})
+
+	t.Run("LogsLinkedUsersBackIn", func(t *testing.T) {
+		if got := userOf(t, sessionOf(t, socialLogin(t, connector, nil, false))); got != created {
+			t.Errorf("expected identity %s, got %s", created, got)
+		}
+	})
+
+	t.Run("RejectsForgedState", func(t *testing.T) {
+		if w := socialLogin(t, connector, nil, true); w.Code != http.StatusBadRequest {
+			t.Errorf("expected %d, got %d", http.StatusBadRequest, w.Code)
+		}
+	})
+
+	t.Run("RejectsInvalidIDTokens", func(t *testing.T) {
+		for name, tamper := range map[string]func(map[string]any){
+			"nonce":    func(c map[string]any) { c["nonce"] = "replayed" },
+			"audience": func(c map[string]any) { c["aud"] = []string{"someone-else"} },
+			"expired":  func(c map[string]any) { c["exp"] = time.Now().Add(-time.Hour).Unix() },
+			"issuer":   func(c map[string]any) { c["iss"] = "https://evil.example.com" },
+		} {
+			provider.Tamper = tamper
+			if w := socialLogin(t, connector, nil, false); w.Code != http.StatusBadGateway {
+				t.Errorf("%s: expected %d, got %d", name, http.StatusBadGateway, w.Code)
+			}
+		}
+		provider.Tamper = nil
+	})
+
+	// An account registered with a password, whose owner later logs in with the provider.
+	acc := models.Account{Username: "yog-sothoth", Email: "yog-sothoth@elder1s.com", Password: "MrN00dle$123"}
+	prof := TestProfile
+	if err = Auth.RegisterIdentity(context.Background(), &prof, &acc); err != nil {
+		t.Fatal(err)
+	}
+	provider.User = mockUser{Subject: "mock-" + string(uid.New()), Email: acc.Email, Verified: true, Name: "Yog Sothoth"}
+
+	t.Run("RefusesTakingOverAccountsByEmail", func(t *testing.T) {
+		if w := socialLogin(t, connector, nil, false); w.Code != http.StatusConflict {
+			t.Errorf("expected %d, got %d %s", http.StatusConflict, w.Code, w.Body.String())
+		}
+	})
+
+	t.Run("LinksFromASession", func(t *testing.T) {
+		pair, err := Auth.LoginManual(context.Background(), acc.Username, acc.Password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		owner := string(pair.Access.Body.UserID)
+
+		session := &http.Cookie{Name: src.CookieTokenName, Value: pair.Access.Token}
+		if got := userOf(t, sessionOf(t, socialLogin(t, connector, session, false))); got != owner {
+			t.Errorf("expected identity %s, got %s", owner, got)
+		}
+
+		// Linked, the provider now logs straight into the account.
+		if got := userOf(t, sessionOf(t, socialLogin(t, connector, nil, false))); got != owner {
+			t.Errorf("expected identity %s, got %s", owner, got)
+		}
+	})
+
+	t.Run("RefusesUnverifiedEmails", func(t *testing.T) {
+		provider.User = mockUser{Subject: "mock-" + string(uid.New()), Email: "unverified@elder1s.com"}
+		if w := socialLogin(t, connector, nil, false); w.Code != http.StatusForbidden {
+			t.Errorf("expected %d, got %d %s", http.StatusForbidden, w.Code, w.Body.String())
+		}
+	})
+}
+
+func TestGitHubLogin(t *testing.T) {
+	provider := newMockProvider(t)
+	provider.User = mockUser{Email: "cthulhu@elder1s.com", Verified: true, Name: "Cthulhu", Username: "Cthulhu"}
+
+	connector := services.NewGitHubEnterpriseConnector(services.OAuthConfig{
+		ClientID:     socialClientID,
+		ClientSecret: socialClientSecret,
+		RedirectURL:  "http://auth.example.com/auth/github/callback",
+	}, provider.URL)
+
+	user := userOf(t, sessionOf(t, socialLogin(t, connector, nil, false)))
+
+	link, err := Auth.Provider.ExternalIdentityService.Find(context.Background(), "github", "4242")
+	if err != nil || link.IdentityID != user || link.Email != provider.User.Email {
+		t.Errorf("github identity not linked from its primary email: %+v %v", link, err)
+	}
+}
@@ -0,0 +1,268 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/authentity/src"
+	"github.com/vaiktorg/grimoire/authentity/src/models"
+	"github.com/vaiktorg/grimoire/authentity/src/services"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTOTP(t *testing.T) {
+	// RFC 6238 appendix B, SHA1, truncated to 6 digits.
+	const secret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	} {
+		code, err := services.TOTPCode(secret, time.Unix(unix, 0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != want {
+			t.Errorf("at %d: expected %s, got %s", unix, want, code)
+		}
+	}
+
+	now := time.Unix(1111111109, 0)
+	late, _ := services.TOTPCode(secret, now.Add(-services.TOTPPeriod))
+	if _, ok := services.ValidateTOTP(secret, late, now, 0); !ok {
+		t.Error("code of the previous period is rejected")
+	}
+	stale, _ := services.TOTPCode(secret, now.Add(-3*services.TOTPPeriod))
+	if _, ok := services.ValidateTOTP(secret, stale, now, 0); ok {
+		t.Error("code three periods old is accepted")
+	}
+
+	counter, ok := services.ValidateTOTP(secret, "081804", now, 0)
+	if !ok {
+		t.Fatal("valid code rejected")
+	}
+	if _, ok = services.ValidateTOTP(secret, "081804", now, counter); ok {
+		t.Error("code accepted twice")
+	}
+}
+
+func TestTwoFactor(t *testing.T) {
+	clock := &fakeClock{t: time.Date(2030, 1, 1, 12, 0, 0, 0, time.UTC)}
+	conf := &src.Config{Clock: clock.Now}
+	auth := newTestAuthentity(t, "2fa", conf)
+
+	ctx := context.Background()
+	acc := registerTestAccount(t, auth, "two-factor")
+
+	pair, err := auth.LoginManual(ctx, acc.Username, acc.Password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	identityID := string(pair.Access.Body.UserID)
+	session := &http.Cookie{Name: src.CookieTokenName, Value: pair.Access.Token}
+
+	call := func(h http.HandlerFunc, method, target string, body any) *httptest.ResponseRecorder {
+		var req *http.Request
+		if body != nil {
+			b, _ := json.Marshal(body)
+			req = httptest.NewRequest(method, target, strings.NewReader(string(b)))
+			req.Header.Set("Content-Type", "application/json")
+		} else {
+			req = httptest.NewRequest(method, target, nil)
+		}
+		req.AddCookie(session)
+
+		w := httptest.NewRecorder()
+		h(w, req)
+		return w
+	}
+	code := func(secret string) string {
+		c, err := services.TOTPCode(secret, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c
+	}
+
+	var enrollment models.TwoFactorEnrollment
+	var recovery models.RecoveryCodes
+	t.Run("Enrolls", func(t *testing.T) {
+		w := call(src.TwoFactorEnrollHandler(auth), http.MethodPost, src.TwoFactorEnrollPath, nil)
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if err := json.NewDecoder(w.Body).Decode(&enrollment); err != nil {
+			t.Fatal(err)
+		}
+
+		uri, err := url.Parse(enrollment.URI)
+		if err != nil || uri.Scheme != "otpauth" || uri.Host != "totp" || uri.Query().Get("secret") != enrollment.Secret ||
+			uri.Query().Get("issuer") != conf.Issuer || !strings.HasSuffix(uri.Path, ":"+acc.Username) {
+			t.Errorf("unexpected provisioning uri %s", enrollment.URI)
+		}
+
+		// Not enabled before it is confirmed.
+		if _, err = auth.LoginManual(ctx, acc.Username, acc.Password); err != nil {
+			t.Errorf("unconfirmed enrollment guards logins: %v", err)
+		}
+
+		w = call(src.TwoFactorConfirmHandler(auth), http.MethodPost, src.TwoFactorConfirmPath, models.TwoFactorRequest{Code: "000000"})
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("wrong code: expected %d, got %d", http.StatusUnauthorized, w.Code)
+		}
+
+		w = call(src.TwoFactorConfirmHandler(auth), http.MethodPost, src.TwoFactorConfirmPath, models.TwoFactorRequest{Code: code(enrollment.Secret)})
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %d, got %d %s", http.StatusOK, w.Code, w.Body.String())
+		}
+		if err = json.NewDecoder(w.Body).Decode(&recovery); err != nil {
+			t.Fatal(err)
+		}
+		if len(recovery.Codes) != services.RecoveryCodeCount {
+			t.Errorf("expected %d recovery codes, got %d", services.RecoveryCodeCount, len(recovery.Codes))
+		}
+
+		w = call(src.TwoFactorEnrollHandler(auth), http.MethodPost, src.TwoFactorEnrollPath, nil)
+		if w.Code != http.StatusConflict {
+			t.Errorf("enrolling again: expected %d, got %d", http.StatusConflict, w.Code)
+		}
+	})
+
+	login := func(t *testing.T) *src.TwoFactorRequiredError {
+		t.Helper()
+
+		pair, err := auth.LoginManual(ctx, acc.Username, acc.Password)
+		var pending *src.TwoFactorRequiredError
+		if !errors.As(err, &pending) || pair != nil {
+			t.Fatalf("expected a login pending the second factor, got %v", err)
+		}
+		return pending
+	}
+
+	t.Run("LogsInInTwoSteps", func(t *testing.T) {
+		pending := login(t)
+
+		// The code confirming the enrollment was spent.
+		if _, err := auth.LoginTwoFactor(ctx, pending.Token, code(enrollment.Secret), ""); !errors.Is(err, services.ErrTwoFactorCode) {
+			t.Errorf("spent code: expected %v, got %v", services.ErrTwoFactorCode, err)
+		}
+
+		clock.t = clock.t.Add(services.TOTPPeriod)
+		next := code(enrollment.Secret)
+		pair, err := auth.LoginTwoFactor(ctx, pending.Token, next, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = auth.LoginToken(pair.Access.Token); err != nil {
+			t.Error(err)
+		}
+
+		if _, err = auth.LoginTwoFactor(ctx, login(t).Token, next, ""); !errors.Is(err, services.ErrTwoFactorCode) {
+			t.Errorf("replayed code: expected %v, got %v", services.ErrTwoFactorCode, err)
+		}
+	})
+
+	t.Run("PendingTokensExpire", func(t *testing.T) {
+		pending := login(t)
+
+		clock.t = clock.t.Add(src.TwoFactorPendingExpireTime + time.Minute)
+		if _, err := auth.LoginTwoFactor(ctx, pending.Token, code(enrollment.Secret), ""); !errors.Is(err, src.TwoFactorTokenError) {
+			t.Errorf("expected %v, got %v", src.TwoFactorTokenError, err)
+		}
+		if _, err := auth.LoginTwoFactor(ctx, pair.Access.Token, code(enrollment.Secret), ""); !errors.Is(err, src.TwoFactorTokenError) {
+			t.Errorf("access token passed for a pending token: %v", err)
+		}
+	})
+
+	t.Run("RecoveryCodesAreSingleUse", func(t *testing.T) {
+		typed := strings.ToUpper(strings.ReplaceAll(recovery.Codes[0], "-", " "))
+		if _, err := auth.LoginTwoFactor(ctx, login(t).Token, typed, ""); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := auth.LoginTwoFactor(ctx, login(t).Token, recovery.Codes[0], ""); !errors.Is(err, services.ErrTwoFactorCode) {
+			t.Errorf("recovery code accepted twice: %v", err)
+		}
+	})
+
+	t.Run("Handlers", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		src.LoginHandler(auth)(w, httptest.NewRequest(http.MethodPost, "/login",
+			strings.NewReader(`{"Username":"`+acc.Username+`","Password":"`+acc.Password+`"}`)))
+
+		var challenge models.TwoFactorChallenge
+		if w.Code != http.StatusAccepted || json.NewDecoder(w.Body).Decode(&challenge) != nil || challenge.Token == "" {
+			t.Fatalf("expected %d with a challenge, got %d", http.StatusAccepted, w.Code)
+		}
+		for _, c := range w.Result().Cookies() {
+			if c.Name == src.CookieTokenName {
+				t.Error("session handed out before the second factor")
+			}
+		}
+
+		clock.t = clock.t.Add(services.TOTPPeriod)
+		form := url.Values{"code": {code(enrollment.Secret)}}
+		r := httptest.NewRequest(http.MethodPost, src.TwoFactorLoginPath, strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.AddCookie(&http.Cookie{Name: src.CookieTwoFactorName, Value: challenge.Token})
+
+		w = httptest.NewRecorder()
+		src.TwoFactorLoginHandler(auth)(w, r)
+		if w.Code != http.StatusSeeOther {
+			t.Fatalf("expected %d, got %d %s", http.StatusSeeOther, w.Code, w.Body.String())
+		}
+
+		var access string
+		for _, c := range w.Result().Cookies() {
+			if c.Name == src.CookieTokenName {
+				access = c.Value
+			}
+		}
+		if err := auth.LoginToken(access); err != nil {
+			t.Errorf("no session after the second factor: %v", err)
+		}
+	})
+
+	t.Run("AdminReset", func(t *testing.T) {
+		target := src.TwoFactorAdminPath + "?identity_id=" + url.QueryEscape(identityID)
+
+		var status models.TwoFactorStatus
+		w := call(src.TwoFactorAdminHandler(auth), http.MethodGet, target, nil)
+		if w.Code != http.StatusOK || json.NewDecoder(w.Body).Decode(&status) != nil {
+			t.Fatalf("expected %d, got %d", http.StatusOK, w.Code)
+		}
+		if !status.Enabled || status.RecoveryCodes != services.RecoveryCodeCount-1 {
+			t.Errorf("unexpected status %+v", status)
+		}
+
+		if w = call(src.TwoFactorAdminHandler(auth), http.MethodDelete, target, nil); w.Code != http.StatusNoContent {
+			t.Fatalf("expected %d, got %d", http.StatusNoContent, w.Code)
+		}
+		if err := auth.LoginToken(session.Value); err == nil {
+			t.Error("session outlived the reset")
+		}
+
+		pair, err := auth.LoginManual(ctx, acc.Username, acc.Password)
+		if err != nil || pair == nil {
+			t.Fatalf("password alone rejected after the reset: %v", err)
+		}
+		session = &http.Cookie{Name: src.CookieTokenName, Value: pair.Access.Token}
+	})
+
+	t.Run("AdminEndpointNeedsAnAdmin", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodDelete, src.TwoFactorAdminPath+"?identity_id="+identityID, nil)
+		r.AddCookie(session)
+
+		w := httptest.NewRecorder()
+		auth.ServeHTTP(w, r)
+		if w.Code != http.StatusForbidden {
+			t.Errorf("expected %d, got %d", http.StatusForbidden, w.Code)
+		}
+	})
+
+}
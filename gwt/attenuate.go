@@ -0,0 +1,323 @@
+package gwt
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"time"
+)
+
+// Attenuation
+// ====================================================================================================
+// Any holder of an HS512 token can derive a child token that can do less, macaroon style,
+// without contacting the issuer:
+//
+//	payload.caveats.sig   caveats = 0x00 | 'A' | uvarint(n) | n * (uvarint(len) | caveat)
+//	sig_0 = signature of payload, sig_i = HMAC-SHA512(sig_i-1, caveat_i)
+//
+// Only sig_n travels with the child, so caveats can be appended but never removed. Verifying
+// needs the same HMAC key as the parent, which is why EdDSA tokens cannot be attenuated.
+// A child shares the parent's Header.ID, so revoking the parent revokes every child.
+
+const (
+	ErrorAttenuateAlg     = "only HS512 tokens can be attenuated"
+	ErrorMalformedCaveats = "token caveats are malformed"
+	ErrorCaveatEmpty      = "caveat restricts nothing"
+	ErrorCaveatAudience   = "caveat audience conflicts with the token audience"
+	ErrorCaveatBody       = "resource and permission caveats need a Resources token body"
+)
+
+const caveatsKind byte = 'A'
+
+// Caveat narrows what a token allows. Zero fields restrict nothing.
+type Caveat struct {
+	ResourceID   []byte       // ResourceID: only this resource remains.
+	ResourceType ResourceType // ResourceType: only resources of this type remain.
+	Permissions  Permission   // Permissions: every role is masked down to these.
+	Expires      time.Time    // Expires: the token expires at this time if it is earlier.
+	Audience     []byte       // Audience: the token is only for this audience.
+}
+
+// caveatWire is the signed form of a Caveat. Unknown fields fail to decode,
+// so an older verifier never ignores a restriction it does not understand.
+type caveatWire struct {
+	ResourceID   []byte       `json:"rid,omitempty"`
+	ResourceType ResourceType `json:"rt,omitempty"`
+	Permissions  Permission   `json:"perm,omitempty"`
+	Expires      int64        `json:"exp,omitempty"`
+	Audience     []byte       `json:"aud,omitempty"`
+}
+
+// Attenuate derives a child of parent restricted by caveats. Holding the parent token is enough,
+// no key is needed, and parent may itself be an attenuated token. Caveats on resources or
+// permissions are refused unless T is *Resources, they could not narrow any other body.
+func (m *MultiCoder[T]) Attenuate(parent string, caveats ...Caveat) (Token, error) {
+	var body T
+	if _, ok := any(body).(*Resources); !ok {
+		for _, c := range caveats {
+			if c.restrictsResources() {
+				return Token{}, errors.New(ErrorCaveatBody)
+			}
+		}
+	}
+
+	header, err := PeekHeader(parent)
+	if err != nil {
+		return Token{}, err
+	}
+	if header.Algorithm != "" && header.Algorithm != HS512 {
+		return Token{}, errors.New(ErrorAttenuateAlg)
+	}
+
+	payload, chain, sig, err := splitAttenuated(parent)
+	if err != nil {
+		return Token{}, err
+	}
+
+	for _, c := range caveats {
+		raw, err := c.encode()
+		if err != nil {
+			return Token{}, err
+		}
+
+		chain = append(chain, raw)
+		sig = chainSignature(sig, raw)
+	}
+
+	return Token{
+		Token:     payload + "." + encodeCaveats(chain) + "." + base64.URLEncoding.EncodeToString(sig),
+		Signature: hex.EncodeToString(sig),
+	}, nil
+}
+
+// Caveats returns the restrictions an attenuated token was decoded with.
+func (g *GWT[T]) Caveats() []Caveat {
+	return g.caveats
+}
+
+// verifyCaveats recomputes the signature chain of an attenuated token.
+func (c *coderConfig) verifyCaveats(header *Header, data []byte, chain [][]byte, sig []byte) error {
+	key, err := c.keys.Key(header.KeyID)
+	if err != nil {
+		return err
+	}
+	if key.Alg() != HS512 || (header.Algorithm != "" && header.Algorithm != HS512) {
+		return errors.New(ErrorAttenuateAlg)
+	}
+
+	expected, err := key.Sign(data)
+	if err != nil {
+		return err
+	}
+	for _, raw := range chain {
+		expected = chainSignature(expected, raw)
+	}
+
+	if !hmac.Equal(expected, sig) {
+		return errors.New(ErrorInvalidToken)
+	}
+
+	return nil
+}
+
+// applyCaveats narrows a decoded token to its caveats.
+func applyCaveats[T any](tok *GWT[T], chain [][]byte) error {
+	for _, raw := range chain {
+		c, err := decodeCaveat(raw)
+		if err != nil {
+			return err
+		}
+
+		if !c.Expires.IsZero() && (tok.Header.Expires.IsZero() || c.Expires.Before(tok.Header.Expires)) {
+			tok.Header.Expires = c.Expires
+		}
+
+		if c.Audience != nil {
+			if tok.Header.Audience != nil && !bytes.Equal(tok.Header.Audience, c.Audience) {
+				return errors.New(ErrorCaveatAudience)
+			}
+			tok.Header.Audience = c.Audience
+		}
+
+		if c.restrictsResources() {
+			res, ok := any(tok.Body).(*Resources)
+			if !ok {
+				return errors.New(ErrorCaveatBody)
+			}
+			if res != nil {
+				res.restrict(c)
+			}
+		}
+
+		tok.caveats = append(tok.caveats, c)
+	}
+
+	return nil
+}
+
+// restrictsResources reports whether c narrows the resources or permissions of a token body.
+func (c Caveat) restrictsResources() bool {
+	return c.ResourceID != nil || c.ResourceType != "" || c.Permissions != 0
+}
+
+// restrict narrows res to what c allows. A type-level grant narrows to the single resource c names.
+func (res *Resources) restrict(c Caveat) {
+	var kept []*Resource
+	for _, r := range res.Resources {
+		if c.ResourceType != "" && r.Type != c.ResourceType {
+			continue
+		}
+
+		if c.ResourceID != nil && !bytes.Equal(r.ResID, c.ResourceID) {
+			if !bytes.Equal(r.ResID, AnyResourceID) {
+				continue
+			}
+			r = &Resource{ResID: c.ResourceID, Type: r.Type, Roles: r.Roles}
+		}
+
+		if c.Permissions != 0 {
+			roles := make([]Role, len(r.Roles))
+			for i, role := range r.Roles {
+				role.Permissions &= c.Permissions
+				roles[i] = role
+			}
+			r.Roles = roles
+		}
+
+		kept = append(kept, r)
+	}
+	res.Resources = kept
+
+	// Inherited permissions are capped as well, see Evaluate.
+	if c.Permissions != 0 {
+		if res.limited {
+			res.limit &= c.Permissions
+		} else {
+			res.limited, res.limit = true, c.Permissions
+		}
+	}
+}
+
+func chainSignature(prev, caveat []byte) []byte {
+	m := hmac.New(sha512.New, prev)
+	m.Write(caveat)
+	return m.Sum(nil)
+}
+
+// Encoding
+// ----------------------------------------------------------------------------------------------------
+
+func (c Caveat) encode() ([]byte, error) {
+	wire := caveatWire{
+		ResourceID:   c.ResourceID,
+		ResourceType: c.ResourceType,
+		Permissions:  c.Permissions,
+		Audience:     c.Audience,
+	}
+	if !c.Expires.IsZero() {
+		wire.Expires = c.Expires.Unix()
+	}
+
+	if wire.ResourceID == nil && wire.ResourceType == "" && wire.Permissions == 0 && wire.Expires == 0 && wire.Audience == nil {
+		return nil, errors.New(ErrorCaveatEmpty)
+	}
+
+	return json.Marshal(wire)
+}
+func decodeCaveat(raw []byte) (Caveat, error) {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+
+	var wire caveatWire
+	if err := dec.Decode(&wire); err != nil {
+		return Caveat{}, errors.New(ErrorMalformedCaveats)
+	}
+
+	c := Caveat{
+		ResourceID:   wire.ResourceID,
+		ResourceType: wire.ResourceType,
+		Permissions:  wire.Permissions,
+		Audience:     wire.Audience,
+	}
+	if wire.Expires != 0 {
+		c.Expires = time.Unix(wire.Expires, 0).UTC()
+	}
+
+	return c, nil
+}
+
+func encodeCaveats(chain [][]byte) string {
+	buff := []byte{envelopeMarker, caveatsKind}
+	buff = binary.AppendUvarint(buff, uint64(len(chain)))
+	for _, raw := range chain {
+		buff = binary.AppendUvarint(buff, uint64(len(raw)))
+		buff = append(buff, raw...)
+	}
+
+	return base64.URLEncoding.EncodeToString(buff)
+}
+func decodeCaveats(segment string) ([][]byte, error) {
+	buff, err := base64.URLEncoding.DecodeString(segment)
+	if err != nil || len(buff) < 2 || buff[0] != envelopeMarker || buff[1] != caveatsKind {
+		return nil, errors.New(ErrorMalformedCaveats)
+	}
+
+	r := &resReader{buf: buff[2:]}
+	n, err := r.count()
+	if err != nil {
+		return nil, errors.New(ErrorMalformedCaveats)
+	}
+
+	chain := make([][]byte, n)
+	for i := range chain {
+		if chain[i], err = r.bytes(); err != nil {
+			return nil, errors.New(ErrorMalformedCaveats)
+		}
+	}
+	if r.remaining() != 0 {
+		return nil, errors.New(ErrorMalformedCaveats)
+	}
+
+	return chain, nil
+}
+
+// IsAttenuated reports whether token was derived with MultiCoder.Attenuate.
+// Attenuated tokens have three parts like JWTs, but are decoded with MultiCoder.Decode.
+func IsAttenuated(token string) bool {
+	return isAttenuated(strings.Split(token, "."))
+}
+
+// isAttenuated tells attenuated tokens apart from JWTs: the caveats segment starts with
+// 0x00 'A', which always encodes to "AE", while a JWT's middle segment is JSON ("ey").
+func isAttenuated(parts []string) bool {
+	return len(parts) == 3 && strings.HasPrefix(parts[1], "AE")
+}
+
+// splitAttenuated returns the payload segment, caveat chain and signature of a token,
+// attenuated or not.
+func splitAttenuated(token string) (payload string, chain [][]byte, sig []byte, err error) {
+	parts := strings.Split(token, ".")
+
+	switch {
+	case len(parts) == 2:
+	case isAttenuated(parts):
+		if chain, err = decodeCaveats(parts[1]); err != nil {
+			return "", nil, nil, err
+		}
+	default:
+		return "", nil, nil, errors.New(ErrorAttenuateAlg)
+	}
+
+	sig, err = base64.URLEncoding.DecodeString(parts[len(parts)-1])
+	if err != nil {
+		return "", nil, nil, errors.New(ErrorInvalidToken)
+	}
+
+	return parts[0], chain, sig, nil
+}
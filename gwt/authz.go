@@ -0,0 +1,208 @@
+package gwt
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+)
+
+// Authorization
+// ====================================================================================================
+// Evaluate answers whether Resources grant a Permission on a resource type or a single resource.
+// Roles inherit the DefaultRoles permissions of every built-in role they outrank, permissions are
+// unioned across all matching roles, and the Decision explains the outcome for audit logs.
+
+// AccessRequest describes what is being asked for. At least one of ResourceType or ResourceID is required,
+// ResourceType always is when ResourceID is AnyResourceID.
+type AccessRequest struct {
+	ResourceType ResourceType // ResourceType: every resource of this type is considered.
+	ResourceID   []byte       // ResourceID: narrows the request to a single resource.
+	Permission   Permission   // Permission: every bit must be granted.
+	MinRole      RoleType     // MinRole: least privileged role accepted, any role when empty.
+}
+
+// Grant is a role that contributed permissions to a Decision.
+type Grant struct {
+	ResourceID   []byte
+	ResourceType ResourceType
+	Role         RoleType
+	Permissions  Permission // Permissions: effective, inherited ones included.
+	Claims       map[RoleType]Claim
+}
+
+type Decision struct {
+	Allowed     bool
+	Reason      string
+	Permissions Permission // Permissions: union over every Grant.
+	Grants      []Grant
+}
+
+func (d Decision) String() string {
+	if d.Allowed {
+		return "allowed: " + d.Reason
+	}
+
+	return "denied: " + d.Reason
+}
+
+// Evaluate checks req against the Resources and explains the outcome.
+func (res *Resources) Evaluate(req AccessRequest) Decision {
+	if req.ResourceType == "" && req.ResourceID == nil {
+		return Decision{Reason: "request names no resource type or resource id"}
+	}
+	if req.ResourceType == "" && bytes.Equal(req.ResourceID, AnyResourceID) {
+		return Decision{Reason: "type-level request names no resource type"}
+	}
+
+	target := describeTarget(req)
+
+	var matched []*Resource
+	for _, r := range res.Resources {
+		if req.ResourceID != nil && !bytes.Equal(r.ResID, req.ResourceID) {
+			continue
+		}
+		if req.ResourceType != "" && r.Type != req.ResourceType {
+			continue
+		}
+
+		matched = append(matched, r)
+	}
+
+	if len(matched) == 0 {
+		return Decision{Reason: "no " + target + " assigned"}
+	}
+
+	decision := Decision{}
+	for _, r := range matched {
+		for _, role := range r.Roles {
+			if req.MinRole != "" && !role.Type.Hierarchy(req.MinRole) {
+				continue
+			}
+
+			effective := role.Permissions | inheritedPermissions(role.Type)
+			if res.limited {
+				effective &= res.limit
+			}
+			decision.Permissions |= effective
+			decision.Grants = append(decision.Grants, Grant{
+				ResourceID:   r.ResID,
+				ResourceType: r.Type,
+				Role:         role.Type,
+				Permissions:  effective,
+				Claims:       role.Claims,
+			})
+		}
+	}
+
+	if len(decision.Grants) == 0 {
+		decision.Reason = fmt.Sprintf("no role at or above %s on %s", req.MinRole, target)
+		return decision
+	}
+
+	if missing := req.Permission &^ decision.Permissions; missing != 0 {
+		decision.Reason = fmt.Sprintf("missing %s on %s, roles %s grant %s",
+			permissionNames(missing), target, grantRoles(decision.Grants), permissionNames(decision.Permissions))
+		return decision
+	}
+
+	decision.Allowed = true
+	decision.Reason = fmt.Sprintf("%s on %s granted by roles %s",
+		permissionNames(req.Permission), target, grantRoles(decision.Grants))
+	return decision
+}
+
+// Authorize is satisfied when any of roles is, each role asking for its own Type as the
+// minimum role and its Permissions. It returns the first allowed Decision, or the last denied one.
+func (res *Resources) Authorize(resourceType ResourceType, roles ...Role) Decision {
+	decision := Decision{Reason: "no roles requested"}
+	for _, role := range roles {
+		decision = res.Evaluate(AccessRequest{
+			ResourceType: resourceType,
+			Permission:   role.Permissions,
+			MinRole:      role.Type,
+		})
+
+		if decision.Allowed {
+			return decision
+		}
+	}
+
+	return decision
+}
+
+// AnyResourceID as a Resource.ResID makes its roles type-level grants,
+// holding on every resource of its type.
+var AnyResourceID = []byte("*")
+
+// AuthorizeInstance asks for perm on the single resource resID of resType,
+// falling back to type-level grants held under AnyResourceID. resType is required.
+func (res *Resources) AuthorizeInstance(resType ResourceType, resID []byte, perm Permission) Decision {
+	if resType == "" {
+		return Decision{Reason: "request names no resource type"}
+	}
+
+	decision := res.Evaluate(AccessRequest{ResourceType: resType, ResourceID: resID, Permission: perm})
+	if decision.Allowed || bytes.Equal(resID, AnyResourceID) {
+		return decision
+	}
+
+	fallback := res.Evaluate(AccessRequest{ResourceType: resType, ResourceID: AnyResourceID, Permission: perm})
+	if fallback.Allowed {
+		fallback.Reason = "type-level grant, " + fallback.Reason
+		return fallback
+	}
+
+	decision.Reason += ", no type-level grant either"
+	return decision
+}
+
+// inheritedPermissions unions the DefaultRoles permissions of the built-in roles ranked below roleType.
+func inheritedPermissions(roleType RoleType) Permission {
+	var perms Permission
+	for _, lower := range builtinRoleTypes {
+		if lower != roleType && roleType.Hierarchy(lower) {
+			perms |= DefaultRoles[lower].Permissions
+		}
+	}
+
+	return perms
+}
+
+func describeTarget(req AccessRequest) string {
+	switch {
+	case req.ResourceID != nil && req.ResourceType != "":
+		return fmt.Sprintf("%s resource %s", req.ResourceType, req.ResourceID)
+	case req.ResourceID != nil:
+		return fmt.Sprintf("resource %s", req.ResourceID)
+	default:
+		return fmt.Sprintf("%s resources", req.ResourceType)
+	}
+}
+
+func permissionNames(p Permission) string {
+	if p == 0 {
+		return "nothing"
+	}
+
+	var names []string
+	for _, perm := range []Permission{Read, Write, Edit, Delete} {
+		if p&perm != 0 {
+			names = append(names, perm.String())
+		}
+	}
+
+	return strings.Join(names, "|")
+}
+
+func grantRoles(grants []Grant) string {
+	seen := make(map[RoleType]bool, len(grants))
+	var roles []string
+	for _, g := range grants {
+		if !seen[g.Role] {
+			seen[g.Role] = true
+			roles = append(roles, g.Role.String())
+		}
+	}
+
+	return strings.Join(roles, ",")
+}
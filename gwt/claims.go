@@ -0,0 +1,80 @@
+package gwt
+
+import (
+	"bytes"
+	"errors"
+	"time"
+)
+
+const (
+	ErrorTokenNotYetValid = "token is not valid yet"
+	ErrorTokenFromFuture  = "token was issued in the future"
+	ErrorTokenAudience    = "token audience does not match"
+)
+
+// DefaultLeeway is the clock skew tolerated between the issuer and the verifier.
+const DefaultLeeway = time.Second * 30
+
+// WithClock replaces time.Now for stamping and validating tokens. Useful in tests.
+func WithClock(now func() time.Time) Option {
+	return func(c *coderConfig) {
+		c.now = now
+	}
+}
+
+// WithLeeway sets the clock skew tolerated when checking Expires, NotBefore and IssuedAt.
+func WithLeeway(leeway time.Duration) Option {
+	return func(c *coderConfig) {
+		c.leeway = leeway
+	}
+}
+
+// WithAudience stamps tokens minted by the MultiCoder with audience,
+// and makes the ValidateGWT* helpers reject tokens minted for anyone else.
+func WithAudience(audience []byte) Option {
+	return func(c *coderConfig) {
+		c.audience = audience
+	}
+}
+
+func (c *coderConfig) clock() time.Time {
+	if c.now == nil {
+		return time.Now().UTC()
+	}
+
+	return c.now().UTC()
+}
+
+// stamp fills the time and audience claims the caller left empty.
+func (c *coderConfig) stamp(header *Header) {
+	if header.IssuedAt.IsZero() {
+		header.IssuedAt = c.clock()
+	}
+	if header.Audience == nil {
+		header.Audience = c.audience
+	}
+}
+
+// validateClaims checks the temporal and audience claims of header.
+func (c *coderConfig) validateClaims(header *Header) error {
+	now := c.clock()
+
+	if now.After(header.Expires.Add(c.leeway)) {
+		return errors.New(ErrorTokenExpired)
+	}
+
+	if !header.NotBefore.IsZero() && now.Add(c.leeway).Before(header.NotBefore) {
+		return errors.New(ErrorTokenNotYetValid)
+	}
+
+	if !header.IssuedAt.IsZero() && now.Add(c.leeway).Before(header.IssuedAt) {
+		return errors.New(ErrorTokenFromFuture)
+	}
+
+	// A token minted for an audience is only accepted by a verifier that is that audience.
+	if (c.audience != nil || header.Audience != nil) && !bytes.Equal(c.audience, header.Audience) {
+		return errors.New(ErrorTokenAudience)
+	}
+
+	return nil
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"github.com/vaiktorg/grimoire/gwt"
+)
+
+func decodeCmd(args []string) error {
+	fs := flag.NewFlagSet("decode", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "Usage: gwt decode [token|-]\n\nPrints the header and body of a token WITHOUT verifying it.\n")
+	}
+	_ = fs.Parse(args)
+
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	view := tokenView{Note: "not verified"}
+
+	// A sealed body still leaves the header worth printing.
+	tok, err := gwt.Peek[*gwt.Resources](token)
+	switch {
+	case err != nil && err.Error() == gwt.ErrorBodyEncrypted:
+		view.Note += ", " + err.Error()
+	case err != nil:
+		return err
+	default:
+		view.Body = newResourcesDoc(tok.Body)
+	}
+
+	view.Header = newHeaderView(tok.Header)
+	return printJSON(view)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"os"
+	"strings"
+)
+
+func keygenCmd(args []string) error {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	alg := fs.String("alg", string(gwt.HS512), "key algorithm, HS512 or EdDSA")
+	id := fs.String("id", "", "key ID, random when empty")
+	out := fs.String("out", "", "key file to write; an existing file gets the key added and activated (required)")
+	public := fs.String("public", "", "also write a verify-only key file for EdDSA keys")
+	_ = fs.Parse(args)
+
+	if *out == "" {
+		fs.Usage()
+		return errors.New("out is required")
+	}
+	if *id == "" {
+		*id = uid.NewUID(8).String()
+	}
+
+	var key *gwt.Key
+	var err error
+	switch strings.ToUpper(*alg) {
+	case string(gwt.HS512):
+		secret := make([]byte, gwt.KeySize)
+		if _, err = rand.Read(secret); err != nil {
+			return err
+		}
+		key = &gwt.Key{ID: *id, Algorithm: gwt.HS512, Secret: secret}
+	case strings.ToUpper(string(gwt.EdDSA)), "ED25519":
+		if key, err = gwt.NewEd25519Key(*id); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported algorithm %q", *alg)
+	}
+
+	kr := gwt.NewKeyRing()
+	if _, err = os.Stat(*out); err == nil {
+		if kr, err = gwt.LoadKeyRingFile(*out); err != nil {
+			return err
+		}
+	}
+
+	if err = kr.RotateKey(key); err != nil {
+		return err
+	}
+	if err = kr.SaveFile(*out); err != nil {
+		return err
+	}
+
+	if *public != "" {
+		if key.Alg() != gwt.EdDSA {
+			return errors.New("public key files only hold EdDSA keys")
+		}
+		if err = kr.Public().SaveFile(*public); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("%s key %s is now active in %s\n", key.Alg(), key.ID, *out)
+	if thumb := key.Thumbprint(); thumb != "" {
+		fmt.Printf("thumbprint %s, pass it to mint -bind to bind tokens to this key\n", thumb)
+	}
+	return nil
+}
@@ -1,5 +1,42 @@
 package main
 
+import (
+	"fmt"
+	"os"
+)
+
+const usage = `Usage: gwt <command> [flags]
+
+Commands:
+  mint     sign a new token
+  decode   print the header and body of a token WITHOUT verifying it
+  verify   check the signature and claims of a token against a key file
+  keygen   generate HMAC or Ed25519 key material into a key file
+
+Run "gwt <command> -h" for the flags of a command.
+`
+
+var commands = map[string]func(args []string) error{
+	"mint":   mintCmd,
+	"decode": decodeCmd,
+	"verify": verifyCmd,
+	"keygen": keygenCmd,
+}
+
 func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	cmd, ok := commands[os.Args[1]]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "gwt: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
 
+	if err := cmd(os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "gwt %s: %s\n", os.Args[1], err)
+		os.Exit(1)
+	}
 }
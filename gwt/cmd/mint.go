@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"time"
+)
+
+func mintCmd(args []string) error {
+	fs := flag.NewFlagSet("mint", flag.ExitOnError)
+	keys := fs.String("keys", "", "key file to sign with, the embedded default key when empty")
+	issuer := fs.String("issuer", "", "token issuer (required)")
+	recipient := fs.String("recipient", "", "token recipient (required)")
+	audience := fs.String("audience", "", "token audience")
+	ttl := fs.Duration("ttl", gwt.TokenExpireTime, "time until the token expires")
+	resources := fs.String("resources", "", "JSON file with the token resources")
+	encKey := fs.String("enc-key", "", "base64 AES key to encrypt the body with")
+	asJWT := fs.Bool("jwt", false, "mint a compact JWT instead of a GWT")
+	bind := fs.String("bind", "", "key thumbprint the holder must prove possession of")
+	compact := fs.Bool("compact", false, "mint a compact, deflated GWT for size constrained cookies")
+	_ = fs.Parse(args)
+
+	if *issuer == "" || *recipient == "" {
+		fs.Usage()
+		return errors.New("issuer and recipient are required")
+	}
+
+	opts, err := coderOptions(*keys, *encKey, *audience)
+	if err != nil {
+		return err
+	}
+	if *compact {
+		opts = append(opts, gwt.WithCompactEncoding(true))
+	}
+
+	mc, err := gwt.NewMultiCoder[*gwt.Resources](opts...)
+	if err != nil {
+		return err
+	}
+
+	body := gwt.NewResources(uid.New())
+	if *resources != "" {
+		if body, err = readResourcesFile(*resources); err != nil {
+			return err
+		}
+	}
+
+	tok := &gwt.GWT[*gwt.Resources]{
+		Header: gwt.Header{
+			Issuer:    []byte(*issuer),
+			Recipient: []byte(*recipient),
+			Expires:   time.Now().Add(*ttl).UTC(),
+
+			Confirmation: *bind,
+		},
+		Body: body,
+	}
+
+	var token gwt.Token
+	if *asJWT {
+		token, err = mc.EncodeJWT(tok)
+	} else {
+		token, err = mc.Encode(tok)
+	}
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(token.Token)
+	return nil
+}
+
+// coderOptions builds MultiCoder options from the shared -keys, -enc-key and -audience flags.
+func coderOptions(keysPath, encKey, audience string) ([]gwt.Option, error) {
+	var opts []gwt.Option
+
+	if keysPath != "" {
+		kr, err := gwt.LoadKeyRingFile(keysPath)
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, gwt.WithKeyRing(kr))
+	}
+
+	key, err := readKey(encKey)
+	if err != nil {
+		return nil, err
+	}
+	if key != nil {
+		opts = append(opts, gwt.WithEncryptionKey(key))
+	}
+
+	if audience != "" {
+		opts = append(opts, gwt.WithAudience([]byte(audience)))
+	}
+
+	return opts, nil
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"github.com/vaiktorg/grimoire/gwt"
+	"strings"
+)
+
+func verifyCmd(args []string) error {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	keys := fs.String("keys", "", "key file to verify with, the embedded default key when empty")
+	audience := fs.String("audience", "", "expected audience, the token's own audience when empty")
+	encKey := fs.String("enc-key", "", "base64 AES key to decrypt the body with")
+	leeway := fs.Duration("leeway", gwt.DefaultLeeway, "clock skew allowed on expiry and not-before")
+	_ = fs.Parse(args)
+
+	token, err := readToken(fs.Args())
+	if err != nil {
+		return err
+	}
+
+	if *audience == "" {
+		if header, err := gwt.PeekHeader(token); err == nil {
+			*audience = string(header.Audience)
+		}
+	}
+
+	opts, err := coderOptions(*keys, *encKey, *audience)
+	if err != nil {
+		return err
+	}
+	opts = append(opts, gwt.WithLeeway(*leeway))
+
+	mc, err := gwt.NewMultiCoder[*gwt.Resources](opts...)
+	if err != nil {
+		return err
+	}
+
+	var tok *gwt.GWT[*gwt.Resources]
+	if strings.Count(token, ".") == 2 && !gwt.IsAttenuated(token) {
+		tok, err = mc.DecodeJWT(token)
+	} else {
+		tok, err = mc.Decode(token)
+	}
+	if err != nil {
+		return err
+	}
+
+	if err = gwt.ValidateGWT(tok); err != nil {
+		return err
+	}
+
+	return printJSON(tokenView{
+		Header: newHeaderView(tok.Header),
+		Body:   newResourcesDoc(tok.Body),
+		Note:   "verified",
+	})
+}
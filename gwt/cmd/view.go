@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// headerView is a Header with its byte fields printed as text.
+type headerView struct {
+	ID        string        `json:"id,omitempty"`
+	Issuer    string        `json:"issuer"`
+	Recipient string        `json:"recipient"`
+	Audience  string        `json:"audience,omitempty"`
+	IssuedAt  *time.Time    `json:"issued_at,omitempty"`
+	NotBefore *time.Time    `json:"not_before,omitempty"`
+	Expires   time.Time     `json:"expires"`
+	Expired   bool          `json:"expired"`
+	KeyID     string        `json:"key_id,omitempty"`
+	Algorithm gwt.Algorithm `json:"algorithm,omitempty"`
+	Bound     string        `json:"bound_to,omitempty"`
+}
+
+// resourcesDoc is the JSON shape of gwt.Resources read by mint and printed by decode and verify.
+type resourcesDoc struct {
+	UserID    string        `json:"user_id"`
+	Resources []resourceDoc `json:"resources"`
+}
+type resourceDoc struct {
+	ID    string           `json:"id,omitempty"`
+	Type  gwt.ResourceType `json:"type"`
+	Roles []roleDoc        `json:"roles"`
+}
+type roleDoc struct {
+	Type        gwt.RoleType      `json:"type"`
+	Permissions []string          `json:"permissions"`
+	Claims      map[string]string `json:"claims,omitempty"`
+}
+
+type tokenView struct {
+	Header headerView    `json:"header"`
+	Body   *resourcesDoc `json:"body,omitempty"`
+	Note   string        `json:"note,omitempty"`
+}
+
+func newHeaderView(h gwt.Header) headerView {
+	return headerView{
+		ID:        h.ID,
+		Issuer:    string(h.Issuer),
+		Recipient: string(h.Recipient),
+		Audience:  string(h.Audience),
+		IssuedAt:  timeOrNil(h.IssuedAt),
+		NotBefore: timeOrNil(h.NotBefore),
+		Expires:   h.Expires,
+		Expired:   time.Now().After(h.Expires),
+		KeyID:     h.KeyID,
+		Algorithm: h.Algorithm,
+		Bound:     h.Confirmation,
+	}
+}
+
+func newResourcesDoc(res *gwt.Resources) *resourcesDoc {
+	if res == nil {
+		return nil
+	}
+
+	doc := &resourcesDoc{UserID: string(res.UserID), Resources: []resourceDoc{}}
+	for _, r := range res.Resources {
+		rd := resourceDoc{ID: string(r.ResID), Type: r.Type, Roles: []roleDoc{}}
+		for _, role := range r.Roles {
+			perms := []string{}
+			for _, p := range []gwt.Permission{gwt.Read, gwt.Write, gwt.Edit, gwt.Delete} {
+				if role.HasPermission(p) {
+					perms = append(perms, p.String())
+				}
+			}
+
+			claims := make(map[string]string, len(role.Claims))
+			for k, c := range role.Claims {
+				claims[k.String()] = c.Value()
+			}
+
+			rd.Roles = append(rd.Roles, roleDoc{Type: role.Type, Permissions: perms, Claims: claims})
+		}
+		doc.Resources = append(doc.Resources, rd)
+	}
+
+	return doc
+}
+
+func (doc *resourcesDoc) toResources() (*gwt.Resources, error) {
+	res := gwt.NewResources(uid.UID(doc.UserID))
+	for _, rd := range doc.Resources {
+		if rd.Type == "" {
+			return nil, errors.New("resource type is required")
+		}
+
+		id := rd.ID
+		if id == "" {
+			id = uid.NewUID(gwt.FixedIDLen).String()
+		}
+
+		r := &gwt.Resource{ResID: []byte(id), Type: rd.Type}
+		for _, role := range rd.Roles {
+			nRole := gwt.Role{Type: role.Type, Claims: map[gwt.RoleType]gwt.Claim{}}
+			for _, name := range role.Permissions {
+				perm, err := gwt.ParsePermission(name)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", name, err)
+				}
+				nRole.Permissions |= perm
+			}
+
+			for k, v := range role.Claims {
+				nRole.AddClaim(gwt.RoleType(k), v)
+			}
+
+			r.Roles = append(r.Roles, nRole)
+		}
+
+		res.Resources = append(res.Resources, r)
+	}
+
+	return res, nil
+}
+
+func readResourcesFile(path string) (*gwt.Resources, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc resourcesDoc
+	if err = json.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	return doc.toResources()
+}
+
+// readToken takes the token from args, or from stdin when args is empty or "-".
+// A leading "Bearer " is dropped so Authorization headers can be pasted as they are.
+func readToken(args []string) (string, error) {
+	var token string
+	if len(args) > 0 && args[0] != "-" {
+		token = args[0]
+	} else {
+		data, err := io.ReadAll(bufio.NewReader(os.Stdin))
+		if err != nil {
+			return "", err
+		}
+		token = string(data)
+	}
+
+	token = strings.TrimPrefix(strings.TrimSpace(token), "Bearer ")
+	if token == "" {
+		return "", errors.New(gwt.ErrorNoTokenFound)
+	}
+
+	return token, nil
+}
+
+// readKey decodes base64 key material from a flag.
+func readKey(b64 string) ([]byte, error) {
+	if b64 == "" {
+		return nil, nil
+	}
+
+	return base64.StdEncoding.DecodeString(b64)
+}
+
+func printJSON(v any) error {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+
+	return &t
+}
@@ -0,0 +1,189 @@
+package gwt
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"github.com/vaiktorg/grimoire/util"
+	"io"
+	"sync"
+)
+
+// Compact envelopes
+// ====================================================================================================
+// Compact envelopes replace gob, which repeats type descriptions in every token, with a fixed
+// binary layout. Resources bodies use Resources.Serialize, any other body falls back to gob:
+//
+//	header: len ID | len Issuer | len Recipient | len Audience |
+//	        varint IssuedAt | varint NotBefore | varint Expires |  (unix seconds, 0 when zero)
+//	        len KeyID | len Algorithm | len Confirmation
+//	body:   flags | body                                           (flags: compactDeflate, compactResources)
+//
+// Times lose their sub-second part. Decode detects the layout by itself, so coders configured
+// without WithCompactEncoding still read compact tokens.
+
+const ErrorCompactBody = "compact token body does not match the token type"
+
+const (
+	compactDeflate   byte = 1 << iota // body is deflated
+	compactResources                  // body is Resources.Serialize, gob otherwise
+)
+
+// WithCompactEncoding mints compact envelopes instead of gob payloads, deflating bodies when
+// compress is set and it makes them smaller. Encrypted tokens, see WithEncryptionKey, are not affected.
+func WithCompactEncoding(compress bool) Option {
+	return func(c *coderConfig) {
+		c.compact = true
+		c.compress = compress
+	}
+}
+
+func encodeCompact[T any](c *coderConfig, tok *GWT[T]) ([]byte, error) {
+	var flags byte
+	var body []byte
+
+	var err error
+	if res, ok := any(tok.Body).(*Resources); ok && res != nil {
+		flags |= compactResources
+		if body, err = res.Serialize(); err != nil {
+			return nil, err
+		}
+	} else if body, err = encodeGob(tok.Body); err != nil {
+		return nil, err
+	}
+
+	if c.compress {
+		if deflated, err := deflate(body); err == nil && len(deflated) < len(body) {
+			flags |= compactDeflate
+			body = deflated
+		}
+	}
+
+	payload := newEnvelope(envelopeCompact, encodeCompactHeader(&tok.Header))
+	payload = append(payload, flags)
+	return append(payload, body...), nil
+}
+func decodeCompact[T any](data []byte) (body T, err error) {
+	if len(data) == 0 {
+		return body, errors.New(ErrorMalformedEnvelope)
+	}
+
+	flags, data := data[0], data[1:]
+	if flags&compactDeflate != 0 {
+		if data, err = inflate(data); err != nil {
+			return body, errors.New(ErrorMalformedEnvelope)
+		}
+	}
+
+	if flags&compactResources == 0 {
+		err = util.DecodeGob(bytes.NewReader(data), &body)
+		return body, err
+	}
+
+	// Resources bodies only decode into a GWT[*Resources].
+	if _, ok := any(body).(*Resources); !ok {
+		return body, errors.New(ErrorCompactBody)
+	}
+
+	res := &Resources{}
+	if err = res.Deserialize(data); err != nil {
+		return body, err
+	}
+
+	return any(res).(T), nil
+}
+
+func encodeCompactHeader(h *Header) []byte {
+	buff := appendBytes(nil, []byte(h.ID))
+	buff = appendBytes(buff, h.Issuer)
+	buff = appendBytes(buff, h.Recipient)
+	buff = appendBytes(buff, h.Audience)
+	buff = binary.AppendVarint(buff, unixOrZero(h.IssuedAt))
+	buff = binary.AppendVarint(buff, unixOrZero(h.NotBefore))
+	buff = binary.AppendVarint(buff, unixOrZero(h.Expires))
+	buff = appendBytes(buff, []byte(h.KeyID))
+	buff = appendBytes(buff, []byte(h.Algorithm))
+	return appendBytes(buff, []byte(h.Confirmation))
+}
+func decodeCompactHeader(data []byte) (Header, error) {
+	r := &resReader{buf: data}
+
+	var h Header
+	var fields [7][]byte
+	var times [3]int64
+	var err error
+
+	for i := 0; i < 4; i++ {
+		if fields[i], err = r.bytes(); err != nil {
+			return h, errors.New(ErrorMalformedEnvelope)
+		}
+	}
+	for i := range times {
+		if times[i], err = r.varint(); err != nil {
+			return h, errors.New(ErrorMalformedEnvelope)
+		}
+	}
+	for i := 4; i < 7; i++ {
+		if fields[i], err = r.bytes(); err != nil {
+			return h, errors.New(ErrorMalformedEnvelope)
+		}
+	}
+	if r.remaining() != 0 {
+		return h, errors.New(ErrorMalformedEnvelope)
+	}
+
+	h.ID = string(fields[0])
+	h.Issuer = bytesOrNil(string(fields[1]))
+	h.Recipient = bytesOrNil(string(fields[2]))
+	h.Audience = bytesOrNil(string(fields[3]))
+	h.IssuedAt = timeOrZero(times[0])
+	h.NotBefore = timeOrZero(times[1])
+	h.Expires = timeOrZero(times[2])
+	h.KeyID = string(fields[4])
+	h.Algorithm = Algorithm(fields[5])
+	h.Confirmation = string(fields[6])
+
+	return h, nil
+}
+
+// deflaters are pooled, a flate.Writer allocates several hundred KB of state.
+var deflaters = sync.Pool{New: func() any {
+	w, _ := flate.NewWriter(nil, flate.BestCompression)
+	return w
+}}
+
+func deflate(data []byte) ([]byte, error) {
+	w := deflaters.Get().(*flate.Writer)
+	defer deflaters.Put(w)
+
+	buff := new(bytes.Buffer)
+	w.Reset(buff)
+
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// maxInflated bounds what a compact body may inflate to, well above any cookie sized token.
+const maxInflated = 1 << 20
+
+func inflate(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+
+	out, err := io.ReadAll(io.LimitReader(r, maxInflated+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(out) > maxInflated {
+		return nil, errors.New(ErrorMalformedEnvelope)
+	}
+
+	return out, nil
+}
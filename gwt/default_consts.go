@@ -17,8 +17,6 @@ func (r ResourceType) String() string {
 	return string(r)
 }
 
-var defaultResourceTypeIdx = map[ResourceType]int{}
-
 // Roles ====================================================================================================
 
 type RoleType string
@@ -38,8 +36,8 @@ const (
 )
 
 func (r RoleType) Hierarchy(compare RoleType) bool {
-	t1, ok1 := defaultRoleTypeIdx[r]
-	t2, ok2 := defaultRoleTypeIdx[compare]
+	t1, ok1 := DefaultRegistry.RoleTypeIndex(r)
+	t2, ok2 := DefaultRegistry.RoleTypeIndex(compare)
 
 	if !ok1 || !ok2 {
 		return false
@@ -57,12 +55,3 @@ var DefaultRoles = map[RoleType]Role{
 	Guest: {Type: Guest, Permissions: Read},
 	User:  {Type: User, Permissions: Read},
 }
-
-var defaultRoleTypeIdx = map[RoleType]int{
-	Owner: 0,
-	Admin: 1,
-	Dev:   2,
-	Mod:   3,
-	Guest: 4,
-	User:  5,
-}
@@ -0,0 +1,313 @@
+package gwt
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/util"
+	"strings"
+)
+
+// Envelopes
+// ====================================================================================================
+// Legacy tokens carry a gob encoded GWT as their payload. Every other payload layout starts with
+// envelopeMarker, which a gob stream never does (it opens with a non-zero message length),
+// followed by a byte naming the layout:
+//
+//	0x00 | kind | uvarint(len(header)) | header | body
+
+const (
+	ErrorTokenDecrypt      = "token could not be decrypted"
+	ErrorNoEncryptionKey   = "token is encrypted but no encryption key is configured"
+	ErrorUnknownEnvelope   = "token envelope is not supported"
+	ErrorMalformedEnvelope = "token envelope is malformed"
+	ErrorBodyEncrypted     = "token body is encrypted"
+)
+
+const envelopeMarker byte = 0x00
+
+const (
+	envelopeEncrypted byte = 'E' // header readable, body sealed with AES-GCM
+	envelopeCompact   byte = 'C' // binary header and body, see WithCompactEncoding
+)
+
+// WithEncryptionKey seals token bodies with AES-GCM under key (16, 24 or 32 bytes).
+// The Header stays readable, see PeekHeader, and is covered by the token signature.
+// Decode verifies the signature and decrypts in one step.
+func WithEncryptionKey(key []byte) Option {
+	return func(c *coderConfig) {
+		c.encKey = key
+	}
+}
+
+func (c *coderConfig) initCrypto() error {
+	if c.encKey == nil {
+		c.crypto = nil
+		return nil
+	}
+
+	block, err := aes.NewCipher(c.encKey)
+	if err != nil {
+		return err
+	}
+
+	c.crypto, err = util.NewCrypto(block)
+	return err
+}
+
+func isEnvelope(payload []byte) bool {
+	return len(payload) > 1 && payload[0] == envelopeMarker
+}
+
+func newEnvelope(kind byte, header []byte) []byte {
+	payload := []byte{envelopeMarker, kind}
+	payload = binary.AppendUvarint(payload, uint64(len(header)))
+	return append(payload, header...)
+}
+
+// splitEnvelope returns the kind, header and body sections of an envelope payload.
+func splitEnvelope(payload []byte) (kind byte, header, body []byte, err error) {
+	if !isEnvelope(payload) {
+		return 0, nil, nil, errors.New(ErrorMalformedEnvelope)
+	}
+
+	kind = payload[1]
+	hdrLen, n := binary.Uvarint(payload[2:])
+	if n <= 0 || hdrLen > uint64(len(payload)-2-n) {
+		return 0, nil, nil, errors.New(ErrorMalformedEnvelope)
+	}
+
+	start := 2 + n
+	end := start + int(hdrLen)
+	return kind, payload[start:end], payload[end:], nil
+}
+
+func encodeGob(v any) ([]byte, error) {
+	buff := new(bytes.Buffer)
+	if err := util.EncodeGob(buff, v); err != nil {
+		return nil, err
+	}
+
+	return buff.Bytes(), nil
+}
+
+// Encrypted
+// ----------------------------------------------------------------------------------------------------
+
+func encodeEncrypted[T any](c *coderConfig, tok *GWT[T]) ([]byte, error) {
+	hdr, err := encodeGob(tok.Header)
+	if err != nil {
+		return nil, err
+	}
+
+	body, err := encodeGob(tok.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	sealed, err := c.crypto.EncryptGCM(body)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(newEnvelope(envelopeEncrypted, hdr), sealed...), nil
+}
+func decodeEncrypted[T any](c *coderConfig, sealed []byte) (body T, err error) {
+	if c.crypto == nil {
+		return body, errors.New(ErrorNoEncryptionKey)
+	}
+
+	plain, err := c.crypto.DecryptGCM(sealed)
+	if err != nil {
+		return body, errors.New(ErrorTokenDecrypt)
+	}
+
+	err = util.DecodeGob(bytes.NewReader(plain), &body)
+	return body, err
+}
+
+// decodeEnvelope authenticates payload with verify and unpacks it into a GWT.
+func decodeEnvelope[T any](c *coderConfig, payload []byte, verify func(*Header) error) (*GWT[T], error) {
+	kind, hdrBuff, bodyBuff, err := splitEnvelope(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := decodeEnvelopeHeader(kind, hdrBuff)
+	if err != nil {
+		return nil, err
+	}
+
+	// Authenticate before touching the body.
+	if err = verify(&header); err != nil {
+		return nil, err
+	}
+
+	ret := &GWT[T]{Header: header}
+	switch kind {
+	case envelopeEncrypted:
+		ret.Body, err = decodeEncrypted[T](c, bodyBuff)
+	case envelopeCompact:
+		ret.Body, err = decodeCompact[T](bodyBuff)
+	default:
+		err = errors.New(ErrorUnknownEnvelope)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return ret, nil
+}
+
+// decodeEnvelopeHeader reads the header section of an envelope of kind.
+func decodeEnvelopeHeader(kind byte, hdrBuff []byte) (Header, error) {
+	if kind == envelopeCompact {
+		return decodeCompactHeader(hdrBuff)
+	}
+
+	var header Header
+	if err := util.DecodeGob(bytes.NewReader(hdrBuff), &header); err != nil {
+		return header, errors.New(ErrorMalformedEnvelope)
+	}
+
+	return header, nil
+}
+
+// PeekHeader returns the Header of any token format WITHOUT verifying it.
+// Use it for routing, never for trust decisions.
+// Caveats of attenuated tokens are applied to the returned Header.
+func PeekHeader(token string) (*Header, error) {
+	parts := strings.Split(token, ".")
+	if !isAttenuated(parts) {
+		return peekHeader(parts)
+	}
+
+	chain, err := decodeCaveats(parts[1])
+	if err != nil {
+		return nil, err
+	}
+
+	header, err := peekHeader([]string{parts[0], parts[2]})
+	if err != nil {
+		return nil, err
+	}
+
+	// Without a body only the header caveats take effect.
+	tok := &GWT[*Resources]{Header: *header}
+	if err = applyCaveats(tok, chain); err != nil {
+		return nil, err
+	}
+
+	return &tok.Header, nil
+}
+func peekHeader(parts []string) (*Header, error) {
+	switch len(parts) {
+	case 3:
+		claimsBuff, err := b64JWT.DecodeString(parts[1])
+		if err != nil {
+			return nil, errors.New(ErrorJWTMalformed)
+		}
+
+		var claims jwtClaims[json.RawMessage]
+		if err = json.Unmarshal(claimsBuff, &claims); err != nil {
+			return nil, errors.New(ErrorJWTMalformed)
+		}
+
+		header := claims.header()
+		if hdrBuff, err := b64JWT.DecodeString(parts[0]); err == nil {
+			var hdr jwtHeader
+			if json.Unmarshal(hdrBuff, &hdr) == nil {
+				header.KeyID, header.Algorithm = hdr.Kid, hdr.Alg
+			}
+		}
+
+		return header, nil
+	case 2:
+		payload, err := base64.URLEncoding.DecodeString(parts[0])
+		if err != nil {
+			return nil, err
+		}
+
+		if isEnvelope(payload) {
+			kind, hdrBuff, _, err := splitEnvelope(payload)
+			if err != nil {
+				return nil, err
+			}
+
+			header, err := decodeEnvelopeHeader(kind, hdrBuff)
+			return &header, err
+		}
+
+		// Gob matches fields by name, so the Header can be lifted out of any GWT[T].
+		var legacy struct{ Header Header }
+		err = util.DecodeGob(bytes.NewReader(payload), &legacy)
+		return &legacy.Header, err
+	default:
+		return nil, errors.New(ErrorInvalidToken)
+	}
+}
+
+// Peek returns the Header and Body of any token format WITHOUT verifying it, for inspection
+// and debugging only. Encrypted bodies stay sealed: the GWT is returned with its Header and
+// an ErrorBodyEncrypted error.
+func Peek[T any](token string) (*GWT[T], error) {
+	header, err := PeekHeader(token)
+	if err != nil {
+		return nil, err
+	}
+
+	ret := &GWT[T]{Header: *header, Token: token}
+	parts := strings.Split(token, ".")
+
+	// The Header already carries the caveats, the Body still has to be narrowed.
+	var chain [][]byte
+	if isAttenuated(parts) {
+		if chain, err = decodeCaveats(parts[1]); err != nil {
+			return nil, err
+		}
+		parts = []string{parts[0], parts[2]}
+	}
+
+	if len(parts) == 3 {
+		claimsBuff, _ := b64JWT.DecodeString(parts[1])
+
+		var claims jwtClaims[T]
+		if err = json.Unmarshal(claimsBuff, &claims); err != nil {
+			return nil, errors.New(ErrorJWTMalformed)
+		}
+
+		ret.Body = claims.Body
+		return ret, nil
+	}
+
+	payload, _ := base64.URLEncoding.DecodeString(parts[0])
+	if !isEnvelope(payload) {
+		var legacy struct{ Body T }
+		if err = util.DecodeGob(bytes.NewReader(payload), &legacy); err != nil {
+			return nil, err
+		}
+
+		ret.Body = legacy.Body
+		return ret, applyCaveats(ret, chain)
+	}
+
+	kind, _, bodyBuff, _ := splitEnvelope(payload)
+	switch kind {
+	case envelopeCompact:
+		if ret.Body, err = decodeCompact[T](bodyBuff); err != nil {
+			return nil, err
+		}
+		return ret, applyCaveats(ret, chain)
+	case envelopeEncrypted:
+		if err = applyCaveats(ret, chain); err != nil {
+			return nil, err
+		}
+		return ret, errors.New(ErrorBodyEncrypted)
+	default:
+		return nil, errors.New(ErrorUnknownEnvelope)
+	}
+}
@@ -1,14 +1,13 @@
 package gwt
 
 import (
-	"bytes"
 	"crypto/hmac"
 	"crypto/sha512"
 	_ "embed"
 	"encoding/base64"
 	"encoding/hex"
-	"encoding/json"
 	"errors"
+	"github.com/vaiktorg/grimoire/uid"
 	"github.com/vaiktorg/grimoire/util"
 	"strings"
 	"time"
@@ -38,6 +37,39 @@ var spice = Spice{
 type MultiCoder[T any] struct {
 	spice Spice
 	mc    *util.MultiCoder[*GWT[T]]
+	conf  *coderConfig
+}
+
+// coderConfig is shared between a MultiCoder and the tokens it decodes,
+// so the ValidateGWT* helpers verify with the same keys the token was decoded with.
+type coderConfig struct {
+	keys        *KeyRing
+	revocations RevocationStore
+
+	now      func() time.Time
+	leeway   time.Duration
+	audience []byte
+
+	encKey []byte
+	crypto *util.Crypto
+
+	compact  bool
+	compress bool
+
+	nonces      NonceCache
+	proofMaxAge time.Duration
+}
+
+var defaultCoderConfig = &coderConfig{keys: DefaultKeyRing, leeway: DefaultLeeway}
+
+// Option configures a MultiCoder.
+type Option func(*coderConfig)
+
+// WithKeyRing signs and verifies tokens with keys instead of DefaultKeyRing.
+func WithKeyRing(keys *KeyRing) Option {
+	return func(c *coderConfig) {
+		c.keys = keys
+	}
 }
 
 const (
@@ -48,27 +80,61 @@ const (
 
 const TokenExpireTime = time.Minute * 15
 
-func NewMultiCoder[T any]() (*MultiCoder[T], error) {
+func NewMultiCoder[T any](opts ...Option) (*MultiCoder[T], error) {
 	mc, err := util.NewMultiCoder[*GWT[T]]()
 	if err != nil {
 		return nil, err
 	}
 
+	conf := *defaultCoderConfig
+	for _, opt := range opts {
+		opt(&conf)
+	}
+
+	if err = conf.initCrypto(); err != nil {
+		return nil, err
+	}
+
 	return &MultiCoder[T]{
 		spice: spice,
 		mc:    mc,
+		conf:  &conf,
 	}, nil
 }
 
+// KeyRing returns the keys this MultiCoder signs and verifies with.
+func (m *MultiCoder[T]) KeyRing() *KeyRing {
+	return m.conf.keys
+}
+
 type GWT[T any] struct {
 	Header Header
 	Body   T
 	Token  string
+
+	conf    *coderConfig // set by the MultiCoder that encoded or decoded this token
+	caveats []Caveat     // set when decoded from an attenuated token
 }
 type Header struct {
+	ID        string    // unique token ID, used for revocation
 	Issuer    []byte    // where the token originated
 	Recipient []byte    // who the token belongs to
+	Audience  []byte    // who the token is meant to be presented to
+	IssuedAt  time.Time // when it was minted
+	NotBefore time.Time // when it starts being valid
 	Expires   time.Time // When it will expirm.
+	KeyID     string    // which KeyRing key signed the token
+	Algorithm Algorithm // how the token was signed
+
+	Confirmation string // thumbprint of the key the holder must prove possession of, see ValidateProof
+}
+
+func (g *GWT[T]) config() *coderConfig {
+	if g.conf == nil {
+		return defaultCoderConfig
+	}
+
+	return g.conf
 }
 
 // Token gets delivered to the user.
@@ -83,14 +149,36 @@ type Token struct {
 }
 
 func (m *MultiCoder[T]) Encode(tok *GWT[T]) (ret Token, err error) {
-	data, err := m.mc.Encode(tok, util.EncodeGob)
+	key, err := m.conf.keys.Active()
+	if err != nil {
+		return
+	}
+
+	if tok.Header.ID == "" {
+		tok.Header.ID = uid.New().String()
+	}
+
+	m.conf.stamp(&tok.Header)
+	tok.Header.KeyID = key.ID
+	tok.Header.Algorithm = key.Alg()
+	tok.conf = m.conf
+
+	var data []byte
+	switch {
+	case m.conf.crypto != nil:
+		data, err = encodeEncrypted(m.conf, tok)
+	case m.conf.compact:
+		data, err = encodeCompact(m.conf, tok)
+	default:
+		data, err = m.mc.Encode(tok, util.EncodeGob)
+	}
 	if err != nil {
 		return
 	}
 
 	// ------------------------------------------------------------------------------------------------
-	// Gen Signature [64]byte 128bit
-	hashSignature, err := GenSignature(HashKey, data)
+	// Gen Signature [64]byte HMAC-SHA512 or Ed25519
+	hashSignature, err := key.Sign(data)
 	if err != nil {
 		return
 	}
@@ -115,7 +203,16 @@ func (m *MultiCoder[T]) Decode(token string) (*GWT[T], error) {
 	}
 
 	tknParts := strings.Split(token, ".")
-	if len(tknParts) != 2 {
+
+	var chain [][]byte
+	switch {
+	case len(tknParts) == 2:
+	case isAttenuated(tknParts):
+		var err error
+		if chain, err = decodeCaveats(tknParts[1]); err != nil {
+			return nil, err
+		}
+	default:
 		return nil, errors.New(ErrorInvalidToken)
 	}
 
@@ -124,25 +221,63 @@ func (m *MultiCoder[T]) Decode(token string) (*GWT[T], error) {
 		return nil, err
 	}
 
-	ret, err := m.mc.Decode(tknBuff, util.DecodeGob)
+	sigBuff, err := base64.URLEncoding.DecodeString(tknParts[len(tknParts)-1])
 	if err != nil {
 		return nil, err
 	}
 
-	// Now validate the signature
-	sigBuff, err := base64.URLEncoding.DecodeString(tknParts[1])
-	if err != nil {
-		return nil, err
+	verify := func(header *Header) error {
+		if chain != nil {
+			return m.conf.verifyCaveats(header, tknBuff, chain, sigBuff)
+		}
+		return m.conf.verify(header, tknBuff, sigBuff)
 	}
 
-	if hashSignature, _ := GenSignature(HashKey, tknBuff); !bytes.Equal(hashSignature, sigBuff) {
-		return nil, errors.New(ErrorInvalidToken)
+	var ret *GWT[T]
+	if isEnvelope(tknBuff) {
+		ret, err = decodeEnvelope[T](m.conf, tknBuff, verify)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		ret, err = m.mc.Decode(tknBuff, util.DecodeGob)
+		if err != nil {
+			return nil, err
+		}
+
+		// Now validate the signature
+		if err = verify(&ret.Header); err != nil {
+			return nil, err
+		}
+	}
+
+	if err = applyCaveats(ret, chain); err != nil {
+		return nil, err
 	}
 
 	ret.Token = token
+	ret.conf = m.conf
 	return ret, nil
 }
 
+// verify checks sig against data with the key and algorithm named in header.
+func (c *coderConfig) verify(header *Header, data, sig []byte) error {
+	key, err := c.keys.Key(header.KeyID)
+	if err != nil {
+		return err
+	}
+
+	alg := header.Algorithm
+	if alg == "" {
+		alg = HS512
+	}
+	if alg != key.Alg() {
+		return errors.New(ErrorAlgMismatch)
+	}
+
+	return key.Verify(data, sig)
+}
+
 func GenSignature(key []byte, tokenBuff []byte) ([]byte, error) {
 	m := hmac.New(sha512.New, key)
 
@@ -174,8 +309,8 @@ func ValidateGWTWithBody[T any](gwt *GWT[T], bodyValidHandler func(T) error) err
 		return errors.New(ErrorInvalidToken)
 	}
 
-	if time.Now().UTC().After(gwt.Header.Expires) {
-		return errors.New(ErrorTokenExpired)
+	if err := gwt.config().validateClaims(&gwt.Header); err != nil {
+		return err
 	}
 
 	if bodyValidHandler != nil {
@@ -184,12 +319,34 @@ func ValidateGWTWithBody[T any](gwt *GWT[T], bodyValidHandler func(T) error) err
 		}
 	}
 
-	return ValidateSignature[T](gwt)
+	if err := ValidateSignature[T](gwt); err != nil {
+		return err
+	}
+
+	return gwt.config().checkRevoked(gwt.Header.ID)
 }
 func ValidateSignature[T any](gwt *GWT[T]) error {
 	// tkn := tknParts[0]
 	// sig := tknParts[1]
 	tknParts := strings.Split(gwt.Token, ".")
+	if isAttenuated(tknParts) {
+		tokBuff, chain, sigBuff, err := splitAttenuated(gwt.Token)
+		if err != nil {
+			return err
+		}
+
+		payload, err := base64.URLEncoding.DecodeString(tokBuff)
+		if err != nil {
+			return err
+		}
+
+		return gwt.config().verifyCaveats(&gwt.Header, payload, chain, sigBuff)
+	}
+	if len(tknParts) == 3 {
+		// Imported through DecodeJWT
+		_, _, err := gwt.config().verifyJWT(gwt.Token)
+		return err
+	}
 	if len(tknParts) != 2 {
 		return errors.New(ErrorInvalidToken)
 	}
@@ -204,31 +361,8 @@ func ValidateSignature[T any](gwt *GWT[T]) error {
 		return err
 	}
 
-	copyGWT := *gwt
-	copyGWT.Token = ""
-
-	// ====================================================================================================
-	// GWTs own signature
-
-	buff := bytes.NewBuffer([]byte{})
-	defer buff.Reset()
-
-	err = json.NewEncoder(buff).Encode(copyGWT)
-	if err != nil {
-		return err
-	}
-
 	//====================================================================================================
 	//Token Signature
 
-	nSigBuff, err := GenSignature(HashKey, tokBuff)
-	if err != nil {
-		return err
-	}
-
-	if !hmac.Equal(nSigBuff, sigBuff) {
-		return errors.New(ErrorInvalidToken)
-	}
-
-	return nil
+	return gwt.config().verify(&gwt.Header, tokBuff, sigBuff)
 }
@@ -0,0 +1,94 @@
+package gwt
+
+import (
+	"crypto/ed25519"
+	"errors"
+)
+
+// JWKS
+// ====================================================================================================
+// The public half of EdDSA keys as RFC 7517 key sets, with RFC 8037 OKP members, so services that do
+// not link gwt can check token signatures with any JOSE library. HS512 keys are never published.
+
+const ErrorKeyNotPublic = "signing key has no public half"
+
+// JWK is an Ed25519 public key.
+type JWK struct {
+	Kty string    `json:"kty"`
+	Crv string    `json:"crv"`
+	X   string    `json:"x"`
+	Kid string    `json:"kid,omitempty"`
+	Alg Algorithm `json:"alg,omitempty"`
+	Use string    `json:"use,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public half of an EdDSA key.
+func (k *Key) JWK() (JWK, error) {
+	if k.Alg() != EdDSA || len(k.PublicKey) != ed25519.PublicKeySize {
+		return JWK{}, errors.New(ErrorKeyNotPublic)
+	}
+
+	return JWK{
+		Kty: "OKP",
+		Crv: "Ed25519",
+		X:   b64JWT.EncodeToString(k.PublicKey),
+		Kid: k.ID,
+		Alg: EdDSA,
+		Use: "sig",
+	}, nil
+}
+
+// JWKS returns the public half of every EdDSA key that still verifies tokens, oldest first.
+func (k *KeyRing) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	for _, key := range k.Keys() {
+		if key.Retired {
+			continue
+		}
+		if jwk, err := key.JWK(); err == nil {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+
+	return set
+}
+
+// Key returns the verify only Key a JWK describes.
+func (j JWK) Key() (*Key, error) {
+	if j.Kty != "OKP" || j.Crv != "Ed25519" || (j.Alg != "" && j.Alg != EdDSA) {
+		return nil, errors.New(ErrorKeyInvalid)
+	}
+
+	pub, err := b64JWT.DecodeString(j.X)
+	if err != nil {
+		return nil, errors.New(ErrorKeyInvalid)
+	}
+
+	key := &Key{ID: j.Kid, Algorithm: EdDSA, PublicKey: pub}
+	if err = key.validate(); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
+
+// KeyRing returns a verify only KeyRing holding every key of the set.
+func (s JWKS) KeyRing() (*KeyRing, error) {
+	kr := NewKeyRing()
+	for _, jwk := range s.Keys {
+		key, err := jwk.Key()
+		if err != nil {
+			return nil, err
+		}
+		if err = kr.Add(key); err != nil {
+			return nil, err
+		}
+	}
+
+	return kr, nil
+}
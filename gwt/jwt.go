@@ -0,0 +1,254 @@
+package gwt
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/uid"
+	"strings"
+	"time"
+)
+
+// JWT / JOSE
+// ====================================================================================================
+// A GWT can also travel as a standard compact JWT so non-Go consumers can read and check it:
+//
+//	base64url(header).base64url(claims).base64url(signature)
+//
+// HS512 JWTs are plain HMAC-SHA512 over the signing input with the key Secret (no Spice),
+// EdDSA JWTs are Ed25519 signatures, as RFC 7518 and RFC 8037 define them.
+
+const (
+	ErrorJWTMalformed   = "jwt is malformed"
+	ErrorJWTUnsupported = "jwt algorithm is not supported"
+)
+
+const jwtType = "JWT"
+
+var b64JWT = base64.RawURLEncoding
+
+type jwtHeader struct {
+	Alg Algorithm `json:"alg"`
+	Typ string    `json:"typ,omitempty"`
+	Kid string    `json:"kid,omitempty"`
+}
+
+type jwtClaims[T any] struct {
+	Jti  string  `json:"jti,omitempty"`
+	Iss  string  `json:"iss"`
+	Sub  string  `json:"sub"`
+	Aud  string  `json:"aud,omitempty"`
+	Iat  int64   `json:"iat,omitempty"`
+	Nbf  int64   `json:"nbf,omitempty"`
+	Exp  int64   `json:"exp"`
+	Cnf  *jwtCnf `json:"cnf,omitempty"`
+	Body T       `json:"body"`
+}
+
+// jwtCnf is the RFC 7800 confirmation claim, jkt as RFC 9449 uses it.
+type jwtCnf struct {
+	Jkt string `json:"jkt"`
+}
+
+// EncodeJWT signs tok with the active key and returns it as a compact JWT.
+func (m *MultiCoder[T]) EncodeJWT(tok *GWT[T]) (ret Token, err error) {
+	key, err := m.conf.keys.Active()
+	if err != nil {
+		return
+	}
+
+	if tok.Header.ID == "" {
+		tok.Header.ID = uid.New().String()
+	}
+
+	m.conf.stamp(&tok.Header)
+	tok.Header.KeyID = key.ID
+	tok.Header.Algorithm = key.Alg()
+	tok.conf = m.conf
+
+	hdr, err := json.Marshal(jwtHeader{Alg: key.Alg(), Typ: jwtType, Kid: key.ID})
+	if err != nil {
+		return
+	}
+
+	claims, err := json.Marshal(jwtClaims[T]{
+		Jti:  tok.Header.ID,
+		Iss:  string(tok.Header.Issuer),
+		Sub:  string(tok.Header.Recipient),
+		Aud:  string(tok.Header.Audience),
+		Iat:  unixOrZero(tok.Header.IssuedAt),
+		Nbf:  unixOrZero(tok.Header.NotBefore),
+		Exp:  tok.Header.Expires.Unix(),
+		Cnf:  cnfOrNil(tok.Header.Confirmation),
+		Body: tok.Body,
+	})
+	if err != nil {
+		return
+	}
+
+	signingInput := b64JWT.EncodeToString(hdr) + "." + b64JWT.EncodeToString(claims)
+
+	sig, err := signJWT(key, []byte(signingInput))
+	if err != nil {
+		return
+	}
+
+	return Token{
+		Token:     signingInput + "." + b64JWT.EncodeToString(sig),
+		Signature: hex.EncodeToString(sig),
+	}, nil
+}
+
+// DecodeJWT verifies a compact JWT against the KeyRing and maps it onto a GWT.
+// Expiry is left to the ValidateGWT* helpers, the same as Decode.
+func (m *MultiCoder[T]) DecodeJWT(token string) (*GWT[T], error) {
+	if token == "" {
+		return nil, errors.New(ErrorNoTokenFound)
+	}
+
+	hdr, claimsBuff, err := m.conf.verifyJWT(token)
+	if err != nil {
+		return nil, err
+	}
+
+	var claims jwtClaims[T]
+	if err = json.Unmarshal(claimsBuff, &claims); err != nil {
+		return nil, errors.New(ErrorJWTMalformed)
+	}
+
+	header := claims.header()
+	header.KeyID = hdr.Kid
+	header.Algorithm = hdr.Alg
+
+	return &GWT[T]{
+		Header: *header,
+		Body:   claims.Body,
+		Token:  token,
+		conf:   m.conf,
+	}, nil
+}
+
+// header maps the registered claims back onto a Header.
+func (c *jwtClaims[T]) header() *Header {
+	var confirmation string
+	if c.Cnf != nil {
+		confirmation = c.Cnf.Jkt
+	}
+
+	return &Header{
+		ID:        c.Jti,
+		Issuer:    []byte(c.Iss),
+		Recipient: []byte(c.Sub),
+		Audience:  bytesOrNil(c.Aud),
+		IssuedAt:  timeOrZero(c.Iat),
+		NotBefore: timeOrZero(c.Nbf),
+		Expires:   time.Unix(c.Exp, 0).UTC(),
+
+		Confirmation: confirmation,
+	}
+}
+
+// verifyJWT checks the JWT signature and returns its header and raw claims.
+func (c *coderConfig) verifyJWT(token string) (*jwtHeader, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New(ErrorJWTMalformed)
+	}
+
+	hdrBuff, err := b64JWT.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, errors.New(ErrorJWTMalformed)
+	}
+
+	var hdr jwtHeader
+	if err = json.Unmarshal(hdrBuff, &hdr); err != nil {
+		return nil, nil, errors.New(ErrorJWTMalformed)
+	}
+
+	if hdr.Alg != HS512 && hdr.Alg != EdDSA {
+		return nil, nil, errors.New(ErrorJWTUnsupported)
+	}
+
+	key, err := c.keys.Key(hdr.Kid)
+	if err != nil {
+		return nil, nil, err
+	}
+	if key.Alg() != hdr.Alg {
+		return nil, nil, errors.New(ErrorAlgMismatch)
+	}
+
+	sig, err := b64JWT.DecodeString(parts[2])
+	if err != nil {
+		return nil, nil, errors.New(ErrorJWTMalformed)
+	}
+
+	if err = verifyJWTSignature(key, []byte(parts[0]+"."+parts[1]), sig); err != nil {
+		return nil, nil, err
+	}
+
+	claims, err := b64JWT.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.New(ErrorJWTMalformed)
+	}
+
+	return &hdr, claims, nil
+}
+
+func signJWT(key *Key, signingInput []byte) ([]byte, error) {
+	if key.Alg() == EdDSA {
+		return key.Sign(signingInput)
+	}
+
+	if !key.CanSign() {
+		return nil, errors.New(ErrorKeyNoSign)
+	}
+
+	m := hmac.New(sha512.New, key.Secret)
+	m.Write(signingInput)
+	return m.Sum(nil), nil
+}
+func verifyJWTSignature(key *Key, signingInput, sig []byte) error {
+	if key.Alg() == EdDSA {
+		return key.Verify(signingInput, sig)
+	}
+
+	expected, err := signJWT(key, signingInput)
+	if err != nil {
+		return err
+	}
+
+	if !hmac.Equal(expected, sig) {
+		return errors.New(ErrorInvalidToken)
+	}
+
+	return nil
+}
+
+// NumericDate helpers, the zero time.Time maps to an absent claim.
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+func timeOrZero(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0).UTC()
+}
+func bytesOrNil(s string) []byte {
+	if s == "" {
+		return nil
+	}
+	return []byte(s)
+}
+func cnfOrNil(thumbprint string) *jwtCnf {
+	if thumbprint == "" {
+		return nil
+	}
+	return &jwtCnf{Jkt: thumbprint}
+}
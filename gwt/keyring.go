@@ -0,0 +1,468 @@
+package gwt
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/uid"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorKeyNotFound  = "signing key not found"
+	ErrorKeyRetired   = "signing key has been retired"
+	ErrorKeyExists    = "signing key already exists"
+	ErrorKeyInvalid   = "signing key is invalid"
+	ErrorKeyActive    = "active signing key cannot be retired"
+	ErrorNoActiveKey  = "keyring has no active key"
+	ErrorKeyEnvNotSet = "keyring environment variable not set"
+	ErrorKeyNoSign    = "signing key can only verify"
+	ErrorAlgMismatch  = "token algorithm does not match signing key"
+)
+
+// Algorithm names the signature scheme a Key uses. It is recorded in every token Header.
+type Algorithm string
+
+const (
+	HS512 Algorithm = "HS512" // HMAC-SHA512 with a shared secret, salted with the Spice.
+	EdDSA Algorithm = "EdDSA" // Ed25519; only the issuer holds the private key.
+)
+
+// DefaultKeyID is the ID given to the embedded HashKey, and the one assumed
+// for tokens that were minted before key IDs existed.
+const DefaultKeyID = "default"
+
+// KeySize is the length in bytes of generated HMAC secrets.
+const KeySize = 64
+
+// DefaultKeyRing holds the embedded HashKey and is used by every MultiCoder
+// that was not given a KeyRing of its own.
+var DefaultKeyRing = NewKeyRing(&Key{ID: DefaultKeyID, Secret: HashKey})
+
+// Key ...
+// ====================================================================================================
+type Key struct {
+	ID        string    `json:"id"`
+	Algorithm Algorithm `json:"alg,omitempty"` // Empty means HS512.
+	Created   time.Time `json:"created"`
+	Retired   bool      `json:"retired,omitempty"`
+
+	Secret     []byte             `json:"secret,omitempty"`      // HS512
+	PrivateKey ed25519.PrivateKey `json:"private_key,omitempty"` // EdDSA, issuer only
+	PublicKey  ed25519.PublicKey  `json:"public_key,omitempty"`  // EdDSA
+}
+
+// NewEd25519Key generates an EdDSA key pair.
+func NewEd25519Key(id string) (*Key, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{ID: id, Algorithm: EdDSA, PrivateKey: priv, PublicKey: pub}, nil
+}
+
+// Alg returns the key's Algorithm, defaulting to HS512.
+func (k *Key) Alg() Algorithm {
+	if k.Algorithm == "" {
+		return HS512
+	}
+
+	return k.Algorithm
+}
+
+// CanSign reports whether the key holds the material to create signatures.
+func (k *Key) CanSign() bool {
+	switch k.Alg() {
+	case HS512:
+		return len(k.Secret) > 0
+	case EdDSA:
+		return len(k.PrivateKey) == ed25519.PrivateKeySize
+	default:
+		return false
+	}
+}
+
+// Public returns a copy of the key without any material that can sign.
+// HS512 keys have no public half, so they yield nil.
+func (k *Key) Public() *Key {
+	if k.Alg() != EdDSA {
+		return nil
+	}
+
+	return &Key{ID: k.ID, Algorithm: EdDSA, Created: k.Created, Retired: k.Retired, PublicKey: k.PublicKey}
+}
+
+// Sign returns the signature of data.
+func (k *Key) Sign(data []byte) ([]byte, error) {
+	if !k.CanSign() {
+		return nil, errors.New(ErrorKeyNoSign)
+	}
+
+	switch k.Alg() {
+	case EdDSA:
+		return ed25519.Sign(k.PrivateKey, data), nil
+	default:
+		return GenSignature(k.Secret, data)
+	}
+}
+
+// Verify checks that sig is a signature of data made with this key.
+func (k *Key) Verify(data, sig []byte) error {
+	switch k.Alg() {
+	case EdDSA:
+		if !ed25519.Verify(k.PublicKey, data, sig) {
+			return errors.New(ErrorInvalidToken)
+		}
+	default:
+		hashSignature, err := GenSignature(k.Secret, data)
+		if err != nil {
+			return err
+		}
+
+		if !hmac.Equal(hashSignature, sig) {
+			return errors.New(ErrorInvalidToken)
+		}
+	}
+
+	return nil
+}
+
+func (k *Key) validate() error {
+	if k == nil || k.ID == "" {
+		return errors.New(ErrorKeyInvalid)
+	}
+
+	switch k.Alg() {
+	case HS512:
+		if len(k.Secret) == 0 {
+			return errors.New(ErrorKeyInvalid)
+		}
+	case EdDSA:
+		if len(k.PublicKey) == 0 && len(k.PrivateKey) == ed25519.PrivateKeySize {
+			k.PublicKey = k.PrivateKey.Public().(ed25519.PublicKey)
+		}
+		if len(k.PublicKey) != ed25519.PublicKeySize {
+			return errors.New(ErrorKeyInvalid)
+		}
+		if len(k.PrivateKey) != 0 && len(k.PrivateKey) != ed25519.PrivateKeySize {
+			return errors.New(ErrorKeyInvalid)
+		}
+	default:
+		return errors.New(ErrorKeyInvalid)
+	}
+
+	return nil
+}
+
+// KeyRing holds every key a token could have been signed with.
+// Encode signs with the active key; Decode accepts any key that is not retired.
+type KeyRing struct {
+	mu     sync.RWMutex
+	active string
+	keys   map[string]*Key
+}
+
+// NewKeyRing returns a KeyRing holding keys. The first key becomes the active one.
+func NewKeyRing(keys ...*Key) *KeyRing {
+	kr := &KeyRing{keys: make(map[string]*Key)}
+	for _, key := range keys {
+		_ = kr.Add(key)
+	}
+
+	return kr
+}
+
+// Add puts key in the ring. It becomes active if the ring has no active key yet
+// and the key is able to sign.
+func (k *KeyRing) Add(key *Key) error {
+	if err := key.validate(); err != nil {
+		return err
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if _, ok := k.keys[key.ID]; ok {
+		return errors.New(ErrorKeyExists)
+	}
+
+	if key.Created.IsZero() {
+		key.Created = time.Now().UTC()
+	}
+
+	k.keys[key.ID] = key
+	if k.active == "" && !key.Retired && key.CanSign() {
+		k.active = key.ID
+	}
+
+	return nil
+}
+
+// Rotate adds a new key holding secret and makes it the active one.
+// A random secret is generated when secret is nil.
+// The previous key keeps verifying tokens until it is retired.
+func (k *KeyRing) Rotate(secret []byte) (*Key, error) {
+	if secret == nil {
+		secret = make([]byte, KeySize)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+
+	key := &Key{ID: uid.NewUID(8).String(), Secret: secret}
+	return key, k.RotateKey(key)
+}
+
+// RotateKey adds key and makes it the active one.
+func (k *KeyRing) RotateKey(key *Key) error {
+	if err := k.Add(key); err != nil {
+		return err
+	}
+
+	return k.Activate(key.ID)
+}
+
+// Public returns a KeyRing holding only the public half of the EdDSA keys.
+// Hand it to services that verify tokens but must never mint them.
+func (k *KeyRing) Public() *KeyRing {
+	pub := NewKeyRing()
+	for _, key := range k.Keys() {
+		if p := key.Public(); p != nil {
+			_ = pub.Add(p)
+		}
+	}
+
+	return pub
+}
+
+// Activate makes the key with id the one new tokens are signed with.
+func (k *KeyRing) Activate(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return errors.New(ErrorKeyNotFound)
+	}
+	if key.Retired {
+		return errors.New(ErrorKeyRetired)
+	}
+	if !key.CanSign() {
+		return errors.New(ErrorKeyNoSign)
+	}
+
+	k.active = id
+	return nil
+}
+
+// Retire stops the key with id from verifying tokens. The active key cannot be retired.
+func (k *KeyRing) Retire(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return errors.New(ErrorKeyNotFound)
+	}
+	if k.active == id {
+		return errors.New(ErrorKeyActive)
+	}
+
+	key.Retired = true
+	return nil
+}
+
+// Active returns the key new tokens are signed with.
+func (k *KeyRing) Active() (*Key, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[k.active]
+	if !ok {
+		return nil, errors.New(ErrorNoActiveKey)
+	}
+
+	return key, nil
+}
+
+// Key returns the key with id as long as it has not been retired.
+// An empty id resolves to DefaultKeyID.
+func (k *KeyRing) Key(id string) (*Key, error) {
+	if id == "" {
+		id = DefaultKeyID
+	}
+
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	key, ok := k.keys[id]
+	if !ok {
+		return nil, errors.New(ErrorKeyNotFound)
+	}
+	if key.Retired {
+		return nil, errors.New(ErrorKeyRetired)
+	}
+
+	return key, nil
+}
+
+// Keys returns a copy of every key in the ring, oldest first.
+func (k *KeyRing) Keys() []Key {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+
+	keys := make([]Key, 0, len(k.keys))
+	for _, key := range k.keys {
+		keys = append(keys, *key)
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i].Created.Before(keys[j].Created)
+	})
+
+	return keys
+}
+
+// Key File I/O
+// ====================================================================================================
+
+type keyRingFile struct {
+	Active string `json:"active"`
+	Keys   []Key  `json:"keys"`
+}
+
+// LoadKeyRingFile reads a KeyRing saved with SaveFile.
+func LoadKeyRingFile(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var file keyRingFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+
+	kr := NewKeyRing()
+	for i := range file.Keys {
+		if err = kr.Add(&file.Keys[i]); err != nil {
+			return nil, err
+		}
+	}
+
+	if file.Active != "" {
+		if err = kr.Activate(file.Active); err != nil {
+			return nil, err
+		}
+	}
+
+	return kr, nil
+}
+
+// SaveFile writes the KeyRing to path as JSON. Secrets are stored base64 encoded.
+func (k *KeyRing) SaveFile(path string) error {
+	k.mu.RLock()
+	file := keyRingFile{Active: k.active}
+	k.mu.RUnlock()
+
+	file.Keys = k.Keys()
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0600)
+}
+
+// LoadKeyRingEnv builds a KeyRing from environment variables:
+//
+//	<prefix>_KEYS         id:base64secret,id:base64secret
+//	<prefix>_ED25519_KEYS id:base64key,id:base64key (64 byte private or 32 byte public keys)
+//	<prefix>_ACTIVE_KEY   id of the signing key (defaults to the first unretired key that can sign)
+//	<prefix>_RETIRED_KEYS id,id
+func LoadKeyRingEnv(prefix string) (*KeyRing, error) {
+	hmacEnv := os.Getenv(prefix + "_KEYS")
+	edEnv := os.Getenv(prefix + "_ED25519_KEYS")
+	if hmacEnv == "" && edEnv == "" {
+		return nil, errors.New(ErrorKeyEnvNotSet)
+	}
+
+	// Retired keys are marked before they are added so none of them becomes the active key.
+	retired := map[string]bool{}
+	if env := os.Getenv(prefix + "_RETIRED_KEYS"); env != "" {
+		for _, id := range strings.Split(env, ",") {
+			retired[strings.TrimSpace(id)] = true
+		}
+	}
+
+	kr := NewKeyRing()
+	if err := addEnvKeys(kr, hmacEnv, retired, func(id string, data []byte) *Key {
+		return &Key{ID: id, Secret: data}
+	}); err != nil {
+		return nil, err
+	}
+
+	if err := addEnvKeys(kr, edEnv, retired, func(id string, data []byte) *Key {
+		if len(data) == ed25519.PrivateKeySize {
+			return &Key{ID: id, Algorithm: EdDSA, PrivateKey: data}
+		}
+		return &Key{ID: id, Algorithm: EdDSA, PublicKey: data}
+	}); err != nil {
+		return nil, err
+	}
+
+	if active := os.Getenv(prefix + "_ACTIVE_KEY"); active != "" {
+		if err := kr.Activate(active); err != nil {
+			return nil, err
+		}
+	}
+
+	// Retiring again reports retired ids that name no key.
+	for id := range retired {
+		if err := kr.Retire(id); err != nil {
+			return nil, err
+		}
+	}
+
+	return kr, nil
+}
+
+func addEnvKeys(kr *KeyRing, env string, retired map[string]bool, newKey func(id string, data []byte) *Key) error {
+	if env == "" {
+		return nil
+	}
+
+	for _, pair := range strings.Split(env, ",") {
+		id, encoded, found := strings.Cut(strings.TrimSpace(pair), ":")
+		if !found {
+			return errors.New(ErrorKeyInvalid)
+		}
+
+		decoded, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return err
+		}
+
+		key := newKey(id, decoded)
+		key.Retired = retired[id]
+		if err = kr.Add(key); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,514 @@
+package gwt
+
+import (
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Policy
+// ====================================================================================================
+// Policies refine an allowed RBAC Decision with attribute rules evaluated against role Claims,
+// request attributes and resource attributes. Deny rules veto, and when any allow rule targets
+// a request at least one of them must match. Conditions on missing attributes never hold, so
+// positive requirements belong in allow rules.
+//
+// Attributes:
+//
+//	claim.<key>     Claim value of a granted role, e.g. claim.department
+//
+// Claims are only looked up on the grants a rule targets, the roles of its Roles on its
+// ResourceTypes. A claim condition holds when it does on any of them, or on all of them when
+// the rule's Claims is AllGrants, and never when none of them carries the claim.
+//	request.<key>   PolicyRequest.Request, e.g. request.method
+//	resource.<key>  PolicyRequest.Resource, e.g. resource.department
+//	time.hour       0 to 23
+//	time.weekday    monday to sunday
+
+const (
+	ErrorPolicyEffect     = "policy rule effect must be allow or deny"
+	ErrorPolicyOperator   = "policy condition operator is not supported"
+	ErrorPolicyAttribute  = "policy condition attribute is not supported"
+	ErrorPolicyValues     = "policy condition has no value to compare against"
+	ErrorPolicyPermission = "policy permission is not supported"
+	ErrorPolicyClaims     = "policy rule claims must be any or all"
+)
+
+type Effect string
+
+const (
+	Allow Effect = "allow"
+	Deny  Effect = "deny"
+)
+
+// ClaimMatch tells on how many of the grants a rule targets its claim conditions must hold.
+type ClaimMatch string
+
+const (
+	AnyGrant  ClaimMatch = "any"
+	AllGrants ClaimMatch = "all"
+)
+
+// Condition operators.
+const (
+	OpEq    = "eq"
+	OpNe    = "ne"
+	OpIn    = "in"
+	OpNotIn = "not_in"
+	OpLt    = "lt"
+	OpLte   = "lte"
+	OpGt    = "gt"
+	OpGte   = "gte"
+)
+
+type Attributes map[string]string
+
+// PolicyRequest is what a Policy is evaluated against, alongside the Decision it refines.
+type PolicyRequest struct {
+	ResourceType ResourceType
+	Permission   Permission
+	Request      Attributes // Request: e.g. method, path
+	Resource     Attributes // Resource: attributes of the resource being accessed
+	Time         time.Time  // Time: defaults to now
+}
+
+type Policy struct {
+	Rules []Rule `yaml:"rules"`
+}
+
+type Rule struct {
+	Name          string         `yaml:"name"`
+	Effect        Effect         `yaml:"effect"`
+	ResourceTypes []ResourceType `yaml:"resource_types,omitempty"` // ResourceTypes: every type when empty
+	Permissions   Permission     `yaml:"permissions,omitempty"`    // Permissions: any requested bit targets the rule, every permission when 0
+	Roles         []RoleType     `yaml:"roles,omitempty"`          // Roles: a granted role must be one of these, any role when empty
+	When          []Condition    `yaml:"when,omitempty"`           // When: every condition must hold
+	Any           []Condition    `yaml:"any,omitempty"`            // Any: one condition must hold, when set
+	Claims        ClaimMatch     `yaml:"claims,omitempty"`         // Claims: AnyGrant when empty
+}
+
+type Condition struct {
+	Attr   string   `yaml:"attr"`
+	Op     string   `yaml:"op"`
+	Value  string   `yaml:"value,omitempty"`
+	Values []string `yaml:"values,omitempty"`
+	Ref    string   `yaml:"ref,omitempty"` // Ref: compares against another attribute instead of Value
+}
+
+// NewPolicy validates rules and returns them as a Policy.
+func NewPolicy(rules ...Rule) (*Policy, error) {
+	p := &Policy{Rules: rules}
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// ParsePolicy reads a Policy from YAML.
+func ParsePolicy(data []byte) (*Policy, error) {
+	p := &Policy{}
+	if err := yaml.Unmarshal(data, p); err != nil {
+		return nil, err
+	}
+
+	if err := p.Validate(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func LoadPolicyFile(path string) (*Policy, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePolicy(data)
+}
+
+func (p *Policy) Validate() error {
+	for _, rule := range p.Rules {
+		if rule.Effect != Allow && rule.Effect != Deny {
+			return fmt.Errorf("%s: %s", rule.Name, ErrorPolicyEffect)
+		}
+		if rule.Claims != "" && rule.Claims != AnyGrant && rule.Claims != AllGrants {
+			return fmt.Errorf("%s: %s", rule.Name, ErrorPolicyClaims)
+		}
+
+		for _, c := range append(append([]Condition{}, rule.When...), rule.Any...) {
+			if err := c.validate(); err != nil {
+				return fmt.Errorf("%s: %w", rule.Name, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Apply refines decision with the Policy. Decisions RBAC already denied are returned as they are.
+func (p *Policy) Apply(decision Decision, req PolicyRequest) Decision {
+	if !decision.Allowed {
+		return decision
+	}
+
+	if req.Time.IsZero() {
+		req.Time = time.Now()
+	}
+
+	var allowTargeted []string
+	allowedBy := ""
+	for _, rule := range p.Rules {
+		grants := rule.targetedGrants(decision.Grants)
+		if !rule.targets(req, grants) {
+			continue
+		}
+
+		matched := rule.matches(policyEnv{req: req, grants: grants, match: rule.Claims})
+		switch {
+		case rule.Effect == Deny && matched:
+			decision.Allowed = false
+			decision.Reason = fmt.Sprintf("policy rule %s denies %s on %s resources",
+				rule.Name, permissionNames(req.Permission), req.ResourceType)
+			return decision
+		case rule.Effect == Allow && matched && allowedBy == "":
+			allowedBy = rule.Name
+		case rule.Effect == Allow:
+			allowTargeted = append(allowTargeted, rule.Name)
+		}
+	}
+
+	switch {
+	case allowedBy != "":
+		decision.Reason += ", policy rule " + allowedBy + " allows it"
+	case len(allowTargeted) > 0:
+		decision.Allowed = false
+		decision.Reason = fmt.Sprintf("no policy rule allows %s on %s resources, tried %s",
+			permissionNames(req.Permission), req.ResourceType, strings.Join(allowTargeted, ","))
+	}
+
+	return decision
+}
+
+// targets reports whether the rule applies to req, granted by the grants targetedGrants kept.
+func (r *Rule) targets(req PolicyRequest, grants []Grant) bool {
+	if len(r.ResourceTypes) > 0 && !contains(r.ResourceTypes, req.ResourceType) {
+		return false
+	}
+	if r.Permissions != 0 && r.Permissions&req.Permission == 0 {
+		return false
+	}
+
+	return len(r.Roles) == 0 || len(grants) > 0
+}
+
+// targetedGrants keeps the grants of the rule's Roles on its ResourceTypes.
+func (r *Rule) targetedGrants(grants []Grant) []Grant {
+	var targeted []Grant
+	for _, g := range grants {
+		if len(r.Roles) > 0 && !contains(r.Roles, g.Role) {
+			continue
+		}
+		if len(r.ResourceTypes) > 0 && !contains(r.ResourceTypes, g.ResourceType) {
+			continue
+		}
+
+		targeted = append(targeted, g)
+	}
+
+	return targeted
+}
+
+func (r *Rule) matches(env policyEnv) bool {
+	for _, c := range r.When {
+		if !c.holds(env) {
+			return false
+		}
+	}
+
+	if len(r.Any) == 0 {
+		return true
+	}
+
+	for _, c := range r.Any {
+		if c.holds(env) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Condition
+// ----------------------------------------------------------------------------------------------------
+
+func (c Condition) validate() error {
+	if !validAttr(c.Attr) || (c.Ref != "" && !validAttr(c.Ref)) {
+		return errors.New(ErrorPolicyAttribute)
+	}
+
+	switch c.Op {
+	case OpIn, OpNotIn:
+		if len(c.Values) == 0 {
+			return errors.New(ErrorPolicyValues)
+		}
+	case OpEq, OpNe, OpLt, OpLte, OpGt, OpGte:
+		if c.Value == "" && c.Ref == "" {
+			return errors.New(ErrorPolicyValues)
+		}
+	default:
+		return errors.New(ErrorPolicyOperator)
+	}
+
+	return nil
+}
+
+// holds evaluates c once, or on each targeted grant when it compares claims, see ClaimMatch.
+func (c Condition) holds(env policyEnv) bool {
+	if !isClaim(c.Attr) && !isClaim(c.Ref) {
+		return c.holdsFor(env, nil)
+	}
+	if len(env.grants) == 0 {
+		return false
+	}
+
+	all := env.match == AllGrants
+	for i := range env.grants {
+		held := c.holdsFor(env, &env.grants[i])
+		if held && !all {
+			return true
+		}
+		if !held && all {
+			return false
+		}
+	}
+
+	return all
+}
+
+// holdsFor evaluates c with the claims of grant.
+func (c Condition) holdsFor(env policyEnv, grant *Grant) bool {
+	got, ok := env.lookup(c.Attr, grant)
+	if !ok {
+		return false
+	}
+
+	want := c.Value
+	if c.Ref != "" {
+		if want, ok = env.lookup(c.Ref, grant); !ok {
+			return false
+		}
+	}
+
+	switch c.Op {
+	case OpEq:
+		return got == want
+	case OpNe:
+		return got != want
+	case OpIn:
+		return contains(c.Values, got)
+	case OpNotIn:
+		return !contains(c.Values, got)
+	}
+
+	a, errA := strconv.ParseFloat(got, 64)
+	b, errB := strconv.ParseFloat(want, 64)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	switch c.Op {
+	case OpLt:
+		return a < b
+	case OpLte:
+		return a <= b
+	case OpGt:
+		return a > b
+	case OpGte:
+		return a >= b
+	}
+
+	return false
+}
+
+// policyEnv resolves condition attributes for a rule, grants are the ones it targets.
+type policyEnv struct {
+	req    PolicyRequest
+	grants []Grant
+	match  ClaimMatch
+}
+
+// lookup resolves attr, claims on grant alone.
+func (e policyEnv) lookup(attr string, grant *Grant) (string, bool) {
+	scope, key, _ := strings.Cut(attr, ".")
+
+	switch scope {
+	case "claim":
+		if grant == nil {
+			return "", false
+		}
+		if claim, ok := grant.Claims[RoleType(key)]; ok {
+			return claim.Value(), true
+		}
+	case "request":
+		v, ok := e.req.Request[key]
+		return v, ok
+	case "resource":
+		v, ok := e.req.Resource[key]
+		return v, ok
+	case "time":
+		switch key {
+		case "hour":
+			return strconv.Itoa(e.req.Time.Hour()), true
+		case "weekday":
+			return strings.ToLower(e.req.Time.Weekday().String()), true
+		}
+	}
+
+	return "", false
+}
+
+func isClaim(attr string) bool {
+	return strings.HasPrefix(attr, "claim.")
+}
+
+func validAttr(attr string) bool {
+	scope, key, ok := strings.Cut(attr, ".")
+	if !ok || key == "" {
+		return false
+	}
+
+	switch scope {
+	case "claim", "request", "resource":
+		return true
+	case "time":
+		return key == "hour" || key == "weekday"
+	}
+
+	return false
+}
+
+func contains[T comparable](list []T, v T) bool {
+	for _, item := range list {
+		if item == v {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Builders
+// ----------------------------------------------------------------------------------------------------
+
+// AllowRule and DenyRule start a Rule, e.g.
+//
+//	gwt.DenyRule("business-hours").For(gwt.Write|gwt.Edit).IfAny(gwt.Attr("time.hour").Lt(9), gwt.Attr("time.hour").Gte(17))
+func AllowRule(name string) Rule {
+	return Rule{Name: name, Effect: Allow}
+}
+func DenyRule(name string) Rule {
+	return Rule{Name: name, Effect: Deny}
+}
+
+func (r Rule) On(types ...ResourceType) Rule {
+	r.ResourceTypes = append(r.ResourceTypes, types...)
+	return r
+}
+func (r Rule) For(perms Permission) Rule {
+	r.Permissions |= perms
+	return r
+}
+func (r Rule) ForRoles(roles ...RoleType) Rule {
+	r.Roles = append(r.Roles, roles...)
+	return r
+}
+func (r Rule) MatchClaims(match ClaimMatch) Rule {
+	r.Claims = match
+	return r
+}
+func (r Rule) If(conds ...Condition) Rule {
+	r.When = append(r.When, conds...)
+	return r
+}
+func (r Rule) IfAny(conds ...Condition) Rule {
+	r.Any = append(r.Any, conds...)
+	return r
+}
+
+// Attr names a condition attribute, see Policy.
+type Attr string
+
+func (a Attr) Eq(v string) Condition {
+	return Condition{Attr: string(a), Op: OpEq, Value: v}
+}
+func (a Attr) Ne(v string) Condition {
+	return Condition{Attr: string(a), Op: OpNe, Value: v}
+}
+func (a Attr) EqAttr(b Attr) Condition {
+	return Condition{Attr: string(a), Op: OpEq, Ref: string(b)}
+}
+func (a Attr) NeAttr(b Attr) Condition {
+	return Condition{Attr: string(a), Op: OpNe, Ref: string(b)}
+}
+func (a Attr) In(v ...string) Condition {
+	return Condition{Attr: string(a), Op: OpIn, Values: v}
+}
+func (a Attr) NotIn(v ...string) Condition {
+	return Condition{Attr: string(a), Op: OpNotIn, Values: v}
+}
+func (a Attr) Lt(v int) Condition {
+	return Condition{Attr: string(a), Op: OpLt, Value: strconv.Itoa(v)}
+}
+func (a Attr) Lte(v int) Condition {
+	return Condition{Attr: string(a), Op: OpLte, Value: strconv.Itoa(v)}
+}
+func (a Attr) Gt(v int) Condition {
+	return Condition{Attr: string(a), Op: OpGt, Value: strconv.Itoa(v)}
+}
+func (a Attr) Gte(v int) Condition {
+	return Condition{Attr: string(a), Op: OpGte, Value: strconv.Itoa(v)}
+}
+
+// Permission YAML
+// ----------------------------------------------------------------------------------------------------
+
+// UnmarshalYAML accepts a permission name or a list of them, e.g. [write, edit].
+func (p *Permission) UnmarshalYAML(node *yaml.Node) error {
+	var names []string
+	if node.Kind == yaml.SequenceNode {
+		if err := node.Decode(&names); err != nil {
+			return err
+		}
+	} else {
+		names = []string{node.Value}
+	}
+
+	*p = 0
+	for _, name := range names {
+		perm, err := ParsePermission(name)
+		if err != nil {
+			return err
+		}
+		*p |= perm
+	}
+
+	return nil
+}
+
+// ParsePermission is the inverse of Permission.String for the named permissions.
+func ParsePermission(name string) (Permission, error) {
+	for _, perm := range []Permission{Read, Write, Edit, Delete} {
+		if perm.String() == strings.ToLower(name) {
+			return perm, nil
+		}
+	}
+
+	return 0, errors.New(ErrorPolicyPermission)
+}
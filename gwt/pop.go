@@ -0,0 +1,332 @@
+package gwt
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"github.com/vaiktorg/grimoire/uid"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Proof of possession
+// ====================================================================================================
+// A token can be bound to an Ed25519 key pair the client holds, DPoP style (RFC 9449). The Header
+// carries the key thumbprint in Confirmation and every request carries a Proof, a JWT signed with
+// that key over the request method, URL, a timestamp and a hash of the token:
+//
+//	header: {"typ":"dpop+jwt","alg":"EdDSA","jwk":{"kty":"OKP","crv":"Ed25519","x":"..."}}
+//	claims: {"jti":"...","htm":"GET","htu":"https://host/path","iat":1700000000,"ath":"..."}
+//
+// Proof IDs are spent in a NonceCache, so a captured proof cannot be replayed either.
+
+const (
+	ErrorProofMissing   = "token is bound to a key and requires a proof"
+	ErrorProofMalformed = "proof is malformed"
+	ErrorProofKey       = "proof key does not match the token"
+	ErrorProofRequest   = "proof does not match the request"
+	ErrorProofStale     = "proof is too old or from the future"
+	ErrorProofToken     = "proof was made for another token"
+	ErrorProofReplayed  = "proof has already been used"
+	ErrorNoNonceCache   = "no nonce cache configured"
+)
+
+// ProofHeader is the HTTP header proofs travel in.
+const ProofHeader = "DPoP"
+
+// DefaultProofMaxAge is how long after its iat a proof is accepted, leeway aside.
+const DefaultProofMaxAge = time.Minute
+
+const proofType = "dpop+jwt"
+
+// WithNonceCache spends proof IDs in cache, and is required to validate proofs.
+func WithNonceCache(cache NonceCache) Option {
+	return func(c *coderConfig) {
+		c.nonces = cache
+	}
+}
+
+// WithProofMaxAge sets how long after it was made a proof is accepted.
+func WithProofMaxAge(maxAge time.Duration) Option {
+	return func(c *coderConfig) {
+		c.proofMaxAge = maxAge
+	}
+}
+
+type proofHeader struct {
+	Typ string    `json:"typ"`
+	Alg Algorithm `json:"alg"`
+	JWK JWK       `json:"jwk"`
+}
+
+type proofClaims struct {
+	Jti string `json:"jti"`
+	Htm string `json:"htm"`
+	Htu string `json:"htu"`
+	Iat int64  `json:"iat"`
+	Ath string `json:"ath,omitempty"`
+}
+
+// Proof is a verified proof of possession.
+type Proof struct {
+	ID         string
+	Method     string
+	URL        string
+	IssuedAt   time.Time
+	Thumbprint string // Thumbprint: of the key the proof was signed with, see Header.Confirmation
+}
+
+// NewProof signs a proof for a request with the EdDSA key. token is the access token sent along,
+// and is empty when asking for a token to be bound to key, e.g. on login.
+func NewProof(key *Key, method, rawURL, token string) (string, error) {
+	if key.Alg() != EdDSA || !key.CanSign() {
+		return "", errors.New(ErrorKeyNoSign)
+	}
+
+	hdr, err := json.Marshal(proofHeader{
+		Typ: proofType,
+		Alg: EdDSA,
+		JWK: JWK{Kty: "OKP", Crv: "Ed25519", X: b64JWT.EncodeToString(key.PublicKey)},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	claims := proofClaims{
+		Jti: uid.New().String(),
+		Htm: method,
+		Htu: rawURL,
+		Iat: time.Now().Unix(),
+	}
+	if token != "" {
+		claims.Ath = tokenHash(token)
+	}
+
+	claimsBuff, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+
+	signingInput := b64JWT.EncodeToString(hdr) + "." + b64JWT.EncodeToString(claimsBuff)
+	sig, err := key.Sign([]byte(signingInput))
+	if err != nil {
+		return "", err
+	}
+
+	return signingInput + "." + b64JWT.EncodeToString(sig), nil
+}
+
+// Thumbprint returns the RFC 7638 thumbprint of an EdDSA key, or "" for HS512 keys.
+func (k *Key) Thumbprint() string {
+	if k.Alg() != EdDSA {
+		return ""
+	}
+
+	return thumbprint(k.PublicKey)
+}
+
+// CheckProof verifies proof was made for method and rawURL, and for token when it is not empty,
+// then spends it. Use it to learn which key to bind a new token to.
+func (m *MultiCoder[T]) CheckProof(proof, method, rawURL, token string) (*Proof, error) {
+	return m.conf.checkProof(proof, method, rawURL, token)
+}
+
+// ValidateProof checks that proof was made with the key gwt is bound to, for method and rawURL.
+// Tokens that are not bound need no proof.
+func ValidateProof[T any](gwt *GWT[T], proof, method, rawURL string) error {
+	if gwt.Header.Confirmation == "" {
+		return nil
+	}
+	if proof == "" {
+		return errors.New(ErrorProofMissing)
+	}
+
+	p, err := gwt.config().checkProof(proof, method, rawURL, gwt.Token)
+	if err != nil {
+		return err
+	}
+	if p.Thumbprint != gwt.Header.Confirmation {
+		return errors.New(ErrorProofKey)
+	}
+
+	return nil
+}
+
+func (c *coderConfig) checkProof(proof, method, rawURL, token string) (*Proof, error) {
+	if c.nonces == nil {
+		return nil, errors.New(ErrorNoNonceCache)
+	}
+
+	pub, claims, err := parseProof(proof)
+	if err != nil {
+		return nil, err
+	}
+
+	if claims.Htm != method || !sameProofURL(claims.Htu, rawURL) {
+		return nil, errors.New(ErrorProofRequest)
+	}
+
+	if (token == "" && claims.Ath != "") || (token != "" && claims.Ath != tokenHash(token)) {
+		return nil, errors.New(ErrorProofToken)
+	}
+
+	maxAge := c.proofMaxAge
+	if maxAge <= 0 {
+		maxAge = DefaultProofMaxAge
+	}
+
+	iat := time.Unix(claims.Iat, 0).UTC()
+	now := c.clock()
+	if now.After(iat.Add(maxAge+c.leeway)) || now.Add(c.leeway).Before(iat) {
+		return nil, errors.New(ErrorProofStale)
+	}
+
+	fresh, err := c.nonces.Spend(claims.Jti, iat.Add(maxAge+c.leeway))
+	if err != nil {
+		return nil, err
+	}
+	if !fresh {
+		return nil, errors.New(ErrorProofReplayed)
+	}
+
+	return &Proof{
+		ID:         claims.Jti,
+		Method:     claims.Htm,
+		URL:        claims.Htu,
+		IssuedAt:   iat,
+		Thumbprint: thumbprint(pub),
+	}, nil
+}
+
+// parseProof checks the proof is a well formed dpop+jwt signed by the key it carries.
+func parseProof(proof string) (ed25519.PublicKey, *proofClaims, error) {
+	parts := strings.Split(proof, ".")
+	if len(parts) != 3 {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+
+	hdrBuff, err := b64JWT.DecodeString(parts[0])
+	if err != nil {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+
+	var hdr proofHeader
+	if err = json.Unmarshal(hdrBuff, &hdr); err != nil {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+	if hdr.Typ != proofType || hdr.Alg != EdDSA || hdr.JWK.Kty != "OKP" || hdr.JWK.Crv != "Ed25519" {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+
+	pub, err := b64JWT.DecodeString(hdr.JWK.X)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+
+	sig, err := b64JWT.DecodeString(parts[2])
+	if err != nil || !ed25519.Verify(pub, []byte(parts[0]+"."+parts[1]), sig) {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+
+	claimsBuff, err := b64JWT.DecodeString(parts[1])
+	if err != nil {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+
+	var claims proofClaims
+	if err = json.Unmarshal(claimsBuff, &claims); err != nil || claims.Jti == "" {
+		return nil, nil, errors.New(ErrorProofMalformed)
+	}
+
+	return pub, &claims, nil
+}
+
+// thumbprint hashes the required members of the OKP JWK in lexicographic order, see RFC 7638.
+func thumbprint(pub ed25519.PublicKey) string {
+	jwk := `{"crv":"Ed25519","kty":"OKP","x":"` + b64JWT.EncodeToString(pub) + `"}`
+	sum := sha256.Sum256([]byte(jwk))
+	return b64JWT.EncodeToString(sum[:])
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return b64JWT.EncodeToString(sum[:])
+}
+
+// sameProofURL compares scheme, host and path, query and fragment are ignored as RFC 9449 asks.
+func sameProofURL(a, b string) bool {
+	ua, errA := url.Parse(a)
+	ub, errB := url.Parse(b)
+	if errA != nil || errB != nil {
+		return false
+	}
+
+	return strings.EqualFold(ua.Scheme, ub.Scheme) && strings.EqualFold(ua.Host, ub.Host) && ua.Path == ub.Path
+}
+
+// NonceCache ...
+// ====================================================================================================
+
+// NonceCache remembers spent proof IDs until the proof could no longer be accepted anyway.
+type NonceCache interface {
+	// Spend records nonce and reports whether it was unused.
+	Spend(nonce string, expires time.Time) (bool, error)
+	Purge(now time.Time) error
+	Close() error
+}
+
+type MemoryNonceCache struct {
+	mu    sync.Mutex
+	spent map[string]time.Time // Key: nonce; Value: when it can be forgotten
+	stop  chan struct{}
+	once  sync.Once
+}
+
+// NewMemoryNonceCache returns a NonceCache that purges expired nonces every gcInterval.
+// Spent nonces already carry the leeway of the proofs, WithGCLeeway is ignored.
+func NewMemoryNonceCache(gcInterval time.Duration, opts ...GCOption) *MemoryNonceCache {
+	s := &MemoryNonceCache{
+		spent: make(map[string]time.Time),
+		stop:  make(chan struct{}),
+	}
+
+	go runGC(gcInterval, s.stop, newGCConfig(opts), s.Purge)
+	return s
+}
+
+func (s *MemoryNonceCache) Spend(nonce string, expires time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.spent[nonce]; ok {
+		return false, nil
+	}
+
+	s.spent[nonce] = expires.UTC()
+	return true, nil
+}
+func (s *MemoryNonceCache) Purge(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for nonce, expires := range s.spent {
+		if now.After(expires) {
+			delete(s.spent, nonce)
+		}
+	}
+
+	return nil
+}
+func (s *MemoryNonceCache) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.spent)
+}
+func (s *MemoryNonceCache) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
@@ -8,26 +8,16 @@ import (
 	"strings"
 )
 
-var (
-	indexToResourceType = make(map[byte]ResourceType)
-	indexToRoleType     = make(map[byte]RoleType)
-	FixedIDLen          = 16
-)
-
-func init() {
-	for k, v := range defaultResourceTypeIdx {
-		indexToResourceType[byte(v)] = k
-	}
-	for k, v := range defaultRoleTypeIdx {
-		indexToRoleType[byte(v)] = k
-	}
-}
+var FixedIDLen = 16
 
 // Resources ...
 // ====================================================================================================
 type Resources struct {
 	UserID    []byte      // UserID: Who these resources belong to
 	Resources []*Resource // Key: Resource.ResID; Value: Resource
+
+	limited bool       // set by caveats of an attenuated token
+	limit   Permission // caps every permission, inherited ones included
 }
 
 func NewResources(userID uid.UID) *Resources {
@@ -36,129 +26,10 @@ func NewResources(userID uid.UID) *Resources {
 	}
 }
 
+// HasAccess reports whether any of role is satisfied on resourceType, see Authorize.
 func (res *Resources) HasAccess(resourceType ResourceType, role ...Role) bool {
-	ok := 0
-	for _, resource := range res.Resources {
-		for _, r := range role {
-			if resource.Type != resourceType {
-				continue
-			}
-
-			if resource.HasRole(r) {
-				ok++
-			}
-		}
-	}
-
-	if ok == 1 {
-		return true
-	}
-
-	return false
+	return res.Authorize(resourceType, role...).Allowed
 }
-func (res *Resources) Serialize() []byte {
-	buffer := new(bytes.Buffer)
-
-	// Serialize UserID directly as a byte slice
-	buffer.Write(res.UserID)
-
-	// Serialize number of resources
-	buffer.WriteByte(byte(len(res.Resources)))
-
-	for _, r := range res.Resources {
-		// Serialize resource ID directly as a byte slice
-		buffer.Write(r.ResID)
-
-		// Serialize resource type as an index
-		buffer.WriteByte(resourceTypeToIndex(r.Type))
-
-		// Serialize number of role assignments
-		buffer.WriteByte(byte(len(r.Roles)))
-
-		for _, role := range r.Roles {
-			// Serialize role type
-			roleTypeIndex := roleTypeToIndex(string(role.Type))
-			buffer.WriteByte(roleTypeIndex)
-
-			// Serialize permissions
-			buffer.WriteByte(byte(role.Permissions))
-
-			/// ==========
-			// Len of Claims
-			buffer.WriteByte(byte(len(role.Claims)))
-
-			for _, claim := range role.Claims {
-
-				// len of claim
-				buffer.WriteByte(byte(len(claim)))
-
-				// claim data
-				buffer.Write([]byte(claim))
-
-			}
-		}
-
-	}
-
-	return buffer.Bytes()
-}
-func (res *Resources) Deserialize(data []byte) error {
-	buffer := bytes.NewBuffer(data)
-
-	// Deserialize UserID
-	res.UserID = make([]byte, FixedIDLen)
-	_, _ = buffer.Read(res.UserID)
-
-	numResources, _ := buffer.ReadByte()
-	resources := make([]Resource, numResources)
-
-	for i := range resources {
-		// Deserialize resource ID
-		resources[i].ResID = make([]byte, FixedIDLen)
-		_, _ = buffer.Read(resources[i].ResID)
-
-		// Deserialize resource type
-		resTypeIndex, _ := buffer.ReadByte()
-
-		resources[i].Type = indexToResourceType[resTypeIndex]
-
-		// Deserialize roles
-		numRoles, _ := buffer.ReadByte()
-
-		resources[i].Roles = make([]Role, numRoles)
-		for j := range resources[i].Roles {
-			// Deserialize role type
-			roleTypeIndex, _ := buffer.ReadByte()
-
-			resources[i].Roles[j].Type = indexToRoleType[roleTypeIndex]
-
-			// Deserialize permissions
-			permByte, _ := buffer.ReadByte()
-
-			resources[i].Roles[j].Permissions = Permission(permByte)
-
-			// Len Claims
-			numClaims, _ := buffer.ReadByte()
-
-			resources[i].Roles[j].Claims = make(map[RoleType]Claim, numClaims)
-			for k := range resources[i].Roles[j].Claims {
-				claimLen, _ := buffer.ReadByte()
-
-				claim := make([]byte, claimLen)
-				_, _ = buffer.Read(claim)
-
-				resources[i].Roles[j].Claims[k] = Claim(claim)
-			}
-		}
-	}
-
-	for _, resource := range resources {
-		res.Resources = append(res.Resources, &resource)
-	}
-
-	return nil
-}
-
 func (res *Resources) AddResource(nRes Resource) {
 	for _, resource := range res.GetResourceByType(nRes.Type) {
 		for _, role := range nRes.Roles {
@@ -205,14 +76,12 @@ func (res *Resources) GetResourceByType(resType ResourceType) []*Resource {
 }
 
 func (res *Resources) String() string {
-	return string(res.Serialize())
-}
+	data, err := res.Serialize()
+	if err != nil {
+		return err.Error()
+	}
 
-func resourceTypeToIndex(resType ResourceType) byte {
-	return byte(defaultResourceTypeIdx[resType])
-}
-func roleTypeToIndex(roleType string) byte {
-	return byte(defaultRoleTypeIdx[RoleType(roleType)])
+	return string(data)
 }
 
 // Resource ...
@@ -305,10 +174,12 @@ func (r *Role) Equals(otherRole Role) bool {
 type Claim string
 
 func (c Claim) Key() string {
-	return string(c)[strings.IndexRune(string(c), '.')-1:]
+	key, _, _ := strings.Cut(string(c), ".")
+	return key
 }
 func (c Claim) Value() string {
-	return string(c)[:strings.IndexRune(string(c), '.')+1]
+	_, value, _ := strings.Cut(string(c), ".")
+	return value
 }
 func (c Claim) String() string {
 	return strings.Replace(string(c), ".", ": ", -1)
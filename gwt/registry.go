@@ -0,0 +1,297 @@
+package gwt
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Registry
+// ====================================================================================================
+// Resources serialize ResourceType and RoleType as numeric indexes, so every service reading a
+// token must agree on them. Built-in types are pre-registered at fixed indexes, application types
+// are appended after them and should be persisted with SaveFile/SyncFile so restarts keep them.
+// Index 0 is reserved for unregistered types.
+
+const (
+	ErrorRegistryEmptyName  = "registry type name is empty"
+	ErrorRegistryIndexTaken = "registry index is already taken"
+	ErrorRegistryMismatch   = "registry does not match the persisted registry"
+	ErrorRegistryVersion    = "registry file version is not supported"
+	ErrorUnknownResource    = "unknown resource type index"
+	ErrorUnknownRole        = "unknown role type index"
+)
+
+// RegistryVersion is the version written by SaveFile.
+const RegistryVersion = 1
+
+var builtinResourceTypes = []ResourceType{
+	Network, DataManagement, UserInterface, SecurityMonitor, SystemAdmin, DevTools, ThirdParty,
+}
+
+// builtinRoleTypes are ordered from most to least privileged, see RoleType.Hierarchy.
+var builtinRoleTypes = []RoleType{
+	Owner, Admin, Dev, Mod, Guest, User,
+}
+
+// DefaultRegistry is used by Resources.Serialize and Resources.Deserialize.
+var DefaultRegistry = NewRegistry()
+
+// RegisterResourceType adds t to the DefaultRegistry and returns its index.
+func RegisterResourceType(t ResourceType) (uint64, error) {
+	return DefaultRegistry.RegisterResourceType(t)
+}
+
+// RegisterRoleType adds t to the DefaultRegistry and returns its index.
+func RegisterRoleType(t RoleType) (uint64, error) {
+	return DefaultRegistry.RegisterRoleType(t)
+}
+
+type Registry struct {
+	mu        sync.RWMutex
+	resources *typeIndex[ResourceType]
+	roles     *typeIndex[RoleType]
+}
+
+// NewRegistry returns a Registry holding only the built-in types.
+func NewRegistry() *Registry {
+	r := &Registry{
+		resources: newTypeIndex[ResourceType](),
+		roles:     newTypeIndex[RoleType](),
+	}
+
+	for _, t := range builtinResourceTypes {
+		_, _ = r.resources.register(t)
+	}
+	for _, t := range builtinRoleTypes {
+		_, _ = r.roles.register(t)
+	}
+
+	return r
+}
+
+// RegisterResourceType assigns t the next free index. Registering a known type returns its index.
+func (r *Registry) RegisterResourceType(t ResourceType) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.resources.register(t)
+}
+
+// RegisterRoleType assigns t the next free index. Registering a known type returns its index.
+// Roles registered later rank below the ones registered before them.
+func (r *Registry) RegisterRoleType(t RoleType) (uint64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.roles.register(t)
+}
+
+func (r *Registry) ResourceTypeIndex(t ResourceType) (uint64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	idx, ok := r.resources.byName[t]
+	return idx, ok
+}
+func (r *Registry) ResourceType(idx uint64) (ResourceType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.resources.byIndex[idx]
+	return t, ok
+}
+func (r *Registry) RoleTypeIndex(t RoleType) (uint64, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	idx, ok := r.roles.byName[t]
+	return idx, ok
+}
+func (r *Registry) RoleType(idx uint64) (RoleType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	t, ok := r.roles.byIndex[idx]
+	return t, ok
+}
+
+// ResourceTypes lists the registered resource types by index.
+func (r *Registry) ResourceTypes() []ResourceType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.resources.list()
+}
+
+// RoleTypes lists the registered role types by index, most privileged first.
+func (r *Registry) RoleTypes() []RoleType {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.roles.list()
+}
+
+// Persistence
+// ----------------------------------------------------------------------------------------------------
+
+type registryFile struct {
+	Version       int                     `json:"version"`
+	ResourceTypes map[ResourceType]uint64 `json:"resource_types"`
+	RoleTypes     map[RoleType]uint64     `json:"role_types"`
+}
+
+// LoadRegistryFile reads a Registry written by SaveFile and validates it.
+func LoadRegistryFile(path string) (*Registry, error) {
+	data, err := os.ReadFile(filepath.Clean(path))
+	if err != nil {
+		return nil, err
+	}
+
+	var file registryFile
+	if err = json.Unmarshal(data, &file); err != nil {
+		return nil, err
+	}
+	if file.Version != RegistryVersion {
+		return nil, errors.New(ErrorRegistryVersion)
+	}
+
+	r := NewRegistry()
+	if err = r.resources.adopt(file.ResourceTypes); err != nil {
+		return nil, err
+	}
+	if err = r.roles.adopt(file.RoleTypes); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+// SaveFile writes the Registry to path as JSON.
+func (r *Registry) SaveFile(path string) error {
+	r.mu.RLock()
+	file := registryFile{
+		Version:       RegistryVersion,
+		ResourceTypes: r.resources.snapshot(),
+		RoleTypes:     r.roles.snapshot(),
+	}
+	r.mu.RUnlock()
+
+	data, err := json.MarshalIndent(file, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(filepath.Clean(path), data, 0600)
+}
+
+// SyncFile adopts the types persisted at path, failing if any disagree with indexes this Registry
+// already assigned, and writes the merged Registry back. A missing file is created.
+// Run it on startup before registering application types so they keep their persisted
+// indexes, then SaveFile once they are registered.
+func (r *Registry) SyncFile(path string) error {
+	persisted, err := LoadRegistryFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+
+	if persisted != nil {
+		r.mu.Lock()
+		err = r.resources.adopt(persisted.resources.snapshot())
+		if err == nil {
+			err = r.roles.adopt(persisted.roles.snapshot())
+		}
+		r.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+
+	return r.SaveFile(path)
+}
+
+// typeIndex ...
+// ====================================================================================================
+type typeIndex[T ~string] struct {
+	byName  map[T]uint64
+	byIndex map[uint64]T
+	next    uint64
+}
+
+func newTypeIndex[T ~string]() *typeIndex[T] {
+	return &typeIndex[T]{
+		byName:  make(map[T]uint64),
+		byIndex: make(map[uint64]T),
+		next:    1,
+	}
+}
+
+func (ti *typeIndex[T]) register(t T) (uint64, error) {
+	if t == "" {
+		return 0, errors.New(ErrorRegistryEmptyName)
+	}
+	if idx, ok := ti.byName[t]; ok {
+		return idx, nil
+	}
+
+	idx := ti.next
+	ti.set(t, idx)
+	return idx, nil
+}
+
+// adopt merges persisted indexes, failing when a name or index is already bound differently.
+func (ti *typeIndex[T]) adopt(persisted map[T]uint64) error {
+	seen := make(map[uint64]bool, len(persisted))
+	for t, idx := range persisted {
+		if t == "" || idx == 0 || seen[idx] {
+			return errors.New(ErrorRegistryMismatch)
+		}
+		seen[idx] = true
+
+		if known, ok := ti.byName[t]; ok {
+			if known != idx {
+				return errors.New(ErrorRegistryMismatch)
+			}
+			continue
+		}
+
+		if _, taken := ti.byIndex[idx]; taken {
+			return errors.New(ErrorRegistryIndexTaken)
+		}
+	}
+
+	for t, idx := range persisted {
+		ti.set(t, idx)
+	}
+
+	return nil
+}
+
+func (ti *typeIndex[T]) set(t T, idx uint64) {
+	ti.byName[t] = idx
+	ti.byIndex[idx] = t
+	if idx >= ti.next {
+		ti.next = idx + 1
+	}
+}
+func (ti *typeIndex[T]) snapshot() map[T]uint64 {
+	out := make(map[T]uint64, len(ti.byName))
+	for t, idx := range ti.byName {
+		out[t] = idx
+	}
+
+	return out
+}
+func (ti *typeIndex[T]) list() []T {
+	out := make([]T, 0, len(ti.byName))
+	for t := range ti.byName {
+		out = append(out, t)
+	}
+	sort.Slice(out, func(i, j int) bool { return ti.byName[out[i]] < ti.byName[out[j]] })
+
+	return out
+}
@@ -0,0 +1,384 @@
+package gwt
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+)
+
+// Resources binary format
+// ====================================================================================================
+// v2 (current), every count and length is a uvarint, permissions are a varint:
+//
+//	0x00 | 0x02 | len UserID | UserID | #resources
+//	  resource: len ResID | ResID | type idx | #roles
+//	    role: role idx | permissions | #claims
+//	      claim: len key | key | len claim | claim
+//
+// Type indexes come from the DefaultRegistry, 0 stands for an empty type. Resources holding a
+// type that is not registered do not serialize.
+//
+// v1 (legacy, decode only) has no header, fixed FixedIDLen IDs, single byte counts and the
+// built-in role types at indexes 0 through 5.
+// v1 never starts with 0x00 since its first byte belongs to an alphanumeric UserID.
+
+const (
+	ErrorResourcesTruncated = "resources data is truncated"
+	ErrorResourcesCorrupt   = "resources data is corrupt"
+	ErrorResourcesVersion   = "resources data version is not supported"
+	ErrorUnregisteredType   = "resource or role type is not registered"
+)
+
+const (
+	resourcesMarker  byte = 0x00
+	resourcesVersion byte = 0x02
+)
+
+// Serialize encodes res in the current layout. Every resource and role type must be empty or
+// registered in the DefaultRegistry.
+func (res *Resources) Serialize() ([]byte, error) {
+	buffer := []byte{resourcesMarker, resourcesVersion}
+
+	// UserID
+	buffer = appendBytes(buffer, res.UserID)
+
+	// Resources
+	buffer = binary.AppendUvarint(buffer, uint64(len(res.Resources)))
+	for _, r := range res.Resources {
+		buffer = appendBytes(buffer, r.ResID)
+		resTypeIndex, err := registeredIndex(DefaultRegistry.ResourceTypeIndex, r.Type)
+		if err != nil {
+			return nil, err
+		}
+		buffer = binary.AppendUvarint(buffer, resTypeIndex)
+
+		// Roles
+		buffer = binary.AppendUvarint(buffer, uint64(len(r.Roles)))
+		for _, role := range r.Roles {
+			roleTypeIndex, err := registeredIndex(DefaultRegistry.RoleTypeIndex, role.Type)
+			if err != nil {
+				return nil, err
+			}
+			buffer = binary.AppendUvarint(buffer, roleTypeIndex)
+			buffer = binary.AppendVarint(buffer, int64(role.Permissions))
+
+			// Claims, sorted so equal Resources serialize to equal bytes
+			keys := make([]string, 0, len(role.Claims))
+			for k := range role.Claims {
+				keys = append(keys, string(k))
+			}
+			sort.Strings(keys)
+
+			buffer = binary.AppendUvarint(buffer, uint64(len(keys)))
+			for _, k := range keys {
+				buffer = appendBytes(buffer, []byte(k))
+				buffer = appendBytes(buffer, []byte(role.Claims[RoleType(k)]))
+			}
+		}
+	}
+
+	return buffer, nil
+}
+
+// Deserialize replaces res with the decoded data. It accepts the current and the legacy layout,
+// and returns an error instead of guessing when data is truncated or corrupt.
+func (res *Resources) Deserialize(data []byte) error {
+	if len(data) > 0 && data[0] == resourcesMarker {
+		if len(data) < 2 {
+			return errors.New(ErrorResourcesTruncated)
+		}
+		if data[1] != resourcesVersion {
+			return errors.New(ErrorResourcesVersion)
+		}
+
+		return res.deserializeV2(&resReader{buf: data[2:]})
+	}
+
+	return res.deserializeV1(&resReader{buf: data})
+}
+
+func (res *Resources) deserializeV2(r *resReader) error {
+	userID, err := r.bytes()
+	if err != nil {
+		return err
+	}
+
+	numResources, err := r.count()
+	if err != nil {
+		return err
+	}
+
+	resources := make([]*Resource, numResources)
+	for i := range resources {
+		resource := &Resource{}
+
+		if resource.ResID, err = r.bytes(); err != nil {
+			return err
+		}
+
+		resTypeIndex, err := r.uvarint()
+		if err != nil {
+			return err
+		}
+		if resource.Type, err = resourceTypeAt(resTypeIndex); err != nil {
+			return err
+		}
+
+		numRoles, err := r.count()
+		if err != nil {
+			return err
+		}
+
+		resource.Roles = make([]Role, numRoles)
+		for j := range resource.Roles {
+			role := &resource.Roles[j]
+
+			roleTypeIndex, err := r.uvarint()
+			if err != nil {
+				return err
+			}
+			if role.Type, err = roleTypeAt(roleTypeIndex); err != nil {
+				return err
+			}
+
+			perm, err := r.varint()
+			if err != nil {
+				return err
+			}
+			role.Permissions = Permission(perm)
+
+			numClaims, err := r.count()
+			if err != nil {
+				return err
+			}
+
+			role.Claims = make(map[RoleType]Claim, numClaims)
+			for k := 0; k < numClaims; k++ {
+				key, err := r.bytes()
+				if err != nil {
+					return err
+				}
+
+				claim, err := r.bytes()
+				if err != nil {
+					return err
+				}
+
+				role.Claims[RoleType(key)] = Claim(claim)
+			}
+		}
+
+		resources[i] = resource
+	}
+
+	if r.remaining() != 0 {
+		return errors.New(ErrorResourcesCorrupt)
+	}
+
+	res.UserID = userID
+	res.Resources = resources
+	return nil
+}
+
+func (res *Resources) deserializeV1(r *resReader) error {
+	userID, err := r.fixed(FixedIDLen)
+	if err != nil {
+		return err
+	}
+
+	numResources, err := r.byte()
+	if err != nil {
+		return err
+	}
+
+	resources := make([]*Resource, numResources)
+	for i := range resources {
+		resource := &Resource{}
+
+		if resource.ResID, err = r.fixed(FixedIDLen); err != nil {
+			return err
+		}
+
+		// v1 wrote every resource type as index 0, the type itself was never stored.
+		if _, err = r.byte(); err != nil {
+			return err
+		}
+
+		numRoles, err := r.byte()
+		if err != nil {
+			return err
+		}
+
+		resource.Roles = make([]Role, numRoles)
+		for j := range resource.Roles {
+			role := &resource.Roles[j]
+
+			roleTypeIndex, err := r.byte()
+			if err != nil {
+				return err
+			}
+			if int(roleTypeIndex) >= len(builtinRoleTypes) {
+				return errors.New(ErrorUnknownRole)
+			}
+			role.Type = builtinRoleTypes[roleTypeIndex]
+
+			permByte, err := r.byte()
+			if err != nil {
+				return err
+			}
+			role.Permissions = Permission(permByte)
+
+			numClaims, err := r.byte()
+			if err != nil {
+				return err
+			}
+
+			// v1 did not store claim keys, they are recovered from the "key.value" claim itself.
+			role.Claims = make(map[RoleType]Claim, numClaims)
+			for k := 0; k < int(numClaims); k++ {
+				claimLen, err := r.byte()
+				if err != nil {
+					return err
+				}
+
+				claim, err := r.fixed(int(claimLen))
+				if err != nil {
+					return err
+				}
+
+				key, _, _ := strings.Cut(string(claim), ".")
+				role.Claims[RoleType(key)] = Claim(claim)
+			}
+		}
+
+		resources[i] = resource
+	}
+
+	res.UserID = userID
+	res.Resources = resources
+	return nil
+}
+
+// resourceTypeAt and roleTypeAt map index 0 to an unregistered type and reject unknown indexes.
+// registeredIndex is the registry index of t, 0 when it is empty.
+func registeredIndex[T ~string](index func(T) (uint64, bool), t T) (uint64, error) {
+	if t == "" {
+		return 0, nil
+	}
+
+	idx, ok := index(t)
+	if !ok {
+		return 0, errors.New(ErrorUnregisteredType + ": " + string(t))
+	}
+
+	return idx, nil
+}
+
+func resourceTypeAt(idx uint64) (ResourceType, error) {
+	if idx == 0 {
+		return "", nil
+	}
+
+	t, ok := DefaultRegistry.ResourceType(idx)
+	if !ok {
+		return "", errors.New(ErrorUnknownResource)
+	}
+
+	return t, nil
+}
+func roleTypeAt(idx uint64) (RoleType, error) {
+	if idx == 0 {
+		return "", nil
+	}
+
+	t, ok := DefaultRegistry.RoleType(idx)
+	if !ok {
+		return "", errors.New(ErrorUnknownRole)
+	}
+
+	return t, nil
+}
+
+func appendBytes(buffer, data []byte) []byte {
+	buffer = binary.AppendUvarint(buffer, uint64(len(data)))
+	return append(buffer, data...)
+}
+
+// resReader reads the Resources formats, failing on truncation instead of zero filling.
+type resReader struct {
+	buf []byte
+	off int
+}
+
+func (r *resReader) remaining() int {
+	return len(r.buf) - r.off
+}
+func (r *resReader) byte() (byte, error) {
+	if r.remaining() < 1 {
+		return 0, errors.New(ErrorResourcesTruncated)
+	}
+
+	b := r.buf[r.off]
+	r.off++
+	return b, nil
+}
+func (r *resReader) fixed(n int) ([]byte, error) {
+	if n < 0 || r.remaining() < n {
+		return nil, errors.New(ErrorResourcesTruncated)
+	}
+
+	out := make([]byte, n)
+	copy(out, r.buf[r.off:r.off+n])
+	r.off += n
+	return out, nil
+}
+func (r *resReader) uvarint() (uint64, error) {
+	v, n := binary.Uvarint(r.buf[r.off:])
+	if n == 0 {
+		return 0, errors.New(ErrorResourcesTruncated)
+	}
+	if n < 0 {
+		return 0, errors.New(ErrorResourcesCorrupt)
+	}
+
+	r.off += n
+	return v, nil
+}
+func (r *resReader) varint() (int64, error) {
+	v, n := binary.Varint(r.buf[r.off:])
+	if n == 0 {
+		return 0, errors.New(ErrorResourcesTruncated)
+	}
+	if n < 0 {
+		return 0, errors.New(ErrorResourcesCorrupt)
+	}
+
+	r.off += n
+	return v, nil
+}
+
+// count reads an element count. Every element takes at least one byte,
+// so a count larger than what is left can only come from corrupt data.
+func (r *resReader) count() (int, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return 0, err
+	}
+	if n > uint64(r.remaining()) {
+		return 0, errors.New(ErrorResourcesCorrupt)
+	}
+
+	return int(n), nil
+}
+func (r *resReader) bytes() ([]byte, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.remaining()) {
+		return nil, errors.New(ErrorResourcesTruncated)
+	}
+
+	return r.fixed(int(n))
+}
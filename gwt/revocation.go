@@ -0,0 +1,231 @@
+package gwt
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	ErrorTokenRevoked      = "token has been revoked"
+	ErrorNoRevocationStore = "no revocation store configured"
+)
+
+// DefaultRevocationGC is how often revocation stores forget entries for tokens that have expired anyway.
+const DefaultRevocationGC = time.Minute * 5
+
+// RevocationStore remembers the IDs of tokens that must stop validating before they expire.
+// Entries only need to live until the token's own expiry and the leeway verifiers give it,
+// after which Purge can drop them.
+type RevocationStore interface {
+	Revoke(tokenID string, expires time.Time) error
+	IsRevoked(tokenID string) (bool, error)
+	Purge(now time.Time) error
+	Close() error
+}
+
+// WithRevocationStore makes the ValidateGWT* helpers reject tokens whose ID is in store.
+func WithRevocationStore(store RevocationStore) Option {
+	return func(c *coderConfig) {
+		c.revocations = store
+	}
+}
+
+// Revoke stops tok from validating for every MultiCoder sharing this RevocationStore.
+func (m *MultiCoder[T]) Revoke(tok *GWT[T]) error {
+	if m.conf.revocations == nil {
+		return errors.New(ErrorNoRevocationStore)
+	}
+	if tok.Header.ID == "" {
+		return errors.New(ErrorInvalidToken)
+	}
+
+	return m.conf.revocations.Revoke(tok.Header.ID, tok.Header.Expires)
+}
+
+func (c *coderConfig) checkRevoked(tokenID string) error {
+	if c.revocations == nil || tokenID == "" {
+		return nil
+	}
+
+	revoked, err := c.revocations.IsRevoked(tokenID)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errors.New(ErrorTokenRevoked)
+	}
+
+	return nil
+}
+
+// GCOption configures how a RevocationStore or NonceCache forgets its entries.
+type GCOption func(*gcConfig)
+
+type gcConfig struct {
+	now    func() time.Time
+	leeway time.Duration
+}
+
+// WithGCClock purges by now instead of time.Now. Give it the clock of the coders sharing the store.
+func WithGCClock(now func() time.Time) GCOption {
+	return func(c *gcConfig) {
+		c.now = now
+	}
+}
+
+// WithGCLeeway keeps entries for leeway past their expiry, DefaultLeeway unless set.
+// Give it the largest WithLeeway of the coders sharing the store.
+func WithGCLeeway(leeway time.Duration) GCOption {
+	return func(c *gcConfig) {
+		c.leeway = leeway
+	}
+}
+
+func newGCConfig(opts []GCOption) gcConfig {
+	c := gcConfig{now: time.Now, leeway: DefaultLeeway}
+	for _, opt := range opts {
+		opt(&c)
+	}
+
+	return c
+}
+
+// runGC calls purge with the time of c's clock every interval until stop is closed.
+func runGC(interval time.Duration, stop <-chan struct{}, c gcConfig, purge func(time.Time) error) {
+	if interval <= 0 {
+		interval = DefaultRevocationGC
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_ = purge(c.now().UTC())
+		case <-stop:
+			return
+		}
+	}
+}
+
+// MemoryRevocationStore ...
+// ====================================================================================================
+type MemoryRevocationStore struct {
+	mu      sync.RWMutex
+	revoked map[string]time.Time // Key: token ID; Value: token expiry
+	leeway  time.Duration
+	stop    chan struct{}
+	once    sync.Once
+}
+
+// NewMemoryRevocationStore returns a RevocationStore that purges expired entries every gcInterval.
+func NewMemoryRevocationStore(gcInterval time.Duration, opts ...GCOption) *MemoryRevocationStore {
+	gc := newGCConfig(opts)
+	s := &MemoryRevocationStore{
+		revoked: make(map[string]time.Time),
+		leeway:  gc.leeway,
+		stop:    make(chan struct{}),
+	}
+
+	go runGC(gcInterval, s.stop, gc, s.Purge)
+	return s
+}
+
+func (s *MemoryRevocationStore) Revoke(tokenID string, expires time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.revoked[tokenID] = expires.UTC()
+	return nil
+}
+func (s *MemoryRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	_, ok := s.revoked[tokenID]
+	return ok, nil
+}
+func (s *MemoryRevocationStore) Purge(now time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, expires := range s.revoked {
+		if now.After(expires.Add(s.leeway)) {
+			delete(s.revoked, id)
+		}
+	}
+
+	return nil
+}
+func (s *MemoryRevocationStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.revoked)
+}
+func (s *MemoryRevocationStore) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
+
+// SQLiteRevocationStore ...
+// ====================================================================================================
+type SQLiteRevocationStore struct {
+	db     *sql.DB
+	leeway time.Duration
+	stop   chan struct{}
+	once   sync.Once
+}
+
+const revocationTable = `CREATE TABLE IF NOT EXISTS gwt_revocations (
+	token_id TEXT PRIMARY KEY,
+	expires  INTEGER NOT NULL
+)`
+
+// NewSQLiteRevocationStore keeps revoked token IDs in the gwt_revocations table of db,
+// creating it when missing, and purges expired entries every gcInterval.
+func NewSQLiteRevocationStore(db *sql.DB, gcInterval time.Duration, opts ...GCOption) (*SQLiteRevocationStore, error) {
+	if _, err := db.Exec(revocationTable); err != nil {
+		return nil, err
+	}
+
+	gc := newGCConfig(opts)
+	s := &SQLiteRevocationStore{
+		db:     db,
+		leeway: gc.leeway,
+		stop:   make(chan struct{}),
+	}
+
+	go runGC(gcInterval, s.stop, gc, s.Purge)
+	return s, nil
+}
+
+func (s *SQLiteRevocationStore) Revoke(tokenID string, expires time.Time) error {
+	_, err := s.db.ExecContext(context.Background(),
+		"INSERT OR REPLACE INTO gwt_revocations (token_id, expires) VALUES (?, ?)",
+		tokenID, expires.UTC().Unix())
+	return err
+}
+func (s *SQLiteRevocationStore) IsRevoked(tokenID string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(context.Background(),
+		"SELECT COUNT(1) FROM gwt_revocations WHERE token_id = ?", tokenID).Scan(&count)
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+func (s *SQLiteRevocationStore) Purge(now time.Time) error {
+	_, err := s.db.ExecContext(context.Background(),
+		"DELETE FROM gwt_revocations WHERE expires < ?", now.Add(-s.leeway).UTC().Unix())
+	return err
+}
+func (s *SQLiteRevocationStore) Close() error {
+	s.once.Do(func() { close(s.stop) })
+	return nil
+}
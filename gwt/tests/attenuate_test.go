@@ -0,0 +1,221 @@
+package tests
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newDelegatedToken() (*gwt.GWT[*gwt.Resources], *gwt.Resource) {
+	tok := newTestToken()
+
+	docs := gwt.NewResource(gwt.DataManagement, gwt.Role{Type: gwt.Owner, Permissions: gwt.Read | gwt.Write})
+	net := gwt.NewResource(gwt.Network, gwt.DefaultRoles[gwt.Admin])
+	tok.Body.Resources = append(tok.Body.Resources, &docs, &net)
+
+	return tok, &docs
+}
+
+func TestAttenuateRestricts(t *testing.T) {
+	attMC, _ := gwt.NewMultiCoder[*gwt.Resources]()
+
+	parent, docs := newDelegatedToken()
+	tok, err := attMC.Encode(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	child, err := attMC.Attenuate(tok.Token, gwt.Caveat{ResourceID: docs.ResID, Permissions: gwt.Read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !gwt.IsAttenuated(child.Token) || gwt.IsAttenuated(tok.Token) {
+		t.Fatal("attenuated tokens are not told apart")
+	}
+
+	decoded, err := attMC.Decode(child.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Caveats()) != 1 || len(decoded.Body.Resources) != 1 {
+		t.Fatalf("caveats were not applied: %d caveats, %d resources", len(decoded.Caveats()), len(decoded.Body.Resources))
+	}
+	if d := decoded.Body.Evaluate(gwt.AccessRequest{ResourceID: docs.ResID, Permission: gwt.Read}); !d.Allowed {
+		t.Errorf("child lost the read it was delegated: %s", d)
+	}
+
+	// The Owner role inherits Edit and Delete from lower roles, the caveat must cap those too.
+	for _, perm := range []gwt.Permission{gwt.Write, gwt.Edit, gwt.Delete} {
+		if d := decoded.Body.Evaluate(gwt.AccessRequest{ResourceID: docs.ResID, Permission: perm}); d.Allowed {
+			t.Errorf("child exceeded its caveat: %s", d)
+		}
+	}
+	if d := decoded.Body.Evaluate(gwt.AccessRequest{ResourceType: gwt.Network, Permission: gwt.Read}); d.Allowed {
+		t.Errorf("child kept a resource outside its caveat: %s", d)
+	}
+
+	// Children of children can only narrow further, a broader caveat grants nothing back.
+	grandchild, err := attMC.Attenuate(child.Token, gwt.Caveat{Permissions: gwt.Read | gwt.Write | gwt.Delete})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err = attMC.Decode(grandchild.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d := decoded.Body.Evaluate(gwt.AccessRequest{ResourceID: docs.ResID, Permission: gwt.Write}); d.Allowed {
+		t.Errorf("grandchild widened its parent: %s", d)
+	}
+
+	// Peek applies caveats as well, so inspection shows what the child can do.
+	peeked, err := gwt.Peek[*gwt.Resources](grandchild.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(peeked.Caveats()) != 2 || len(peeked.Body.Resources) != 1 {
+		t.Errorf("peek ignored caveats: %d caveats, %d resources", len(peeked.Caveats()), len(peeked.Body.Resources))
+	}
+}
+
+func TestAttenuateExpiryAndAudience(t *testing.T) {
+	attMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithAudience([]byte("dashboard")))
+
+	parent := newTestToken()
+	tok, err := attMC.Encode(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A later expiry never extends the parent.
+	later, _ := attMC.Attenuate(tok.Token, gwt.Caveat{Expires: parent.Header.Expires.Add(time.Hour)})
+	decoded, err := attMC.Decode(later.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Header.Expires.After(parent.Header.Expires) {
+		t.Error("caveat extended the parent expiry")
+	}
+
+	expired, _ := attMC.Attenuate(tok.Token, gwt.Caveat{Expires: time.Now().Add(-time.Hour)})
+	decoded, err = attMC.Decode(expired.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err == nil || err.Error() != gwt.ErrorTokenExpired {
+		t.Errorf("expected %q, got %v", gwt.ErrorTokenExpired, err)
+	}
+
+	// The parent was minted for the dashboard, a child for another audience is useless.
+	billing, _ := attMC.Attenuate(tok.Token, gwt.Caveat{Audience: []byte("billing")})
+	if _, err = attMC.Decode(billing.Token); err == nil || err.Error() != gwt.ErrorCaveatAudience {
+		t.Errorf("expected %q, got %v", gwt.ErrorCaveatAudience, err)
+	}
+
+	if _, err = attMC.Attenuate(tok.Token, gwt.Caveat{}); err == nil || err.Error() != gwt.ErrorCaveatEmpty {
+		t.Errorf("expected %q, got %v", gwt.ErrorCaveatEmpty, err)
+	}
+}
+
+func TestAttenuateRejectsTampering(t *testing.T) {
+	attMC, _ := gwt.NewMultiCoder[*gwt.Resources]()
+
+	parent, docs := newDelegatedToken()
+	tok, _ := attMC.Encode(parent)
+
+	narrow, _ := attMC.Attenuate(tok.Token, gwt.Caveat{ResourceID: docs.ResID, Permissions: gwt.Read})
+	broad, _ := attMC.Attenuate(tok.Token, gwt.Caveat{Permissions: gwt.Read | gwt.Write})
+
+	n := strings.Split(narrow.Token, ".")
+	b := strings.Split(broad.Token, ".")
+
+	tampered := map[string]string{
+		"stripped caveats": n[0] + "." + n[2],
+		"swapped caveats":  n[0] + "." + b[1] + "." + n[2],
+		"parent signature": n[0] + "." + n[1] + "." + strings.Split(tok.Token, ".")[1],
+	}
+	for name, token := range tampered {
+		if _, err := attMC.Decode(token); err == nil {
+			t.Errorf("%s: tampered token decoded", name)
+		}
+	}
+
+	otherMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(&gwt.Key{ID: "other", Secret: []byte("other-secret")})))
+	if _, err := otherMC.Decode(narrow.Token); err == nil {
+		t.Error("child verified without the issuer key")
+	}
+}
+
+func TestAttenuateRejectsEdDSA(t *testing.T) {
+	key, _ := gwt.NewEd25519Key("ed1")
+	edMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(key)))
+
+	tok, err := edMC.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = edMC.Attenuate(tok.Token, gwt.Caveat{Permissions: gwt.Read}); err == nil || err.Error() != gwt.ErrorAttenuateAlg {
+		t.Errorf("expected %q, got %v", gwt.ErrorAttenuateAlg, err)
+	}
+}
+
+func TestAttenuateRevokedWithParent(t *testing.T) {
+	store := gwt.NewMemoryRevocationStore(time.Hour)
+	defer store.Close()
+
+	attMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithRevocationStore(store))
+
+	tok, _ := attMC.Encode(newTestToken())
+	child, _ := attMC.Attenuate(tok.Token, gwt.Caveat{Permissions: gwt.Read})
+
+	parent, err := attMC.Decode(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = attMC.Revoke(parent); err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := attMC.Decode(child.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err == nil || err.Error() != gwt.ErrorTokenRevoked {
+		t.Errorf("expected %q, got %v", gwt.ErrorTokenRevoked, err)
+	}
+}
+
+func TestAttenuateNeedsResourcesBody(t *testing.T) {
+	strMC, _ := gwt.NewMultiCoder[string]()
+	resMC, _ := gwt.NewMultiCoder[*gwt.Resources]()
+
+	tok, err := strMC.Encode(&gwt.GWT[string]{
+		Header: gwt.Header{Issuer: []byte("Authentity"), Recipient: []byte("Vaiktorg"), Expires: time.Now().Add(time.Hour)},
+		Body:   "full authority",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = strMC.Attenuate(tok.Token, gwt.Caveat{Permissions: gwt.Read}); err == nil || err.Error() != gwt.ErrorCaveatBody {
+		t.Errorf("expected %q, got %v", gwt.ErrorCaveatBody, err)
+	}
+	if _, err = strMC.Attenuate(tok.Token, gwt.Caveat{Expires: time.Now().Add(time.Minute)}); err != nil {
+		t.Errorf("expiry caveat refused: %v", err)
+	}
+
+	// A child narrowed by a coder of another body type must not decode as if it were narrowed.
+	child, err := resMC.Attenuate(tok.Token, gwt.Caveat{ResourceType: gwt.Network})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = strMC.Decode(child.Token); err == nil || err.Error() != gwt.ErrorCaveatBody {
+		t.Errorf("expected %q, got %v", gwt.ErrorCaveatBody, err)
+	}
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"strings"
+	"testing"
+)
+
+func newAuthzResources(roles ...gwt.Role) (*gwt.Resources, *gwt.Resource) {
+	res := gwt.NewResources(uid.New())
+	r := gwt.NewResource(gwt.DataManagement, roles...)
+	res.Resources = append(res.Resources, &r)
+
+	return res, &r
+}
+
+func TestEvaluateRoleInheritance(t *testing.T) {
+	// An Owner with only Read on the resource still inherits what a Mod may do.
+	res, _ := newAuthzResources(gwt.Role{Type: gwt.Owner, Permissions: gwt.Read})
+
+	if !res.HasAccess(gwt.DataManagement, gwt.DefaultRoles[gwt.Mod]) {
+		t.Error("owner failed a check that only requires a moderator")
+	}
+
+	guest, _ := newAuthzResources(gwt.DefaultRoles[gwt.Guest])
+	decision := guest.Evaluate(gwt.AccessRequest{ResourceType: gwt.DataManagement, Permission: gwt.Read, MinRole: gwt.Mod})
+	if decision.Allowed {
+		t.Error("guest passed a check that requires a moderator")
+	}
+	if !strings.Contains(decision.Reason, "no role at or above mod") {
+		t.Errorf("unexpected reason: %s", decision.Reason)
+	}
+}
+
+func TestEvaluateUnionsPermissions(t *testing.T) {
+	res, _ := newAuthzResources(
+		gwt.Role{Type: gwt.User, Permissions: gwt.Read},
+		gwt.Role{Type: gwt.User, Permissions: gwt.Write},
+	)
+
+	decision := res.Evaluate(gwt.AccessRequest{ResourceType: gwt.DataManagement, Permission: gwt.Read | gwt.Write})
+	if !decision.Allowed || len(decision.Grants) != 2 {
+		t.Errorf("permissions were not unioned: %s", decision)
+	}
+
+	decision = res.Evaluate(gwt.AccessRequest{ResourceType: gwt.DataManagement, Permission: gwt.Delete})
+	if decision.Allowed || !strings.Contains(decision.Reason, "missing delete") {
+		t.Errorf("unexpected decision: %s", decision)
+	}
+}
+
+func TestEvaluateByResourceID(t *testing.T) {
+	res, target := newAuthzResources(gwt.Role{Type: gwt.Dev, Permissions: gwt.Write})
+	other := gwt.NewResource(gwt.DataManagement, gwt.DefaultRoles[gwt.Guest])
+	res.Resources = append(res.Resources, &other)
+
+	if d := res.Evaluate(gwt.AccessRequest{ResourceID: target.ResID, Permission: gwt.Write}); !d.Allowed {
+		t.Errorf("write denied on the granted resource: %s", d)
+	}
+	if d := res.Evaluate(gwt.AccessRequest{ResourceID: other.ResID, Permission: gwt.Write}); d.Allowed {
+		t.Errorf("write granted on a read-only resource: %s", d)
+	}
+	if d := res.Evaluate(gwt.AccessRequest{ResourceID: []byte("missing"), Permission: gwt.Read}); d.Allowed {
+		t.Errorf("access granted on an unassigned resource: %s", d)
+	}
+}
+
+func TestAuthorizeInstanceFallback(t *testing.T) {
+	res, target := newAuthzResources(gwt.Role{Type: gwt.User, Permissions: gwt.Edit})
+
+	if d := res.AuthorizeInstance(gwt.DataManagement, target.ResID, gwt.Edit); !d.Allowed {
+		t.Errorf("edit denied on the granted resource: %s", d)
+	}
+	if d := res.AuthorizeInstance(gwt.DataManagement, []byte("other"), gwt.Edit); d.Allowed {
+		t.Errorf("edit granted on another resource: %s", d)
+	}
+
+	typeLevel := gwt.Resource{ResID: gwt.AnyResourceID, Type: gwt.DataManagement, Roles: []gwt.Role{{Type: gwt.User, Permissions: gwt.Read}}}
+	res.Resources = append(res.Resources, &typeLevel)
+
+	d := res.AuthorizeInstance(gwt.DataManagement, []byte("other"), gwt.Read)
+	if !d.Allowed || !strings.Contains(d.Reason, "type-level") {
+		t.Errorf("type-level grant was not used: %s", d)
+	}
+	if d = res.AuthorizeInstance(gwt.DataManagement, []byte("other"), gwt.Edit); d.Allowed {
+		t.Errorf("type-level grant widened permissions: %s", d)
+	}
+
+	// A type-level grant holds on its own type only, a request must name one.
+	if d = res.AuthorizeInstance("", []byte("other"), gwt.Read); d.Allowed {
+		t.Errorf("type-level grant used without a resource type: %s", d)
+	}
+	if d = res.Evaluate(gwt.AccessRequest{ResourceID: gwt.AnyResourceID, Permission: gwt.Read}); d.Allowed {
+		t.Errorf("type-level grant evaluated without a resource type: %s", d)
+	}
+}
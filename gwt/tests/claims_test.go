@@ -0,0 +1,113 @@
+package tests
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"testing"
+	"time"
+)
+
+type fakeClock struct{ now time.Time }
+
+func (c *fakeClock) Now() time.Time          { return c.now }
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+func TestTemporalClaims(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	claimsMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithClock(clock.Now), gwt.WithLeeway(time.Second*5))
+
+	tok := newTestToken()
+	tok.Header.NotBefore = clock.now.Add(time.Minute)
+	tok.Header.Expires = clock.now.Add(time.Minute * 2)
+
+	encoded, err := claimsMC.Encode(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := claimsMC.Decode(encoded.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.Header.IssuedAt.Equal(clock.now) {
+		t.Errorf("issued-at was not stamped from the injected clock: %v", decoded.Header.IssuedAt)
+	}
+
+	if err = gwt.ValidateGWT(decoded); err == nil || err.Error() != gwt.ErrorTokenNotYetValid {
+		t.Errorf("expected %q, got %v", gwt.ErrorTokenNotYetValid, err)
+	}
+
+	// Inside the skew tolerance of not-before.
+	clock.Advance(time.Minute - time.Second*3)
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Errorf("token rejected within leeway: %v", err)
+	}
+
+	// Past expiry but inside the skew tolerance.
+	clock.Advance(time.Minute + time.Second*6)
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Errorf("token rejected within leeway: %v", err)
+	}
+
+	clock.Advance(time.Second * 5)
+	if err = gwt.ValidateGWT(decoded); err == nil || err.Error() != gwt.ErrorTokenExpired {
+		t.Errorf("expected %q, got %v", gwt.ErrorTokenExpired, err)
+	}
+}
+
+func TestIssuedInFuture(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)}
+	claimsMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithClock(clock.Now), gwt.WithLeeway(time.Second))
+
+	tok := newTestToken()
+	tok.Header.IssuedAt = clock.now.Add(time.Hour)
+	tok.Header.Expires = clock.now.Add(time.Hour * 2)
+
+	encoded, _ := claimsMC.Encode(tok)
+	decoded, err := claimsMC.Decode(encoded.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = gwt.ValidateGWT(decoded); err == nil || err.Error() != gwt.ErrorTokenFromFuture {
+		t.Errorf("expected %q, got %v", gwt.ErrorTokenFromFuture, err)
+	}
+}
+
+func TestAudience(t *testing.T) {
+	dashboard, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithAudience([]byte("dashboard")))
+	admin, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithAudience([]byte("authentity-admin")))
+
+	dashTok, err := dashboard.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	adminTok, err := admin.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		coder   *gwt.MultiCoder[*gwt.Resources]
+		token   string
+		allowed bool
+	}{
+		{"dashboard on dashboard", dashboard, dashTok.Token, true},
+		{"dashboard on admin", admin, dashTok.Token, false},
+		{"admin on dashboard", dashboard, adminTok.Token, false},
+		{"admin on admin", admin, adminTok.Token, true},
+	} {
+		decoded, err := c.coder.Decode(c.token)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+
+		err = gwt.ValidateGWT(decoded)
+		if c.allowed && err != nil {
+			t.Errorf("%s: %v", c.name, err)
+		}
+		if !c.allowed && (err == nil || err.Error() != gwt.ErrorTokenAudience) {
+			t.Errorf("%s: expected %q, got %v", c.name, gwt.ErrorTokenAudience, err)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package tests
+
+import (
+	"encoding/json"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// gwtCLI builds the gwt command into a temporary directory and returns a function running it.
+func gwtCLI(t *testing.T) func(args ...string) (string, error) {
+	t.Helper()
+
+	goBin, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip("go toolchain not found")
+	}
+
+	bin := filepath.Join(t.TempDir(), "gwt")
+	if out, err := exec.Command(goBin, "build", "-o", bin, "github.com/vaiktorg/grimoire/gwt/cmd").CombinedOutput(); err != nil {
+		t.Fatalf("building gwt: %v\n%s", err, out)
+	}
+
+	return func(args ...string) (string, error) {
+		out, err := exec.Command(bin, args...).Output()
+		return strings.TrimSpace(string(out)), err
+	}
+}
+
+func TestCmdRoundTrip(t *testing.T) {
+	run := gwtCLI(t)
+	keys := filepath.Join(t.TempDir(), "keys.json")
+
+	if _, err := run("keygen", "-out", keys); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := run("mint", "-keys", keys, "-issuer", "Authentity", "-recipient", "Vaiktorg", "-audience", "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cmd := range [][]string{
+		{"verify", "-keys", keys, token},
+		{"decode", token},
+	} {
+		out, err := run(cmd...)
+		if err != nil {
+			t.Fatalf("%s: %v", cmd[0], err)
+		}
+
+		var view struct {
+			Header struct {
+				Issuer    string `json:"issuer"`
+				Recipient string `json:"recipient"`
+				Audience  string `json:"audience"`
+			} `json:"header"`
+			Note string `json:"note"`
+		}
+		if err = json.Unmarshal([]byte(out), &view); err != nil {
+			t.Fatalf("%s: %v", cmd[0], err)
+		}
+		if view.Header.Issuer != "Authentity" || view.Header.Recipient != "Vaiktorg" || view.Header.Audience != "api" {
+			t.Errorf("%s: unexpected header %+v", cmd[0], view.Header)
+		}
+		if cmd[0] == "verify" && view.Note != "verified" {
+			t.Errorf("verify: unexpected note %q", view.Note)
+		}
+	}
+}
+
+func TestCmdVerifyRejects(t *testing.T) {
+	run := gwtCLI(t)
+	dir := t.TempDir()
+	keys, other := filepath.Join(dir, "keys.json"), filepath.Join(dir, "other.json")
+
+	for _, path := range []string{keys, other} {
+		// Both keys share an ID so the wrong one is only told apart by the signature.
+		if _, err := run("keygen", "-id", "k1", "-out", path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	valid, err := run("mint", "-keys", keys, "-issuer", "Authentity", "-recipient", "Vaiktorg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := run("mint", "-keys", keys, "-issuer", "Authentity", "-recipient", "Vaiktorg", "-ttl", "-1h")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = run("verify", "-keys", keys, valid); err != nil {
+		t.Fatalf("valid token rejected: %v", err)
+	}
+	if _, err = run("verify", "-keys", keys, expired); err == nil {
+		t.Error("expired token verified")
+	}
+	if _, err = run("verify", "-keys", other, valid); err == nil {
+		t.Error("token verified with the wrong key")
+	}
+}
@@ -0,0 +1,180 @@
+package tests
+
+import (
+	"fmt"
+	"github.com/vaiktorg/grimoire/gwt"
+	"strings"
+	"testing"
+)
+
+// newHeavyToken holds n resources with a couple of claimed roles each, roughly what a busy user carries.
+func newHeavyToken(n int) *gwt.GWT[*gwt.Resources] {
+	tok := newTestToken()
+	for i := 0; i < n; i++ {
+		r := gwt.NewResource(gwt.DataManagement,
+			gwt.Role{Type: gwt.Admin, Permissions: gwt.Read | gwt.Write, Claims: map[gwt.RoleType]gwt.Claim{
+				"department": "department.engineering",
+			}},
+			gwt.DefaultRoles[gwt.User],
+		)
+		tok.Body.Resources = append(tok.Body.Resources, &r)
+	}
+
+	return tok
+}
+
+func TestCompactRoundTrip(t *testing.T) {
+	compactMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithCompactEncoding(true))
+	gobMC, _ := gwt.NewMultiCoder[*gwt.Resources]()
+
+	tok := newHeavyToken(10)
+	compact, err := compactMC.Encode(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	legacy, err := gobMC.Encode(newHeavyToken(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(compact.Token) >= len(legacy.Token) {
+		t.Errorf("compact token is not smaller: %d >= %d bytes", len(compact.Token), len(legacy.Token))
+	}
+
+	// Decoding picks the layout up by itself, whatever the decoder mints.
+	for name, mc := range map[string]*gwt.MultiCoder[*gwt.Resources]{"compact": compactMC, "gob": gobMC} {
+		decoded, err := mc.Decode(compact.Token)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if err = gwt.ValidateGWT(decoded); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+
+		if decoded.Header.ID != tok.Header.ID || decoded.Header.Expires.Unix() != tok.Header.Expires.Unix() {
+			t.Errorf("%s: header did not round trip: %+v", name, decoded.Header)
+		}
+		if len(decoded.Body.Resources) != 10 || decoded.Body.Resources[3].Roles[0].Claims["department"] != "department.engineering" {
+			t.Errorf("%s: body did not round trip", name)
+		}
+	}
+
+	if _, err = compactMC.Decode(legacy.Token); err != nil {
+		t.Errorf("compact coder cannot read gob tokens: %v", err)
+	}
+
+	peeked, err := gwt.Peek[*gwt.Resources](compact.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if peeked.Header.ID != tok.Header.ID || len(peeked.Body.Resources) != 10 {
+		t.Error("peek cannot read compact tokens")
+	}
+}
+
+func TestCompactOtherBodies(t *testing.T) {
+	compactMC, _ := gwt.NewMultiCoder[string](gwt.WithCompactEncoding(false))
+
+	tok := &gwt.GWT[string]{Header: newTestToken().Header, Body: "hello"}
+	encoded, err := compactMC.Encode(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := compactMC.Decode(encoded.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Body != "hello" {
+		t.Errorf("unexpected body %q", decoded.Body)
+	}
+
+	// A Resources body does not decode into another token type.
+	resMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithCompactEncoding(false))
+	resTok, _ := resMC.Encode(newHeavyToken(1))
+	if _, err = compactMC.Decode(resTok.Token); err == nil || err.Error() != gwt.ErrorCompactBody {
+		t.Errorf("expected %q, got %v", gwt.ErrorCompactBody, err)
+	}
+}
+
+func TestCompactRejectsTampering(t *testing.T) {
+	compactMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithCompactEncoding(true))
+
+	encoded, _ := compactMC.Encode(newHeavyToken(3))
+	parts := strings.Split(encoded.Token, ".")
+
+	other, _ := compactMC.Encode(newHeavyToken(3))
+	forged := parts[0] + "." + strings.Split(other.Token, ".")[1]
+	if _, err := compactMC.Decode(forged); err == nil {
+		t.Error("token decoded with another token's signature")
+	}
+}
+
+// Benchmarks report token size alongside cost, e.g. go test -bench Token -run ^$ ./gwt/tests
+func BenchmarkTokenEncode(b *testing.B) {
+	for _, bc := range tokenBenchCases() {
+		b.Run(bc.name, func(b *testing.B) {
+			tok := newHeavyToken(bc.resources)
+
+			var size int
+			for i := 0; i < b.N; i++ {
+				tok.Header.ID = ""
+				encoded, err := bc.mc.Encode(tok)
+				if err != nil {
+					b.Fatal(err)
+				}
+				size = len(encoded.Token)
+			}
+
+			b.ReportMetric(float64(size), "token-bytes")
+		})
+	}
+}
+
+func BenchmarkTokenDecode(b *testing.B) {
+	for _, bc := range tokenBenchCases() {
+		b.Run(bc.name, func(b *testing.B) {
+			encoded, err := bc.mc.Encode(newHeavyToken(bc.resources))
+			if err != nil {
+				b.Fatal(err)
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err = bc.mc.Decode(encoded.Token); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			b.ReportMetric(float64(len(encoded.Token)), "token-bytes")
+		})
+	}
+}
+
+type tokenBenchCase struct {
+	name      string
+	resources int
+	mc        *gwt.MultiCoder[*gwt.Resources]
+}
+
+func tokenBenchCases() []tokenBenchCase {
+	gobMC, _ := gwt.NewMultiCoder[*gwt.Resources]()
+	compactMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithCompactEncoding(false))
+	deflateMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithCompactEncoding(true))
+
+	var cases []tokenBenchCase
+	for _, n := range []int{1, 10, 30} {
+		for _, c := range []struct {
+			name string
+			mc   *gwt.MultiCoder[*gwt.Resources]
+		}{{"gob", gobMC}, {"compact", compactMC}, {"compact+deflate", deflateMC}} {
+			cases = append(cases, tokenBenchCase{
+				name:      fmt.Sprintf("%s/%dres", c.name, n),
+				resources: n,
+				mc:        c.mc,
+			})
+		}
+	}
+
+	return cases
+}
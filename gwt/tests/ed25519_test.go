@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"testing"
+)
+
+func TestEd25519SignAndVerify(t *testing.T) {
+	key, err := gwt.NewEd25519Key("ed1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuerKeys := gwt.NewKeyRing(key)
+	issuer, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(issuerKeys))
+	verifier, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(issuerKeys.Public()))
+
+	tok, err := issuer.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := verifier.Decode(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if decoded.Header.Algorithm != gwt.EdDSA {
+		t.Errorf("expected algorithm %s, got %s", gwt.EdDSA, decoded.Header.Algorithm)
+	}
+
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Error(err)
+	}
+
+	// A service holding only the public key must not be able to mint tokens.
+	if _, err = verifier.Encode(newTestToken()); err == nil {
+		t.Error("verify-only keyring signed a token")
+	}
+}
+
+func TestEd25519RejectsTampering(t *testing.T) {
+	key, _ := gwt.NewEd25519Key("ed1")
+	issuer, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(key)))
+
+	tok, err := issuer.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := gwt.NewEd25519Key("ed1")
+	verifier, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(other).Public()))
+	if _, err = verifier.Decode(tok.Token); err == nil {
+		t.Error("token verified with an unrelated public key")
+	}
+}
+
+func TestAlgorithmMismatch(t *testing.T) {
+	// An HS512 key published under the same ID must not verify an EdDSA token.
+	key, _ := gwt.NewEd25519Key("shared")
+	issuer, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(key)))
+	tok, err := issuer.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	hmacKeys := gwt.NewKeyRing(&gwt.Key{ID: "shared", Secret: key.PublicKey})
+	verifier, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(hmacKeys))
+	if _, err = verifier.Decode(tok.Token); err == nil {
+		t.Error("EdDSA token accepted by an HS512 key")
+	}
+}
@@ -0,0 +1,99 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/base64"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"strings"
+	"testing"
+)
+
+func TestEncryptedGWT(t *testing.T) {
+	encKey := uid.NewUID(32).Bytes()
+	encMC, err := gwt.NewMultiCoder[*gwt.Resources](gwt.WithEncryptionKey(encKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orig := newTestToken()
+	res := gwt.NewResource(gwt.SystemAdmin, gwt.DefaultRoles[gwt.Owner])
+	orig.Body.Resources = append(orig.Body.Resources, &res)
+
+	tok, err := encMC.Encode(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The body must not be readable from the cookie.
+	payload, _ := base64.URLEncoding.DecodeString(strings.Split(tok.Token, ".")[0])
+	if bytes.Contains(payload, res.ResID) || bytes.Contains(payload, orig.Body.UserID) {
+		t.Error("resources leak in plain text")
+	}
+
+	// The header stays readable for routing.
+	header, err := gwt.PeekHeader(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(header.Recipient, orig.Header.Recipient) || header.ID != orig.Header.ID {
+		t.Error("peeked header does not match")
+	}
+
+	decoded, err := encMC.Decode(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(serialize(t, decoded.Body), serialize(t, orig.Body)) {
+		t.Error("decrypted body does not match")
+	}
+}
+
+func TestEncryptedGWTWrongKey(t *testing.T) {
+	encMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithEncryptionKey(uid.NewUID(32).Bytes()))
+	otherMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithEncryptionKey(uid.NewUID(32).Bytes()))
+	plainMC, _ := gwt.NewMultiCoder[*gwt.Resources]()
+
+	tok, err := encMC.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = otherMC.Decode(tok.Token); err == nil || err.Error() != gwt.ErrorTokenDecrypt {
+		t.Errorf("expected %q, got %v", gwt.ErrorTokenDecrypt, err)
+	}
+	if _, err = plainMC.Decode(tok.Token); err == nil || err.Error() != gwt.ErrorNoEncryptionKey {
+		t.Errorf("expected %q, got %v", gwt.ErrorNoEncryptionKey, err)
+	}
+
+	// Flipping a ciphertext byte must fail the signature before decryption is attempted.
+	parts := strings.Split(tok.Token, ".")
+	payload, _ := base64.URLEncoding.DecodeString(parts[0])
+	payload[len(payload)-1] ^= 0xFF
+	tampered := base64.URLEncoding.EncodeToString(payload) + "." + parts[1]
+	if _, err = encMC.Decode(tampered); err == nil || err.Error() != gwt.ErrorInvalidToken {
+		t.Errorf("expected %q, got %v", gwt.ErrorInvalidToken, err)
+	}
+
+	if _, err = gwt.NewMultiCoder[*gwt.Resources](gwt.WithEncryptionKey([]byte("short"))); err == nil {
+		t.Error("invalid AES key accepted")
+	}
+}
+
+func TestPeekHeaderLegacy(t *testing.T) {
+	tok, err := mc.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	header, err := gwt.PeekHeader(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(header.Issuer) != "Authentity" {
+		t.Errorf("unexpected issuer %q", header.Issuer)
+	}
+}
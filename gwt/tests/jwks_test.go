@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/gwt"
+	"strings"
+	"testing"
+)
+
+func TestJWKS(t *testing.T) {
+	old, _ := gwt.NewEd25519Key("ed-old")
+	current, _ := gwt.NewEd25519Key("ed-current")
+	retired, _ := gwt.NewEd25519Key("ed-retired")
+
+	keys := gwt.NewKeyRing(&gwt.Key{ID: "hmac", Secret: []byte("shared secret")}, old, retired)
+	if err := keys.RotateKey(current); err != nil {
+		t.Fatal(err)
+	}
+	if err := keys.Retire("ed-retired"); err != nil {
+		t.Fatal(err)
+	}
+
+	set := keys.JWKS()
+	var kids []string
+	for _, jwk := range set.Keys {
+		kids = append(kids, jwk.Kid)
+	}
+	if strings.Join(kids, ",") != "ed-old,ed-current" {
+		t.Fatalf("unexpected keys in the set: %v", kids)
+	}
+
+	// Verifiers rebuild the ring from the published JSON alone.
+	buff, err := json.Marshal(set)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var published gwt.JWKS
+	if err = json.Unmarshal(buff, &published); err != nil {
+		t.Fatal(err)
+	}
+	if published.Keys[1].Kty != "OKP" || published.Keys[1].Crv != "Ed25519" || published.Keys[1].Use != "sig" {
+		t.Errorf("unexpected jwk %+v", published.Keys[1])
+	}
+
+	ring, err := published.KeyRing()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	issuer, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(keys))
+	verifier, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(ring))
+
+	jwt, err := issuer.EncodeJWT(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifier.DecodeJWT(jwt.Token); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = verifier.Encode(newTestToken()); err == nil {
+		t.Error("a ring built from a JWKS can sign")
+	}
+
+	// Native tokens check with nothing but the published x member.
+	native, err := issuer.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(native.Token, ".")
+	payload, _ := base64.URLEncoding.DecodeString(parts[0])
+	sig, _ := base64.URLEncoding.DecodeString(parts[1])
+	pub, _ := base64.RawURLEncoding.DecodeString(published.Keys[1].X)
+	if !ed25519.Verify(pub, payload, sig) {
+		t.Error("native token does not verify with the published key")
+	}
+}
+
+func TestJWKRejectsOtherKeys(t *testing.T) {
+	if _, err := (&gwt.Key{ID: "hmac", Secret: []byte("shared secret")}).JWK(); err == nil || err.Error() != gwt.ErrorKeyNotPublic {
+		t.Errorf("expected %q, got %v", gwt.ErrorKeyNotPublic, err)
+	}
+
+	for _, jwk := range []gwt.JWK{
+		{Kty: "EC", Crv: "P-256", X: "AAAA", Kid: "ec"},
+		{Kty: "OKP", Crv: "Ed25519", X: "AAAA", Kid: "short"},
+		{Kty: "OKP", Crv: "Ed25519", X: strings.Repeat("A", 43), Kid: "wrong-alg", Alg: gwt.HS512},
+	} {
+		if _, err := jwk.Key(); err == nil {
+			t.Errorf("%s: accepted", jwk.Kid)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/vaiktorg/grimoire/gwt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJWTRoundTripHS512(t *testing.T) {
+	secret := []byte("a shared jwt secret")
+	jwtMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(&gwt.Key{ID: "hs", Secret: secret})))
+
+	orig := newTestToken()
+	orig.Body.AddResource(gwt.NewResource(gwt.Network, gwt.DefaultRoles[gwt.Dev]))
+
+	tok, err := jwtMC.EncodeJWT(orig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Any off-the-shelf HS512 implementation must agree on the signature.
+	parts := strings.Split(tok.Token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected 3 jwt segments, got %d", len(parts))
+	}
+	m := hmac.New(sha512.New, secret)
+	m.Write([]byte(parts[0] + "." + parts[1]))
+	if base64.RawURLEncoding.EncodeToString(m.Sum(nil)) != parts[2] {
+		t.Error("HS512 signature does not match RFC 7518")
+	}
+
+	var claims map[string]any
+	payload, _ := base64.RawURLEncoding.DecodeString(parts[1])
+	if err = json.Unmarshal(payload, &claims); err != nil {
+		t.Fatal(err)
+	}
+	if claims["iss"] != "Authentity" || claims["sub"] != "Vaiktorg" {
+		t.Errorf("unexpected registered claims: %v", claims)
+	}
+	if int64(claims["exp"].(float64)) != orig.Header.Expires.Unix() {
+		t.Errorf("exp claim mismatch")
+	}
+
+	decoded, err := jwtMC.DecodeJWT(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Error(err)
+	}
+	if !bytes.Equal(decoded.Header.Recipient, orig.Header.Recipient) {
+		t.Error("recipient mismatch")
+	}
+	if !bytes.Equal(serialize(t, decoded.Body), serialize(t, orig.Body)) {
+		t.Error("body mismatch")
+	}
+}
+
+func TestJWTRoundTripEdDSA(t *testing.T) {
+	key, _ := gwt.NewEd25519Key("ed")
+	issuer, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(key)))
+	verifier, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(issuer.KeyRing().Public()))
+
+	tok, err := issuer.EncodeJWT(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(tok.Token, ".")
+	sig, _ := base64.RawURLEncoding.DecodeString(parts[2])
+	if !ed25519.Verify(key.PublicKey, []byte(parts[0]+"."+parts[1]), sig) {
+		t.Error("EdDSA signature does not verify with the raw public key")
+	}
+
+	decoded, err := verifier.DecodeJWT(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Header.Algorithm != gwt.EdDSA {
+		t.Errorf("expected EdDSA, got %s", decoded.Header.Algorithm)
+	}
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestJWTRejectsInvalid(t *testing.T) {
+	jwtMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(&gwt.Key{ID: "hs", Secret: []byte("secret")})))
+
+	tok, err := jwtMC.EncodeJWT(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	parts := strings.Split(tok.Token, ".")
+
+	// alg "none" must never be accepted
+	none := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","typ":"JWT","kid":"hs"}`))
+	if _, err = jwtMC.DecodeJWT(none + "." + parts[1] + "."); err == nil {
+		t.Error("alg none accepted")
+	}
+
+	// tampered claims
+	tampered := base64.RawURLEncoding.EncodeToString([]byte(`{"iss":"Authentity","sub":"root","exp":9999999999,"body":null}`))
+	if _, err = jwtMC.DecodeJWT(parts[0] + "." + tampered + "." + parts[2]); err == nil {
+		t.Error("tampered claims accepted")
+	}
+
+	// expired
+	expired := newTestToken()
+	expired.Header.Expires = time.Now().Add(-time.Minute)
+	tok, _ = jwtMC.EncodeJWT(expired)
+	decoded, err := jwtMC.DecodeJWT(tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err == nil {
+		t.Error("expired jwt validated")
+	}
+}
@@ -0,0 +1,165 @@
+package tests
+
+import (
+	"encoding/base64"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newTestToken() *gwt.GWT[*gwt.Resources] {
+	return &gwt.GWT[*gwt.Resources]{
+		Header: gwt.Header{
+			Issuer:    []byte("Authentity"),
+			Recipient: []byte("Vaiktorg"),
+			Expires:   time.Now().Add(gwt.TokenExpireTime),
+		},
+		Body: gwt.NewResources(uid.New()),
+	}
+}
+
+func TestKeyRingRotation(t *testing.T) {
+	kr := gwt.NewKeyRing(&gwt.Key{ID: "k1", Secret: []byte(uid.NewUID(64))})
+	krMC, err := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(kr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldTok, err := krMC.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = kr.Rotate(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	newTok, err := krMC.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := krMC.Decode(newTok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Header.KeyID == "k1" {
+		t.Error("token was not signed with the rotated key")
+	}
+
+	// Tokens signed with the previous key keep working until it is retired.
+	decoded, err = krMC.Decode(oldTok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Error(err)
+	}
+
+	if err = kr.Retire("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = krMC.Decode(oldTok.Token); err == nil {
+		t.Error("token signed with a retired key was accepted")
+	}
+
+	active, _ := kr.Active()
+	if err = kr.Retire(active.ID); err == nil {
+		t.Error("active key was retired")
+	}
+}
+
+func TestKeyRingRejectsForeignKey(t *testing.T) {
+	mc1, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(&gwt.Key{ID: "a", Secret: []byte("secret-a")})))
+	mc2, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithKeyRing(gwt.NewKeyRing(&gwt.Key{ID: "a", Secret: []byte("secret-b")})))
+
+	tok, err := mc1.Encode(newTestToken())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err = mc2.Decode(tok.Token); err == nil {
+		t.Error("token signed with a different secret was accepted")
+	}
+}
+
+func TestKeyRingFile(t *testing.T) {
+	kr := gwt.NewKeyRing(&gwt.Key{ID: "k1", Secret: []byte("first")})
+	if _, err := kr.Rotate([]byte("second")); err != nil {
+		t.Fatal(err)
+	}
+	if err := kr.Retire("k1"); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "keys.json")
+	if err := kr.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := gwt.LoadKeyRingFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := kr.Active()
+	got, err := loaded.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.ID != want.ID || string(got.Secret) != "second" {
+		t.Errorf("active key mismatch: %s", got.ID)
+	}
+
+	if _, err = loaded.Key("k1"); err == nil {
+		t.Error("retired key survived the round trip as usable")
+	}
+}
+
+func TestKeyRingEnv(t *testing.T) {
+	t.Setenv("GWTTEST_KEYS", "k1:"+base64.StdEncoding.EncodeToString([]byte("one"))+",k2:"+base64.StdEncoding.EncodeToString([]byte("two")))
+	t.Setenv("GWTTEST_ACTIVE_KEY", "k2")
+	t.Setenv("GWTTEST_RETIRED_KEYS", "k1")
+
+	kr, err := gwt.LoadKeyRingEnv("GWTTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	active, err := kr.Active()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if active.ID != "k2" || string(active.Secret) != "two" {
+		t.Errorf("unexpected active key %s", active.ID)
+	}
+
+	if _, err = kr.Key("k1"); err == nil {
+		t.Error("retired key is still usable")
+	}
+}
+
+func TestKeyRingEnvRetiresFirstKey(t *testing.T) {
+	t.Setenv("GWTTEST_KEYS", "k1:"+base64.StdEncoding.EncodeToString([]byte("one"))+",k2:"+base64.StdEncoding.EncodeToString([]byte("two")))
+	t.Setenv("GWTTEST_RETIRED_KEYS", "k1")
+
+	kr, err := gwt.LoadKeyRingEnv("GWTTEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if active, err := kr.Active(); err != nil || active.ID != "k2" {
+		t.Errorf("first unretired key is not active: %v", err)
+	}
+	if _, err = kr.Key("k1"); err == nil {
+		t.Error("retired key is still usable")
+	}
+
+	t.Setenv("GWTTEST_RETIRED_KEYS", "k1,k3")
+	if _, err = gwt.LoadKeyRingEnv("GWTTEST"); err == nil {
+		t.Error("unknown retired key was accepted")
+	}
+}
@@ -0,0 +1,173 @@
+package tests
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"strings"
+	"testing"
+	"time"
+)
+
+const businessHoursPolicy = `
+rules:
+  - name: business-hours
+    effect: deny
+    permissions: [write, edit, delete]
+    any:
+      - {attr: time.hour, op: lt, value: "9"}
+      - {attr: time.hour, op: gte, value: "17"}
+      - {attr: time.weekday, op: in, values: [saturday, sunday]}
+`
+
+func newEditor(department string) *gwt.Resources {
+	role := gwt.Role{Type: gwt.Mod, Permissions: gwt.Read | gwt.Edit, Claims: map[gwt.RoleType]gwt.Claim{}}
+	role.AddClaim("department", department)
+
+	res := gwt.NewResources(uid.New())
+	r := gwt.NewResource(gwt.DataManagement, role)
+	res.Resources = append(res.Resources, &r)
+
+	return res
+}
+
+func TestPolicyOwnDepartment(t *testing.T) {
+	policy, err := gwt.NewPolicy(
+		gwt.AllowRule("own-department").
+			On(gwt.DataManagement).
+			For(gwt.Edit).
+			If(gwt.Attr("claim.department").EqAttr("resource.department")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	editor := newEditor("sales")
+	rbac := editor.Evaluate(gwt.AccessRequest{ResourceType: gwt.DataManagement, Permission: gwt.Edit})
+	if !rbac.Allowed {
+		t.Fatalf("rbac denied the editor: %s", rbac)
+	}
+
+	req := gwt.PolicyRequest{ResourceType: gwt.DataManagement, Permission: gwt.Edit}
+
+	req.Resource = gwt.Attributes{"department": "sales"}
+	if d := policy.Apply(rbac, req); !d.Allowed {
+		t.Errorf("edit in own department denied: %s", d)
+	}
+
+	req.Resource = gwt.Attributes{"department": "billing"}
+	if d := policy.Apply(rbac, req); d.Allowed {
+		t.Errorf("edit in another department allowed: %s", d)
+	}
+
+	// The rule only targets edits, reads are left to RBAC.
+	req.Permission = gwt.Read
+	if d := policy.Apply(rbac, req); !d.Allowed {
+		t.Errorf("read denied by an edit-only rule: %s", d)
+	}
+}
+
+func TestPolicyClaimsOfTargetedGrants(t *testing.T) {
+	// A user of billing who is also a moderator of sales, on the same resource.
+	mod := gwt.Role{Type: gwt.Mod, Permissions: gwt.Read | gwt.Edit, Claims: map[gwt.RoleType]gwt.Claim{}}
+	mod.AddClaim("department", "sales")
+	user := gwt.Role{Type: gwt.User, Permissions: gwt.Read, Claims: map[gwt.RoleType]gwt.Claim{}}
+	user.AddClaim("department", "billing")
+
+	res := gwt.NewResources(uid.New())
+	r := gwt.NewResource(gwt.DataManagement, user, mod)
+	res.Resources = append(res.Resources, &r)
+
+	rbac := res.Evaluate(gwt.AccessRequest{ResourceType: gwt.DataManagement, Permission: gwt.Edit})
+	if !rbac.Allowed || len(rbac.Grants) != 2 {
+		t.Fatalf("expected both roles granted: %s", rbac)
+	}
+
+	ownDepartment := gwt.Attr("claim.department").EqAttr("resource.department")
+	tests := []struct {
+		name       string
+		rule       gwt.Rule
+		department string
+		allow      bool
+	}{
+		{"ModeratorOwnDepartment", gwt.AllowRule("mods").ForRoles(gwt.Mod).If(ownDepartment), "sales", true},
+		{"UserClaimIgnored", gwt.AllowRule("mods").ForRoles(gwt.Mod).If(ownDepartment), "billing", false},
+		{"AnyGrant", gwt.AllowRule("any").If(ownDepartment), "billing", true},
+		{"AllGrants", gwt.AllowRule("all").MatchClaims(gwt.AllGrants).If(ownDepartment), "sales", false},
+		{"RuleForOtherRoles", gwt.AllowRule("owners").ForRoles(gwt.Owner).If(ownDepartment), "sales", true},
+	}
+
+	for _, tt := range tests {
+		policy, err := gwt.NewPolicy(tt.rule)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		d := policy.Apply(rbac, gwt.PolicyRequest{
+			ResourceType: gwt.DataManagement,
+			Permission:   gwt.Edit,
+			Resource:     gwt.Attributes{"department": tt.department},
+		})
+		if d.Allowed != tt.allow {
+			t.Errorf("%s: %s", tt.name, d)
+		}
+	}
+}
+
+func TestPolicyBusinessHoursYAML(t *testing.T) {
+	policy, err := gwt.ParsePolicy([]byte(businessHoursPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rbac := newEditor("sales").Evaluate(gwt.AccessRequest{ResourceType: gwt.DataManagement, Permission: gwt.Edit})
+	tuesday := time.Date(2024, time.January, 2, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		at    time.Time
+		perm  gwt.Permission
+		allow bool
+	}{
+		{tuesday.Add(10 * time.Hour), gwt.Edit, true},
+		{tuesday.Add(20 * time.Hour), gwt.Edit, false},
+		{tuesday.Add(8 * time.Hour), gwt.Edit, false},
+		{tuesday.Add(20 * time.Hour), gwt.Read, true},
+		{tuesday.Add(4*24*time.Hour + 10*time.Hour), gwt.Edit, false}, // Saturday
+	}
+
+	for _, tt := range tests {
+		d := policy.Apply(rbac, gwt.PolicyRequest{ResourceType: gwt.DataManagement, Permission: tt.perm, Time: tt.at})
+		if d.Allowed != tt.allow {
+			t.Errorf("%s %s: %s", tt.at.Format(time.RFC1123), tt.perm, d)
+		}
+		if !tt.allow && !strings.Contains(d.Reason, "business-hours") {
+			t.Errorf("denial does not name the rule: %s", d.Reason)
+		}
+	}
+}
+
+func TestPolicyKeepsRBACDenial(t *testing.T) {
+	policy, _ := gwt.NewPolicy(gwt.AllowRule("anyone").If(gwt.Attr("request.method").Eq("GET")))
+
+	guest := newEditor("sales").Evaluate(gwt.AccessRequest{ResourceType: gwt.Network, Permission: gwt.Read})
+	d := policy.Apply(guest, gwt.PolicyRequest{ResourceType: gwt.Network, Permission: gwt.Read, Request: gwt.Attributes{"method": "GET"}})
+	if d.Allowed {
+		t.Error("policy overrode an RBAC denial")
+	}
+}
+
+func TestPolicyValidation(t *testing.T) {
+	invalid := []string{
+		"rules: [{name: a, effect: maybe}]",
+		"rules: [{name: a, effect: deny, when: [{attr: time.hour, op: between, value: '1'}]}]",
+		"rules: [{name: a, effect: deny, when: [{attr: secret.key, op: eq, value: x}]}]",
+		"rules: [{name: a, effect: deny, when: [{attr: request.path, op: in}]}]",
+		"rules: [{name: a, effect: deny, permissions: [fly]}]",
+		"rules: [{name: a, effect: deny, claims: most}]",
+	}
+
+	for _, doc := range invalid {
+		if _, err := gwt.ParsePolicy([]byte(doc)); err == nil {
+			t.Errorf("invalid policy accepted: %s", doc)
+		}
+	}
+}
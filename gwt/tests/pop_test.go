@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"encoding/base64"
+	"github.com/vaiktorg/grimoire/gwt"
+	"testing"
+	"time"
+)
+
+const proofURL = "https://authentity.example/account"
+
+func newBoundToken(t *testing.T, mc *gwt.MultiCoder[*gwt.Resources], holder *gwt.Key) *gwt.GWT[*gwt.Resources] {
+	tok := newTestToken()
+	tok.Header.Confirmation = holder.Thumbprint()
+
+	encoded, err := mc.Encode(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := mc.Decode(encoded.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return decoded
+}
+
+func TestThumbprint(t *testing.T) {
+	// RFC 8037 appendix A.3
+	pub, _ := base64.RawURLEncoding.DecodeString("11qYAYKxCrfVS_7TyWQHOg7hcvPapiMlrwIaaPcHURo")
+	key := &gwt.Key{ID: "rfc8037", Algorithm: gwt.EdDSA, PublicKey: pub}
+
+	if got := key.Thumbprint(); got != "kPrK_qmxVWaYVA9wwBF6Iuo3vVzz7TxHCTwXBygrS4k" {
+		t.Errorf("unexpected thumbprint %s", got)
+	}
+}
+
+func TestProofOfPossession(t *testing.T) {
+	nonces := gwt.NewMemoryNonceCache(time.Hour)
+	defer nonces.Close()
+
+	popMC, _ := gwt.NewMultiCoder[*gwt.Resources](gwt.WithNonceCache(nonces))
+	holder, _ := gwt.NewEd25519Key("holder")
+	thief, _ := gwt.NewEd25519Key("thief")
+
+	tok := newBoundToken(t, popMC, holder)
+	if err := gwt.ValidateGWT(tok); err != nil {
+		t.Fatal(err)
+	}
+
+	proof, err := gwt.NewProof(holder, "GET", proofURL+"?page=2", tok.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateProof(tok, proof, "GET", proofURL); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = gwt.ValidateProof(tok, proof, "GET", proofURL); err == nil || err.Error() != gwt.ErrorProofReplayed {
+		t.Errorf("expected %q, got %v", gwt.ErrorProofReplayed, err)
+	}
+
+	if err = gwt.ValidateProof(tok, "", "GET", proofURL); err == nil || err.Error() != gwt.ErrorProofMissing {
+		t.Errorf("expected %q, got %v", gwt.ErrorProofMissing, err)
+	}
+
+	stolen, _ := gwt.NewProof(thief, "GET", proofURL, tok.Token)
+	if err = gwt.ValidateProof(tok, stolen, "GET", proofURL); err == nil || err.Error() != gwt.ErrorProofKey {
+		t.Errorf("expected %q, got %v", gwt.ErrorProofKey, err)
+	}
+
+	wrongMethod, _ := gwt.NewProof(holder, "GET", proofURL, tok.Token)
+	if err = gwt.ValidateProof(tok, wrongMethod, "DELETE", proofURL); err == nil || err.Error() != gwt.ErrorProofRequest {
+		t.Errorf("expected %q, got %v", gwt.ErrorProofRequest, err)
+	}
+
+	otherToken, _ := gwt.NewProof(holder, "GET", proofURL, "another.token")
+	if err = gwt.ValidateProof(tok, otherToken, "GET", proofURL); err == nil || err.Error() != gwt.ErrorProofToken {
+		t.Errorf("expected %q, got %v", gwt.ErrorProofToken, err)
+	}
+
+	// Tokens that are not bound need no proof.
+	unbound, _ := popMC.Decode(mustEncode(t, popMC, newTestToken()))
+	if err = gwt.ValidateProof(unbound, "", "GET", proofURL); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProofStale(t *testing.T) {
+	nonces := gwt.NewMemoryNonceCache(time.Hour)
+	defer nonces.Close()
+
+	clock := &fakeClock{now: time.Now()}
+	popMC, _ := gwt.NewMultiCoder[*gwt.Resources](
+		gwt.WithNonceCache(nonces),
+		gwt.WithClock(clock.Now),
+		gwt.WithLeeway(time.Second),
+		gwt.WithProofMaxAge(time.Minute),
+	)
+	holder, _ := gwt.NewEd25519Key("holder")
+	tok := newBoundToken(t, popMC, holder)
+
+	proof, _ := gwt.NewProof(holder, "GET", proofURL, tok.Token)
+	clock.Advance(time.Minute * 2)
+
+	if err := gwt.ValidateProof(tok, proof, "GET", proofURL); err == nil || err.Error() != gwt.ErrorProofStale {
+		t.Errorf("expected %q, got %v", gwt.ErrorProofStale, err)
+	}
+}
+
+func TestCheckProofForBinding(t *testing.T) {
+	popMC, _ := gwt.NewMultiCoder[*gwt.Resources]()
+	holder, _ := gwt.NewEd25519Key("holder")
+
+	proof, _ := gwt.NewProof(holder, "POST", proofURL, "")
+	if _, err := popMC.CheckProof(proof, "POST", proofURL, ""); err == nil || err.Error() != gwt.ErrorNoNonceCache {
+		t.Errorf("expected %q, got %v", gwt.ErrorNoNonceCache, err)
+	}
+
+	nonces := gwt.NewMemoryNonceCache(time.Hour)
+	defer nonces.Close()
+	popMC, _ = gwt.NewMultiCoder[*gwt.Resources](gwt.WithNonceCache(nonces))
+
+	p, err := popMC.CheckProof(proof, "POST", proofURL, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Thumbprint != holder.Thumbprint() {
+		t.Error("proof thumbprint does not match the holder key")
+	}
+
+	// The binding survives the JWT form.
+	tok := newTestToken()
+	tok.Header.Confirmation = p.Thumbprint
+	jwt, err := popMC.EncodeJWT(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	decoded, err := popMC.DecodeJWT(jwt.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Header.Confirmation != p.Thumbprint {
+		t.Error("jwt lost the key binding")
+	}
+}
+
+func mustEncode(t *testing.T, mc *gwt.MultiCoder[*gwt.Resources], tok *gwt.GWT[*gwt.Resources]) string {
+	encoded, err := mc.Encode(tok)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return encoded.Token
+}
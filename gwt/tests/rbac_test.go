@@ -17,7 +17,7 @@ func TestSerializationDeserialization(t *testing.T) {
 	original.AddResource(res2)
 
 	// Serialize
-	serialized := original.Serialize()
+	serialized := serialize(t, original)
 
 	// Deserialize
 	resources := &gwt.Resources{}
@@ -28,7 +28,7 @@ func TestSerializationDeserialization(t *testing.T) {
 	}
 
 	// Compare original and deserialized
-	if !reflect.DeepEqual(original.Serialize(), resources.Serialize()) {
+	if !reflect.DeepEqual(serialize(t, original), serialize(t, resources)) {
 		t.Errorf("Original: %+v\nDeserialized: %+v\n", original, resources)
 		return
 	}
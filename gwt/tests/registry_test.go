@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRegistryBuiltins(t *testing.T) {
+	reg := gwt.NewRegistry()
+
+	types := reg.ResourceTypes()
+	if len(types) != 7 || types[0] != gwt.Network || types[6] != gwt.ThirdParty {
+		t.Errorf("unexpected built-in resource types: %v", types)
+	}
+
+	roles := reg.RoleTypes()
+	if len(roles) != 6 || roles[0] != gwt.Owner || roles[5] != gwt.User {
+		t.Errorf("unexpected built-in role types: %v", roles)
+	}
+
+	if !gwt.Owner.Hierarchy(gwt.Guest) || gwt.RoleType(gwt.Guest).Hierarchy(gwt.Owner) {
+		t.Error("role hierarchy does not follow registration order")
+	}
+}
+
+func TestRegistryResourceTypesRoundTrip(t *testing.T) {
+	billing := gwt.ResourceType("billing")
+	if _, err := gwt.RegisterResourceType(billing); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := gwt.RegisterRoleType("auditor"); err != nil {
+		t.Fatal(err)
+	}
+
+	original := gwt.NewResources(uid.New())
+	for _, r := range []gwt.Resource{
+		gwt.NewResource(gwt.Network, gwt.DefaultRoles[gwt.Dev]),
+		gwt.NewResource(gwt.DataManagement, gwt.DefaultRoles[gwt.Guest]),
+		gwt.NewResource(billing, gwt.Role{Type: "auditor", Permissions: gwt.Read}),
+	} {
+		r := r
+		original.Resources = append(original.Resources, &r)
+	}
+
+	decoded := &gwt.Resources{}
+	if err := decoded.Deserialize(serialize(t, original)); err != nil {
+		t.Fatal(err)
+	}
+
+	for i, r := range original.Resources {
+		got := decoded.Resources[i]
+		if got.Type != r.Type || got.Roles[0].Type != r.Roles[0].Type {
+			t.Errorf("resource %d decoded as %s/%s, want %s/%s", i, got.Type, got.Roles[0].Type, r.Type, r.Roles[0].Type)
+		}
+	}
+}
+
+func TestRegistryRejectsUnknownIndex(t *testing.T) {
+	// 0x00 0x02 | empty UserID | 1 resource | empty ResID | type index 100 | 0 roles
+	data := []byte{0x00, 0x02, 0x00, 0x01, 0x00, 100, 0x00}
+
+	if err := (&gwt.Resources{}).Deserialize(data); err == nil {
+		t.Error("unknown resource type index was accepted")
+	}
+}
+
+func TestRegistryRejectsUnregisteredTypes(t *testing.T) {
+	for name, r := range map[string]gwt.Resource{
+		"Resource": gwt.NewResource("unregistered", gwt.DefaultRoles[gwt.User]),
+		"Role":     gwt.NewResource(gwt.Network, gwt.Role{Type: "unregistered", Permissions: gwt.Read}),
+	} {
+		r := r
+		res := gwt.NewResources(uid.New())
+		res.Resources = append(res.Resources, &r)
+
+		if _, err := res.Serialize(); err == nil {
+			t.Errorf("%s: unregistered type serialized", name)
+		}
+	}
+}
+
+func TestRegistrySyncFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+
+	first := gwt.NewRegistry()
+	if err := first.SyncFile(path); err != nil {
+		t.Fatal(err)
+	}
+	billingIdx, _ := first.RegisterResourceType("billing")
+	reportsIdx, _ := first.RegisterResourceType("reports")
+	if err := first.SaveFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// A restart that registers in a different order keeps the persisted indexes.
+	restarted := gwt.NewRegistry()
+	if err := restarted.SyncFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if idx, _ := restarted.RegisterResourceType("reports"); idx != reportsIdx {
+		t.Errorf("reports moved from %d to %d", reportsIdx, idx)
+	}
+	if idx, _ := restarted.RegisterResourceType("billing"); idx != billingIdx {
+		t.Errorf("billing moved from %d to %d", billingIdx, idx)
+	}
+
+	// Indexes already handed out that disagree with the file must fail validation.
+	conflicting := gwt.NewRegistry()
+	_, _ = conflicting.RegisterResourceType("reports")
+	if err := conflicting.SyncFile(path); err == nil {
+		t.Error("conflicting registry passed validation")
+	}
+}
+
+func TestRegistryFileVersion(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "registry.json")
+	if err := os.WriteFile(path, []byte(`{"version":99}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := gwt.LoadRegistryFile(path); err == nil {
+		t.Error("unsupported registry version was loaded")
+	}
+}
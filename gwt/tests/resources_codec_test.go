@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"bytes"
+	"github.com/vaiktorg/grimoire/gwt"
+	"github.com/vaiktorg/grimoire/uid"
+	"strings"
+	"testing"
+)
+
+func newClaimedResources(count int) *gwt.Resources {
+	res := gwt.NewResources(uid.New())
+	for i := 0; i < count; i++ {
+		role := gwt.Role{Type: gwt.Dev, Permissions: gwt.Read | gwt.Write, Claims: map[gwt.RoleType]gwt.Claim{}}
+		role.AddClaim("team", "core")
+		role.AddClaim("region", "us-east")
+
+		r := gwt.NewResource(gwt.Network, role)
+		res.Resources = append(res.Resources, &r)
+	}
+
+	return res
+}
+
+// serialize is res.Serialize for resources of registered types.
+func serialize(t testing.TB, res *gwt.Resources) []byte {
+	t.Helper()
+
+	data, err := res.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestResourcesKeepClaims(t *testing.T) {
+	original := newClaimedResources(2)
+
+	decoded := &gwt.Resources{}
+	if err := decoded.Deserialize(serialize(t, original)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Resources) != 2 {
+		t.Fatalf("expected 2 resources, got %d", len(decoded.Resources))
+	}
+	if bytes.Equal(decoded.Resources[0].ResID, decoded.Resources[1].ResID) {
+		t.Error("decoded resources alias each other")
+	}
+
+	claims := decoded.Resources[0].Roles[0].Claims
+	if claims["team"] != "team.core" || claims["region"] != "region.us-east" {
+		t.Errorf("claims lost in round trip: %v", claims)
+	}
+}
+
+func TestResourcesLargeCounts(t *testing.T) {
+	original := newClaimedResources(300)
+	original.UserID = []byte(strings.Repeat("u", 300))
+
+	decoded := &gwt.Resources{}
+	if err := decoded.Deserialize(serialize(t, original)); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(decoded.Resources) != 300 || len(decoded.UserID) != 300 {
+		t.Errorf("counts over 255 were truncated: %d resources, %d byte id", len(decoded.Resources), len(decoded.UserID))
+	}
+}
+
+func TestResourcesRejectTruncated(t *testing.T) {
+	data := serialize(t, newClaimedResources(1))
+
+	for i := 0; i < len(data); i++ {
+		if err := (&gwt.Resources{}).Deserialize(data[:i]); err == nil {
+			t.Fatalf("truncated data of length %d was accepted", i)
+		}
+	}
+}
+
+func TestResourcesLegacyLayout(t *testing.T) {
+	userID := []byte(uid.NewUID(gwt.FixedIDLen))
+	resID := []byte(uid.NewUID(gwt.FixedIDLen))
+	claim := []byte("team.core")
+
+	legacy := append([]byte{}, userID...)
+	legacy = append(legacy, 1)        // #resources
+	legacy = append(legacy, resID...) // ResID
+	legacy = append(legacy, 0, 1)     // type idx, #roles
+	legacy = append(legacy, 0, 3, 1)  // role idx, permissions, #claims
+	legacy = append(legacy, byte(len(claim)))
+	legacy = append(legacy, claim...)
+
+	decoded := &gwt.Resources{}
+	if err := decoded.Deserialize(legacy); err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(decoded.UserID, userID) || !bytes.Equal(decoded.Resources[0].ResID, resID) {
+		t.Error("legacy ids were not decoded")
+	}
+
+	role := decoded.Resources[0].Roles[0]
+	if role.Permissions != 3 || role.Claims["team"] != "team.core" {
+		t.Errorf("legacy role was not decoded: %+v", role)
+	}
+
+	if err := decoded.Deserialize(legacy[:len(legacy)-2]); err == nil {
+		t.Error("truncated legacy data was accepted")
+	}
+}
+
+func FuzzDeserialize(f *testing.F) {
+	f.Add(serialize(f, newClaimedResources(2)))
+	f.Add(serialize(f, gwt.NewResources(uid.New())))
+	f.Add([]byte{0x00, 0x02, 0xff, 0xff, 0xff, 0xff, 0x0f})
+	f.Add([]byte("AAAAAAAAAAAAAAAA\x01"))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		res := &gwt.Resources{}
+		if err := res.Deserialize(data); err != nil {
+			return
+		}
+
+		// Anything accepted must survive a round trip unchanged.
+		again := &gwt.Resources{}
+		if err := again.Deserialize(serialize(t, res)); err != nil {
+			t.Fatalf("re-decoding serialized resources failed: %v", err)
+		}
+		if !bytes.Equal(serialize(t, res), serialize(t, again)) {
+			t.Fatal("round trip is not stable")
+		}
+	})
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"database/sql"
+	"github.com/vaiktorg/grimoire/gwt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func testRevocation(t *testing.T, store gwt.RevocationStore) {
+	revMC, err := gwt.NewMultiCoder[*gwt.Resources](gwt.WithRevocationStore(store))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tok1, tok2 := newTestToken(), newTestToken()
+	t1, _ := revMC.Encode(tok1)
+	t2, _ := revMC.Encode(tok2)
+
+	if tok1.Header.ID == "" || tok1.Header.ID == tok2.Header.ID {
+		t.Fatalf("tokens do not carry unique IDs: %q %q", tok1.Header.ID, tok2.Header.ID)
+	}
+
+	decoded, err := revMC.Decode(t1.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = gwt.ValidateGWT(decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = revMC.Revoke(decoded); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = gwt.ValidateGWT(decoded); err == nil || err.Error() != gwt.ErrorTokenRevoked {
+		t.Errorf("expected %q, got %v", gwt.ErrorTokenRevoked, err)
+	}
+
+	other, _ := revMC.Decode(t2.Token)
+	if err = gwt.ValidateGWT(other); err != nil {
+		t.Errorf("unrelated token was affected by revocation: %v", err)
+	}
+
+	// Verifiers accept tokens for a leeway past their expiry, so must the revocation.
+	if err = store.Purge(tok1.Header.Expires.Add(gwt.DefaultLeeway - time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := store.IsRevoked(tok1.Header.ID); !revoked {
+		t.Error("revocation entry purged within the leeway")
+	}
+
+	// Entries are dropped once the token would have expired anyway.
+	if err = store.Purge(tok1.Header.Expires.Add(gwt.DefaultLeeway + time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	if revoked, _ := store.IsRevoked(tok1.Header.ID); revoked {
+		t.Error("expired revocation entry survived purge")
+	}
+}
+
+func TestMemoryRevocationStore(t *testing.T) {
+	store := gwt.NewMemoryRevocationStore(time.Hour)
+	defer store.Close()
+
+	testRevocation(t, store)
+}
+
+func TestSQLiteRevocationStore(t *testing.T) {
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "revocations.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := gwt.NewSQLiteRevocationStore(db, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testRevocation(t, store)
+}
+
+func TestRevocationGC(t *testing.T) {
+	// A day ahead of the wall clock, so only the store's own clock can tell what expired.
+	now := time.Now().Add(24 * time.Hour)
+	store := gwt.NewMemoryRevocationStore(time.Millisecond*10, gwt.WithGCClock(func() time.Time { return now }))
+	defer store.Close()
+
+	_ = store.Revoke("expired", now.Add(-gwt.DefaultLeeway-time.Second))
+	_ = store.Revoke("leeway", now.Add(-time.Second))
+	_ = store.Revoke("live", now.Add(time.Hour))
+
+	deadline := time.Now().Add(time.Second)
+	for store.Len() > 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if store.Len() != 2 {
+		t.Errorf("expected 2 entries after gc, got %d", store.Len())
+	}
+	for _, id := range []string{"leeway", "live"} {
+		if revoked, _ := store.IsRevoked(id); !revoked {
+			t.Errorf("gc dropped %q, which a verifier may still accept", id)
+		}
+	}
+}
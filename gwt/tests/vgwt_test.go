@@ -2,10 +2,8 @@ package tests
 
 import (
 	"bytes"
-	"fmt"
 	"github.com/vaiktorg/grimoire/gwt"
 	"github.com/vaiktorg/grimoire/gwt/vhash"
-	"image"
 	"testing"
 	"time"
 )
@@ -39,27 +37,25 @@ func TestVGWT(t *testing.T) {
 		return
 	}
 
-	//var maskHash []byte
-	var mask *image.RGBA
-	_, mask, err = vhash.CreateTokenCard([]byte(tok.Signature))
+	card := new(bytes.Buffer)
+	randHash, mask, err := vhash.CreateTokenCard(card, []byte(tok.Signature))
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 		return
 	}
 
-	var decodedHash []byte
-	decodedHash = vhash.ReadTokenCard(vhash.GridConfig.ExportPath, mask)
+	if !bytes.Equal(vhash.MaskDigest(mask), randHash) {
+		t.Error("mask digest does not match the card's random hash")
+	}
+
+	decodedHash, err := vhash.ReadTokenCard(card, randHash)
 	if err != nil {
 		t.Error(err)
 		t.FailNow()
 		return
 	}
 
-	fmt.Println(tok.Signature)
-	fmt.Println(decodedHash)
-	fmt.Println(tok.Signature)
-
 	if !bytes.Equal(decodedHash, []byte(tok.Signature)) {
 		t.Log(decodedHash)
 		t.Log(tok.Signature)
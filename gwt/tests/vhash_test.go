@@ -0,0 +1,291 @@
+package tests
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/hex"
+	"github.com/vaiktorg/grimoire/gwt/vhash"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"math"
+	"math/rand"
+	"testing"
+)
+
+// Degraded card corpus
+// ====================================================================================================
+// Every case is derived from the same card on the default template, deterministically, and must read
+// back the exact hash.
+
+type cardDamage struct {
+	name    string
+	degrade func(img image.Image) image.Image
+}
+
+var cardCorpus = []cardDamage{
+	{"pristine", func(img image.Image) image.Image { return img }},
+	{"downscale 0.5", scaled(0.5)},
+	{"downscale 0.75", scaled(0.75)},
+	{"upscale 1.5", scaled(1.5)},
+	{"upscale 2.3", scaled(2.3)},
+	{"rotate 3", rotated(3)},
+	{"rotate -5", rotated(-5)},
+	{"rotate 12 on a desk", chain(padded(80), rotated(12))},
+	{"jpeg 50", recompressed(50)},
+	{"jpeg 30", recompressed(30)},
+	{"crop to symbol", cropped(image.Rect(6, 6, 266, 522))},
+	{"blur", blurred},
+	{"noise", noisy(40)},
+	{"dim and uneven", shaded},
+	{"scribbled", scribbled},
+	{"phone photo", chain(rotated(-4), scaled(0.8), blurred, noisy(20), recompressed(40))},
+	{"padded scan", chain(padded(120), rotated(2), scaled(1.7), recompressed(60))},
+}
+
+func TestVHashCorpus(t *testing.T) {
+	hash, key := cardHash(), cardKey()
+
+	card, err := vhash.EncodeCard(hash, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range cardCorpus {
+		t.Run(c.name, func(t *testing.T) {
+			decoded, err := vhash.DecodeCard(c.degrade(card), key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(decoded, hash) {
+				t.Errorf("decoded %q", decoded)
+			}
+		})
+	}
+}
+
+func TestVHashWrongKeys(t *testing.T) {
+	card, _ := vhash.EncodeCard(cardHash(), cardKey())
+
+	other, _ := vhash.RandomMask()
+	if decoded, err := vhash.DecodeCard(card, other); err == nil {
+		t.Errorf("card read with another mask: %q", decoded)
+	}
+	if decoded, err := vhash.DecodeCard(card, cardKey(), vhash.WithHashKey([]byte("another key"))); err == nil {
+		t.Errorf("card read with another hash key: %q", decoded)
+	}
+}
+
+func TestVHashTemplates(t *testing.T) {
+	hash, key := cardHash(), cardKey()
+
+	// A blank card is just the symbol and a margin.
+	blank, err := vhash.EncodeCard(hash, key, vhash.WithTemplate(nil, image.Pt(20, 20)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := vhash.SymbolSize.Add(image.Pt(40, 40)); blank.Bounds().Size() != want {
+		t.Errorf("blank card is %v, expected %v", blank.Bounds().Size(), want)
+	}
+
+	// Cards stream through any writer and reader, JPEG included.
+	buff := new(bytes.Buffer)
+	if err = jpeg.Encode(buff, blank, &jpeg.Options{Quality: 60}); err != nil {
+		t.Fatal(err)
+	}
+	decoded, err := vhash.ReadTokenCard(buff, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(decoded, hash) {
+		t.Errorf("decoded %q", decoded)
+	}
+
+	small := image.NewRGBA(image.Rect(0, 0, 200, 200))
+	if _, err = vhash.EncodeCard(hash, key, vhash.WithTemplate(small, image.Point{})); err == nil || err.Error() != vhash.ErrorTemplateSize {
+		t.Errorf("expected %q, got %v", vhash.ErrorTemplateSize, err)
+	}
+}
+
+func TestVHashNoSymbol(t *testing.T) {
+	blank := image.NewRGBA(image.Rect(0, 0, 272, 528))
+	draw.Draw(blank, blank.Bounds(), image.White, image.Point{}, draw.Src)
+
+	if _, err := vhash.DecodeCard(blank, cardKey()); err == nil || err.Error() != vhash.ErrorNoSymbol {
+		t.Errorf("expected %q, got %v", vhash.ErrorNoSymbol, err)
+	}
+}
+
+// cardHash looks like a GWT signature, the hex of a SHA-512.
+func cardHash() []byte {
+	sum := sha512.Sum512([]byte("vhash corpus"))
+	return []byte(hex.EncodeToString(sum[:]))
+}
+func cardKey() []byte {
+	key := sha512.Sum512([]byte("vhash corpus key"))
+	return key[:]
+}
+
+// Degradations
+// ----------------------------------------------------------------------------------------------------
+
+func chain(steps ...func(image.Image) image.Image) func(image.Image) image.Image {
+	return func(img image.Image) image.Image {
+		for _, step := range steps {
+			img = step(img)
+		}
+		return img
+	}
+}
+
+// warp resamples src bilinearly into a w by h image, inverse mapping each destination pixel.
+func warp(src image.Image, w, h int, inverse func(x, y float64) (float64, float64)) image.Image {
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			sx, sy := inverse(float64(x)+0.5, float64(y)+0.5)
+			dst.Set(x, y, bilinear(src, sx-0.5, sy-0.5))
+		}
+	}
+	return dst
+}
+func bilinear(img image.Image, x, y float64) color.Color {
+	b := img.Bounds()
+	x0, y0 := int(math.Floor(x)), int(math.Floor(y))
+	fx, fy := x-float64(x0), y-float64(y0)
+
+	at := func(x, y int) [3]float64 {
+		if x < b.Min.X || y < b.Min.Y || x >= b.Max.X || y >= b.Max.Y {
+			return [3]float64{0xffff, 0xffff, 0xffff}
+		}
+		r, g, bl, _ := img.At(x, y).RGBA()
+		return [3]float64{float64(r), float64(g), float64(bl)}
+	}
+
+	var out [3]float64
+	p00, p10, p01, p11 := at(x0, y0), at(x0+1, y0), at(x0, y0+1), at(x0+1, y0+1)
+	for i := range out {
+		out[i] = p00[i]*(1-fx)*(1-fy) + p10[i]*fx*(1-fy) + p01[i]*(1-fx)*fy + p11[i]*fx*fy
+	}
+	return color.RGBA64{R: uint16(out[0]), G: uint16(out[1]), B: uint16(out[2]), A: 0xffff}
+}
+
+func scaled(f float64) func(image.Image) image.Image {
+	return func(img image.Image) image.Image {
+		b := img.Bounds()
+		return warp(img, int(float64(b.Dx())*f), int(float64(b.Dy())*f), func(x, y float64) (float64, float64) {
+			return x / f, y / f
+		})
+	}
+}
+
+func rotated(deg float64) func(image.Image) image.Image {
+	return func(img image.Image) image.Image {
+		b := img.Bounds()
+		sin, cos := math.Sincos(deg * math.Pi / 180)
+		cx, cy := float64(b.Dx())/2, float64(b.Dy())/2
+
+		return warp(img, b.Dx(), b.Dy(), func(x, y float64) (float64, float64) {
+			dx, dy := x-cx, y-cy
+			return cx + dx*cos + dy*sin, cy - dx*sin + dy*cos
+		})
+	}
+}
+
+func recompressed(quality int) func(image.Image) image.Image {
+	return func(img image.Image) image.Image {
+		buff := new(bytes.Buffer)
+		_ = jpeg.Encode(buff, img, &jpeg.Options{Quality: quality})
+		out, _ := jpeg.Decode(buff)
+		return out
+	}
+}
+
+func cropped(r image.Rectangle) func(image.Image) image.Image {
+	return func(img image.Image) image.Image {
+		out := image.NewRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+		draw.Draw(out, out.Bounds(), img, r.Min, draw.Src)
+		return out
+	}
+}
+
+func padded(margin int) func(image.Image) image.Image {
+	return func(img image.Image) image.Image {
+		b := img.Bounds()
+		out := image.NewRGBA(image.Rect(0, 0, b.Dx()+2*margin, b.Dy()+2*margin))
+		draw.Draw(out, out.Bounds(), &image.Uniform{C: color.RGBA{R: 0x9a, G: 0x8c, B: 0x70, A: 0xff}}, image.Point{}, draw.Src)
+		draw.Draw(out, b.Add(image.Pt(margin, margin)), img, b.Min, draw.Src)
+		return out
+	}
+}
+
+func blurred(img image.Image) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			var sum [3]uint32
+			var n uint32
+			for dy := -1; dy <= 1; dy++ {
+				for dx := -1; dx <= 1; dx++ {
+					if !image.Pt(x+dx, y+dy).In(b) {
+						continue
+					}
+					r, g, bl, _ := img.At(x+dx, y+dy).RGBA()
+					sum[0], sum[1], sum[2] = sum[0]+r, sum[1]+g, sum[2]+bl
+					n++
+				}
+			}
+			out.Set(x, y, color.RGBA64{R: uint16(sum[0] / n), G: uint16(sum[1] / n), B: uint16(sum[2] / n), A: 0xffff})
+		}
+	}
+	return out
+}
+
+func noisy(amplitude int) func(image.Image) image.Image {
+	return func(img image.Image) image.Image {
+		rnd := rand.New(rand.NewSource(int64(amplitude)))
+		return pixelwise(img, func(x, y int, v uint8) uint8 {
+			return clampByte(int(v) + rnd.Intn(2*amplitude+1) - amplitude)
+		})
+	}
+}
+
+// shaded darkens the card and adds a lighting gradient across it.
+func shaded(img image.Image) image.Image {
+	w := float64(img.Bounds().Dx())
+	return pixelwise(img, func(x, y int, v uint8) uint8 {
+		return clampByte(int(float64(v) * (0.35 + 0.4*float64(x)/w)))
+	})
+}
+
+// scribbled draws a pen stroke across the data modules.
+func scribbled(img image.Image) image.Image {
+	out := image.NewRGBA(img.Bounds())
+	draw.Draw(out, out.Bounds(), img, img.Bounds().Min, draw.Src)
+	draw.Draw(out, image.Rect(40, 200, 230, 212), image.Black, image.Point{}, draw.Src)
+	return out
+}
+
+func pixelwise(img image.Image, f func(x, y int, v uint8) uint8) image.Image {
+	b := img.Bounds()
+	out := image.NewRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+			out.SetRGBA(x, y, color.RGBA{R: f(x, y, c.R), G: f(x, y, c.G), B: f(x, y, c.B), A: 0xff})
+		}
+	}
+	return out
+}
+
+func clampByte(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 0xff {
+		return 0xff
+	}
+	return uint8(v)
+}
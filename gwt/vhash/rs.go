@@ -0,0 +1,250 @@
+package vhash
+
+import "errors"
+
+// Reed-Solomon
+// ====================================================================================================
+// Systematic Reed-Solomon over GF(2^8), primitive polynomial 0x11d and generator 2, the same field
+// QR codes use. nsym parity bytes correct up to nsym/2 corrupted bytes anywhere in the codeword.
+// Polynomials are stored highest degree first.
+
+const ErrorTooManyErrors = "card is too damaged to recover"
+
+var gfExp [512]byte
+var gfLog [256]int
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfLog[x] = i
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+	for i := 255; i < 512; i++ {
+		gfExp[i] = gfExp[i-255]
+	}
+}
+
+func gfMul(x, y byte) byte {
+	if x == 0 || y == 0 {
+		return 0
+	}
+	return gfExp[gfLog[x]+gfLog[y]]
+}
+func gfDiv(x, y byte) byte {
+	if x == 0 {
+		return 0
+	}
+	return gfExp[(gfLog[x]+255-gfLog[y])%255]
+}
+func gfPow2(p int) byte {
+	return gfExp[((p%255)+255)%255]
+}
+func gfInverse(x byte) byte {
+	return gfExp[255-gfLog[x]]
+}
+
+func polyScale(p []byte, x byte) []byte {
+	r := make([]byte, len(p))
+	for i := range p {
+		r[i] = gfMul(p[i], x)
+	}
+	return r
+}
+func polyAdd(p, q []byte) []byte {
+	n := len(p)
+	if len(q) > n {
+		n = len(q)
+	}
+
+	r := make([]byte, n)
+	for i := range p {
+		r[i+len(r)-len(p)] = p[i]
+	}
+	for i := range q {
+		r[i+len(r)-len(q)] ^= q[i]
+	}
+	return r
+}
+func polyMul(p, q []byte) []byte {
+	r := make([]byte, len(p)+len(q)-1)
+	for j := range q {
+		for i := range p {
+			r[i+j] ^= gfMul(p[i], q[j])
+		}
+	}
+	return r
+}
+func polyEval(p []byte, x byte) byte {
+	y := p[0]
+	for i := 1; i < len(p); i++ {
+		y = gfMul(y, x) ^ p[i]
+	}
+	return y
+}
+func reversed(p []byte) []byte {
+	r := make([]byte, len(p))
+	for i := range p {
+		r[len(p)-1-i] = p[i]
+	}
+	return r
+}
+
+func rsGenerator(nsym int) []byte {
+	g := []byte{1}
+	for i := 0; i < nsym; i++ {
+		g = polyMul(g, []byte{1, gfPow2(i)})
+	}
+	return g
+}
+
+// rsEncode returns msg followed by nsym parity bytes.
+func rsEncode(msg []byte, nsym int) []byte {
+	gen := rsGenerator(nsym)
+
+	out := make([]byte, len(msg)+nsym)
+	copy(out, msg)
+	for i := range msg {
+		coef := out[i]
+		if coef == 0 {
+			continue
+		}
+		for j := 1; j < len(gen); j++ {
+			out[i+j] ^= gfMul(gen[j], coef)
+		}
+	}
+
+	copy(out, msg)
+	return out
+}
+
+// rsDecode corrects codeword in place and returns its message part.
+func rsDecode(codeword []byte, nsym int) ([]byte, error) {
+	synd := rsSyndromes(codeword, nsym)
+	if !allZero(synd) {
+		errLoc, err := rsErrorLocator(synd, nsym)
+		if err != nil {
+			return nil, err
+		}
+
+		errPos, err := rsFindErrors(reversed(errLoc), len(codeword))
+		if err != nil {
+			return nil, err
+		}
+
+		rsCorrect(codeword, synd, errPos)
+		if !allZero(rsSyndromes(codeword, nsym)) {
+			return nil, errors.New(ErrorTooManyErrors)
+		}
+	}
+
+	return codeword[:len(codeword)-nsym], nil
+}
+
+// rsSyndromes are padded with a leading 0, which keeps the indexes of the algorithms below aligned.
+func rsSyndromes(msg []byte, nsym int) []byte {
+	synd := make([]byte, nsym+1)
+	for i := 0; i < nsym; i++ {
+		synd[i+1] = polyEval(msg, gfPow2(i))
+	}
+	return synd
+}
+
+// rsErrorLocator runs Berlekamp-Massey.
+func rsErrorLocator(synd []byte, nsym int) ([]byte, error) {
+	errLoc := []byte{1}
+	oldLoc := []byte{1}
+
+	shift := len(synd) - nsym
+	for i := 0; i < nsym; i++ {
+		k := i + shift
+
+		delta := synd[k]
+		for j := 1; j < len(errLoc); j++ {
+			delta ^= gfMul(errLoc[len(errLoc)-1-j], synd[k-j])
+		}
+
+		oldLoc = append(oldLoc, 0)
+		if delta != 0 {
+			if len(oldLoc) > len(errLoc) {
+				newLoc := polyScale(oldLoc, delta)
+				oldLoc = polyScale(errLoc, gfInverse(delta))
+				errLoc = newLoc
+			}
+			errLoc = polyAdd(errLoc, polyScale(oldLoc, delta))
+		}
+	}
+
+	for len(errLoc) > 0 && errLoc[0] == 0 {
+		errLoc = errLoc[1:]
+	}
+	if (len(errLoc)-1)*2 > nsym {
+		return nil, errors.New(ErrorTooManyErrors)
+	}
+
+	return errLoc, nil
+}
+
+// rsFindErrors runs a Chien search for the roots of the error locator.
+func rsFindErrors(errLoc []byte, n int) ([]int, error) {
+	var pos []int
+	for i := 0; i < n; i++ {
+		if polyEval(errLoc, gfPow2(i)) == 0 {
+			pos = append(pos, n-1-i)
+		}
+	}
+
+	if len(pos) != len(errLoc)-1 {
+		return nil, errors.New(ErrorTooManyErrors)
+	}
+
+	return pos, nil
+}
+
+// rsCorrect computes the error magnitudes with Forney's algorithm and applies them.
+func rsCorrect(msg, synd []byte, errPos []int) {
+	coefPos := make([]int, len(errPos))
+	for i, p := range errPos {
+		coefPos[i] = len(msg) - 1 - p
+	}
+
+	errLoc := []byte{1}
+	for _, p := range coefPos {
+		errLoc = polyMul(errLoc, []byte{gfPow2(p), 1})
+	}
+
+	// Error evaluator: synd * errLoc mod x^(len(errLoc)).
+	product := polyMul(reversed(synd), errLoc)
+	errEval := reversed(product[len(product)-len(errLoc):])
+
+	x := make([]byte, len(coefPos))
+	for i, p := range coefPos {
+		x[i] = gfPow2(p)
+	}
+
+	for i, xi := range x {
+		xiInv := gfInverse(xi)
+
+		locPrime := byte(1)
+		for j, xj := range x {
+			if j != i {
+				locPrime = gfMul(locPrime, 1^gfMul(xiInv, xj))
+			}
+		}
+
+		y := gfMul(xi, polyEval(reversed(errEval), xiInv))
+		msg[errPos[i]] ^= gfDiv(y, locPrime)
+	}
+}
+
+func allZero(b []byte) bool {
+	for _, v := range b {
+		if v != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,602 @@
+package vhash
+
+import (
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"sort"
+)
+
+// Symbol
+// ====================================================================================================
+// The hash is drawn as a grid of black and white modules, QR style, so it survives resampling and
+// lossy compression. Three finder patterns (top left, top right, bottom left) locate and orient the
+// grid, an alignment pattern near the bottom right corrects perspective, and a quiet zone of light
+// modules separates the symbol from the card template:
+//
+//	F F F . . . . . F F F     F  7x7 finder + 1 module separator
+//	F F F . . . . . F F F     A  5x5 alignment
+//	. . . . . . . . . . .     .  data modules, row major, dark = 1
+//	F F F . . . . A . . .
+//	F F F . . . . . . . .
+//
+// The reader binarizes the image against its local mean, finds the finders by their 1:1:3:1:1 run
+// ratio in any direction, and samples every module through the transform they imply.
+
+const (
+	ErrorNoSymbol = "no token symbol found in the image"
+)
+
+const (
+	symbolCols = 30
+	symbolRows = 62
+	quietZone  = 1 // light modules around the symbol
+	moduleSize = 8 // pixels per module on a rendered card
+
+	finderSize = 7
+	alignSize  = 5
+	alignCol   = symbolCols - 9 // alignment top left module
+	alignRow   = symbolRows - 9
+)
+
+// SymbolSize is the size in pixels of a rendered symbol, quiet zone included.
+var SymbolSize = image.Pt((symbolCols+2*quietZone)*moduleSize, (symbolRows+2*quietZone)*moduleSize)
+
+var (
+	darkModule  = color.RGBA{R: 0x14, G: 0x14, B: 0x1e, A: 0xff}
+	lightModule = color.RGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}
+)
+
+// Finder and alignment centers in module coordinates, the origin being the symbol's top left corner.
+var (
+	finderTL = point{finderSize / 2.0, finderSize / 2.0}
+	finderTR = point{symbolCols - finderSize/2.0, finderSize / 2.0}
+	finderBL = point{finderSize / 2.0, symbolRows - finderSize/2.0}
+	alignC   = point{alignCol + alignSize/2.0, alignRow + alignSize/2.0}
+)
+
+// dataModules lists the modules left for data, in the order bits are placed.
+var dataModules = func() []image.Point {
+	var mods []image.Point
+	for r := 0; r < symbolRows; r++ {
+		for c := 0; c < symbolCols; c++ {
+			if _, reserved := functionModule(c, r); !reserved {
+				mods = append(mods, image.Pt(c, r))
+			}
+		}
+	}
+	return mods
+}()
+
+// functionModule reports whether module c,r belongs to a finder, separator or alignment pattern, and its color.
+func functionModule(c, r int) (dark, reserved bool) {
+	corners := [][2]int{{0, 0}, {symbolCols - finderSize, 0}, {0, symbolRows - finderSize}}
+	for _, o := range corners {
+		dx, dy := c-o[0], r-o[1]
+		if dx >= -1 && dx <= finderSize && dy >= -1 && dy <= finderSize {
+			if dx < 0 || dy < 0 || dx == finderSize || dy == finderSize {
+				return false, true // separator
+			}
+
+			ring := chebyshev(dx-finderSize/2, dy-finderSize/2)
+			return ring != 2, true
+		}
+	}
+
+	dx, dy := c-alignCol, r-alignRow
+	if dx >= 0 && dx < alignSize && dy >= 0 && dy < alignSize {
+		return chebyshev(dx-alignSize/2, dy-alignSize/2) != 1, true
+	}
+
+	return false, false
+}
+
+// drawSymbol renders bits, one per dataModules entry, with its top left quiet zone corner at at.
+func drawSymbol(img draw.Image, at image.Point, bits []bool) {
+	draw.Draw(img, image.Rectangle{Min: at, Max: at.Add(SymbolSize)}, &image.Uniform{C: lightModule}, image.Point{}, draw.Src)
+
+	module := func(c, r int, dark bool) {
+		if !dark {
+			return
+		}
+		x := at.X + (c+quietZone)*moduleSize
+		y := at.Y + (r+quietZone)*moduleSize
+		draw.Draw(img, image.Rect(x, y, x+moduleSize, y+moduleSize), &image.Uniform{C: darkModule}, image.Point{}, draw.Src)
+	}
+
+	for r := 0; r < symbolRows; r++ {
+		for c := 0; c < symbolCols; c++ {
+			if dark, reserved := functionModule(c, r); reserved {
+				module(c, r, dark)
+			}
+		}
+	}
+	for i, m := range dataModules {
+		module(m.X, m.Y, bits[i])
+	}
+}
+
+// readSymbol finds the symbol in img and returns candidate readings of its data bits, best first.
+func readSymbol(img image.Image) ([][]bool, error) {
+	bin := binarize(img)
+
+	finders := bin.findFinders()
+	tl, tr, bl, ok := orderFinders(finders)
+	if !ok {
+		return nil, errors.New(ErrorNoSymbol)
+	}
+
+	affine := newAffine(tl, tr, bl)
+
+	var readings [][]bool
+	if align, found := bin.findAlignment(affine); found {
+		if h, ok := solveHomography(
+			[4]point{finderTL, finderTR, finderBL, alignC},
+			[4]point{tl.center, tr.center, bl.center, align},
+		); ok {
+			readings = append(readings, bin.sample(h))
+		}
+	}
+
+	return append(readings, bin.sample(affine)), nil
+}
+
+// Binarization
+// ----------------------------------------------------------------------------------------------------
+
+type binImage struct {
+	w, h int
+	dark []bool
+}
+
+func (b *binImage) at(x, y int) bool {
+	if x < 0 || y < 0 || x >= b.w || y >= b.h {
+		return false
+	}
+	return b.dark[y*b.w+x]
+}
+
+// binarize marks pixels noticeably darker than the mean of their neighbourhood, which copes with
+// uneven lighting and JPEG noise better than a global threshold.
+func binarize(img image.Image) *binImage {
+	bounds := img.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+
+	lum := make([]int, w*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			lum[y*w+x] = luminance(img.At(bounds.Min.X+x, bounds.Min.Y+y))
+		}
+	}
+
+	// Integral image, one row and column of padding.
+	sum := make([]int, (w+1)*(h+1))
+	for y := 0; y < h; y++ {
+		row := 0
+		for x := 0; x < w; x++ {
+			row += lum[y*w+x]
+			sum[(y+1)*(w+1)+x+1] = sum[y*(w+1)+x+1] + row
+		}
+	}
+
+	radius := w
+	if h < radius {
+		radius = h
+	}
+	radius /= 8
+	if radius < 8 {
+		radius = 8
+	}
+
+	bin := &binImage{w: w, h: h, dark: make([]bool, w*h)}
+	for y := 0; y < h; y++ {
+		y0, y1 := clamp(y-radius, 0, h), clamp(y+radius+1, 0, h)
+		for x := 0; x < w; x++ {
+			x0, x1 := clamp(x-radius, 0, w), clamp(x+radius+1, 0, w)
+
+			area := (x1 - x0) * (y1 - y0)
+			total := sum[y1*(w+1)+x1] - sum[y0*(w+1)+x1] - sum[y1*(w+1)+x0] + sum[y0*(w+1)+x0]
+			bin.dark[y*w+x] = lum[y*w+x]*area < total-12*area
+		}
+	}
+
+	return bin
+}
+
+func luminance(c color.Color) int {
+	r, g, b, _ := c.RGBA()
+	return int((299*r + 587*g + 114*b) / 1000 >> 8)
+}
+
+// Finders
+// ----------------------------------------------------------------------------------------------------
+
+type finder struct {
+	center point
+	module float64 // module size in pixels
+	hits   int
+}
+
+// findFinders scans every row for dark/light runs in a 1:1:3:1:1 ratio and confirms them vertically.
+func (b *binImage) findFinders() []finder {
+	var found []finder
+
+	for y := 0; y < b.h; y++ {
+		runs, starts := b.rowRuns(y)
+		for i := 0; i+5 <= len(runs); i++ {
+			if !b.at(starts[i], y) {
+				continue
+			}
+
+			window := runs[i : i+5]
+			if !finderRatio(window) {
+				continue
+			}
+
+			cx := float64(starts[i+2]) + float64(window[2])/2
+			total := sum(window)
+
+			cy, vTotal, ok := b.crossCheckVertical(int(cx), y, total)
+			if !ok {
+				continue
+			}
+
+			cx2, hTotal, ok := b.crossCheckHorizontal(int(cx), int(cy), total)
+			if !ok {
+				continue
+			}
+
+			found = mergeFinder(found, finder{
+				center: point{cx2, cy},
+				module: float64(vTotal+hTotal) / 14,
+				hits:   1,
+			})
+		}
+	}
+
+	sort.Slice(found, func(i, j int) bool { return found[i].hits > found[j].hits })
+	return found
+}
+
+func (b *binImage) rowRuns(y int) (runs, starts []int) {
+	x := 0
+	for x < b.w {
+		start, dark := x, b.at(x, y)
+		for x < b.w && b.at(x, y) == dark {
+			x++
+		}
+		runs = append(runs, x-start)
+		starts = append(starts, start)
+	}
+	return runs, starts
+}
+
+func finderRatio(runs []int) bool {
+	total := sum(runs)
+	if total < finderSize {
+		return false
+	}
+
+	module := float64(total) / finderSize
+	tolerance := module * 0.7
+	for i, want := range []float64{1, 1, 3, 1, 1} {
+		if math.Abs(float64(runs[i])-want*module) > want*tolerance {
+			return false
+		}
+	}
+
+	return true
+}
+
+// crossCheckVertical measures the runs through x around y and returns the refined center.
+func (b *binImage) crossCheckVertical(x, y, hTotal int) (float64, int, bool) {
+	runs, start := b.runsThrough(y, hTotal, func(i int) bool { return b.at(x, i) })
+	if runs == nil || !finderRatio(runs) || math.Abs(float64(sum(runs)-hTotal)) > 0.5*float64(hTotal) {
+		return 0, 0, false
+	}
+
+	return float64(start+runs[0]+runs[1]) + float64(runs[2])/2, sum(runs), true
+}
+func (b *binImage) crossCheckHorizontal(x, y, vTotal int) (float64, int, bool) {
+	runs, start := b.runsThrough(x, vTotal, func(i int) bool { return b.at(i, y) })
+	if runs == nil || !finderRatio(runs) || math.Abs(float64(sum(runs)-vTotal)) > 0.5*float64(vTotal) {
+		return 0, 0, false
+	}
+
+	return float64(start+runs[0]+runs[1]) + float64(runs[2])/2, sum(runs), true
+}
+
+// runsThrough walks out from pos, which must be dark, collecting the dark center run and two runs on
+// either side, at most limit pixels each way.
+func (b *binImage) runsThrough(pos, limit int, dark func(int) bool) ([]int, int) {
+	if !dark(pos) {
+		return nil, 0
+	}
+
+	var runs [5]int
+	i := pos
+	for _, slot := range []struct {
+		idx  int
+		dark bool
+	}{{2, true}, {1, false}, {0, true}} {
+		for i >= 0 && pos-i <= limit && dark(i) == slot.dark {
+			runs[slot.idx]++
+			i--
+		}
+	}
+	start := i + 1
+
+	i = pos + 1
+	for _, slot := range []struct {
+		idx  int
+		dark bool
+	}{{2, true}, {3, false}, {4, true}} {
+		for i-pos <= limit && dark(i) == slot.dark && i < pos+limit+1 {
+			runs[slot.idx]++
+			i++
+		}
+	}
+
+	for _, r := range runs {
+		if r == 0 {
+			return nil, 0
+		}
+	}
+
+	return runs[:], start
+}
+
+func mergeFinder(found []finder, f finder) []finder {
+	for i := range found {
+		g := &found[i]
+		if g.center.dist(f.center) < 2*g.module {
+			n := float64(g.hits)
+			g.center = point{(g.center.x*n + f.center.x) / (n + 1), (g.center.y*n + f.center.y) / (n + 1)}
+			g.module = (g.module*n + f.module) / (n + 1)
+			g.hits++
+			return found
+		}
+	}
+
+	return append(found, f)
+}
+
+// orderFinders picks the three finders that best form the symbol's corners and names them.
+func orderFinders(found []finder) (tl, tr, bl finder, ok bool) {
+	if len(found) > 8 {
+		found = found[:8]
+	}
+
+	wantRatio := (finderBL.y - finderTL.y) / (finderTR.x - finderTL.x)
+
+	best := math.Inf(1)
+	for i := 0; i < len(found); i++ {
+		for j := i + 1; j < len(found); j++ {
+			for k := j + 1; k < len(found); k++ {
+				a, b, c, score, valid := cornerFit(found[i], found[j], found[k], wantRatio)
+				if valid && score < best {
+					best, tl, tr, bl, ok = score, a, b, c, true
+				}
+			}
+		}
+	}
+
+	return tl, tr, bl, ok
+}
+
+// cornerFit names the corners of a candidate triple and scores how far it is from the symbol's shape.
+func cornerFit(p, q, r finder, wantRatio float64) (tl, tr, bl finder, score float64, ok bool) {
+	// The top left finder is opposite the longest side.
+	switch {
+	case q.center.dist(r.center) >= p.center.dist(q.center) && q.center.dist(r.center) >= p.center.dist(r.center):
+		tl, tr, bl = p, q, r
+	case p.center.dist(r.center) >= p.center.dist(q.center):
+		tl, tr, bl = q, p, r
+	default:
+		tl, tr, bl = r, p, q
+	}
+
+	// The top right finder is the closer one.
+	if tl.center.dist(tr.center) > tl.center.dist(bl.center) {
+		tr, bl = bl, tr
+	}
+
+	ex, ey := tr.center.sub(tl.center), bl.center.sub(tl.center)
+
+	// Image y grows downwards, a mirrored symbol has the opposite winding.
+	cross := ex.x*ey.y - ex.y*ey.x
+	if cross <= 0 {
+		return tl, tr, bl, 0, false
+	}
+
+	cos := (ex.x*ey.x + ex.y*ey.y) / (ex.len() * ey.len())
+	ratio := ey.len() / ex.len()
+
+	modules := []float64{tl.module, tr.module, bl.module}
+	sort.Float64s(modules)
+	if modules[2] > 2*modules[0] {
+		return tl, tr, bl, 0, false
+	}
+
+	// Finder spacing must agree with the module size they report.
+	pitch := ex.len() / (finderTR.x - finderTL.x)
+	if pitch < modules[0]*0.5 || pitch > modules[2]*2 {
+		return tl, tr, bl, 0, false
+	}
+
+	score = math.Abs(cos)*4 + math.Abs(ratio/wantRatio-1) + (modules[2]-modules[0])/modules[1]
+	return tl, tr, bl, score, score < 1
+}
+
+// Alignment
+// ----------------------------------------------------------------------------------------------------
+
+// findAlignment searches around where the finders predict the alignment pattern for its best match.
+func (b *binImage) findAlignment(t transform) (point, bool) {
+	predicted := t.apply(alignC)
+	ex := t.apply(point{alignC.x + 1, alignC.y}).sub(predicted)
+	ey := t.apply(point{alignC.x, alignC.y + 1}).sub(predicted)
+
+	radius := int(2*math.Max(ex.len(), ey.len())) + 1
+
+	best, bestScore := predicted, -1
+	for dy := -radius; dy <= radius; dy++ {
+		for dx := -radius; dx <= radius; dx++ {
+			c := point{predicted.x + float64(dx), predicted.y + float64(dy)}
+
+			score := 0
+			for j := 0; j < alignSize; j++ {
+				for i := 0; i < alignSize; i++ {
+					want := chebyshev(i-alignSize/2, j-alignSize/2) != 1
+					s := c.add(ex.scale(float64(i - alignSize/2))).add(ey.scale(float64(j - alignSize/2)))
+					if b.at(int(s.x), int(s.y)) == want {
+						score++
+					}
+				}
+			}
+
+			if score > bestScore {
+				best, bestScore = c, score
+			}
+		}
+	}
+
+	return best, bestScore >= alignSize*alignSize-3
+}
+
+// Sampling
+// ----------------------------------------------------------------------------------------------------
+
+// sample reads every data module with a majority vote over a few pixels around its center.
+func (b *binImage) sample(t transform) []bool {
+	bits := make([]bool, len(dataModules))
+	for i, m := range dataModules {
+		center := point{float64(m.X) + 0.5, float64(m.Y) + 0.5}
+
+		votes := 0
+		for _, o := range []point{{0, 0}, {-0.2, -0.2}, {0.2, -0.2}, {-0.2, 0.2}, {0.2, 0.2}} {
+			p := t.apply(center.add(o))
+			if b.at(int(p.x), int(p.y)) {
+				votes++
+			}
+		}
+
+		bits[i] = votes >= 3
+	}
+
+	return bits
+}
+
+// Geometry
+// ----------------------------------------------------------------------------------------------------
+
+type point struct{ x, y float64 }
+
+func (p point) add(q point) point     { return point{p.x + q.x, p.y + q.y} }
+func (p point) sub(q point) point     { return point{p.x - q.x, p.y - q.y} }
+func (p point) scale(f float64) point { return point{p.x * f, p.y * f} }
+func (p point) len() float64          { return math.Hypot(p.x, p.y) }
+func (p point) dist(q point) float64  { return p.sub(q).len() }
+
+// transform maps module coordinates onto image pixels.
+type transform interface {
+	apply(p point) point
+}
+
+type affine struct {
+	origin, ex, ey point
+}
+
+// newAffine maps the finder centers onto where they were found.
+func newAffine(tl, tr, bl finder) affine {
+	return affine{
+		origin: tl.center,
+		ex:     tr.center.sub(tl.center).scale(1 / (finderTR.x - finderTL.x)),
+		ey:     bl.center.sub(tl.center).scale(1 / (finderBL.y - finderTL.y)),
+	}
+}
+func (a affine) apply(p point) point {
+	return a.origin.add(a.ex.scale(p.x - finderTL.x)).add(a.ey.scale(p.y - finderTL.y))
+}
+
+type homography [9]float64
+
+func (h homography) apply(p point) point {
+	w := h[6]*p.x + h[7]*p.y + h[8]
+	return point{(h[0]*p.x + h[1]*p.y + h[2]) / w, (h[3]*p.x + h[4]*p.y + h[5]) / w}
+}
+
+// solveHomography finds the perspective transform taking src onto dst.
+func solveHomography(src, dst [4]point) (homography, bool) {
+	var m [8][9]float64
+	for i := 0; i < 4; i++ {
+		s, d := src[i], dst[i]
+		m[2*i] = [9]float64{s.x, s.y, 1, 0, 0, 0, -d.x * s.x, -d.x * s.y, d.x}
+		m[2*i+1] = [9]float64{0, 0, 0, s.x, s.y, 1, -d.y * s.x, -d.y * s.y, d.y}
+	}
+
+	// Gaussian elimination with partial pivoting.
+	for col := 0; col < 8; col++ {
+		pivot := col
+		for row := col + 1; row < 8; row++ {
+			if math.Abs(m[row][col]) > math.Abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(m[pivot][col]) < 1e-9 {
+			return homography{}, false
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+
+		for row := 0; row < 8; row++ {
+			if row == col {
+				continue
+			}
+			f := m[row][col] / m[col][col]
+			for k := col; k < 9; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+		}
+	}
+
+	var h homography
+	for i := 0; i < 8; i++ {
+		h[i] = m[i][8] / m[i][i]
+	}
+	h[8] = 1
+
+	return h, true
+}
+
+func chebyshev(dx, dy int) int {
+	if dx < 0 {
+		dx = -dx
+	}
+	if dy < 0 {
+		dy = -dy
+	}
+	if dx > dy {
+		return dx
+	}
+	return dy
+}
+
+func clamp(v, lo, hi int) int {
+	if v < lo {
+		return lo
+	}
+	if v > hi {
+		return hi
+	}
+	return v
+}
+
+func sum(runs []int) int {
+	total := 0
+	for _, r := range runs {
+		total += r
+	}
+	return total
+}
@@ -4,111 +4,196 @@ import (
 	"bytes"
 	"crypto/rand"
 	"crypto/sha512"
+	_ "embed"
 	"errors"
 	"github.com/vaiktorg/grimoire/gwt"
 	"image"
 	"image/color"
 	"image/draw"
+	_ "image/jpeg"
 	"image/png"
-	"os"
+	"io"
 )
 
-type VTokenConfig struct {
-	HashKey []byte
+//go:embed res/vtkn_tmpl.png
+var defaultTemplatePNG []byte
 
-	// Authentication Icon GridSquare
-	IconGridSrc  image.Point
-	IconGridRect image.Rectangle
+// DefaultTemplate is the card the symbol is drawn on unless WithTemplate says otherwise.
+var DefaultTemplate = func() image.Image {
+	img, err := png.Decode(bytes.NewReader(defaultTemplatePNG))
+	if err != nil {
+		panic(err)
+	}
+	return img
+}()
+
+const (
+	ErrorInvalidHash  = "invalid hash len"
+	ErrorTemplateSize = "card template cannot fit the symbol"
+)
+
+const (
+	hashLen   = 128
+	parityLen = 76 // corrects up to 38 damaged bytes
+)
 
-	TemplateImg string
-	PatternImg  string
-	ExportPath  string
+// Config
+// ====================================================================================================
+
+type cardConfig struct {
+	hashKey  []byte
+	template image.Image
+	symbolAt image.Point
 }
 
-var GridConfig = VTokenConfig{
-	IconGridSrc:  image.Pt(8, 8),
-	IconGridRect: image.Rect(0, 0, 256, 512),
+type Option func(*cardConfig)
 
-	TemplateImg: "res/vtkn_tmpl.png",
-	PatternImg:  "res/vtkn_mask.png",
+// WithHashKey masks cards with key instead of gwt.HashKey. Cards only read with the key they were made with.
+func WithHashKey(key []byte) Option {
+	return func(c *cardConfig) {
+		c.hashKey = key
+	}
+}
 
-	ExportPath: "dist/id_card.png",
-	HashKey:    gwt.HashKey,
+// WithTemplate draws cards on template, with the top left corner of the symbol, quiet zone included,
+// at symbolAt. The template must fit SymbolSize from there. A nil template draws a blank card.
+func WithTemplate(template image.Image, symbolAt image.Point) Option {
+	return func(c *cardConfig) {
+		c.template = template
+		c.symbolAt = symbolAt
+	}
 }
 
-const hashLen = 128
+func newCardConfig(opts []Option) *cardConfig {
+	c := &cardConfig{
+		hashKey:  gwt.HashKey,
+		template: DefaultTemplate,
+		symbolAt: image.Pt(8, 8),
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
 
+// Cards
 // ====================================================================================================
 
-func CreateTokenCard(hash []byte) (randHash []byte, randMask *image.RGBA, err error) {
-	if hash == nil || len(hash) < hashLen {
-		return nil, nil, errors.New("invalid hash len")
+// CreateTokenCard writes a PNG card of hash to w, masked with a fresh random mask. The card only reads
+// with randHash, the mask's digest, see ReadTokenCard.
+func CreateTokenCard(w io.Writer, hash []byte, opts ...Option) (randHash []byte, randMask *image.RGBA, err error) {
+	randHash, randMask = RandomMask()
+
+	img, err := EncodeCard(hash, randHash, opts...)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	// Open Template Image
-	img := openImage(GridConfig.TemplateImg)
+	return randHash, randMask, png.Encode(w, img)
+}
 
-	// Generate HashGrid
-	hashToImage(img, hash)
+// ReadTokenCard reads back the hash of a card image, PNG or JPEG, made by CreateTokenCard.
+func ReadTokenCard(r io.Reader, randHash []byte, opts ...Option) ([]byte, error) {
+	img, _, err := image.Decode(r)
+	if err != nil {
+		return nil, err
+	}
 
-	// Apply Pattern Mask
-	XORBlend(img, openImage(GridConfig.PatternImg))
+	return DecodeCard(img, randHash, opts...)
+}
 
-	// Apply Random Mask
-	randHash, randMask = RandomMask()
-	XORBlend(img, randMask)
+// EncodeCard draws hash onto a copy of the card template. The hash is Reed-Solomon encoded and masked
+// with a keystream of the hash key and randHash.
+func EncodeCard(hash, randHash []byte, opts ...Option) (*image.RGBA, error) {
+	if len(hash) < hashLen {
+		return nil, errors.New(ErrorInvalidHash)
+	}
+
+	conf := newCardConfig(opts)
+
+	card := image.NewRGBA(image.Rectangle{Max: conf.symbolAt.Add(SymbolSize).Add(conf.symbolAt)})
+	draw.Draw(card, card.Bounds(), &image.Uniform{C: lightModule}, image.Point{}, draw.Src)
+	if conf.template != nil {
+		bounds := conf.template.Bounds()
+		symbol := image.Rectangle{Min: conf.symbolAt, Max: conf.symbolAt.Add(SymbolSize)}
+		if !symbol.In(bounds.Sub(bounds.Min)) {
+			return nil, errors.New(ErrorTemplateSize)
+		}
+
+		card = image.NewRGBA(bounds.Sub(bounds.Min))
+		draw.Draw(card, card.Bounds(), conf.template, bounds.Min, draw.Src)
+	}
 
-	return randHash, randMask, saveImage(img)
+	codeword := rsEncode(hash[:hashLen], parityLen)
+	drawSymbol(card, conf.symbolAt, maskBits(codeword, conf.keystream(randHash)))
+
+	return card, nil
 }
-func ReadTokenCard(filepath string, randMask *image.RGBA) []byte {
-	subImg := openImage(filepath).SubImage(GridConfig.IconGridRect.Add(GridConfig.IconGridSrc)).(*image.RGBA)
-	//Remove Random Mask
-	XORBlend(subImg, randMask)
 
-	// Remove Pattern Mask
-	XORBlend(subImg, openImage(GridConfig.PatternImg))
+// DecodeCard finds the symbol anywhere in img, which may be scaled, slightly rotated, cropped to the
+// symbol or lossily compressed, and returns the hash once damaged modules are corrected.
+// Only WithHashKey matters when decoding.
+func DecodeCard(img image.Image, randHash []byte, opts ...Option) ([]byte, error) {
+	conf := newCardConfig(opts)
 
-	return imageToHash(subImg)
+	readings, err := readSymbol(img)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := conf.keystream(randHash)
+	for _, bits := range readings {
+		if hash, err := rsDecode(unmaskBits(bits, stream), parityLen); err == nil {
+			return hash, nil
+		}
+	}
+
+	return nil, errors.New(ErrorTooManyErrors)
 }
 
-// HashGrid
+// Masks
 // ====================================================================================================
+// Module bits are XORed with a keystream of the hash key and the random mask's digest, so a card only
+// reads with its mask, and so the data never forms large flat areas or false finder patterns.
+
+func maskBits(codeword, stream []byte) []bool {
+	bits := make([]bool, len(dataModules))
+	for i := range bits {
+		var bit byte
+		if i/8 < len(codeword) {
+			bit = codeword[i/8] >> (7 - i%8) & 1
+		}
+		bits[i] = bit^(stream[i/8]>>(7-i%8)&1) == 1
+	}
 
-func hashToImage(img *image.RGBA, data []byte) {
-	gridX := GridConfig.IconGridRect.Dx() / len(data) * 4
-	gridY := GridConfig.IconGridRect.Dy() / len(data) * 2
+	return bits
+}
+func unmaskBits(bits []bool, stream []byte) []byte {
+	codeword := make([]byte, hashLen+parityLen)
+	for i := 0; i < len(codeword)*8; i++ {
+		if bits[i] {
+			codeword[i/8] |= 1 << (7 - i%8)
+		}
+	}
+	for i := range codeword {
+		codeword[i] ^= stream[i]
+	}
 
-	cellSizeX := gridX * 4
-	cellSizeY := gridY * 4
+	return codeword
+}
 
-	Grid(data, cellSizeX, cellSizeY, gridX, gridY, func(x, y int, b byte) {
-		// Adjust the x and y positions relative to the image bounds
-		x += GridConfig.IconGridSrc.X
-		y += GridConfig.IconGridSrc.Y
+// keystream covers every data module, counter mode over SHA-512.
+func (c *cardConfig) keystream(randHash []byte) []byte {
+	var stream []byte
+	for counter := byte(0); len(stream)*8 < len(dataModules); counter++ {
+		h := sha512.New()
+		h.Write(c.hashKey)
+		h.Write(randHash)
+		h.Write([]byte{counter})
+		stream = h.Sum(stream)
+	}
 
-		squareRect := image.Rect(x, y, x+cellSizeX, y+cellSizeY)
-		draw.Draw(img, squareRect, &image.Uniform{C: colorFromByte(b)}, GridConfig.IconGridSrc, draw.Src)
-	})
-}
-func imageToHash(img *image.RGBA) []byte {
-	bounds := img.Bounds()
-
-	cellSize := 32
-	grid := GridConfig.IconGridRect.Dx() / cellSize
-	sampleSizeX := cellSize / 4
-	sampleSizeY := cellSize / 4
-	hash := make([]byte, hashLen)
-	GridSquare(hash, cellSize, grid, func(x, y int, b byte) {
-		// Adjust the x and y positions relative to the image bounds
-		x += GridConfig.IconGridSrc.X
-		y += GridConfig.IconGridSrc.Y
-
-		// Average the colors from the determined sample area
-		c := averageColor(img, x, y, sampleSizeX, sampleSizeY) // Modify to sample the entire cell
-		hash[(y-bounds.Min.Y)/cellSize*grid+(x-bounds.Min.X)/cellSize] = byteFromColor(c)
-	})
-
-	return hash
+	return stream
 }
 
 // ====================================================================================================
@@ -130,110 +215,11 @@ func byteFromColor(c color.RGBA) byte {
 	// Example using bitwise OR:
 	return (c.R << 4) | (c.G << 2) | c.B // Reconstruct byte from channel bits
 }
-func averageColor(img image.Image, x, y, width, height int) color.RGBA {
-	var r, g, b, a, count uint32
-	for dy := 0; dy < height; dy++ {
-		for dx := 0; dx < width; dx++ {
-			// Check if pixel coordinates are within the image bounds
-			if x+dx >= img.Bounds().Max.X || y+dy >= img.Bounds().Max.Y {
-				continue // Skip this pixel
-			}
-			pixel := img.At(x+dx, y+dy)
-			pr, pg, pb, pa := pixel.RGBA()
-			r += pr
-			g += pg
-			b += pb
-			a += pa
-			count++
-		}
-	}
-	// Calculate the average color; divide by count and by 0x101 to scale 16-bit color to 8-bit color
-	r = (r / count) / 0x101
-	g = (g / count) / 0x101
-	b = (b / count) / 0x101
-	a = (a / count) / 0x101
-
-	return color.RGBA{R: uint8(r), G: uint8(g), B: uint8(b), A: uint8(a)}
-}
-
-// ====================================================================================================
-
-// GridSquare : I want to use this for every grid in the code
-func GridSquare(hash []byte, cellSize, gridSize int, h func(x, y int, b byte)) {
-	for i, b := range hash {
-		x := (i % gridSize) * cellSize
-		y := (i / gridSize) * cellSize
-
-		h(x, y, b)
-	}
-}
-func Grid(hash []byte, cellX, cellY, gridX, gridY int, h func(x, y int, b byte)) {
-	for i, b := range hash {
-		x := (i % gridX) * cellX
-		y := (i / gridY) * cellY
-
-		h(x, y, b)
-	}
-}
-
-// ====================================================================================================
-
-// Image File  I/O
-func saveImage(img image.Image) error {
-	buff := bytes.NewBuffer([]byte{})
-	if err := png.Encode(buff, img); err != nil {
-		return err
-	}
-
-	return os.WriteFile(GridConfig.ExportPath, buff.Bytes(), 0644)
-}
-func openImage(filepath string) *image.RGBA {
-	f, err := os.Open(filepath)
-
-	if err != nil {
-		return nil
-	}
-	defer f.Close()
-
-	img, err := png.Decode(f)
-	if err != nil {
-		return nil
-	}
-
-	rgba, ok := img.(*image.RGBA)
-	if !ok {
-		rgba = image.NewRGBA(img.Bounds())
-		draw.Draw(rgba, rgba.Bounds(), img, image.Point{}, draw.Src)
-	}
-
-	return rgba
-}
 
 // ====================================================================================================
 // Watermarks
 // ----------------------------------------------------------------------------------------------------
 
-// XORBlend applies the XOR operation between two images
-func XORBlend(img, mask *image.RGBA) {
-	imgBounds := img.Bounds()
-
-	for y := imgBounds.Min.Y; y < imgBounds.Max.Y; y++ {
-		for x := imgBounds.Min.X; x < imgBounds.Max.X; x++ {
-			color1 := img.At(x, y).(color.RGBA)
-			color2 := mask.At(x-GridConfig.IconGridSrc.X, y-GridConfig.IconGridSrc.Y).(color.RGBA)
-			img.Set(x, y, xorColors(color1, color2))
-		}
-	}
-}
-func xorColors(c1, c2 color.RGBA) color.RGBA {
-	return color.RGBA{
-		R: c1.R ^ c2.R,
-		G: c1.G ^ c2.G,
-		B: c1.B ^ c2.B,
-		A: c1.A, // If the mask contains alpha, you may want to XOR this channel as well
-	}
-}
-
 func RandomMask() (mask []byte, maskImg *image.RGBA) {
 	// Map byteValue to a color index within the palette
 	mask = make([]byte, hashLen*2)
@@ -245,11 +231,24 @@ func RandomMask() (mask []byte, maskImg *image.RGBA) {
 	for i := range b {
 		x := i % 512
 		y := i / 512
-		squareRect := image.Rect(x, y, x+1, y+1)
-		draw.Draw(img, squareRect, &image.Uniform{C: colorFromByte(b[i])}, image.Point{}, draw.Src)
+		img.SetRGBA(x, y, colorFromByte(b[i]))
 		mask = append(mask, b[i])
 	}
 
 	hashMask := sha512.Sum512(mask)
 	return hashMask[:], img
 }
+
+// MaskDigest recovers the randHash RandomMask returned along with maskImg, for callers that kept the image.
+func MaskDigest(maskImg image.Image) []byte {
+	bounds := maskImg.Bounds()
+	mask := make([]byte, hashLen*2, hashLen*2+bounds.Dx()*bounds.Dy())
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			mask = append(mask, byteFromColor(color.RGBAModel.Convert(maskImg.At(x, y)).(color.RGBA)))
+		}
+	}
+
+	hashMask := sha512.Sum512(mask)
+	return hashMask[:]
+}
@@ -73,11 +73,11 @@ func (l *SimLogger) Output(f func(log Log) error) {
 }
 
 func (l *SimLogger) Println(in ...any) {
-	fmt.Println(in)
+	fmt.Println(in...)
 }
 
 func (l *SimLogger) Printf(str string, data ...any) {
-	fmt.Printf(str, data)
+	fmt.Printf(str, data...)
 }
 
 func (l *SimLogger) Log(level Level, msg string, data ...any) {
@@ -63,13 +63,14 @@ func (c *Crypto) DecryptBlowfish(ciphertext []byte) ([]byte, error) {
 }
 
 func (c *Crypto) EncryptGCM(src []byte) ([]byte, error) {
-	nonce := make([]byte, c.block.BlockSize())
-	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+	aesgcm, err := cipher.NewGCM(c.block)
+	if err != nil {
 		return nil, err
 	}
 
-	aesgcm, err := cipher.NewGCM(c.block)
-	if err != nil {
+	// Must match the NonceSize DecryptGCM splits off, GCM panics on any other length.
+	nonce := make([]byte, aesgcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, err
 	}
 